@@ -0,0 +1,13 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/mahdi-cpp/messages-api/internal/api/handlers"
+)
+
+func adminRoutes(router *gin.Engine, adminHandler *handlers.AdminHandler) {
+
+	admin := router.Group("/api/admin", adminHandler.Authorize)
+
+	admin.GET("/snapshot", adminHandler.Snapshot)
+}
@@ -93,11 +93,16 @@ func main() {
 	// 2. Instantiate handlers.
 	chatHandler := handlers.NewChatHandler(appManager)
 	messageHandler := handlers.NewMessageHandler(appManager)
+	var adminHandler *handlers.AdminHandler
+	if token := config.AdminToken(); token != "" {
+		adminHandler = handlers.NewAdminHandler(appManager, token)
+	}
 
 	// 3. Set up all routes using the single router instance.
 	setupRoutes(router, appManager,
 		chatHandler,
 		messageHandler,
+		adminHandler,
 	)
 
 	// 4. Start the server with the fully configured router.
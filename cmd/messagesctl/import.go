@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager_sqlite"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/store"
+)
+
+// importers copy a collection_manager JSON directory into a SQLite store,
+// one per collection type.
+var importers = map[string]func(ctx context.Context, src, dst string) (int, error){
+	"chat":    importJSON[*chat.Chat],
+	"message": importJSON[*message.Message],
+}
+
+// importJSON opens src with collection_manager, which also replays its
+// write-ahead log, and copies every item into the SQLite database dst.
+func importJSON[T store.Item](ctx context.Context, src, dst string) (int, error) {
+	from, err := collection_manager.New[T](src)
+	if err != nil {
+		return 0, fmt.Errorf("error opening %s: %w", src, err)
+	}
+	defer from.Close()
+
+	to, err := collection_manager_sqlite.New[T](dst)
+	if err != nil {
+		return 0, err
+	}
+	defer to.Close()
+
+	return collection_manager_sqlite.Import[T](ctx, to, from)
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	kind := fs.String("type", "message", "collection type: chat or message")
+	src := fs.String("src", "", "collection_manager JSON directory to import")
+	dst := fs.String("dst", "", "SQLite database to write, default <src>/"+collection_manager_sqlite.FileName)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	importer, ok := importers[*kind]
+	if !ok {
+		return fmt.Errorf("unknown collection type %q", *kind)
+	}
+	if *src == "" {
+		return errors.New("-src is required")
+	}
+	if *dst == "" {
+		*dst = filepath.Join(*src, collection_manager_sqlite.FileName)
+	}
+
+	count, err := importer(context.Background(), *src, *dst)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: imported %d items into %s\n", *src, count, *dst)
+	return nil
+}
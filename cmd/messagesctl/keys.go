@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+	"github.com/mahdi-cpp/messages-api/internal/store"
+)
+
+// reencrypts re-encrypt a collection with the cipher given, one per
+// collection type.
+var reencrypts = map[string]func(ctx context.Context, engine, dir string, cipher encryption.Cipher) (int, error){
+	"chat":    reencrypt[*chat.Chat],
+	"message": reencrypt[*message.Message],
+}
+
+func reencrypt[T store.Item](ctx context.Context, engine, dir string, cipher encryption.Cipher) (int, error) {
+	s, err := store.Open[T](engine, dir, collection_manager.WithCipher(cipher))
+	if err != nil {
+		return 0, err
+	}
+	r, ok := s.(store.Reencrypter)
+	if !ok {
+		s.Close()
+		return 0, fmt.Errorf("store engine %q does not support encryption", engine)
+	}
+	rewritten, err := r.Reencrypt(ctx)
+	if closeErr := s.Close(); err == nil {
+		err = closeErr
+	}
+	return rewritten, err
+}
+
+// loadKeyring loads the master keys of keyfile, or returns nil when no
+// keyfile was given, for commands that read stores with or without
+// encryption.
+func loadKeyring(keyfile string) (*encryption.Keyring, error) {
+	if keyfile == "" {
+		return nil, nil
+	}
+	return encryption.LoadKeyfile(keyfile)
+}
+
+// dataKeys returns the data keys of a collection directory, or nil when
+// the directory was never encrypted. An encrypted one needs a keyring.
+func dataKeys(ring *encryption.Keyring, dir string) (encryption.Cipher, error) {
+	if _, err := os.Stat(filepath.Join(dir, encryption.KeysFileName)); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if ring == nil {
+		return nil, errors.New("collection is encrypted, -keyfile is required")
+	}
+	return encryption.OpenDataKeys(ring, dir)
+}
+
+// runKeygen adds a master key to a keyfile, creating the keyfile if needed.
+// Restart the server to wrap data keys with the new key; the older keys
+// must stay in the keyfile until then.
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	keyfile := fs.String("keyfile", "", "master keyfile, see MESSAGES_KEYFILE")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keyfile == "" {
+		return errors.New("-keyfile is required")
+	}
+
+	id, err := encryption.AddMasterKey(*keyfile)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added master key %d to %s\n", id, *keyfile)
+	return nil
+}
+
+// runRotateKey adds a data key to each collection and re-encrypts its
+// records with it. A running server picks up the new key when it next
+// reads a record sealed with it, and re-encrypts the collections it opens
+// in the background, so this is only needed to finish a rotation at once.
+func runRotateKey(args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	keyfile := fs.String("keyfile", "", "master keyfile, see MESSAGES_KEYFILE")
+	kind := fs.String("type", "message", "collection type: chat or message")
+	engine := fs.String("engine", store.EngineJSON, "store engine: collection_manager or generic_index")
+	dir := fs.String("dir", "", "collection directory, or a glob pattern such as 'chats/*/messages'")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	reencrypt, ok := reencrypts[*kind]
+	if !ok {
+		return fmt.Errorf("unknown collection type %q", *kind)
+	}
+	if *keyfile == "" || *dir == "" {
+		return errors.New("-keyfile and -dir are required")
+	}
+	ring, err := encryption.LoadKeyfile(*keyfile)
+	if err != nil {
+		return err
+	}
+	dirs, err := filepath.Glob(*dir)
+	if err != nil {
+		return err
+	}
+	if len(dirs) == 0 {
+		return fmt.Errorf("no directory matches %s", *dir)
+	}
+
+	total := 0
+	for _, d := range dirs {
+		keys, err := encryption.OpenDataKeys(ring, d)
+		if err != nil {
+			return fmt.Errorf("%s: %w", d, err)
+		}
+		version, err := keys.Rotate()
+		if err != nil {
+			return fmt.Errorf("%s: %w", d, err)
+		}
+		rewritten, err := reencrypt(context.Background(), *engine, d, keys)
+		if err != nil {
+			return fmt.Errorf("%s: %w", d, err)
+		}
+		fmt.Printf("%s: re-encrypted %d items with data key %d\n", d, rewritten, version)
+		total += rewritten
+	}
+	fmt.Printf("re-encrypted %d items in %d directories\n", total, len(dirs))
+	return nil
+}
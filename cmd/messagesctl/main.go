@@ -0,0 +1,62 @@
+// Command messagesctl is the offline administration tool for the message
+// stores. Stores must not be open by the server while it runs.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"verify":   {usage: "verify -engine <engine> -dir <dir>", run: runVerify},
+	"repair":   {usage: "repair -engine <engine> -dir <dir>", run: runRepair},
+	"import":   {usage: "import -type <chat|message> -src <json dir> [-dst <sqlite file>]", run: runImport},
+	"snapshot": {usage: "snapshot [-root <dir>] -out <archive>", run: runSnapshot},
+	"restore":  {usage: "restore -src <archive> (-dst <dir> | -verify-only)", run: runRestore},
+	"migrate":  {usage: "migrate -type <chat|message> -dir <dir or glob> [-dry-run] [-keyfile <keyfile>]", run: runMigrate},
+	"reshard":  {usage: "reshard -type <chat|message> -dir <dir or glob> [-layout <flat|hex|time>] [-keyfile <keyfile>]", run: runReshard},
+	"keygen":   {usage: "keygen -keyfile <keyfile>", run: runKeygen},
+	"rotate-key": {
+		usage: "rotate-key -keyfile <keyfile> -type <chat|message> -dir <dir or glob> [-engine <engine>]",
+		run:   runRotateKey,
+	},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "messagesctl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: messagesctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+	"github.com/mahdi-cpp/messages-api/internal/migration"
+)
+
+// migrators upgrade the item files of a collection_manager JSON directory
+// to the latest schema version, one per collection type.
+var migrators = map[string]func(dir string, cipher encryption.Cipher, dryRun bool) ([]string, error){
+	"chat":    migrateDir[*chat.Chat],
+	"message": migrateDir[*message.Message],
+}
+
+// migrateDir upgrades the item files of dir, in any layout, and returns
+// the paths of the ones that changed. Sealed files are opened with cipher.
+func migrateDir[T any](dir string, cipher encryption.Cipher, dryRun bool) ([]string, error) {
+	files, err := collection_manager.ItemFiles(dir, collection_manager.LayoutFlat)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(files))
+	for _, path := range files {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+
+	var changed []string
+	for _, path := range paths {
+		migrated, err := migration.File[T](path, cipher, dryRun)
+		if err != nil {
+			return changed, fmt.Errorf("error migrating %s: %w", path, err)
+		}
+		if migrated {
+			changed = append(changed, path)
+		}
+	}
+	return changed, nil
+}
+
+// runMigrate upgrades stored items offline. The server migrates items as it
+// loads them too, so this is only needed to migrate a whole root at once.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	kind := fs.String("type", "message", "collection type: chat or message")
+	dir := fs.String("dir", "", "collection directory, or a glob pattern such as 'chats/*/messages'")
+	dryRun := fs.Bool("dry-run", false, "only report the files that would change")
+	keyfile := fs.String("keyfile", "", "master keyfile of an encrypted store, see MESSAGES_KEYFILE")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	migrate, ok := migrators[*kind]
+	if !ok {
+		return fmt.Errorf("unknown collection type %q", *kind)
+	}
+	if *dir == "" {
+		return errors.New("-dir is required")
+	}
+	dirs, err := filepath.Glob(*dir)
+	if err != nil {
+		return err
+	}
+	if len(dirs) == 0 {
+		return fmt.Errorf("no directory matches %s", *dir)
+	}
+	ring, err := loadKeyring(*keyfile)
+	if err != nil {
+		return err
+	}
+
+	verb := "migrated"
+	if *dryRun {
+		verb = "would migrate"
+	}
+	total := 0
+	for _, d := range dirs {
+		cipher, err := dataKeys(ring, d)
+		if err != nil {
+			return fmt.Errorf("%s: %w", d, err)
+		}
+		changed, err := migrate(d, cipher, *dryRun)
+		for _, path := range changed {
+			fmt.Printf("%s %s\n", verb, path)
+		}
+		total += len(changed)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%s %d items in %d directories\n", verb, total, len(dirs))
+	return nil
+}
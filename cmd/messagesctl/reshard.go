@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+	"github.com/mahdi-cpp/messages-api/internal/store"
+)
+
+// reshards move the item files of a collection_manager JSON directory to
+// a layout, one per collection type.
+var reshards = map[string]func(ctx context.Context, dir string, layout collection_manager.Layout, cipher encryption.Cipher) (int, error){
+	"chat":    reshardJSON[*chat.Chat],
+	"message": reshardJSON[*message.Message],
+}
+
+// reshardJSON moves the item files of dir to layout. The items are loaded
+// first, so those of an encrypted store need its cipher.
+func reshardJSON[T store.Item](ctx context.Context, dir string, layout collection_manager.Layout, cipher encryption.Cipher) (int, error) {
+	opts := []collection_manager.Option{collection_manager.WithLayout(layout)}
+	if cipher != nil {
+		opts = append(opts, collection_manager.WithCipher(cipher))
+	}
+	manager, err := collection_manager.New[T](dir, opts...)
+	if err != nil {
+		return 0, fmt.Errorf("error opening %s: %w", dir, err)
+	}
+	moved, err := manager.Reshard(ctx)
+	if closeErr := manager.Close(); err == nil {
+		err = closeErr
+	}
+	return moved, err
+}
+
+// runReshard moves stored items to another file layout offline. A running
+// server reshards the collections it opens in the background instead.
+func runReshard(args []string) error {
+	fs := flag.NewFlagSet("reshard", flag.ContinueOnError)
+	kind := fs.String("type", "message", "collection type: chat or message")
+	dir := fs.String("dir", "", "collection directory, or a glob pattern such as 'chats/*/messages'")
+	layoutName := fs.String("layout", string(collection_manager.LayoutHex), "target layout: flat, hex or time")
+	keyfile := fs.String("keyfile", "", "master keyfile of an encrypted store, see MESSAGES_KEYFILE")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	reshard, ok := reshards[*kind]
+	if !ok {
+		return fmt.Errorf("unknown collection type %q", *kind)
+	}
+	layout, err := collection_manager.ParseLayout(*layoutName)
+	if err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New("-dir is required")
+	}
+	dirs, err := filepath.Glob(*dir)
+	if err != nil {
+		return err
+	}
+	if len(dirs) == 0 {
+		return fmt.Errorf("no directory matches %s", *dir)
+	}
+	ring, err := loadKeyring(*keyfile)
+	if err != nil {
+		return err
+	}
+
+	total := 0
+	for _, d := range dirs {
+		cipher, err := dataKeys(ring, d)
+		if err != nil {
+			return fmt.Errorf("%s: %w", d, err)
+		}
+		moved, err := reshard(context.Background(), d, layout, cipher)
+		if err != nil {
+			return fmt.Errorf("%s: %w", d, err)
+		}
+		if moved > 0 {
+			fmt.Printf("%s: moved %d items\n", d, moved)
+		}
+		total += moved
+	}
+	fmt.Printf("moved %d items in %d directories to the %s layout\n", total, len(dirs), layout)
+	return nil
+}
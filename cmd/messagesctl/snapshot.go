@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mahdi-cpp/messages-api/internal/config"
+	"github.com/mahdi-cpp/messages-api/internal/snapshot"
+)
+
+// runSnapshot archives a data root offline, with the server stopped. A
+// running server takes its snapshots through GET /api/admin/snapshot,
+// served when MESSAGES_ADMIN_TOKEN is set.
+func runSnapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	root := fs.String("root", config.RootDir, "data root to archive")
+	out := fs.String("out", "", "archive file to write")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("-out is required")
+	}
+
+	file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := snapshot.Write(file, *root)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+
+	fmt.Printf("%s: %d files\n", *out, len(manifest.Files))
+	return nil
+}
+
+// runRestore verifies an archive against its manifest and extracts it into
+// a new data root.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	src := fs.String("src", "", "archive to restore")
+	dst := fs.String("dst", "", "new data root, must not exist or be empty")
+	verifyOnly := fs.Bool("verify-only", false, "only check the archive, do not extract it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *src == "" {
+		return errors.New("-src is required")
+	}
+	if *dst == "" && !*verifyOnly {
+		return errors.New("-dst is required")
+	}
+
+	file, err := os.Open(*src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var manifest *snapshot.Manifest
+	if *verifyOnly {
+		manifest, err = snapshot.Verify(file)
+	} else {
+		manifest, err = snapshot.Restore(file, *dst)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d files from snapshot of %s ok\n", *src, len(manifest.Files), manifest.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+	return nil
+}
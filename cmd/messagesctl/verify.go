@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager_generic_index"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager_lazy_loading"
+)
+
+// errCorrupt makes verify exit with a non-zero status when it finds corruption.
+var errCorrupt = errors.New("corruption found, run repair to quarantine it")
+
+// checker runs verify or repair on one store engine and prints the result.
+type checker struct {
+	verify func(dir string) (report, error)
+	repair func(dir string) (report, error)
+}
+
+// report is the engine-independent view of a verify report.
+type report struct {
+	records      int
+	indexEntries int
+	corrupt      []string
+	quarantined  []string
+}
+
+var checkers = map[string]checker{
+	"generic_index": {
+		verify: func(dir string) (report, error) {
+			return fromGenericIndex(collection_manager_generic_index.Verify(dir))
+		},
+		repair: func(dir string) (report, error) {
+			return fromGenericIndex(collection_manager_generic_index.Repair(dir))
+		},
+	},
+	"lazy_loading": {
+		verify: func(dir string) (report, error) {
+			return fromLazyLoading(collection_manager_lazy_loading.Verify(dir))
+		},
+		repair: func(dir string) (report, error) {
+			return fromLazyLoading(collection_manager_lazy_loading.Repair(dir))
+		},
+	},
+}
+
+func fromGenericIndex(r *collection_manager_generic_index.VerifyReport, err error) (report, error) {
+	if r == nil {
+		return report{}, err
+	}
+	out := report{records: r.Records, indexEntries: r.IndexEntries, quarantined: r.Quarantined}
+	for _, c := range r.Corrupt {
+		out.corrupt = append(out.corrupt, fmt.Sprintf("%s offset %d: %s", c.File, c.Offset, c.Reason))
+	}
+	return out, err
+}
+
+func fromLazyLoading(r *collection_manager_lazy_loading.VerifyReport, err error) (report, error) {
+	if r == nil {
+		return report{}, err
+	}
+	out := report{records: r.Records, indexEntries: r.IndexEntries, quarantined: r.Quarantined}
+	for _, c := range r.Corrupt {
+		out.corrupt = append(out.corrupt, fmt.Sprintf("%s offset %d: %s", c.File, c.Offset, c.Reason))
+	}
+	return out, err
+}
+
+func parseStoreFlags(name string, args []string) (checker, string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	engine := fs.String("engine", "generic_index", "store engine: generic_index or lazy_loading")
+	dir := fs.String("dir", "", "directory holding data.db and index.db")
+	if err := fs.Parse(args); err != nil {
+		return checker{}, "", err
+	}
+
+	c, ok := checkers[*engine]
+	if !ok {
+		return checker{}, "", fmt.Errorf("unknown engine %q", *engine)
+	}
+	if *dir == "" {
+		return checker{}, "", errors.New("-dir is required")
+	}
+	return c, *dir, nil
+}
+
+func runVerify(args []string) error {
+	c, dir, err := parseStoreFlags("verify", args)
+	if err != nil {
+		return err
+	}
+
+	r, err := c.verify(dir)
+	if err != nil {
+		return err
+	}
+
+	printReport(dir, r)
+	if len(r.corrupt) > 0 {
+		return errCorrupt
+	}
+	return nil
+}
+
+func runRepair(args []string) error {
+	c, dir, err := parseStoreFlags("repair", args)
+	if err != nil {
+		return err
+	}
+
+	r, err := c.repair(dir)
+	printReport(dir, r)
+	return err
+}
+
+func printReport(dir string, r report) {
+	fmt.Printf("%s: %d records, %d index entries, %d corrupt\n", dir, r.records, r.indexEntries, len(r.corrupt))
+	for _, c := range r.corrupt {
+		fmt.Printf("  corrupt: %s\n", c)
+	}
+	for _, path := range r.quarantined {
+		fmt.Printf("  quarantined: %s\n", path)
+	}
+}
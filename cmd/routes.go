@@ -11,6 +11,7 @@ import (
 func setupRoutes(router *gin.Engine, appManager *application.AppManager,
 	chatHandler *handlers.ChatHandler,
 	messageHandler *handlers.MessageHandler,
+	adminHandler *handlers.AdminHandler,
 ) {
 
 	// WebSocket route
@@ -23,4 +24,9 @@ func setupRoutes(router *gin.Engine, appManager *application.AppManager,
 
 	chatRoutes(router, chatHandler)
 	messageRoutes(router, messageHandler)
+
+	// Admin routes are only served with an admin token configured.
+	if adminHandler != nil {
+		adminRoutes(router, adminHandler)
+	}
 }
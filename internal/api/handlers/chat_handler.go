@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"github.com/mahdi-cpp/messages-api/internal/application"
 	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
 	"github.com/mahdi-cpp/messages-api/internal/helpers"
+	"github.com/mahdi-cpp/messages-api/internal/version"
 )
 
 type ChatHandler struct {
@@ -139,6 +141,7 @@ func (h *ChatHandler) readSingleChat(c *gin.Context, chatID uuid.UUID) {
 		return
 	}
 
+	c.Header("ETag", etag(readChat.Version))
 	c.JSON(http.StatusOK, readChat)
 }
 
@@ -165,16 +168,18 @@ func (h *ChatHandler) readSingleChat(c *gin.Context, chatID uuid.UUID) {
 
 // Update
 // @Summary update an existing chat
-// @Description Updates an existing chat's properties, such as its members or title.
+// @Description Updates an existing chat's properties, such as its members or title. With If-Match set to the ETag of the chat, the update is rejected if the chat was modified since.
 // @Tags chat
 // @Accept json
 // @Produce json
-// @Param id path string true "Chat ID"
+// @Param chatId path string true "Chat ID"
+// @Param If-Match header string false "ETag the update is based on"
 // @Param request body chat.UpdateOptions true "Chat update options"
 // @Success 200 {object} object "Chat updated successfully"
 // @Failure 304 {string} string "Not Modified"
-// @Failure 400 {string} string "Invalid JSON body"
-// @Router /chats/{id} [put]
+// @Failure 400 {string} string "Invalid JSON body or chat IDs other than the path"
+// @Failure 412 {string} string "Chat was modified"
+// @Router /chats/{chatId} [patch]
 func (h *ChatHandler) Update(c *gin.Context) {
 
 	var request chat.UpdateOptions
@@ -185,15 +190,35 @@ func (h *ChatHandler) Update(c *gin.Context) {
 		return
 	}
 
-	// اعتبارسنجی - حداقل یک چت باید انتخاب شده باشد
-	if len(request.ChatIDs) == 0 {
+	chatID, err := uuid.Parse(c.Param("chatId"))
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "At least one chat ID is required",
+			"error": "Invalid chat ID: " + err.Error(),
 		})
 		return
 	}
 
-	err := h.appManager.UpdateChats(request)
+	// The path names the chat; chat IDs in the body may only repeat it.
+	for _, id := range request.ChatIDs {
+		if id != chatID {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Chat ID " + id.String() + " in the body does not match the path",
+			})
+			return
+		}
+	}
+	request.ChatIDs = []uuid.UUID{chatID}
+
+	request.IfVersion = ifMatch(c)
+
+	updated, err := h.appManager.UpdateChats(request)
+	if errors.Is(err, version.ErrConflict) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{
+			"message": "Chat was modified",
+			"error":   err.Error(),
+		})
+		return
+	}
 	if err != nil {
 		// بهتر است لاگ خطا نیز ثبت شود
 		log.Printf("Update failed: %v", err)
@@ -204,9 +229,10 @@ func (h *ChatHandler) Update(c *gin.Context) {
 		return
 	}
 
+	c.Header("ETag", etag(updated[0].Version))
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Successfully updated",
-		"count":   len(request.ChatIDs),
+		"count":   len(updated),
 	})
 }
 
@@ -1,15 +1,22 @@
 package handlers
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/goccy/go-json"
 
+	"github.com/gin-gonic/gin"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/application"
 	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
 	"github.com/mahdi-cpp/messages-api/internal/config"
 	"github.com/mahdi-cpp/messages-api/internal/helpers"
+	"github.com/mahdi-cpp/messages-api/internal/store"
 )
 
 const baseURL = "http://localhost:50151/api/"
@@ -167,3 +174,68 @@ func TestChatDelete(t *testing.T) {
 
 	t.Logf("Deleted %d chat", respBody)
 }
+
+// TestChatUpdateIfMatch runs the update handler on a store of its own,
+// unlike the tests above, which need a running server.
+func TestChatUpdateIfMatch(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	chats, err := store.Open[*chat.Chat](store.EngineJSON, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chats.Close()
+
+	created, err := chats.Create(&chat.Chat{Title: "before"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := created.Version
+
+	h := NewChatHandler(&application.AppManager{ChatCollectionManager: chats})
+	router := gin.New()
+	router.PATCH("/api/chats/:chatId", h.Update)
+
+	patch := func(chatID uuid.UUID, ifMatch, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPatch, "/api/chats/"+chatID.String(), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := patch(created.ID, etag(version), `{"title": "after"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	stored, err := chats.Read(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != "after" || stored.Version == version {
+		t.Fatalf("stored chat has title %q and version %q, want the update", stored.Title, stored.Version)
+	}
+	if got := rec.Header().Get("ETag"); got != etag(stored.Version) {
+		t.Errorf("ETag = %s, want %s", got, etag(stored.Version))
+	}
+
+	// The version the first update was based on is stale now.
+	rec = patch(created.ID, etag(version), `{"title": "stale"}`)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("status = %d, want 412: %s", rec.Code, rec.Body)
+	}
+	if stored, _ := chats.Read(created.ID); stored.Title != "after" {
+		t.Errorf("stale update changed the title to %q", stored.Title)
+	}
+
+	// The body cannot name another chat than the path.
+	rec = patch(created.ID, "", `{"chatIds": ["`+uuid.New().String()+`"], "title": "other"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body)
+	}
+}
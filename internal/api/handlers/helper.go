@@ -1,5 +1,11 @@
 package handlers
 
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
 type BuckUpdateChats struct {
 	Ids []string `json:"ids"`
 }
@@ -7,3 +13,19 @@ type BuckUpdateChats struct {
 type BuckDeleteChats struct {
 	Ids []string `json:"ids"`
 }
+
+// etag returns the ETag header value for an item version.
+func etag(version string) string {
+	return `"` + version + `"`
+}
+
+// ifMatch returns the version required by the If-Match header, or "" when
+// there is none or it matches any version.
+func ifMatch(c *gin.Context) string {
+	value := strings.TrimSpace(c.GetHeader("If-Match"))
+	if value == "*" {
+		return ""
+	}
+	value = strings.TrimPrefix(value, "W/")
+	return strings.Trim(value, `"`)
+}
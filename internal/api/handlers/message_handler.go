@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -9,6 +10,7 @@ import (
 	"github.com/mahdi-cpp/messages-api/internal/application"
 	"github.com/mahdi-cpp/messages-api/internal/collections/message"
 	"github.com/mahdi-cpp/messages-api/internal/helpers"
+	"github.com/mahdi-cpp/messages-api/internal/version"
 )
 
 type MessageHandler struct {
@@ -151,6 +153,7 @@ func (h *MessageHandler) readSingleMessage(c *gin.Context, chatID, messageId uui
 		return
 	}
 
+	c.Header("ETag", etag(readMessage.Version))
 	c.JSON(http.StatusOK, readMessage)
 }
 
@@ -163,19 +166,24 @@ func (h *MessageHandler) Update(c *gin.Context) {
 		return
 	}
 
-	chatManager, err := h.appManager.GetChatManager(request.ChatID)
-	if err != nil {
+	if _, err := h.appManager.GetChatManager(request.ChatID); err != nil {
 		fmt.Println(err)
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
 
-	messageUpdated, err := chatManager.UpdateMessage(request)
+	request.IfVersion = ifMatch(c)
+	messageUpdated, err := h.appManager.MessageUpdate(request)
+	if errors.Is(err, version.ErrConflict) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	c.Header("ETag", etag(messageUpdated.Version))
 	c.JSON(http.StatusOK, messageUpdated)
 }
 
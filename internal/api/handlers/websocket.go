@@ -47,5 +47,10 @@ func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		username = idString
 	}
 
-	h.appManager.CreateWebsocketClient(w, r, userID, username)
+	// A user may connect from several devices; each one keeps its own
+	// connection, see hub.Hub.
+	deviceID := r.URL.Query().Get("device_id")
+	platform := r.URL.Query().Get("platform")
+
+	h.appManager.CreateWebsocketClient(w, r, userID, username, deviceID, platform)
 }
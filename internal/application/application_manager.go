@@ -10,13 +10,17 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/mahdi-cpp/iris-tools/image_loader"
+	"github.com/mahdi-cpp/messages-api/internal/changefeed"
 	"github.com/mahdi-cpp/messages-api/internal/chat_manager"
 	"github.com/mahdi-cpp/messages-api/internal/collection_manager"
 	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
 	"github.com/mahdi-cpp/messages-api/internal/collections/message"
 	"github.com/mahdi-cpp/messages-api/internal/config"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
 	"github.com/mahdi-cpp/messages-api/internal/helpers"
 	"github.com/mahdi-cpp/messages-api/internal/hub"
+	"github.com/mahdi-cpp/messages-api/internal/retention"
+	"github.com/mahdi-cpp/messages-api/internal/store"
 )
 
 var upgrader = websocket.Upgrader{
@@ -27,11 +31,15 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024 * 10,
 }
 
+// chatMembersIndex is the chat collection index on member user IDs.
+const chatMembersIndex = "members"
+
 type AppManager struct {
 	mu                    sync.RWMutex
 	usersStatus           map[string]*UserStatusData //key is userID
-	ChatCollectionManager *collection_manager.Manager[*chat.Chat]
-	chatManagers          map[uuid.UUID]*chat_manager.Manager // Maps chatIDs to their Manager
+	ChatCollectionManager store.Store[*chat.Chat]
+	chatManagers          *chat_manager.Cache // Maps chatIDs to their Manager
+	changes               *changefeed.Feed
 	hub                   *hub.Hub
 	iconLoader            *image_loader.ImageLoader
 	// Added a channel to receive messages from the Hub for saving to a file.
@@ -39,6 +47,13 @@ type AppManager struct {
 	messagesToSave chan *hub.Message
 
 	createChat chan *chat.Chat
+
+	// chatWrites is held shared by the writes to ChatCollectionManager, and
+	// exclusively by Snapshot.
+	chatWrites sync.RWMutex
+
+	// retention purges old messages in the background, see retention.Service.
+	retention *retention.Service
 }
 
 func (m *AppManager) GetHub() *hub.Hub {
@@ -49,18 +64,24 @@ func NewApplicationManager() (*AppManager, error) {
 
 	manager := &AppManager{
 		messagesToSave: make(chan *hub.Message, 1000), // Initialize the channel
-		chatManagers:   make(map[uuid.UUID]*chat_manager.Manager),
+		chatManagers:   chat_manager.NewCache(config.ChatCacheBytes()),
 		createChat:     make(chan *chat.Chat, 100),
 	}
 
 	// Pass the new channel to the Hub
 	// کانال جدید را به Hub پاس می‌دهیم.
-	//manager.hub = hub.NewHub(manager.messagesToSave)
-	//go manager.hub.Run()
+	// The hub calls back for joins, resumes and receipts only once clients
+	// connect, after the chat collection below is open.
+	manager.hub = hub.NewHub(manager.messagesToSave)
+	manager.hub.SetMembership(manager.isChatMember)
+	manager.hub.SetReplay(manager.replayMessages)
+	manager.hub.SetReceipts(manager.acknowledgeReceipt)
+	manager.hub.SetChatCreator(manager.createClientChat)
+	go manager.hub.Run()
 
 	// Start goroutine to listen for messages and save them to chats file.
 	// یک goroutine برای گوش دادن به پیام‌ها و ذخیره آن‌ها در فایل راه‌اندازی می‌کنیم.
-	//go manager.saveMessagesToFile()
+	go manager.saveMessagesToFile()
 
 	var m1 runtime.MemStats
 	runtime.ReadMemStats(&m1)
@@ -68,11 +89,60 @@ func NewApplicationManager() (*AppManager, error) {
 
 	var err error
 	var chatsDirectory = config.GetPath("test/chats")
-	manager.ChatCollectionManager, err = collection_manager.New[*chat.Chat](chatsDirectory)
+	chatOpts := []collection_manager.Option{
+		collection_manager.WithLayout(collection_manager.Layout(config.ItemLayout("chats"))),
+		collection_manager.WithBackgroundReshard(),
+	}
+
+	// With a keyfile, chats and the messages of every chat are stored
+	// encrypted, each collection with its own data keys.
+	if keyfile := config.Keyfile(); keyfile != "" {
+		ring, err := encryption.LoadKeyfile(keyfile)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := encryption.OpenDataKeys(ring, chatsDirectory)
+		if err != nil {
+			return nil, err
+		}
+		chatOpts = append(chatOpts, collection_manager.WithCipher(keys))
+		manager.chatManagers.SetKeyring(ring)
+	}
+
+	manager.ChatCollectionManager, err = store.Open[*chat.Chat](config.StoreEngine("chats"), chatsDirectory, chatOpts...)
 	if err != nil {
 		panic(err)
 	}
 
+	// Chats and messages report their changes to one feed, for consumers
+	// that mirror them elsewhere.
+	manager.changes, err = changefeed.Open(config.GetPath("changefeed"))
+	if err != nil {
+		return nil, err
+	}
+	if publisher, ok := manager.ChatCollectionManager.(store.Publisher); ok {
+		publisher.SetChangeFeed(manager.changes, "chats")
+	}
+	manager.chatManagers.SetChangeFeed(manager.changes)
+
+	// Engines without secondary indexes fall back to a scan in ReadUserChats.
+	if indexer, ok := manager.ChatCollectionManager.(store.Indexer[*chat.Chat]); ok {
+		if err := indexer.AddIndex(chatMembersIndex, chat.MemberUserIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	if interval := config.RetentionInterval(); interval > 0 {
+		policy := retention.Policy{
+			SoftDeleteGrace: config.RetentionSoftDeleteGrace(),
+			MaxAge:          config.RetentionMaxAge(),
+			MaxCount:        config.RetentionMaxCount(),
+		}
+		manager.retention = retention.NewService(manager.ChatCollectionManager, manager.purgeMessages,
+			policy, interval, config.GetPath("retention/audit.log"))
+		manager.retention.Start()
+	}
+
 	// Get final memory stats
 	var m2 runtime.MemStats
 	runtime.ReadMemStats(&m2)
@@ -89,25 +159,45 @@ func NewApplicationManager() (*AppManager, error) {
 
 func (m *AppManager) GetChatManager(chatID uuid.UUID) (*chat_manager.Manager, error) {
 
-	chatManager, ok := m.chatManagers[chatID]
-	if ok {
+	// The manager is cheap until its messages are used; the cache loads them
+	// lazily and unloads the least recently used chats over its budget.
+	return m.chatManagers.Get(chatID, func() (*chat_manager.Manager, error) {
+		chat1, err := m.ChatCollectionManager.Read(chatID)
+		if err != nil {
+			fmt.Println("chat not found in cash")
+			return nil, err
+		}
+
+		chatManager, err := chat_manager.New(chat1)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
 		return chatManager, nil
-	}
+	})
+}
 
-	chat1, err := m.ChatCollectionManager.Read(chatID)
+// purgeMessages calls fn with the messages of a chat for deleting them in
+// bulk, see chat_manager.Manager.Purge, and sends the deletions to the
+// members of the chat.
+func (m *AppManager) purgeMessages(chatID uuid.UUID, fn func(messages store.Store[*message.Message]) error) error {
+	chatManager, err := m.GetChatManager(chatID)
 	if err != nil {
-		fmt.Println("chat not found in cash")
-		return nil, err
+		return err
 	}
-
-	chatManager, err = chat_manager.New(chat1)
-	if err != nil {
-		fmt.Println(err)
+	deleted, err := chatManager.Purge(fn)
+	if m.hub != nil {
+		for _, change := range deleted {
+			m.hub.BroadcastEvent(chatID, change.Seq, messageDeletedFrame(chatID, change.Seq, change.Deleted))
+		}
 	}
+	return err
+}
 
-	m.chatManagers[chatID] = chatManager // add to cash
-
-	return chatManager, nil
+// SubscribeChanges returns a subscription to the changes of chats and
+// messages with a sequence number of from or later, see changefeed.Feed.
+func (m *AppManager) SubscribeChanges(from uint64) *changefeed.Subscription {
+	return m.changes.Subscribe(from)
 }
 
 func (m *AppManager) createChatTimout() {
@@ -120,8 +210,8 @@ func (m *AppManager) createChatTimout() {
 
 func (m *AppManager) MessageCreate(newMessage *message.Message) (*message.Message, error) {
 
-	chatManager, ok := m.chatManagers[newMessage.ChatID]
-	if !ok {
+	chatManager, err := m.GetChatManager(newMessage.ChatID)
+	if err != nil {
 		fmt.Println("chat not found.")
 		return nil, errors.New("chat not found")
 	}
@@ -134,26 +224,42 @@ func (m *AppManager) MessageCreate(newMessage *message.Message) (*message.Messag
 
 	newMessage.ID = id
 
-	_, err = chatManager.Messages.Create(newMessage)
+	err = chatManager.CreateMessage(newMessage)
 	if err != nil {
 		fmt.Println("Failed to create message to file.")
 		return nil, err
 	}
+	m.hub.BroadcastEvent(newMessage.ChatID, newMessage.Seq, messageFrame(newMessage))
 
 	return newMessage, nil
 }
 
-func (m *AppManager) ReadAllMessages(with *message.SearchOptions) ([]*message.Message, error) {
+// MessageUpdate updates a message, see chat_manager.Manager.UpdateMessage,
+// and sends the edit to the members of its chat.
+func (m *AppManager) MessageUpdate(updateOptions message.UpdateOptions) (*message.Message, error) {
 
-	chatManager, ok := m.chatManagers[with.ChatID]
-	if !ok {
-		return nil, fmt.Errorf("chatId not found")
+	chatManager, err := m.GetChatManager(updateOptions.ChatID)
+	if err != nil {
+		return nil, err
 	}
 
-	all, err := chatManager.ReadAllMessages()
+	updated, err := chatManager.UpdateMessage(updateOptions)
 	if err != nil {
 		return nil, err
 	}
+	if m.hub != nil {
+		m.hub.BroadcastEvent(updated.ChatID, updated.ChangeSeq, messageEditedFrame(updated))
+	}
+
+	return updated, nil
+}
+
+func (m *AppManager) ReadAllMessages(with *message.SearchOptions) ([]*message.Message, error) {
+
+	chatManager, err := m.GetChatManager(with.ChatID)
+	if err != nil {
+		return nil, fmt.Errorf("chatId not found")
+	}
 
-	return message.Search(all, with), nil
+	return chatManager.SearchMessages(with)
 }
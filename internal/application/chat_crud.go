@@ -1,13 +1,20 @@
 package application
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/google/uuid"
-	"github.com/mahdi-cpp/iris-tools/search"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager_sqlite"
 	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
 	"github.com/mahdi-cpp/messages-api/internal/config"
 	"github.com/mahdi-cpp/messages-api/internal/helpers"
+	"github.com/mahdi-cpp/messages-api/internal/store"
+	"github.com/mahdi-cpp/messages-api/internal/version"
 )
 
 func (m *AppManager) ChatCreate(requestChat *chat.Chat) (*chat.Chat, error) {
@@ -23,12 +30,16 @@ func (m *AppManager) ChatCreate(requestChat *chat.Chat) (*chat.Chat, error) {
 		return nil, fmt.Errorf("failed to generate chat ID: %w", err)
 	}
 	requestChat.ID = chatID
+	chat.ClearCursors(requestChat.Members)
 
 	// Step 3: create the chat in the database
+	m.chatWrites.RLock()
+	defer m.chatWrites.RUnlock()
 	_, err = m.ChatCollectionManager.Create(requestChat)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create chat in database: %w", err)
 	}
+	m.syncChatMembers(requestChat)
 
 	return requestChat, nil
 }
@@ -45,84 +56,189 @@ func (m *AppManager) ReadChat(chatID uuid.UUID) (*chat.Chat, error) {
 
 func (m *AppManager) ReadAllChats(chatOptions *chat.SearchOptions) ([]*chat.Chat, error) {
 
-	chats, err := m.ChatCollectionManager.ReadAll()
+	if db, ok := m.ChatCollectionManager.(*collection_manager_sqlite.Manager[*chat.Chat]); ok {
+		found, err := collection_manager_sqlite.SearchChats(context.Background(), db, config.Mahdi, chatOptions)
+		if err != nil {
+			return nil, err
+		}
+		return m.withUnreadCounts(config.Mahdi, found)
+	}
+
+	userChats, err := m.ReadUserChats(config.Mahdi)
 	if err != nil {
 		return nil, err
 	}
 
+	filterChats := chat.Search(userChats, chatOptions)
+
+	return m.withUnreadCounts(config.Mahdi, filterChats)
+}
+
+// ReadUserChats returns the chats the user is a member of, looked up through
+// the members index instead of scanning every chat.
+func (m *AppManager) ReadUserChats(userID uuid.UUID) ([]*chat.Chat, error) {
+
 	var userChats []*chat.Chat
-	results := search.Find(chats, chat.HasMemberWith(chat.MemberWithUserID(config.Mahdi)))
+	if indexer, ok := m.ChatCollectionManager.(store.Indexer[*chat.Chat]); ok {
+		found, err := indexer.FindBy(chatMembersIndex, userID)
+		if err != nil {
+			return nil, err
+		}
+		userChats = found
+	} else {
+		isMember := chat.HasMemberWith(chat.MemberWithUserID(userID))
+		err := m.ChatCollectionManager.Iterate(context.Background(), func(c *chat.Chat) bool {
+			if isMember(c) {
+				userChats = append(userChats, c)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	lessFn := chat.GetLessFunc("updatedAt", "start")
 	if lessFn != nil {
-		search.SortIndexedItems(results, lessFn)
+		sort.SliceStable(userChats, func(i, j int) bool {
+			return lessFn(userChats[i], userChats[j])
+		})
 	}
 
-	//fmt.Println("ReadAllChats: ", len(results))
+	return userChats, nil
+}
+
+// updateRetries is how many times an update without If-Match is retried
+// after losing a race with a concurrent update.
+const updateRetries = 3
 
-	for _, result := range results {
-		userChats = append(userChats, result.Value)
+// UpdateChats applies the update options to every chat and returns the
+// updated chats. With IfVersion set, it updates a single chat and fails
+// with a version conflict if the chat changed since that version.
+func (m *AppManager) UpdateChats(updateOptions chat.UpdateOptions) ([]*chat.Chat, error) {
+
+	if updateOptions.IfVersion != "" && len(updateOptions.ChatIDs) != 1 {
+		return nil, fmt.Errorf("a version can only be given for a single chat")
 	}
 
-	filterChats := chat.Search(userChats, chatOptions)
+	// Receipt cursors are not kept in the chats.
+	if updateOptions.Members != nil {
+		chat.ClearCursors(*updateOptions.Members)
+	}
+	chat.ClearCursors(updateOptions.AddMembers)
+
+	m.chatWrites.RLock()
+	defer m.chatWrites.RUnlock()
 
-	return filterChats, nil
+	for attempt := 1; ; attempt++ {
+		updated, err := m.updateChats(updateOptions)
+		if errors.Is(err, version.ErrConflict) && updateOptions.IfVersion == "" && attempt < updateRetries {
+			continue
+		}
+		if err == nil {
+			// Live subscriptions follow the committed members.
+			m.syncChatMembers(updated...)
+		}
+		return updated, err
+	}
 }
 
-func (m *AppManager) ReadUserChats(userID uuid.UUID) ([]*chat.Chat, error) {
+func (m *AppManager) updateChats(updateOptions chat.UpdateOptions) ([]*chat.Chat, error) {
 
-	chats, err := m.ChatCollectionManager.ReadAll()
+	// All chats are updated in one transaction, so a failure on any of them
+	// leaves every chat as it was.
+	tx := collection_manager.NewTx()
+	chatsTx, err := store.Join(m.ChatCollectionManager, tx)
 	if err != nil {
-		return nil, err
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to update chats: %w", err)
 	}
 
-	//searchOptions := &chat.SearchOptions{
-	//	Page: 0,
-	//	Size:  10,
-	//}
-	//filterChats := chat.Search(ChatCollectionManager, searchOptions)
+	updated := make([]*chat.Chat, 0, len(updateOptions.ChatIDs))
+	for _, chatID := range updateOptions.ChatIDs {
+		current, err := m.ChatCollectionManager.Read(chatID)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to read chat %s: %w", chatID, err)
+		}
 
-	var filterChats []*chat.Chat
-	results := search.Find(chats, chat.HasMemberWith(chat.MemberWithUserID(userID)))
+		chat1, err := collection_manager.Clone(current)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to copy chat %s: %w", chatID, err)
+		}
 
-	lessFn := chat.GetLessFunc("updatedAt", "start")
-	if lessFn != nil {
-		search.SortIndexedItems(results, lessFn)
-	}
+		chat.Update(chat1, updateOptions)
+		if updateOptions.IfVersion != "" {
+			chat1.Version = updateOptions.IfVersion
+		}
 
-	for _, result := range results {
-		filterChats = append(filterChats, result.Value)
+		if err := chatsTx.Update(chat1); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to update chat %s: %w", chatID, err)
+		}
+		updated = append(updated, chat1)
 	}
 
-	return filterChats, nil
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to update chats: %w", err)
+	}
+	return updated, nil
 }
 
-func (m *AppManager) UpdateChats(updateOptions chat.UpdateOptions) error {
+// ChatDelete removes a chat together with all of its messages in a single
+// transaction.
+func (m *AppManager) ChatDelete(chatID uuid.UUID) error {
 
-	for _, chatID := range updateOptions.ChatIDs {
-		chat1, err := m.ChatCollectionManager.Read(chatID)
+	m.chatWrites.RLock()
+	defer m.chatWrites.RUnlock()
+
+	chatManager, err := m.GetChatManager(chatID)
+	if err != nil {
+		fmt.Println("error deleting chat")
+		return err
+	}
+
+	// The transaction is committed while the messages are held loaded, so
+	// the chat cache cannot unload them in between.
+	err = chatManager.WithMessages(func(messages store.Store[*message.Message]) error {
+		tx := collection_manager.NewTx()
+		chatsTx, err := store.Join(m.ChatCollectionManager, tx)
 		if err != nil {
-			return fmt.Errorf("failed to read chat %s: %w", chatID, err)
+			tx.Rollback()
+			return err
+		}
+		if err := chatsTx.Delete(chatID); err != nil {
+			tx.Rollback()
+			return err
 		}
-		
-		chat.Update(chat1, updateOptions)
 
-		_, err = m.ChatCollectionManager.Update(chat1)
+		all, err := messages.ReadAll()
 		if err != nil {
-			return fmt.Errorf("failed to update chat %s: %w", chatID, err)
+			tx.Rollback()
+			return err
 		}
-	}
-	return nil
-}
-
-func (m *AppManager) ChatDelete(chatID uuid.UUID) error {
 
-	err := m.ChatCollectionManager.Delete(chatID)
+		messagesTx, err := store.Join(messages, tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, msg := range all {
+			if err := messagesTx.Delete(msg.ID); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	})
 	if err != nil {
 		fmt.Println("error deleting chat")
 		return err
 	}
+	if m.hub != nil {
+		m.hub.RemoveChat(chatID)
+	}
 
-	delete(m.chatManagers, chatID)
-	return nil
+	return m.chatManagers.Remove(chatID)
 }
@@ -0,0 +1,94 @@
+package application
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/hub"
+)
+
+// Acknowledge persists a delivered or read receipt of a member up to a
+// message on the chat, and reports whether the cursor of the member moved.
+// The cursors are kept with the messages of the chat, so the chat and its
+// version do not change, see chat_manager.Manager.Acknowledge.
+func (m *AppManager) Acknowledge(chatID, userID uuid.UUID, receipt chat.Receipt, messageID uuid.UUID) (int64, bool, error) {
+
+	chat1, err := m.ChatCollectionManager.Read(chatID)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read chat %s: %w", chatID, err)
+	}
+	if _, ok := chat1.Member(userID); !ok {
+		return 0, false, chat.ErrNotMember
+	}
+
+	chatManager, err := m.GetChatManager(chatID)
+	if err != nil {
+		return 0, false, err
+	}
+	msg, err := chatManager.ReadMessage(messageID)
+	if err != nil {
+		return 0, false, err
+	}
+	if msg.ChatID != chatID || msg.Seq == 0 {
+		return 0, false, fmt.Errorf("message %s cannot be acknowledged in chat %s", messageID, chatID)
+	}
+
+	advanced, err := chatManager.Acknowledge(userID, receipt, messageID, msg.Seq)
+	return msg.Seq, advanced, err
+}
+
+// acknowledgeReceipt persists a receipt sent through the hub. A receipt
+// without a message acknowledges the last message of the chat.
+func (m *AppManager) acknowledgeReceipt(receipt *hub.Receipt) (bool, error) {
+	if receipt.MessageID == uuid.Nil {
+		chatManager, err := m.GetChatManager(receipt.ChatID)
+		if err != nil {
+			return false, err
+		}
+		seq, messageID, err := chatManager.LastMessage()
+		if err != nil || seq == 0 {
+			return false, err
+		}
+		receipt.MessageID = messageID
+	}
+	seq, advanced, err := m.Acknowledge(receipt.ChatID, receipt.UserID, chat.Receipt(receipt.Kind), receipt.MessageID)
+	receipt.Seq = seq
+	return advanced, err
+}
+
+// withUnreadCounts returns copies of chats with the current receipt
+// cursors of their members, and UnreadCount set for a user from their read
+// cursor in each chat.
+func (m *AppManager) withUnreadCounts(userID uuid.UUID, chats []*chat.Chat) ([]*chat.Chat, error) {
+
+	counted := make([]*chat.Chat, 0, len(chats))
+	for _, c := range chats {
+		chatManager, err := m.GetChatManager(c.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		// The stored chats are shared, so the cursors and the count are
+		// set on a copy.
+		chat1 := *c
+		chat1.Members = slices.Clone(c.Members)
+		for i := range chat1.Members {
+			cursors, err := chatManager.Cursors(chat1.Members[i].UserID)
+			if err != nil {
+				return nil, err
+			}
+			chat1.Members[i].Cursors = &cursors
+		}
+
+		if member, ok := chat1.Member(userID); ok {
+			chat1.UnreadCount, err = chatManager.UnreadCount(userID, member.ReadSeq)
+			if err != nil {
+				return nil, err
+			}
+		}
+		counted = append(counted, &chat1)
+	}
+	return counted, nil
+}
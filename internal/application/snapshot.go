@@ -0,0 +1,88 @@
+package application
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mahdi-cpp/messages-api/internal/config"
+	"github.com/mahdi-cpp/messages-api/internal/snapshot"
+	"github.com/mahdi-cpp/messages-api/internal/store"
+)
+
+// Snapshot writes a consistent archive of config.RootDir to w while the
+// server runs. Writes to the chats and to the messages of every chat are
+// stopped only while the files are staged; the archive is compressed from
+// the staged files afterwards.
+func (m *AppManager) Snapshot(w io.Writer) (*snapshot.Manifest, error) {
+
+	staged, err := m.stageSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer staged.Remove()
+
+	return staged.Write(w)
+}
+
+// stageSnapshot stages config.RootDir with writes stopped. Stores of
+// store.EngineJSON only replace their item files by rename and append to
+// their logs, so once checkpointed they are linked rather than copied,
+// which keeps the pause short and the loaded chats in memory. The other
+// engines write their files in place, so they are copied with every chat
+// unloaded.
+func (m *AppManager) stageSnapshot() (*snapshot.Staged, error) {
+
+	m.chatWrites.Lock()
+	defer m.chatWrites.Unlock()
+
+	chats, ok := m.ChatCollectionManager.(store.Pauser)
+	if !ok || !linkable(config.StoreEngine("chats")) || !linkable(config.StoreEngine("messages")) {
+		return m.copySnapshot()
+	}
+
+	// Messages first, so that no call on them waits for the chats meanwhile.
+	resumeMessages, err := m.chatManagers.Pause()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pause messages: %w", err)
+	}
+	defer resumeMessages()
+
+	resumeChats, err := chats.Pause()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pause chats: %w", err)
+	}
+	defer resumeChats()
+
+	// The staging directory must be on the file system of the root for
+	// the links, so it is put next to it.
+	return snapshot.Link(config.RootDir, filepath.Dir(config.RootDir))
+}
+
+// copySnapshot copies config.RootDir to a staging directory. m.chatWrites
+// must be held.
+func (m *AppManager) copySnapshot() (*snapshot.Staged, error) {
+
+	resume, err := m.chatManagers.Quiesce()
+	if err != nil {
+		return nil, fmt.Errorf("failed to quiesce chats: %w", err)
+	}
+	defer resume()
+
+	// Stores with a write-ahead log are recovered from it on restore, but
+	// a checkpoint keeps the archive smaller.
+	if checkpointer, ok := m.ChatCollectionManager.(interface{ Checkpoint() error }); ok {
+		if err := checkpointer.Checkpoint(); err != nil {
+			return nil, fmt.Errorf("failed to checkpoint chats: %w", err)
+		}
+	}
+
+	return snapshot.Stage(config.RootDir, os.TempDir())
+}
+
+// linkable reports whether the files of a store engine can be staged by
+// snapshot.Link.
+func linkable(engine string) bool {
+	return engine == "" || engine == store.EngineJSON
+}
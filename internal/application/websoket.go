@@ -7,12 +7,13 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
 	"github.com/mahdi-cpp/messages-api/internal/collections/message"
 	"github.com/mahdi-cpp/messages-api/internal/helpers"
 	"github.com/mahdi-cpp/messages-api/internal/hub"
 )
 
-func (m *AppManager) CreateWebsocketClient(w http.ResponseWriter, r *http.Request, userID uuid.UUID, username string) {
+func (m *AppManager) CreateWebsocketClient(w http.ResponseWriter, r *http.Request, userID uuid.UUID, username, deviceID, platform string) {
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -21,20 +22,30 @@ func (m *AppManager) CreateWebsocketClient(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	log.Printf("WebSocket connection established for user: %s (%s)", username, userID)
-
-	client := hub.NewClient(m.hub, conn, userID)
+	client := hub.NewClient(m.hub, conn, userID, deviceID, platform)
+	log.Printf("WebSocket connection established for user: %s (%s) on device %s", username, userID, client.DeviceID())
 	m.hub.RegisterClient(client)
 
+	// The connection receives the traffic of every chat the user is a
+	// member of, without joining them one by one.
+	userChats, err := m.ReadUserChats(userID)
+	if err != nil {
+		log.Printf("Failed to read chats of user %s: %v", userID, err)
+	}
+	for _, c := range userChats {
+		m.hub.JoinChat(c.ID, userID)
+	}
+
 	go client.WritePump()
 	go client.ReadPump()
 
 	// Send welcome message only to this chat_client
 	welcomeMessage := map[string]interface{}{
-		"type":    "system",
-		"message": "Welcome to the chat!",
-		"userId":  userID,
-		"success": true,
+		"type":     "system",
+		"message":  "Welcome to the chat!",
+		"userId":   userID,
+		"deviceId": client.DeviceID(),
+		"success":  true,
 	}
 
 	if err := client.SendMessage(welcomeMessage); err != nil {
@@ -50,6 +61,84 @@ func (m *AppManager) CreateWebsocketClient(w http.ResponseWriter, r *http.Reques
 	m.notifyUserJoined(userID, chatId, username)
 }
 
+// isChatMember reports whether a user is a member of a persisted chat. It
+// authorizes the join requests of the hub.
+func (m *AppManager) isChatMember(chatID, userID uuid.UUID) (bool, error) {
+	chat1, err := m.ChatCollectionManager.Read(chatID)
+	if err != nil {
+		return false, err
+	}
+	return chat.HasMemberWith(chat.MemberWithUserID(userID))(chat1), nil
+}
+
+// createClientChat persists a chat a client created over its WebSocket, with
+// the user as its creator and only member.
+func (m *AppManager) createClientChat(userID uuid.UUID, name string) (uuid.UUID, error) {
+	created, err := m.ChatCreate(&chat.Chat{
+		Title: name,
+		Members: []chat.Member{
+			{UserID: userID, Role: "creator", IsActive: true, JoinedAt: time.Now()},
+		},
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return created.ID, nil
+}
+
+// replayMessages returns the changes of the messages of a chat after a
+// sequence number as hub events, for clients resuming after a reconnect.
+func (m *AppManager) replayMessages(chatID uuid.UUID, after int64) ([]hub.Event, error) {
+	chatManager, err := m.GetChatManager(chatID)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := chatManager.ChangesAfter(after)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]hub.Event, 0, len(changes))
+	for _, change := range changes {
+		var frame map[string]interface{}
+		switch {
+		case change.Message == nil:
+			frame = messageDeletedFrame(chatID, change.Seq, change.Deleted)
+		case change.Message.Seq > after:
+			// Created after the cursor, so the client has not seen it in
+			// any form.
+			frame = messageFrame(change.Message)
+		default:
+			frame = messageEditedFrame(change.Message)
+		}
+		events = append(events, hub.Event{Seq: change.Seq, Message: frame})
+	}
+	return events, nil
+}
+
+// syncChatMembers passes the members of chats on to their chat managers,
+// subscribes the connected members to them in the hub, and unsubscribes
+// users that are no longer members.
+func (m *AppManager) syncChatMembers(chats ...*chat.Chat) {
+	if m.chatManagers != nil {
+		for _, c := range chats {
+			if chatManager, ok := m.chatManagers.Lookup(c.ID); ok {
+				chatManager.SetMembers(c.Members)
+			}
+		}
+	}
+	if m.hub == nil {
+		return
+	}
+	for _, c := range chats {
+		userIDs := make([]uuid.UUID, 0, len(c.Members))
+		for _, member := range c.Members {
+			userIDs = append(userIDs, member.UserID)
+		}
+		m.hub.SyncChatMembers(c.ID, userIDs)
+	}
+}
+
 // notifyUserJoined sends a notification when a user joins a chat
 func (m *AppManager) notifyUserJoined(userID, chatID uuid.UUID, username string) {
 
@@ -66,37 +155,81 @@ func (m *AppManager) notifyUserJoined(userID, chatID uuid.UUID, username string)
 	m.hub.BroadcastToChat(chatID, joinMessage)
 }
 
+// saveMessagesToFile stores the messages clients send through the hub. A
+// message is acked to its sender and broadcast to the chat only once it is
+// stored, in its stored form.
 func (m *AppManager) saveMessagesToFile() {
 	for msg := range m.messagesToSave {
 
-		chatManager, err := m.GetChatManager(msg.ChatID)
+		newMessage, err := m.saveMessage(msg)
 		if err != nil {
-			return
+			log.Printf("Failed to save message of user %s in chat %s: %v", msg.UserID, msg.ChatID, err)
+			m.hub.RejectMessage(msg, "failed to store the message")
+			continue
 		}
 
-		id, err := helpers.GenerateUUID()
-		if err != nil {
-			fmt.Printf("Failed to generate uuid: %v", err)
-			return
-		}
+		m.hub.AckMessage(msg, newMessage.ID, newMessage.Seq)
+		m.hub.BroadcastEvent(msg.ChatID, newMessage.Seq, messageFrame(newMessage))
+	}
+}
 
-		newMessage := &message.Message{
-			//MessageType: "message",
-			ID:        id,
-			UserID:    msg.UserID,
-			ChatID:    msg.ChatID,
-			Caption:   msg.Content,
-			CreatedAt: time.Now(),
-			UpdatedAt: time.Now(),
-			Version:   "1",
-		}
+func (m *AppManager) saveMessage(msg *hub.Message) (*message.Message, error) {
 
-		err = chatManager.CreateMessage(newMessage)
-		if err != nil {
-			fmt.Println("Failed to create message to file.")
-			return
-		}
+	chatManager, err := m.GetChatManager(msg.ChatID)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := helpers.GenerateUUID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate uuid: %w", err)
+	}
+
+	newMessage := &message.Message{
+		//MessageType: "message",
+		ID:        id,
+		UserID:    msg.UserID,
+		ChatID:    msg.ChatID,
+		Caption:   msg.Content,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	if err := chatManager.CreateMessage(newMessage); err != nil {
+		return nil, fmt.Errorf("failed to create message: %w", err)
+	}
+	return newMessage, nil
+}
+
+// messageFrame is the frame a stored message is sent to clients in, live
+// and on replay.
+func messageFrame(msg *message.Message) map[string]interface{} {
+	return map[string]interface{}{
+		"type":    "message",
+		"chatId":  msg.ChatID,
+		"seq":     msg.Seq,
+		"message": msg,
+	}
+}
+
+// messageEditedFrame is the frame an edit of a message is sent to clients
+// in, numbered with the sequence number of the edit.
+func messageEditedFrame(msg *message.Message) map[string]interface{} {
+	return map[string]interface{}{
+		"type":    "message_edited",
+		"chatId":  msg.ChatID,
+		"seq":     msg.ChangeSeq,
+		"message": msg,
+	}
+}
 
-		m.hub.BroadcastToChat(msg.ChatID, newMessage)
+// messageDeletedFrame is the frame the deletion of a message is sent to
+// clients in.
+func messageDeletedFrame(chatID uuid.UUID, seq int64, messageID uuid.UUID) map[string]interface{} {
+	return map[string]interface{}{
+		"type":      "message_deleted",
+		"chatId":    chatID,
+		"seq":       seq,
+		"messageId": messageID,
 	}
 }
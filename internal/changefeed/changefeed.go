@@ -0,0 +1,330 @@
+// Package changefeed records the changes made to the collections as an
+// append-only log of events with increasing sequence numbers. Consumers
+// subscribe from a sequence number and receive the logged events followed
+// by new ones as they are appended, so they can resume after a restart.
+package changefeed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+const (
+	FileName = "changes.log"
+	// frameHeaderSize is the [length uint32][crc32 uint32] prefix of every frame.
+	frameHeaderSize = 8
+)
+
+var ErrClosed = errors.New("change feed is closed")
+
+type Op string
+
+const (
+	OpCreate Op = "create"
+	OpUpdate Op = "update"
+	OpDelete Op = "delete"
+)
+
+// Event is one change to an item. Before is empty for a create and After
+// is empty for a delete.
+type Event struct {
+	Seq        uint64          `json:"seq"`
+	Collection string          `json:"collection"`
+	ID         uuid.UUID       `json:"id"`
+	Op         Op              `json:"op"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	Time       time.Time       `json:"time"`
+}
+
+// Change is an Event with Before and After decoded as T. They are the zero
+// value when absent.
+type Change[T any] struct {
+	Seq        uint64
+	Collection string
+	ID         uuid.UUID
+	Op         Op
+	Before     T
+	After      T
+	Time       time.Time
+}
+
+// Decode returns e with its items decoded as T.
+func Decode[T any](e Event) (Change[T], error) {
+	change := Change[T]{Seq: e.Seq, Collection: e.Collection, ID: e.ID, Op: e.Op, Time: e.Time}
+	if len(e.Before) > 0 {
+		if err := json.Unmarshal(e.Before, &change.Before); err != nil {
+			return change, fmt.Errorf("error decoding event %d: %w", e.Seq, err)
+		}
+	}
+	if len(e.After) > 0 {
+		if err := json.Unmarshal(e.After, &change.After); err != nil {
+			return change, fmt.Errorf("error decoding event %d: %w", e.Seq, err)
+		}
+	}
+	return change, nil
+}
+
+// Feed is a persisted change log. Events are framed as [length][crc32][json]
+// and fsynced before Append returns; a torn frame left by a crash is
+// dropped when the feed is opened.
+type Feed struct {
+	path string
+	file *os.File
+
+	mu     sync.Mutex
+	size   int64
+	seq    uint64
+	closed bool
+	// appended is closed and replaced on every append, waking subscribers.
+	appended chan struct{}
+}
+
+// Open opens or creates the feed stored in dir.
+func Open(dir string) (*Feed, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating change feed directory: %w", err)
+	}
+
+	path := filepath.Join(dir, FileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening change feed: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error getting change feed info: %w", err)
+	}
+
+	f := &Feed{path: path, file: file, size: info.Size(), appended: make(chan struct{})}
+
+	var valid int64
+	err = scan(file, 0, f.size, func(e *Event, end int64) bool {
+		f.seq = e.Seq
+		valid = end
+		return true
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if valid < f.size {
+		fmt.Printf("changefeed: discarding %d bytes of torn tail in %s\n", f.size-valid, path)
+		if err := file.Truncate(valid); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error truncating torn change feed tail: %w", err)
+		}
+		f.size = valid
+	}
+	return f, nil
+}
+
+// Seq returns the sequence number of the last event.
+func (f *Feed) Seq() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.seq
+}
+
+// Append records a change to the item with the given ID and returns its
+// sequence number. A nil before or after, such as the before of a create,
+// is left out of the event.
+func (f *Feed) Append(collection string, id uuid.UUID, op Op, before, after any) (uint64, error) {
+	e := &Event{Collection: collection, ID: id, Op: op, Time: time.Now().UTC()}
+
+	var err error
+	if e.Before, err = marshal(before); err != nil {
+		return 0, fmt.Errorf("error marshaling change: %w", err)
+	}
+	if e.After, err = marshal(after); err != nil {
+		return 0, fmt.Errorf("error marshaling change: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, ErrClosed
+	}
+
+	e.Seq = f.seq + 1
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling change: %w", err)
+	}
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[frameHeaderSize:], payload)
+
+	if _, err := f.file.WriteAt(frame, f.size); err != nil {
+		return 0, fmt.Errorf("error writing change: %w", err)
+	}
+	if err := f.file.Sync(); err != nil {
+		return 0, fmt.Errorf("error syncing change feed: %w", err)
+	}
+
+	f.size += int64(len(frame))
+	f.seq = e.Seq
+	close(f.appended)
+	f.appended = make(chan struct{})
+	return e.Seq, nil
+}
+
+// Close closes the feed and ends every subscription.
+func (f *Feed) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	close(f.appended)
+	return f.file.Close()
+}
+
+// Subscription delivers the events of a feed in sequence order.
+type Subscription struct {
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+// Subscribe returns a subscription to the events with a sequence number of
+// from or later: those already logged, then new ones as they are appended.
+// A consumer that stored the sequence number of the last event it handled
+// resumes with Subscribe(seq + 1).
+//
+// Events are read back from the log, so a slow subscriber never holds up
+// writers; it only falls behind.
+func (f *Feed) Subscribe(from uint64) *Subscription {
+	s := &Subscription{events: make(chan Event, 64), done: make(chan struct{})}
+	go s.run(f, from)
+	return s
+}
+
+// Events returns the channel the events are delivered on. It is closed
+// when the subscription or the feed is closed, or reading the log failed.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Err returns the error that ended the subscription, once Events is closed.
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+func (s *Subscription) run(f *Feed, from uint64) {
+	defer close(s.events)
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		s.err = fmt.Errorf("error opening change feed: %w", err)
+		return
+	}
+	defer file.Close()
+
+	var offset int64
+	for {
+		f.mu.Lock()
+		size, closed, appended := f.size, f.closed, f.appended
+		f.mu.Unlock()
+		if closed {
+			s.err = ErrClosed
+			return
+		}
+
+		stopped := false
+		err := scan(file, offset, size, func(e *Event, end int64) bool {
+			if e.Seq >= from {
+				select {
+				case s.events <- *e:
+				case <-s.done:
+					stopped = true
+					return false
+				}
+			}
+			offset = end
+			return true
+		})
+		if err != nil {
+			s.err = err
+			return
+		}
+		if stopped {
+			return
+		}
+
+		select {
+		case <-appended:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// scan calls fn with every intact event between offset and size and the
+// offset of the frame after it, until fn returns false. It stops silently
+// at the first short or corrupt frame.
+func scan(file *os.File, offset, size int64, fn func(e *Event, end int64) bool) error {
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, size-offset))
+	header := make([]byte, frameHeaderSize)
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+		if int64(length) > size-offset-frameHeaderSize {
+			return nil
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return nil
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return nil
+		}
+
+		var e Event
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return fmt.Errorf("error decoding change at offset %d: %w", offset, err)
+		}
+		offset += frameHeaderSize + int64(length)
+		if !fn(&e, offset) {
+			return nil
+		}
+	}
+}
+
+func marshal(item any) (json.RawMessage, error) {
+	if item == nil {
+		return nil, nil
+	}
+	if v := reflect.ValueOf(item); v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, nil
+	}
+	return json.Marshal(item)
+}
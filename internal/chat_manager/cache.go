@@ -0,0 +1,234 @@
+package chat_manager
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/changefeed"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+)
+
+// Cache hands out one Manager per chat and bounds the memory of their
+// loaded messages, counts and receipt cursors. Managers are created without
+// loading anything; when the estimated size of the loaded chats grows over
+// the budget, the least recently used ones are flushed and unloaded until it
+// fits again. An unloaded manager only keeps the chat it was created with.
+type Cache struct {
+	// gate is held shared by every call on the messages or the receipts
+	// of a chat, which are the calls that write to its files, and
+	// exclusively while the cache is quiesced or paused.
+	gate sync.RWMutex
+
+	mu       sync.Mutex
+	budget   int64
+	used     int64
+	managers map[uuid.UUID]*Manager
+	lru      *list.List // loaded managers, most recently used first
+	feed     *changefeed.Feed
+	ring     *encryption.Keyring
+}
+
+// NewCache returns a cache that keeps at most budget bytes of messages
+// loaded. The chat used last is always kept, even when it alone is larger.
+func NewCache(budget int64) *Cache {
+	return &Cache{
+		budget:   budget,
+		managers: make(map[uuid.UUID]*Manager),
+		lru:      list.New(),
+	}
+}
+
+// SetChangeFeed makes the message collections loaded from now on report
+// their changes to feed, see store.Publisher.
+func (c *Cache) SetChangeFeed(feed *changefeed.Feed) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.feed = feed
+}
+
+func (c *Cache) changeFeed() *changefeed.Feed {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.feed
+}
+
+// SetKeyring makes the message collections loaded from now on encrypted,
+// each chat with its own data keys wrapped by the master keys of ring.
+func (c *Cache) SetKeyring(ring *encryption.Keyring) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ring = ring
+}
+
+func (c *Cache) keyring() *encryption.Keyring {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ring
+}
+
+// Get returns the manager of a chat, calling open to create it on first use.
+func (c *Cache) Get(chatID uuid.UUID, open func() (*Manager, error)) (*Manager, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if manager, ok := c.managers[chatID]; ok {
+		return manager, nil
+	}
+
+	manager, err := open()
+	if err != nil {
+		return nil, err
+	}
+	manager.cache = c
+	c.managers[chatID] = manager
+	return manager, nil
+}
+
+// Lookup returns the manager of a chat, if it was created.
+func (c *Cache) Lookup(chatID uuid.UUID) (*Manager, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	manager, ok := c.managers[chatID]
+	return manager, ok
+}
+
+// Remove unloads the manager of a chat and forgets it, for deleted chats.
+func (c *Cache) Remove(chatID uuid.UUID) error {
+	c.mu.Lock()
+	manager, ok := c.managers[chatID]
+	if ok {
+		delete(c.managers, chatID)
+		c.unlink(manager)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return manager.unload()
+}
+
+// Close flushes and unloads every chat.
+func (c *Cache) Close() error {
+	return c.unloadAll()
+}
+
+func (c *Cache) unloadAll() error {
+	c.mu.Lock()
+	managers := make([]*Manager, 0, len(c.managers))
+	for _, manager := range c.managers {
+		c.unlink(manager)
+		managers = append(managers, manager)
+	}
+	c.mu.Unlock()
+
+	var errs []error
+	for _, manager := range managers {
+		errs = append(errs, manager.unload())
+	}
+	return errors.Join(errs...)
+}
+
+// Quiesce waits for the calls in progress on the messages of every chat,
+// then flushes and unloads the loaded chats, so that their files are
+// complete on disk and no longer change. New calls block until resume is
+// called, after which the chats load again on use.
+func (c *Cache) Quiesce() (resume func(), err error) {
+	c.gate.Lock()
+	if err := c.unloadAll(); err != nil {
+		c.gate.Unlock()
+		return nil, err
+	}
+	return c.gate.Unlock, nil
+}
+
+// Pause waits for the calls in progress on the messages of every chat and
+// holds new ones back until resume is called, like Quiesce, but keeps the
+// loaded chats in memory: their collections are paused instead, see
+// store.Pauser, which checkpoints them and stops their background work. It
+// fails when a loaded collection cannot be paused.
+func (c *Cache) Pause() (resume func(), err error) {
+	c.gate.Lock()
+	c.mu.Lock()
+	managers := make([]*Manager, 0, len(c.managers))
+	for _, manager := range c.managers {
+		managers = append(managers, manager)
+	}
+	c.mu.Unlock()
+
+	var resumes []func()
+	resume = func() {
+		for _, fn := range resumes {
+			fn()
+		}
+		c.gate.Unlock()
+	}
+	for _, manager := range managers {
+		fn, err := manager.pause()
+		if err != nil {
+			resume()
+			return nil, err
+		}
+		if fn != nil {
+			resumes = append(resumes, fn)
+		}
+	}
+	return resume, nil
+}
+
+// Used returns the estimated size of the loaded chats and the number of them.
+func (c *Cache) Used() (int64, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used, c.lru.Len()
+}
+
+// touch marks m as used last with the given size, and unloads the least
+// recently used chats while the budget is exceeded. It must be called
+// without holding the lock of any manager, since unloading waits for the
+// calls in progress on the evicted chats.
+func (c *Cache) touch(m *Manager, size int64) {
+	c.mu.Lock()
+	if m.elem == nil {
+		m.elem = c.lru.PushFront(m)
+	} else {
+		c.lru.MoveToFront(m.elem)
+	}
+	c.used += size - m.size
+	m.size = size
+
+	var evicted []*Manager
+	for c.used > c.budget && c.lru.Len() > 1 {
+		victim := c.lru.Back().Value.(*Manager)
+		c.unlink(victim)
+		evicted = append(evicted, victim)
+	}
+	c.mu.Unlock()
+
+	for _, victim := range evicted {
+		if err := victim.unload(); err != nil {
+			log.Printf("chat cache: %v", err)
+		}
+	}
+}
+
+// forget drops m from the loaded chats, before it is closed directly.
+func (c *Cache) forget(m *Manager) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unlink(m)
+}
+
+// unlink removes m from the LRU list. c.mu must be held.
+func (c *Cache) unlink(m *Manager) {
+	if m.elem == nil {
+		return
+	}
+	c.lru.Remove(m.elem)
+	m.elem = nil
+	c.used -= m.size
+	m.size = 0
+}
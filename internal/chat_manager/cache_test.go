@@ -0,0 +1,155 @@
+package chat_manager
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+
+	dir := t.TempDir()
+	// Room for two chats of one message each, counted for UnreadCount.
+	const chatSize = messageSizeEstimate + countedSizeEstimate
+	cache := NewCache(2 * chatSize)
+	defer cache.Close()
+
+	get := func(chatID uuid.UUID) *Manager {
+		manager, err := cache.Get(chatID, func() (*Manager, error) {
+			return NewAt(&chat.Chat{ID: chatID}, filepath.Join(dir, chatID.String()))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manager
+	}
+
+	chatIDs := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	messageIDs := make([]uuid.UUID, len(chatIDs))
+	for i, chatID := range chatIDs {
+		manager := get(chatID)
+		if manager.Loaded() {
+			t.Fatalf("chat %d loaded before use", i)
+		}
+		msg := &message.Message{ID: uuid.New(), ChatID: chatID, Caption: "hello"}
+		if err := manager.CreateMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+		messageIDs[i] = msg.ID
+	}
+
+	if get(chatIDs[0]).Loaded() {
+		t.Fatal("least recently used chat was not unloaded")
+	}
+	if !get(chatIDs[1]).Loaded() || !get(chatIDs[2]).Loaded() {
+		t.Fatal("recently used chats were unloaded")
+	}
+	if used, loaded := cache.Used(); loaded != 2 || used != 2*chatSize {
+		t.Fatalf("cache holds %d chats of %d bytes, want 2 of %d", loaded, used, 2*chatSize)
+	}
+
+	// The evicted chat was flushed and loads again on use, which in turn
+	// evicts the next least recently used chat.
+	msg, err := get(chatIDs[0]).ReadMessage(messageIDs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Caption != "hello" {
+		t.Fatalf("caption = %q after reload, want %q", msg.Caption, "hello")
+	}
+	if get(chatIDs[1]).Loaded() {
+		t.Fatal("chat 1 was not unloaded after chat 0 was reloaded")
+	}
+
+	if err := cache.Remove(chatIDs[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, loaded := cache.Used(); loaded != 1 {
+		t.Fatalf("%d chats loaded after remove, want 1", loaded)
+	}
+}
+
+func TestCacheQuiesce(t *testing.T) {
+
+	cache := NewCache(1 << 20)
+	chatID := uuid.New()
+	manager, err := cache.Get(chatID, func() (*Manager, error) {
+		return NewAt(&chat.Chat{ID: chatID}, t.TempDir())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.CreateMessage(&message.Message{ChatID: chatID}); err != nil {
+		t.Fatal(err)
+	}
+
+	resume, err := cache.Quiesce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manager.Loaded() {
+		t.Fatal("chat still loaded while quiesced")
+	}
+
+	done := make(chan error)
+	go func() { done <- manager.CreateMessage(&message.Message{ChatID: chatID}) }()
+	select {
+	case err := <-done:
+		t.Fatalf("write went through while quiesced: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	resume()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	all, err := manager.ReadAllMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("%d messages after resume, want 2", len(all))
+	}
+	cache.Close()
+}
+
+func TestCachePause(t *testing.T) {
+
+	cache := NewCache(1 << 20)
+	chatID := uuid.New()
+	manager, err := cache.Get(chatID, func() (*Manager, error) {
+		return NewAt(&chat.Chat{ID: chatID}, t.TempDir())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.CreateMessage(&message.Message{ChatID: chatID}); err != nil {
+		t.Fatal(err)
+	}
+
+	resume, err := cache.Pause()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manager.Loaded() {
+		t.Fatal("chat was unloaded by pause")
+	}
+
+	done := make(chan error)
+	go func() { done <- manager.CreateMessage(&message.Message{ChatID: chatID}) }()
+	select {
+	case err := <-done:
+		t.Fatalf("write went through while paused: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	resume()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+}
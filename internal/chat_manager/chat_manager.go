@@ -1,55 +1,289 @@
 package chat_manager
 
 import (
+	"container/list"
+	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"slices"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/mahdi-cpp/messages-api/internal/collection_manager"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager_sqlite"
 	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
 	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/config"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+	"github.com/mahdi-cpp/messages-api/internal/store"
+	"github.com/mahdi-cpp/messages-api/internal/version"
 )
 
 const (
 	root        = "/app/iris/com.iris.messages/chats"
 	chatMessage = "/metadata/v1/messages"
+
+	// messagesCollection names the message collections in the change feed.
+	messagesCollection = "messages"
+
+	// messageSizeEstimate is the memory a loaded message is assumed to take,
+	// used to weigh chats against the cache budget.
+	messageSizeEstimate = 2 << 10 // 2 KB
+
+	// updateRetries is how many times an update without a version is tried
+	// when it loses a race with a concurrent update.
+	updateRetries = 3
 )
 
+// Manager holds the messages of one chat. The message collection is opened
+// on first use and can be unloaded again by a Cache, in which case the next
+// call opens it from disk.
 type Manager struct {
-	chat     *chat.Chat
-	Messages *collection_manager.Manager[*message.Message]
+	chat *chat.Chat
+	dir  string
+
+	mu       sync.RWMutex
+	messages store.Store[*message.Message] // nil while unloaded
+
+	// seqMu serializes the changes of the messages, so they are stored in
+	// the order of their sequence numbers. seq is the last one handed out and
+	// seqReserved the last one reserved on disk, see nextSeq.
+	seqMu       sync.Mutex
+	seq         int64
+	seqReserved int64
+	seqLoaded   bool
+
+	// countMu guards what UnreadCount keeps of the messages, see unread.go.
+	// counted is sorted by sequence number; countsOnDisk reports whether
+	// the counts file holds it.
+	countMu      sync.Mutex
+	counted      []counted
+	countsLoaded bool
+	countsOnDisk bool
+
+	// receiptsMu guards the members of the chat, the receipt cursors of
+	// the members, nil until loaded, and the number of lines of their log,
+	// see receipts.go. members follows the chat through SetMembers, unlike
+	// chat, which only names it.
+	receiptsMu   sync.Mutex
+	members      []chat.Member
+	receipts     map[uuid.UUID]chat.Cursors
+	receiptLines int
+
+	// cache, elem and size are guarded by cache.mu.
+	cache *Cache
+	elem  *list.Element
+	size  int64
 }
 
 func New(chat *chat.Chat) (*Manager, error) {
+	return NewAt(chat, filepath.Join(root, chat.ID.String(), chatMessage))
+}
 
-	manager := &Manager{
-		chat: chat,
+// NewAt returns the manager of a chat whose messages are stored in dir.
+// Nothing is read until the messages are first used.
+func NewAt(chat *chat.Chat, dir string) (*Manager, error) {
+	if chat == nil {
+		return nil, fmt.Errorf("error initializing chat message manager: chat is nil")
 	}
+	return &Manager{chat: chat, dir: dir, members: slices.Clone(chat.Members)}, nil
+}
+
+// load opens the message collection if it is not loaded.
+func (m *Manager) load() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	var err error
-	// In this layer, we still initialize the collection manager without a context.
-	// The timeout for initial loading can be handled internally by the New function itself.
-	var messagesDir = filepath.Join(root, chat.ID.String(), chatMessage)
-	manager.Messages, err = collection_manager.New[*message.Message](messagesDir)
+	if m.messages != nil {
+		return nil
+	}
+	opts := []collection_manager.Option{
+		collection_manager.WithLayout(collection_manager.Layout(config.ItemLayout("messages"))),
+		collection_manager.WithBackgroundReshard(),
+	}
+	if m.cache != nil {
+		if ring := m.cache.keyring(); ring != nil {
+			keys, err := encryption.OpenDataKeys(ring, m.dir)
+			if err != nil {
+				return fmt.Errorf("error opening data keys of chat %s: %w", m.chat.ID, err)
+			}
+			opts = append(opts, collection_manager.WithCipher(keys))
+		}
+	}
+	messages, err := store.Open[*message.Message](config.StoreEngine("messages"), m.dir, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("error initializing chat message manager: %w", err)
+		return fmt.Errorf("error initializing chat message manager: %w", err)
 	}
+	if m.cache != nil {
+		if publisher, ok := messages.(store.Publisher); ok {
+			if feed := m.cache.changeFeed(); feed != nil {
+				publisher.SetChangeFeed(feed, messagesCollection)
+			}
+		}
+	}
+	m.messages = messages
+	return nil
+}
+
+// unload flushes and closes the message collection and drops it, releasing
+// its in-memory maps, together with the counts and the receipt cursors.
+func (m *Manager) unload() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	return manager, nil
+	m.dropReceipts()
+	countsErr := m.saveCounts()
+	if m.messages == nil {
+		return countsErr
+	}
+	err := m.messages.Close()
+	m.messages = nil
+	if err != nil {
+		return fmt.Errorf("error closing messages of chat %s: %w", m.chat.ID, err)
+	}
+	return countsErr
 }
 
-// CreateMessage adds a new message to the chat. No context is passed here.
-func (m *Manager) CreateMessage(addMessage *message.Message) error {
-	_, err := m.Messages.Create(addMessage)
+// pause pauses the loaded message collection, see Cache.Pause. resume is
+// nil when nothing is loaded.
+func (m *Manager) pause() (resume func(), err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.messages == nil {
+		return nil, nil
+	}
+	pauser, ok := m.messages.(store.Pauser)
+	if !ok {
+		return nil, fmt.Errorf("messages of chat %s cannot be paused", m.chat.ID)
+	}
+	resume, err = pauser.Pause()
 	if err != nil {
+		return nil, fmt.Errorf("error pausing messages of chat %s: %w", m.chat.ID, err)
+	}
+	return resume, nil
+}
+
+// Loaded reports whether the message collection is in memory.
+func (m *Manager) Loaded() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.messages != nil
+}
+
+// Close flushes the messages to disk and releases them. The manager can
+// still be used afterwards, it loads the messages again.
+func (m *Manager) Close() error {
+	if m.cache != nil {
+		m.cache.forget(m)
+	}
+	return m.unload()
+}
+
+// memorySize estimates the memory held by the loaded messages, counts and
+// receipt cursors.
+func (m *Manager) memorySize() int64 {
+	m.countMu.Lock()
+	size := int64(len(m.counted)) * countedSizeEstimate
+	m.countMu.Unlock()
+
+	m.receiptsMu.Lock()
+	size += int64(len(m.receipts)) * receiptSizeEstimate
+	m.receiptsMu.Unlock()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.messages == nil {
+		return size
+	}
+	// Stores that keep only part of their items in memory know better.
+	if sizer, ok := m.messages.(interface{ MemorySize() int64 }); ok {
+		return size + sizer.MemorySize()
+	}
+	return size + int64(m.messages.Count())*messageSizeEstimate
+}
+
+// used accounts for the memory of the manager in the cache after a call
+// that loads counts or receipt cursors without the messages, so they are
+// unloaded like messages are. It must be called without holding the lock
+// of any manager or the cache gate.
+func (m *Manager) used() {
+	if m.cache == nil {
+		return
+	}
+	m.cache.gate.RLock()
+	defer m.cache.gate.RUnlock()
+	m.cache.touch(m, m.memorySize())
+}
+
+// WithMessages calls fn with the loaded message collection, loading it
+// first if needed. The collection is not unloaded until fn returns, so fn
+// must not keep it.
+func (m *Manager) WithMessages(fn func(messages store.Store[*message.Message]) error) error {
+	if m.cache != nil {
+		m.cache.gate.RLock()
+		defer m.cache.gate.RUnlock()
+	}
+
+	for {
+		if err := m.load(); err != nil {
+			return err
+		}
+		// The cache may unload other chats here, so no lock is held.
+		if m.cache != nil {
+			m.cache.touch(m, m.memorySize())
+		}
+
+		m.mu.RLock()
+		if m.messages == nil {
+			// Unloaded by a concurrent eviction in between, load it again.
+			m.mu.RUnlock()
+			continue
+		}
+		err := fn(m.messages)
+		m.mu.RUnlock()
+
+		// Account for the messages fn added or removed.
+		if m.cache != nil {
+			m.cache.touch(m, m.memorySize())
+		}
 		return err
 	}
-	return nil
+}
+
+// CreateMessage adds a new message to the chat and gives it the next
+// sequence number of the chat. No context is passed here.
+func (m *Manager) CreateMessage(addMessage *message.Message) error {
+	m.seqMu.Lock()
+	defer m.seqMu.Unlock()
+
+	return m.WithMessages(func(messages store.Store[*message.Message]) error {
+		seq, err := m.nextSeq()
+		if err != nil {
+			return err
+		}
+		if err := m.prepareCounts(messages); err != nil {
+			return err
+		}
+		addMessage.Seq, addMessage.ChangeSeq = seq, seq
+		if _, err := messages.Create(addMessage); err != nil {
+			return err
+		}
+		m.count(addMessage)
+		return nil
+	})
 }
 
 // ReadMessage retrieves a message by its ID.
 func (m *Manager) ReadMessage(messageId uuid.UUID) (*message.Message, error) {
-	selectMessage, err := m.Messages.Read(messageId)
+	var selectMessage *message.Message
+	err := m.WithMessages(func(messages store.Store[*message.Message]) error {
+		var err error
+		selectMessage, err = messages.Read(messageId)
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error reading message %s: %w", messageId, err)
 	}
@@ -58,32 +292,160 @@ func (m *Manager) ReadMessage(messageId uuid.UUID) (*message.Message, error) {
 
 // ReadAllMessages retrieves all messages in the chat.
 func (m *Manager) ReadAllMessages() ([]*message.Message, error) {
-	all, err := m.Messages.ReadAll()
+	var all []*message.Message
+	err := m.WithMessages(func(messages store.Store[*message.Message]) error {
+		var err error
+		all, err = messages.ReadAll()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return all, nil
 }
 
-// UpdateMessage updates a message.
-func (m *Manager) UpdateMessage(updateOptions message.UpdateOptions) (*message.Message, error) {
-	msg, err := m.Messages.Read(updateOptions.MessageID)
+// SearchMessages returns the messages matching the search options, using the
+// message indexes or SQL to avoid scanning the whole chat when the store
+// supports them.
+func (m *Manager) SearchMessages(with *message.SearchOptions) ([]*message.Message, error) {
+	var found []*message.Message
+	err := m.WithMessages(func(messages store.Store[*message.Message]) error {
+		var err error
+		if db, ok := messages.(*collection_manager_sqlite.Manager[*message.Message]); ok {
+			found, err = collection_manager_sqlite.SearchMessages(context.Background(), db, with)
+		} else if finder, ok := messages.(message.Finder); ok {
+			found, err = message.SearchIndexed(finder, with)
+		} else {
+			found, err = message.SearchIter(context.Background(), messages, with)
+		}
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	message.Update(msg, updateOptions)
-	msg, err = m.Messages.Update(msg)
+	return found, nil
+}
+
+// UpdateMessage updates a message and gives the edit the next sequence
+// number of the chat. With IfVersion set, it fails with a version conflict
+// if the message changed since that version; otherwise an update that
+// loses a race with another one is retried.
+func (m *Manager) UpdateMessage(updateOptions message.UpdateOptions) (*message.Message, error) {
+	for attempt := 1; ; attempt++ {
+		msg, err := m.updateMessage(updateOptions)
+		if errors.Is(err, version.ErrConflict) && updateOptions.IfVersion == "" && attempt < updateRetries {
+			continue
+		}
+		return msg, err
+	}
+}
+
+func (m *Manager) updateMessage(updateOptions message.UpdateOptions) (*message.Message, error) {
+	m.seqMu.Lock()
+	defer m.seqMu.Unlock()
+
+	var msg *message.Message
+	err := m.WithMessages(func(messages store.Store[*message.Message]) error {
+		current, err := messages.Read(updateOptions.MessageID)
+		if err != nil {
+			return err
+		}
+		// The stored message is shared with readers, so the update is made
+		// on a copy and only replaces it once written.
+		msg, err = collection_manager.Clone(current)
+		if err != nil {
+			return err
+		}
+		message.Update(msg, updateOptions)
+		if updateOptions.IfVersion != "" {
+			msg.Version = updateOptions.IfVersion
+		}
+		if err := m.prepareCounts(messages); err != nil {
+			return err
+		}
+		if msg.ChangeSeq, err = m.nextSeq(); err != nil {
+			return err
+		}
+		if msg, err = messages.Update(msg); err != nil {
+			return err
+		}
+		m.count(msg)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 	return msg, nil
 }
 
-// DeleteMessage deletes a message.
-func (m *Manager) DeleteMessage(messageID uuid.UUID) error {
-	err := m.Messages.Delete(messageID)
+// DeleteMessage deletes a message and records the deletion with the next
+// sequence number of the chat. It returns that number.
+func (m *Manager) DeleteMessage(messageID uuid.UUID) (int64, error) {
+	m.seqMu.Lock()
+	defer m.seqMu.Unlock()
+
+	var seq int64
+	err := m.WithMessages(func(messages store.Store[*message.Message]) error {
+		var err error
+		seq, err = m.deleteMessage(messages, messageID)
+		return err
+	})
+	return seq, err
+}
+
+// deleteMessage deletes a message from messages with a tombstone. It must
+// be called with m.seqMu held, from within WithMessages.
+func (m *Manager) deleteMessage(messages store.Store[*message.Message], messageID uuid.UUID) (int64, error) {
+	msg, err := messages.Read(messageID)
+	if err != nil {
+		return 0, fmt.Errorf("error reading message %s: %w", messageID, err)
+	}
+	if err := m.prepareCounts(messages); err != nil {
+		return 0, err
+	}
+	seq, err := m.nextSeq()
+	if err != nil {
+		return 0, err
+	}
+	if err := m.writeTombstone(seq, messageID); err != nil {
+		return 0, err
+	}
+	if err := messages.Delete(messageID); err != nil {
+		return 0, err
+	}
+	m.uncount(msg.Seq)
+	return seq, nil
+}
+
+// Purge calls fn with the messages of the chat like WithMessages, for
+// deleting messages in bulk. Messages fn deletes are recorded like those
+// of DeleteMessage, so clients catching up learn of them, and returned as
+// changes in the order they were deleted, also when fn fails. Messages
+// cannot be created or edited in the chat meanwhile.
+func (m *Manager) Purge(fn func(messages store.Store[*message.Message]) error) ([]Change, error) {
+	m.seqMu.Lock()
+	defer m.seqMu.Unlock()
+
+	purge := &purgeStore{manager: m}
+	err := m.WithMessages(func(messages store.Store[*message.Message]) error {
+		purge.Store = messages
+		return fn(purge)
+	})
+	return purge.deleted, err
+}
+
+// purgeStore records the deletions of a Purge.
+type purgeStore struct {
+	store.Store[*message.Message]
+	manager *Manager
+	deleted []Change
+}
+
+func (p *purgeStore) Delete(id uuid.UUID) error {
+	seq, err := p.manager.deleteMessage(p.Store, id)
 	if err != nil {
 		return err
 	}
+	p.deleted = append(p.deleted, Change{Seq: seq, Deleted: id})
 	return nil
 }
@@ -0,0 +1,196 @@
+package chat_manager
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+)
+
+const (
+	// receiptsFileName logs the receipt cursors of the members of a chat,
+	// a JSON line each time those of a member move, the last one winning.
+	// They are kept apart from the chat, so receipts do not change it.
+	receiptsFileName = "receipts.log"
+
+	// receiptsCompactFactor is how many lines per member the receipts log
+	// grows to before it is rewritten with one line per member.
+	receiptsCompactFactor = 16
+
+	// receiptSizeEstimate is the memory the loaded cursors of a member are
+	// assumed to take, see Manager.memorySize.
+	receiptSizeEstimate = 128
+)
+
+// receiptLine is a line of the receipts log.
+type receiptLine struct {
+	UserID uuid.UUID `json:"userId"`
+	chat.Cursors
+}
+
+// Acknowledge moves the receipt cursors of a member up to the message
+// messageID, numbered seq in the chat, see chat.Cursors.Acknowledge, and
+// reports whether one moved. The log is not synced for it: cursors only
+// move forward and clients acknowledge later messages again, so a crash of
+// the machine at worst moves them back a little. Like the calls on the
+// messages, it waits while the cache is paused, see Cache.Pause.
+func (m *Manager) Acknowledge(userID uuid.UUID, receipt chat.Receipt, messageID uuid.UUID, seq int64) (bool, error) {
+	if m.cache != nil {
+		m.cache.gate.RLock()
+		defer m.cache.gate.RUnlock()
+	}
+
+	advanced, err := m.acknowledge(userID, receipt, messageID, seq)
+	if m.cache != nil {
+		m.cache.touch(m, m.memorySize())
+	}
+	return advanced, err
+}
+
+func (m *Manager) acknowledge(userID uuid.UUID, receipt chat.Receipt, messageID uuid.UUID, seq int64) (bool, error) {
+	m.receiptsMu.Lock()
+	defer m.receiptsMu.Unlock()
+
+	if err := m.loadReceipts(); err != nil {
+		return false, err
+	}
+	cursors := m.receipts[userID]
+	advanced, err := cursors.Acknowledge(receipt, messageID, seq)
+	if err != nil || !advanced {
+		return false, err
+	}
+	if err := m.appendReceipt(receiptLine{UserID: userID, Cursors: cursors}); err != nil {
+		return false, err
+	}
+	m.receipts[userID] = cursors
+
+	if m.receiptLines > receiptsCompactFactor*len(m.receipts) {
+		// The receipt is logged already, so this is only reported.
+		if err := m.compactReceipts(); err != nil {
+			log.Printf("chat %s: %v", m.chat.ID, err)
+		}
+	}
+	return true, nil
+}
+
+// Cursors returns the receipt cursors of a member.
+func (m *Manager) Cursors(userID uuid.UUID) (chat.Cursors, error) {
+	m.receiptsMu.Lock()
+	err := m.loadReceipts()
+	cursors := m.receipts[userID]
+	m.receiptsMu.Unlock()
+
+	m.used()
+	if err != nil {
+		return chat.Cursors{}, err
+	}
+	return cursors, nil
+}
+
+// SetMembers replaces the members of the chat the manager was created
+// with, after they changed. The cursors of former members are dropped.
+func (m *Manager) SetMembers(members []chat.Member) {
+	m.receiptsMu.Lock()
+	defer m.receiptsMu.Unlock()
+
+	m.members = slices.Clone(members)
+	for userID := range m.receipts {
+		if !m.isMember(userID) {
+			delete(m.receipts, userID)
+		}
+	}
+}
+
+// isMember reports whether userID is a member of the chat. m.receiptsMu
+// must be held.
+func (m *Manager) isMember(userID uuid.UUID) bool {
+	return slices.ContainsFunc(m.members, func(member chat.Member) bool { return member.UserID == userID })
+}
+
+// loadReceipts reads the receipts log, if it is not loaded, keeping the
+// cursors of the members. Cursors stored in the chat before receipts were
+// logged are taken as a start. Lines torn by a crash are skipped.
+// m.receiptsMu must be held.
+func (m *Manager) loadReceipts() error {
+	if m.receipts != nil {
+		return nil
+	}
+	receipts := make(map[uuid.UUID]chat.Cursors)
+	for _, member := range m.members {
+		if member.Cursors != nil {
+			receipts[member.UserID] = *member.Cursors
+		}
+	}
+
+	lines := 0
+	f, err := os.Open(filepath.Join(m.dir, receiptsFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error reading receipts of chat %s: %w", m.chat.ID, err)
+	}
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var line receiptLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				continue
+			}
+			lines++
+			if m.isMember(line.UserID) {
+				receipts[line.UserID] = line.Cursors
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("error reading receipts of chat %s: %w", m.chat.ID, err)
+		}
+	}
+	m.receipts, m.receiptLines = receipts, lines
+	return nil
+}
+
+// appendReceipt appends line to the receipts log. m.receiptsMu must be
+// held.
+func (m *Manager) appendReceipt(line receiptLine) error {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return fmt.Errorf("error encoding receipt of chat %s: %w", m.chat.ID, err)
+	}
+	if err := appendLine(filepath.Join(m.dir, receiptsFileName), data, false); err != nil {
+		return fmt.Errorf("error writing receipt of chat %s: %w", m.chat.ID, err)
+	}
+	m.receiptLines++
+	return nil
+}
+
+// compactReceipts rewrites the receipts log with one line per member.
+// m.receiptsMu must be held.
+func (m *Manager) compactReceipts() error {
+	var lines bytes.Buffer
+	for userID, cursors := range m.receipts {
+		data, err := json.Marshal(receiptLine{UserID: userID, Cursors: cursors})
+		if err != nil {
+			return fmt.Errorf("error encoding receipts of chat %s: %w", m.chat.ID, err)
+		}
+		lines.Write(append(data, '\n'))
+	}
+	if err := writeFile(filepath.Join(m.dir, receiptsFileName), lines.Bytes()); err != nil {
+		return fmt.Errorf("error compacting receipts of chat %s: %w", m.chat.ID, err)
+	}
+	m.receiptLines = len(m.receipts)
+	return nil
+}
+
+// dropReceipts releases the loaded cursors, when the chat is unloaded.
+func (m *Manager) dropReceipts() {
+	m.receiptsMu.Lock()
+	defer m.receiptsMu.Unlock()
+	m.receipts, m.receiptLines = nil, 0
+}
@@ -0,0 +1,114 @@
+package chat_manager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func TestAcknowledge(t *testing.T) {
+
+	dir := t.TempDir()
+	chatID, userID := uuid.New(), uuid.New()
+	legacy := chat.Cursors{DeliveredSeq: 1, ReadSeq: 1}
+	c := &chat.Chat{ID: chatID, Members: []chat.Member{{UserID: userID, Cursors: &legacy}}}
+	manager, err := NewAt(c, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	var msg *message.Message
+	for i := 0; i < 2; i++ {
+		msg = &message.Message{ID: uuid.New(), ChatID: chatID}
+		if err := manager.CreateMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Cursors stored in the chat are the start, and only move forward.
+	if advanced, err := manager.Acknowledge(userID, chat.ReceiptDelivered, msg.ID, 1); err != nil || advanced {
+		t.Fatalf("receipt behind the stored cursors advanced %v, err %v", advanced, err)
+	}
+	for i := 0; i < receiptsCompactFactor*2; i++ {
+		if advanced, err := manager.Acknowledge(userID, chat.ReceiptRead, msg.ID, int64(i+2)); err != nil || !advanced {
+			t.Fatalf("read receipt advanced %v, err %v", advanced, err)
+		}
+	}
+	if manager.receiptLines > receiptsCompactFactor {
+		t.Fatalf("receipts log has %d lines, want it compacted", manager.receiptLines)
+	}
+
+	// The cursors are read back from the log, the stored chat unchanged.
+	reopened, err := NewAt(c, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursors, err := reopened.Cursors(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := int64(receiptsCompactFactor*2 + 1)
+	if cursors.ReadSeq != want || cursors.DeliveredSeq != want || cursors.ReadUpTo != msg.ID {
+		t.Fatalf("cursors after reopening = %+v, want read and delivered up to seq %d", cursors, want)
+	}
+	if *c.Members[0].Cursors != legacy {
+		t.Fatal("receipts changed the chat")
+	}
+}
+
+func TestReceiptsUnloadAndMembers(t *testing.T) {
+
+	dir := t.TempDir()
+	// Room for one chat only, so using one unloads the other.
+	cache := NewCache(1)
+	defer cache.Close()
+
+	userID, other := uuid.New(), uuid.New()
+	get := func(chatID uuid.UUID) *Manager {
+		manager, err := cache.Get(chatID, func() (*Manager, error) {
+			c := &chat.Chat{ID: chatID, Members: []chat.Member{{UserID: userID}, {UserID: other}}}
+			chatDir := filepath.Join(dir, chatID.String())
+			if err := os.MkdirAll(chatDir, 0755); err != nil {
+				return nil, err
+			}
+			return NewAt(c, chatDir)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manager
+	}
+
+	first, second := get(uuid.New()), get(uuid.New())
+	if _, err := first.Acknowledge(userID, chat.ReceiptRead, uuid.New(), 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.Cursors(userID); err != nil {
+		t.Fatal(err)
+	}
+	first.receiptsMu.Lock()
+	unloaded := first.receipts == nil
+	first.receiptsMu.Unlock()
+	if !unloaded {
+		t.Fatal("receipts of the least recently used chat were not unloaded")
+	}
+	if cursors, err := first.Cursors(userID); err != nil || cursors.ReadSeq != 3 {
+		t.Fatalf("cursors after reload = %+v, %v, want read seq 3", cursors, err)
+	}
+
+	// A former member has no cursors, also after the receipts are reloaded.
+	if _, err := second.Acknowledge(other, chat.ReceiptRead, uuid.New(), 1); err != nil {
+		t.Fatal(err)
+	}
+	second.SetMembers([]chat.Member{{UserID: userID}})
+	for i := 0; i < 2; i++ {
+		if cursors, err := second.Cursors(other); err != nil || cursors.ReadSeq != 0 {
+			t.Fatalf("cursors of a former member = %+v, %v, want none", cursors, err)
+		}
+		second.dropReceipts()
+	}
+}
@@ -0,0 +1,271 @@
+package chat_manager
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/store"
+)
+
+const (
+	// seqFileName holds the sequence numbers reserved for the messages of
+	// a chat. It is not a .json file, so stores do not take it for an item.
+	seqFileName = "chat.seq"
+
+	// tombstonesFileName logs the deleted messages of a chat, one line of
+	// sequence number and message ID each, so that clients catching up
+	// learn of deletions too.
+	tombstonesFileName = "tombstones.log"
+
+	// seqBlock is how many sequence numbers are reserved at once. A restart
+	// skips the unused rest of a block, so sequence numbers have gaps but
+	// never repeat.
+	seqBlock = 64
+)
+
+// nextSeq returns the sequence number of the next message of the chat. It
+// must be called with m.seqMu held, and with the messages loaded, which
+// creates the directory of the chat.
+func (m *Manager) nextSeq() (int64, error) {
+	if !m.seqLoaded {
+		reserved, err := m.readSeq()
+		if err != nil {
+			return 0, err
+		}
+		m.seq, m.seqReserved, m.seqLoaded = reserved, reserved, true
+	}
+
+	if m.seq == m.seqReserved {
+		if err := m.writeSeq(m.seqReserved + seqBlock); err != nil {
+			return 0, fmt.Errorf("error reserving sequence numbers of chat %s: %w", m.chat.ID, err)
+		}
+		m.seqReserved += seqBlock
+	}
+	m.seq++
+	return m.seq, nil
+}
+
+// readSeq returns the last sequence number reserved in the chat, zero for
+// a chat without one.
+func (m *Manager) readSeq() (int64, error) {
+	data, err := os.ReadFile(filepath.Join(m.dir, seqFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading sequence of chat %s: %w", m.chat.ID, err)
+	}
+	seq, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing sequence of chat %s: %w", m.chat.ID, err)
+	}
+	return seq, nil
+}
+
+// writeSeq durably records seq as the last reserved sequence number.
+func (m *Manager) writeSeq(seq int64) error {
+	return writeFile(filepath.Join(m.dir, seqFileName), []byte(strconv.FormatInt(seq, 10)+"\n"))
+}
+
+// writeFile durably replaces the file at path with data.
+func writeFile(path string, data []byte) error {
+	tempFile := path + ".tmp"
+	f, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// appendLine appends line and a newline to the file at path, creating it,
+// and syncs it if durable. A last line torn by a crash is ended first, so
+// that line is not joined to it.
+func appendLine(path string, line []byte, durable bool) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	data := make([]byte, 0, len(line)+2)
+	if info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+			f.Close()
+			return err
+		}
+		if last[0] != '\n' {
+			data = append(data, '\n')
+		}
+	}
+	data = append(append(data, line...), '\n')
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if durable {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// syncDir makes the entries of dir durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Change is a change of a message of a chat, numbered Seq in the chat.
+// Message is the message as created or edited, nil when it was deleted,
+// in which case Deleted is its ID.
+type Change struct {
+	Seq     int64
+	Message *message.Message
+	Deleted uuid.UUID
+}
+
+// ChangesAfter returns the changes of the chat with a sequence number after
+// seq, in sequence order, for a client to catch up from the last change it
+// received. A message created and then edited after seq is returned once,
+// with the sequence number of the edit.
+func (m *Manager) ChangesAfter(seq int64) ([]Change, error) {
+	tombstones, err := m.readTombstones()
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	err = m.WithMessages(func(messages store.Store[*message.Message]) error {
+		changed := make(map[uuid.UUID]*message.Message)
+		if finder, ok := messages.(message.Finder); ok {
+			// Messages created before edits were numbered have no
+			// ChangeSeq, so the new ones are looked up by Seq as well.
+			for _, field := range []string{"Seq", "ChangeSeq"} {
+				found, err := finder.FindRange(field, seq+1, nil)
+				if err != nil {
+					return err
+				}
+				for _, msg := range found {
+					changed[msg.ID] = msg
+				}
+			}
+		} else {
+			err := messages.Iterate(context.Background(), func(msg *message.Message) bool {
+				if changeSeq(msg) > seq {
+					changed[msg.ID] = msg
+				}
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, msg := range changed {
+			changes = append(changes, Change{Seq: changeSeq(msg), Message: msg})
+		}
+
+		for _, tombstone := range tombstones {
+			if tombstone.Seq <= seq {
+				continue
+			}
+			// The message is still there if its deletion failed after the
+			// tombstone was written.
+			if _, err := messages.Read(tombstone.Deleted); err == nil {
+				continue
+			}
+			changes = append(changes, tombstone)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading changes of chat %s after %d: %w", m.chat.ID, seq, err)
+	}
+
+	slices.SortFunc(changes, func(a, b Change) int { return cmp.Compare(a.Seq, b.Seq) })
+	return changes, nil
+}
+
+// changeSeq returns the sequence number of the last change of msg.
+func changeSeq(msg *message.Message) int64 {
+	return max(msg.Seq, msg.ChangeSeq)
+}
+
+// writeTombstone durably records the deletion of a message, numbered seq.
+// It is written before the message is deleted, so a deletion is never
+// missed by ChangesAfter.
+func (m *Manager) writeTombstone(seq int64, messageID uuid.UUID) error {
+	line := []byte(strconv.FormatInt(seq, 10) + " " + messageID.String())
+	if err := appendLine(filepath.Join(m.dir, tombstonesFileName), line, true); err != nil {
+		return fmt.Errorf("error writing tombstone of message %s: %w", messageID, err)
+	}
+	return nil
+}
+
+// readTombstones returns the deletions recorded in the chat. A last line
+// torn by a crash is skipped; its message was not deleted.
+func (m *Manager) readTombstones() ([]Change, error) {
+	f, err := os.Open(filepath.Join(m.dir, tombstonesFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading tombstones of chat %s: %w", m.chat.ID, err)
+	}
+	defer f.Close()
+
+	var tombstones []Change
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		seqField, idField, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		seq, err := strconv.ParseInt(seqField, 10, 64)
+		if err != nil {
+			continue
+		}
+		id, err := uuid.Parse(idField)
+		if err != nil {
+			continue
+		}
+		tombstones = append(tombstones, Change{Seq: seq, Deleted: id})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading tombstones of chat %s: %w", m.chat.ID, err)
+	}
+	return tombstones, nil
+}
@@ -0,0 +1,175 @@
+package chat_manager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/store"
+)
+
+func TestMessageSeq(t *testing.T) {
+
+	dir := t.TempDir()
+	chatID := uuid.New()
+	manager, err := NewAt(&chat.Chat{ID: chatID}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		msg := &message.Message{ChatID: chatID}
+		if err := manager.CreateMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Seq != int64(i+1) {
+			t.Fatalf("message %d got seq %d, want %d", i, msg.Seq, i+1)
+		}
+	}
+
+	after, err := manager.ChangesAfter(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 2 || after[0].Seq != 4 || after[1].Seq != 5 {
+		t.Fatalf("got %d changes after seq 3, want seqs 4 and 5", len(after))
+	}
+	if err := manager.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new manager of the chat continues after the reserved block, never
+	// handing out a number again.
+	manager, err = NewAt(&chat.Chat{ID: chatID}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	msg := &message.Message{ChatID: chatID}
+	if err := manager.CreateMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Seq != seqBlock+1 {
+		t.Fatalf("seq after reopen = %d, want %d", msg.Seq, seqBlock+1)
+	}
+}
+
+func TestUnreadCount(t *testing.T) {
+
+	chatID, userID := uuid.New(), uuid.New()
+	manager, err := NewAt(&chat.Chat{ID: chatID}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	first := &message.Message{ID: uuid.New(), ChatID: chatID, UserID: uuid.New()}
+	for _, msg := range []*message.Message{
+		first,
+		{ChatID: chatID, UserID: userID},
+		{ChatID: chatID, UserID: uuid.New()},
+		{ChatID: chatID, UserID: uuid.New(), IsDeleted: true},
+	} {
+		if err := manager.CreateMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Own and deleted messages are not unread.
+	checkUnread := func(counts map[int64]int) {
+		t.Helper()
+		for readSeq, want := range counts {
+			unread, err := manager.UnreadCount(userID, readSeq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unread != want {
+				t.Fatalf("unread after seq %d = %d, want %d", readSeq, unread, want)
+			}
+		}
+	}
+	checkUnread(map[int64]int{0: 2, 1: 1, 3: 0})
+	if seq, id, err := manager.LastMessage(); err != nil || seq != 4 || id == uuid.Nil {
+		t.Fatalf("LastMessage = %d, %s, %v, want seq 4", seq, id, err)
+	}
+
+	// Unloaded, the chat is counted from the counts file without loading
+	// the messages, until they change again.
+	if err := manager.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkUnread(map[int64]int{0: 2, 1: 1, 3: 0})
+	if manager.Loaded() {
+		t.Fatal("counting loaded the messages")
+	}
+	if _, err := manager.DeleteMessage(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(manager.dir, countsFileName)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("counts file left after a change: %v", err)
+	}
+	checkUnread(map[int64]int{0: 1, 1: 1, 3: 0})
+}
+
+func TestChangesAfter(t *testing.T) {
+
+	chatID := uuid.New()
+	manager, err := NewAt(&chat.Chat{ID: chatID}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	var ids []uuid.UUID
+	for i := 0; i < 3; i++ {
+		msg := &message.Message{ID: uuid.New(), ChatID: chatID}
+		if err := manager.CreateMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+
+	// An edit, a deletion and a purge each take the next number.
+	edited, err := manager.UpdateMessage(message.UpdateOptions{ChatID: chatID, MessageID: ids[0], Content: "edited"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.Seq != 1 || edited.ChangeSeq != 4 {
+		t.Fatalf("edited message has seq %d and change seq %d, want 1 and 4", edited.Seq, edited.ChangeSeq)
+	}
+	if seq, err := manager.DeleteMessage(ids[1]); err != nil || seq != 5 {
+		t.Fatalf("DeleteMessage = %d, %v, want 5", seq, err)
+	}
+	purged, err := manager.Purge(func(messages store.Store[*message.Message]) error {
+		return messages.Delete(ids[2])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged[0].Seq != 6 || purged[0].Deleted != ids[2] {
+		t.Fatalf("Purge = %+v, want the deletion of %s numbered 6", purged, ids[2])
+	}
+
+	changes, err := manager.ChangesAfter(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{{Seq: 4}, {Seq: 5, Deleted: ids[1]}, {Seq: 6, Deleted: ids[2]}}
+	if len(changes) != len(want) {
+		t.Fatalf("got %d changes after seq 2, want %d", len(changes), len(want))
+	}
+	for i, change := range changes {
+		if change.Seq != want[i].Seq || change.Deleted != want[i].Deleted {
+			t.Fatalf("change %d = seq %d deleted %s, want seq %d deleted %s", i, change.Seq, change.Deleted, want[i].Seq, want[i].Deleted)
+		}
+	}
+	if changes[0].Message == nil || changes[0].Message.ID != ids[0] {
+		t.Fatal("first change is not the edited message")
+	}
+
+	// Nothing is reported after the last change.
+	if changes, err := manager.ChangesAfter(6); err != nil || len(changes) != 0 {
+		t.Fatalf("ChangesAfter(6) = %d changes, %v, want none", len(changes), err)
+	}
+}
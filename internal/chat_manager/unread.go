@@ -0,0 +1,212 @@
+package chat_manager
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/store"
+)
+
+// countedSizeEstimate is the memory a counted message is assumed to take,
+// see Manager.memorySize.
+const countedSizeEstimate = 64
+
+// countsFileName holds what UnreadCount keeps of the messages of a chat.
+// It is written when the messages are unloaded and removed before they
+// next change, so it is never stale; without it the messages are scanned.
+// Like seqFileName, it is not a .json file.
+const countsFileName = "chat.counts"
+
+// counted is what UnreadCount and LastMessage keep of a numbered message.
+type counted struct {
+	Seq     int64     `json:"seq"`
+	ID      uuid.UUID `json:"id"`
+	UserID  uuid.UUID `json:"userId"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+// UnreadCount returns how many messages of the chat after the read cursor
+// readSeq of a user were sent by others and are not deleted. The messages
+// are not loaded for it, unless the chat has never been counted.
+func (m *Manager) UnreadCount(userID uuid.UUID, readSeq int64) (int, error) {
+	unread := 0
+	err := m.withCounts(func(counts []counted) {
+		i, _ := slices.BinarySearchFunc(counts, readSeq+1, func(c counted, seq int64) int { return cmp.Compare(c.Seq, seq) })
+		for _, c := range counts[i:] {
+			if c.UserID != userID && !c.Deleted {
+				unread++
+			}
+		}
+	})
+	return unread, err
+}
+
+// LastMessage returns the sequence number and the ID of the last message
+// of the chat, zero and uuid.Nil when it has none. Like UnreadCount, it
+// does not load the messages.
+func (m *Manager) LastMessage() (int64, uuid.UUID, error) {
+	var seq int64
+	var id uuid.UUID
+	err := m.withCounts(func(counts []counted) {
+		if len(counts) > 0 {
+			seq, id = counts[len(counts)-1].Seq, counts[len(counts)-1].ID
+		}
+	})
+	return seq, id, err
+}
+
+// withCounts calls fn with the counts, loading them first, from the counts
+// file or else by scanning the messages.
+func (m *Manager) withCounts(fn func(counts []counted)) error {
+	defer m.used()
+	for {
+		m.countMu.Lock()
+		if err := m.readCounts(); err != nil {
+			m.countMu.Unlock()
+			return err
+		}
+		if m.countsLoaded {
+			fn(m.counted)
+			m.countMu.Unlock()
+			return nil
+		}
+		m.countMu.Unlock()
+
+		// Scanned with creation held back, so that no message is missed.
+		m.seqMu.Lock()
+		err := m.WithMessages(func(messages store.Store[*message.Message]) error {
+			m.countMu.Lock()
+			defer m.countMu.Unlock()
+			return m.scanCounts(messages)
+		})
+		m.seqMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// prepareCounts loads the counts before the messages change, and removes
+// the counts file, which would no longer match. It must be called with
+// m.seqMu held, from within WithMessages.
+func (m *Manager) prepareCounts(messages store.Store[*message.Message]) error {
+	m.countMu.Lock()
+	defer m.countMu.Unlock()
+
+	if err := m.readCounts(); err != nil {
+		return err
+	}
+	if err := m.scanCounts(messages); err != nil {
+		return err
+	}
+	if !m.countsOnDisk {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(m.dir, countsFileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing counts of chat %s: %w", m.chat.ID, err)
+	}
+	if err := syncDir(m.dir); err != nil {
+		return fmt.Errorf("error removing counts of chat %s: %w", m.chat.ID, err)
+	}
+	m.countsOnDisk = false
+	return nil
+}
+
+// count records a created or updated message after prepareCounts.
+func (m *Manager) count(msg *message.Message) {
+	if msg.Seq == 0 {
+		return
+	}
+	m.countMu.Lock()
+	defer m.countMu.Unlock()
+
+	c := counted{Seq: msg.Seq, ID: msg.ID, UserID: msg.UserID, Deleted: msg.IsDeleted}
+	i, found := slices.BinarySearchFunc(m.counted, msg.Seq, func(c counted, seq int64) int { return cmp.Compare(c.Seq, seq) })
+	if found {
+		m.counted[i] = c
+	} else {
+		m.counted = slices.Insert(m.counted, i, c)
+	}
+}
+
+// uncount forgets a deleted message numbered seq after prepareCounts.
+func (m *Manager) uncount(seq int64) {
+	m.countMu.Lock()
+	defer m.countMu.Unlock()
+
+	if i, found := slices.BinarySearchFunc(m.counted, seq, func(c counted, seq int64) int { return cmp.Compare(c.Seq, seq) }); found {
+		m.counted = slices.Delete(m.counted, i, i+1)
+	}
+}
+
+// readCounts loads the counts from the counts file, if they are not
+// loaded and the file exists. m.countMu must be held.
+func (m *Manager) readCounts() error {
+	if m.countsLoaded {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(m.dir, countsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading counts of chat %s: %w", m.chat.ID, err)
+	}
+	var counts []counted
+	if err := json.Unmarshal(data, &counts); err != nil {
+		return fmt.Errorf("error decoding counts of chat %s: %w", m.chat.ID, err)
+	}
+	m.counted, m.countsLoaded, m.countsOnDisk = counts, true, true
+	return nil
+}
+
+// scanCounts loads the counts from messages, if they are not loaded.
+// m.countMu must be held.
+func (m *Manager) scanCounts(messages store.Store[*message.Message]) error {
+	if m.countsLoaded {
+		return nil
+	}
+	var counts []counted
+	err := messages.Iterate(context.Background(), func(msg *message.Message) bool {
+		if msg.Seq != 0 {
+			counts = append(counts, counted{Seq: msg.Seq, ID: msg.ID, UserID: msg.UserID, Deleted: msg.IsDeleted})
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("error counting messages of chat %s: %w", m.chat.ID, err)
+	}
+	slices.SortFunc(counts, func(a, b counted) int { return cmp.Compare(a.Seq, b.Seq) })
+	m.counted, m.countsLoaded, m.countsOnDisk = counts, true, false
+	return nil
+}
+
+// saveCounts writes the counts to the counts file, unless it is there
+// already, and drops them from memory, when the messages are unloaded.
+func (m *Manager) saveCounts() error {
+	m.countMu.Lock()
+	defer m.countMu.Unlock()
+
+	if !m.countsLoaded {
+		return nil
+	}
+	if !m.countsOnDisk {
+		data, err := json.Marshal(m.counted)
+		if err != nil {
+			return fmt.Errorf("error encoding counts of chat %s: %w", m.chat.ID, err)
+		}
+		if err := writeFile(filepath.Join(m.dir, countsFileName), data); err != nil {
+			return fmt.Errorf("error writing counts of chat %s: %w", m.chat.ID, err)
+		}
+	}
+	m.counted, m.countsLoaded, m.countsOnDisk = nil, false, false
+	return nil
+}
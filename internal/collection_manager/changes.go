@@ -0,0 +1,51 @@
+package collection_manager
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/changefeed"
+)
+
+// SetChangeFeed makes every Create, Update and Delete, direct or through a
+// transaction, append an event for collection to feed once it is applied.
+// Events of the same item are appended in the order of its changes.
+func (m *Manager[T]) SetChangeFeed(feed *changefeed.Feed, collection string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.feed = feed
+	m.collection = collection
+}
+
+func (m *Manager[T]) changeFeed() (*changefeed.Feed, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.feed, m.collection
+}
+
+// stored returns the version of an item on disk, which is the one before a
+// change while it is applied. The in-memory item cannot be used, since
+// callers may have modified it in place before updating it. It returns nil
+// without a change feed, or when the item cannot be read.
+func (m *Manager[T]) stored(id uuid.UUID) any {
+	if feed, _ := m.changeFeed(); feed == nil {
+		return nil
+	}
+	item, err := m.readItemFromDisk(id)
+	if err != nil {
+		return nil
+	}
+	return item
+}
+
+// publish appends a change to the change feed, if there is one. The change
+// is already applied, so a failure is reported but not returned.
+func (m *Manager[T]) publish(op walOp, id uuid.UUID, before, after any) {
+	feed, collection := m.changeFeed()
+	if feed == nil {
+		return
+	}
+	if _, err := feed.Append(collection, id, changefeed.Op(op), before, after); err != nil {
+		fmt.Printf("collection_manager: failed to publish %s of %s in %s: %v\n", op, id, m.baseDir, err)
+	}
+}
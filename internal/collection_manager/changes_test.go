@@ -0,0 +1,81 @@
+package collection_manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mahdi-cpp/messages-api/internal/changefeed"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func TestChangeFeed(t *testing.T) {
+
+	feed, err := changefeed.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+
+	manager, err := New[*message.Message](t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	manager.SetChangeFeed(feed, "messages")
+
+	msg, err := manager.Create(&message.Message{Caption: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Modified in place, as callers do after a Read.
+	msg.Caption = "second"
+	if _, err := manager.Update(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := manager.Begin()
+	if err := tx.Delete(msg.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		op            changefeed.Op
+		before, after string
+	}{
+		{changefeed.OpCreate, "", "first"},
+		{changefeed.OpUpdate, "first", "second"},
+		{changefeed.OpDelete, "second", ""},
+	}
+
+	sub := feed.Subscribe(0)
+	defer sub.Close()
+	for i, w := range want {
+		var e changefeed.Event
+		select {
+		case e = <-sub.Events():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d not delivered", i+1)
+		}
+		change, err := changefeed.Decode[*message.Message](e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change.Seq != uint64(i+1) || change.Op != w.op || change.Collection != "messages" || change.ID != msg.ID {
+			t.Fatalf("event %d = %+v, want %s of %s", i+1, e, w.op, msg.ID)
+		}
+		if caption(change.Before) != w.before || caption(change.After) != w.after {
+			t.Fatalf("event %d goes from %q to %q, want %q to %q",
+				i+1, caption(change.Before), caption(change.After), w.before, w.after)
+		}
+	}
+}
+
+func caption(msg *message.Message) string {
+	if msg == nil {
+		return ""
+	}
+	return msg.Caption
+}
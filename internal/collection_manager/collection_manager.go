@@ -1,16 +1,22 @@
 package collection_manager
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
 	"sync"
 
 	"github.com/goccy/go-json"
 	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/changefeed"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+	"github.com/mahdi-cpp/messages-api/internal/migration"
+	"github.com/mahdi-cpp/messages-api/internal/version"
 )
 
 // collectionItem is the interface that every item in the collection must implement.
@@ -20,13 +26,29 @@ type collectionItem interface {
 	GetID() uuid.UUID
 }
 
+// assignID gives an item created without an ID a UUID v7.
+func assignID(item collectionItem) error {
+	if item.GetID() != uuid.Nil {
+		return nil
+	}
+	id, err := uuid.NewV7()
+	if err != nil {
+		return fmt.Errorf("failed to generate ID: %w", err)
+	}
+	item.SetID(id)
+	return nil
+}
+
 // ---
 // registry section: in-memory data store.
 // This registry uses string keys, which is fine as uuid.UUID is always converted to string for storage.
 
 type registry[T any] struct {
 	items map[uuid.UUID]T
-	mu    sync.RWMutex
+	// keys holds the IDs of items in ascending order, so the items can be
+	// visited in key order, which is creation order for UUID v7 IDs.
+	keys []uuid.UUID
+	mu   sync.RWMutex
 }
 
 func newRegistry[T any]() *registry[T] {
@@ -36,6 +58,17 @@ func newRegistry[T any]() *registry[T] {
 func (r *registry[T]) create(key uuid.UUID, value T) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.put(key, value)
+}
+
+// put stores value and adds key to the ordered keys if it is new. Callers
+// hold r.mu.
+func (r *registry[T]) put(key uuid.UUID, value T) {
+	if _, exists := r.items[key]; !exists {
+		// UUID v7 keys are increasing, so this is nearly always an append.
+		i, _ := slices.BinarySearchFunc(r.keys, key, compareIDs)
+		r.keys = slices.Insert(r.keys, i, key)
+	}
 	r.items[key] = value
 }
 
@@ -51,27 +84,54 @@ func (r *registry[T]) read(key uuid.UUID) (T, error) {
 	return val, nil
 }
 
+// readAll returns every item in key order.
 func (r *registry[T]) readAll() []T {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	result := make([]T, 0, len(r.items))
-	for _, v := range r.items {
-		result = append(result, v)
+	result := make([]T, 0, len(r.keys))
+	for _, key := range r.keys {
+		result = append(result, r.items[key])
 	}
 	return result
 }
 
+// scan returns up to limit items with keys from from onwards, in key order,
+// and the key to continue from. The returned key is uuid.Nil when there are
+// no more items.
+func (r *registry[T]) scan(from uuid.UUID, limit int) ([]T, uuid.UUID) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i, _ := slices.BinarySearchFunc(r.keys, from, compareIDs)
+	end := min(i+limit, len(r.keys))
+
+	result := make([]T, 0, end-i)
+	for _, key := range r.keys[i:end] {
+		result = append(result, r.items[key])
+	}
+	if end == len(r.keys) {
+		return result, uuid.Nil
+	}
+	return result, r.keys[end]
+}
+
 func (r *registry[T]) update(key uuid.UUID, newValue T) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.items[key] = newValue
+	r.put(key, newValue)
 }
 
 func (r *registry[T]) delete(key uuid.UUID) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if _, exists := r.items[key]; !exists {
+		return
+	}
 	delete(r.items, key)
+	if i, found := slices.BinarySearchFunc(r.keys, key, compareIDs); found {
+		r.keys = slices.Delete(r.keys, i, i+1)
+	}
 }
 
 // Count returns the number of items in the registry.
@@ -87,6 +147,7 @@ func (r *registry[T]) clear() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.items = make(map[uuid.UUID]T)
+	r.keys = nil
 }
 
 func (r *registry[T]) isEmpty() bool {
@@ -101,19 +162,53 @@ func (r *registry[T]) isEmpty() bool {
 type Manager[T collectionItem] struct {
 	baseDir string
 	items   *registry[T]
+	// indexes are the secondary indexes kept in step with items.
+	indexes *indexSet[T]
 	mu      sync.RWMutex
 	// fileMutexes is a map of mutexes, one for each file.
 	// The key is the item's UUID.
 	fileMutexes map[uuid.UUID]*sync.Mutex
+	// wal records every change before it touches the item files.
+	wal *wal
+	// walGate is held shared by writers and exclusively by Checkpoint,
+	// so the log is never emptied while a change is half applied.
+	walGate sync.RWMutex
+	// feed receives an event for every applied change, see SetChangeFeed.
+	feed       *changefeed.Feed
+	collection string
+	// layout places the item files, and misplaced holds the paths of the
+	// items stored elsewhere, see Reshard. misplaced is guarded by mu.
+	layout    Layout
+	misplaced map[uuid.UUID]string
+	// dirtyDirs are the directories changed since the last checkpoint.
+	dirtyMu   sync.Mutex
+	dirtyDirs map[string]struct{}
+	// stopReshard stops a background reshard, see WithBackgroundReshard.
+	stopReshard func()
+	// cipher seals the stored items, see WithCipher. stale holds the items
+	// not sealed with its active data key, and is guarded by mu.
+	cipher        encryption.Cipher
+	stale         map[uuid.UUID]struct{}
+	stopReencrypt func()
 }
 
-// New creates a new instance of Manager.
-func New[T collectionItem](path string) (*Manager[T], error) {
+// New creates a new instance of Manager. Items are stored with LayoutFlat
+// unless another layout is given with WithLayout.
+func New[T collectionItem](path string, opts ...Option) (*Manager[T], error) {
 
 	if strings.HasSuffix(path, ".json") {
 		return nil, errors.New("path must be a directory, not a file")
 	}
 
+	o := options{layout: LayoutFlat}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	layout, err := ParseLayout(string(o.layout))
+	if err != nil {
+		return nil, err
+	}
+
 	if err := os.MkdirAll(path, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
@@ -121,24 +216,81 @@ func New[T collectionItem](path string) (*Manager[T], error) {
 	manager := &Manager[T]{
 		baseDir:     path,
 		items:       newRegistry[T](),
+		indexes:     newIndexSet[T](),
 		fileMutexes: make(map[uuid.UUID]*sync.Mutex),
+		layout:      layout,
+		misplaced:   make(map[uuid.UUID]string),
+		dirtyDirs:   make(map[string]struct{}),
+		cipher:      o.cipher,
+		stale:       make(map[uuid.UUID]struct{}),
+	}
+
+	manager.wal, err = openWAL(filepath.Join(path, walFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	// Replayed deletes must find items stored outside their layout path.
+	if manager.wal.length() > 0 {
+		if _, err := manager.scanItemFiles(); err != nil {
+			manager.wal.close()
+			return nil, fmt.Errorf("failed to load items: %w", err)
+		}
+	}
+
+	// Bring the item files up to date with the log before loading them.
+	if err := manager.replayWAL(); err != nil {
+		manager.wal.close()
+		return nil, fmt.Errorf("failed to recover from wal: %w", err)
 	}
 
 	items, err := manager.readAllItemsFromDisk()
 	if err != nil {
+		manager.wal.close()
 		return nil, fmt.Errorf("failed to load items: %w", err)
 	}
 
 	for _, item := range items {
 		manager.items.create(item.GetID(), item)
+		manager.indexes.add(item.GetID(), item)
+	}
+
+	if err := manager.checkpoint(); err != nil {
+		manager.wal.close()
+		return nil, fmt.Errorf("failed to checkpoint wal: %w", err)
+	}
+
+	if o.background && manager.Misplaced() > 0 {
+		manager.reshardInBackground()
+	}
+	if manager.cipher != nil && manager.Stale() > 0 {
+		manager.reencryptInBackground()
 	}
 
 	return manager, nil
 }
 
-// itemPath returns the path to a JSON file based on the item's ID.
+// Close stops a background reshard or re-encryption, checkpoints the
+// write-ahead log and closes it.
+func (m *Manager[T]) Close() error {
+	if m.stopReshard != nil {
+		m.stopReshard()
+		m.stopReshard = nil
+	}
+	if m.stopReencrypt != nil {
+		m.stopReencrypt()
+		m.stopReencrypt = nil
+	}
+	if err := m.Checkpoint(); err != nil {
+		return err
+	}
+	return m.wal.close()
+}
+
+// itemPath returns the path to a JSON file based on the item's ID and the
+// layout of the manager.
 func (m *Manager[T]) itemPath(id uuid.UUID) string {
-	return filepath.Join(m.baseDir, id.String()+".json")
+	return filepath.Join(m.baseDir, m.layout.relPath(id))
 }
 
 // getOrCreateMutex returns a mutex for a given item ID, creating it if it doesn't exist.
@@ -163,64 +315,141 @@ func (m *Manager[T]) deleteMutex(id uuid.UUID) {
 // They do not have their own locks.
 
 func (m *Manager[T]) readAllItemsFromDisk() ([]T, error) {
-	entries, err := os.ReadDir(m.baseDir)
+	files, err := m.scanItemFiles()
 	if err != nil {
 		return nil, err
 	}
 
-	items := make([]T, 0, len(entries))
-	for _, entry := range entries {
-		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
-			continue
-		}
-
-		filename := strings.TrimSuffix(entry.Name(), ".json")
-		if _, err := uuid.Parse(filename); err != nil {
-			fmt.Printf("collection_manager: skipping file with invalid UUID filename: %s, error: %v\n", entry.Name(), err)
-			continue
-		}
-
-		item, err := m.readItemFromDisk(filename)
+	items := make([]T, 0, len(files))
+	for id := range files {
+		item, migrated, err := m.decodeItemFile(id)
 		if err != nil {
-			fmt.Printf("collection_manager: error reading item %s: %v\n", filename, err)
+			fmt.Printf("collection_manager: error reading item %s: %v\n", id, err)
 			continue
 		}
+		// Upgraded items are written back, so each file is migrated once;
+		// one that cannot be is upgraded again on the next load.
+		if migrated {
+			if err := m.rewriteItem(item); err != nil {
+				fmt.Printf("collection_manager: error writing migrated item %s: %v\n", id, err)
+			}
+		}
 		items = append(items, item)
 	}
 	return items, nil
 }
 
-func (m *Manager[T]) readItemFromDisk(id string) (T, error) {
+// readItemFromDisk reads an item file, opening it first if it is sealed,
+// and upgrading it if it was written with an older schema version, see
+// migration.Upgrade.
+func (m *Manager[T]) readItemFromDisk(id uuid.UUID) (T, error) {
+	item, _, err := m.decodeItemFile(id)
+	return item, err
+}
+
+// decodeItemFile is readItemFromDisk, also reporting whether the item was
+// upgraded.
+func (m *Manager[T]) decodeItemFile(id uuid.UUID) (T, bool, error) {
 	var zero T
-	path := filepath.Join(m.baseDir, id+".json")
-	file, err := os.ReadFile(path)
+	file, err := os.ReadFile(m.filePath(id))
 	if err != nil {
-		return zero, err
+		return zero, false, err
 	}
 
 	if len(file) == 0 {
-		return zero, errors.New("empty file")
+		return zero, false, errors.New("empty file")
+	}
+
+	file, err = m.open(id, file)
+	if err != nil {
+		return zero, false, err
+	}
+
+	data, from, err := migration.Upgrade[T](file)
+	if err != nil {
+		return zero, false, err
 	}
 
 	var item T
-	if err := json.Unmarshal(file, &item); err != nil {
-		return zero, err
+	if err := json.Unmarshal(data, &item); err != nil {
+		return zero, false, err
+	}
+
+	return item, from < migration.Latest[T](), nil
+}
+
+// rewriteItem writes an unchanged item back to its file through the
+// write-ahead log, as Update does.
+func (m *Manager[T]) rewriteItem(item T) error {
+	m.walGate.RLock()
+	defer m.walGate.RUnlock()
+
+	seq, err := m.logChange(walOpUpdate, item.GetID(), item)
+	if err != nil {
+		return fmt.Errorf("failed to log update: %w", err)
+	}
+	if err := m.writeItemToDisk(item); err != nil {
+		return m.abortChange(seq, err)
 	}
-	return item, nil
+	return nil
 }
 
+// writeItemToDisk writes an item to its layout path, sealed if the manager
+// has a cipher, removing the file it had under another layout.
 func (m *Manager[T]) writeItemToDisk(item T) error {
-	path := m.itemPath(item.GetID())
 	jsonData, err := json.MarshalIndent(item, "", "  ")
 	if err != nil {
 		return err
 	}
+	jsonData = migration.Stamp[T](jsonData)
+	if jsonData, err = m.seal(item.GetID(), jsonData); err != nil {
+		return err
+	}
+
+	if err := m.writeFile(m.itemPath(item.GetID()), jsonData); err != nil {
+		return err
+	}
+	m.fresh(item.GetID())
+	return m.placed(item.GetID())
+}
+
+// writeFile replaces the file at path with data through a temporary file,
+// creating its shard directories as needed.
+func (m *Manager[T]) writeFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if dir != m.baseDir {
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			// The new directories are entries of their parents.
+			for parent := filepath.Dir(dir); parent != m.baseDir; parent = filepath.Dir(parent) {
+				m.touchDir(parent)
+			}
+		}
+	}
 
 	tempFile := path + ".tmp"
-	if err := os.WriteFile(tempFile, jsonData, 0644); err != nil {
+	file, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
 		return err
 	}
-	return os.Rename(tempFile, path)
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile, path); err != nil {
+		return err
+	}
+	m.touchDir(dir)
+	return nil
 }
 
 // ---
@@ -228,26 +457,48 @@ func (m *Manager[T]) writeItemToDisk(item T) error {
 
 // Create a new item in the collection.
 func (m *Manager[T]) Create(newItem T) (T, error) {
-	mutex := m.getOrCreateMutex(newItem.GetID())
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	if reflect.ValueOf(newItem).IsNil() {
 		var zero T
 		return zero, errors.New("cannot create nil item")
 	}
 
+	if err := assignID(newItem); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	mutex := m.getOrCreateMutex(newItem.GetID())
+	mutex.Lock()
+	defer mutex.Unlock()
+
 	if _, err := m.items.read(newItem.GetID()); err == nil {
 		var zero T
 		return zero, fmt.Errorf("item with ID %s already exists", newItem.GetID().String())
 	}
+	version.Init(newItem)
+
+	m.walGate.RLock()
+	seq, err := m.logChange(walOpCreate, newItem.GetID(), newItem)
+	if err != nil {
+		m.walGate.RUnlock()
+		var zero T
+		return zero, fmt.Errorf("failed to log create: %w", err)
+	}
 
 	if err := m.writeItemToDisk(newItem); err != nil {
+		err = m.abortChange(seq, err)
+		m.walGate.RUnlock()
 		var zero T
 		return zero, err
 	}
 
 	m.items.create(newItem.GetID(), newItem)
+	m.indexes.add(newItem.GetID(), newItem)
+	m.walGate.RUnlock()
+
+	m.publish(walOpCreate, newItem.GetID(), nil, newItem)
+
+	m.maybeCheckpoint()
 	return newItem, nil
 }
 
@@ -261,7 +512,7 @@ func (m *Manager[T]) Read(id uuid.UUID) (T, error) {
 	return m.items.read(id)
 }
 
-// ReadAll items from the collection.
+// ReadAll items from the collection, in ID order.
 func (m *Manager[T]) ReadAll() ([]T, error) {
 	// NOTE: This operation still needs a coarse-grained lock or a more complex solution
 	// to prevent items from being created/deleted while iterating.
@@ -269,28 +520,94 @@ func (m *Manager[T]) ReadAll() ([]T, error) {
 	return m.items.readAll(), nil
 }
 
-// Update an existing item in the collection.
-func (m *Manager[T]) Update(updatedItem T) (T, error) {
-	mutex := m.getOrCreateMutex(updatedItem.GetID())
-	mutex.Lock()
-	defer mutex.Unlock()
+// iterateBatchSize is the number of items Iterate copies out of the
+// registry at a time, so fn runs without holding the registry lock.
+const iterateBatchSize = 256
 
+// Iterate calls fn for every item in the collection in ID order until fn
+// returns false or ctx is cancelled.
+func (m *Manager[T]) Iterate(ctx context.Context, fn func(item T) bool) error {
+	return m.IterateFrom(ctx, uuid.Nil, fn)
+}
+
+// IterateFrom calls fn for every item whose ID is from or after it, in ID
+// order, until fn returns false or ctx is cancelled. Items are read from
+// the registry in batches: items created or deleted during the iteration
+// are visited only if the cursor has not passed them yet.
+func (m *Manager[T]) IterateFrom(ctx context.Context, from uuid.UUID, fn func(item T) bool) error {
+	for {
+		items, next := m.items.scan(from, iterateBatchSize)
+		for _, item := range items {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !fn(item) {
+				return nil
+			}
+		}
+		if next == uuid.Nil {
+			return nil
+		}
+		from = next
+	}
+}
+
+// Update an existing item in the collection. Items that carry a version
+// must be based on the stored one, which is then incremented; a stale
+// update fails with a *version.ConflictError, and a failed one keeps the
+// version it had.
+func (m *Manager[T]) Update(updatedItem T) (T, error) {
 	if reflect.ValueOf(updatedItem).IsNil() {
 		var zero T
 		return zero, errors.New("cannot update with nil item")
 	}
 
+	mutex := m.getOrCreateMutex(updatedItem.GetID())
+	mutex.Lock()
+	defer mutex.Unlock()
+
 	if _, err := m.items.read(updatedItem.GetID()); err != nil {
 		var zero T
 		return zero, fmt.Errorf("item with ID %s does not exist", updatedItem.GetID().String())
 	}
 
+	// Callers may have changed the item they read in place, so the version
+	// is checked against the item as stored rather than the registry.
+	before, err := m.readItemFromDisk(updatedItem.GetID())
+	if err != nil {
+		var zero T
+		return zero, fmt.Errorf("failed to read item %s: %w", updatedItem.GetID(), err)
+	}
+	if err := version.Check(updatedItem.GetID(), before, updatedItem); err != nil {
+		var zero T
+		return zero, err
+	}
+	previous := version.Bump(updatedItem)
+
+	m.walGate.RLock()
+	seq, err := m.logChange(walOpUpdate, updatedItem.GetID(), updatedItem)
+	if err != nil {
+		m.walGate.RUnlock()
+		version.Reset(updatedItem, previous)
+		var zero T
+		return zero, fmt.Errorf("failed to log update: %w", err)
+	}
+
 	if err := m.writeItemToDisk(updatedItem); err != nil {
+		err = m.abortChange(seq, err)
+		m.walGate.RUnlock()
+		version.Reset(updatedItem, previous)
 		var zero T
 		return zero, err
 	}
 
 	m.items.update(updatedItem.GetID(), updatedItem)
+	m.indexes.add(updatedItem.GetID(), updatedItem)
+	m.walGate.RUnlock()
+
+	m.publish(walOpUpdate, updatedItem.GetID(), before, updatedItem)
+
+	m.maybeCheckpoint()
 	return updatedItem, nil
 }
 
@@ -304,16 +621,48 @@ func (m *Manager[T]) Delete(id uuid.UUID) error {
 		return fmt.Errorf("item with ID %s does not exist", id.String())
 	}
 
-	path := m.itemPath(id)
-	if err := os.Remove(path); err != nil {
+	before := m.stored(id)
+
+	m.walGate.RLock()
+	var zero T
+	seq, err := m.logChange(walOpDelete, id, zero)
+	if err != nil {
+		m.walGate.RUnlock()
+		return fmt.Errorf("failed to log delete: %w", err)
+	}
+
+	if err := m.removeItemFile(id); err != nil {
+		err = m.abortChange(seq, err)
+		m.walGate.RUnlock()
 		return err
 	}
 
 	m.items.delete(id)
+	m.indexes.remove(id)
+	m.walGate.RUnlock()
+
+	m.publish(walOpDelete, id, before, nil)
+
 	m.deleteMutex(id) // Clean up the mutex after deleting the item
+	m.maybeCheckpoint()
 	return nil
 }
 
+// Clone returns a deep copy of an item by round-tripping it through JSON.
+// Use it to modify an item read from a Manager without touching the shared
+// in-memory value until the change is committed.
+func Clone[T collectionItem](item T) (T, error) {
+	var copied T
+	data, err := json.Marshal(item)
+	if err != nil {
+		return copied, err
+	}
+	if err := json.Unmarshal(data, &copied); err != nil {
+		return copied, err
+	}
+	return copied, nil
+}
+
 // Count an item from the collection by its ID.
 func (m *Manager[T]) Count() int {
 	return m.items.count()
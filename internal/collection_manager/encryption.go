@@ -0,0 +1,195 @@
+package collection_manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+)
+
+// errNoCipher is returned for a sealed item file or log entry read by a
+// manager opened without a cipher.
+var errNoCipher = errors.New("item is encrypted, but the collection has no cipher")
+
+// WithCipher seals item files and write-ahead log entries with c, so items
+// are never stored as plaintext. Plaintext items written before are still
+// read, and are sealed in the background, as are items sealed with a data
+// key that is no longer active, see Reencrypt. Close stops it.
+func WithCipher(c encryption.Cipher) Option {
+	return func(o *options) { o.cipher = c }
+}
+
+// CipherOf returns the cipher set with WithCipher in opts, or nil, for
+// callers that hand the options of New to another engine.
+func CipherOf(opts ...Option) encryption.Cipher {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o.cipher
+}
+
+// seal returns the stored form of the item file data.
+func (m *Manager[T]) seal(id uuid.UUID, data []byte) ([]byte, error) {
+	if m.cipher == nil {
+		return data, nil
+	}
+	return m.cipher.Seal(id, data)
+}
+
+// open returns the JSON of a stored item file, and records the item for
+// Reencrypt when it is not sealed with the active data key.
+func (m *Manager[T]) open(id uuid.UUID, data []byte) ([]byte, error) {
+	if m.cipher == nil {
+		if encryption.IsSealed(data) {
+			return nil, errNoCipher
+		}
+		return data, nil
+	}
+
+	if !m.cipher.Current(data) {
+		m.mu.Lock()
+		m.stale[id] = struct{}{}
+		m.mu.Unlock()
+	}
+	return m.cipher.Open(id, data)
+}
+
+// fresh records that the stored file of an item is sealed with the active
+// data key, or gone.
+func (m *Manager[T]) fresh(id uuid.UUID) {
+	m.mu.Lock()
+	delete(m.stale, id)
+	m.mu.Unlock()
+}
+
+// walData returns the Data of a log entry for the item JSON data. Sealed
+// data is stored as a base64 string, which keeps the entry valid JSON.
+func (m *Manager[T]) walData(id uuid.UUID, data []byte) (json.RawMessage, error) {
+	if m.cipher == nil {
+		return data, nil
+	}
+	sealed, err := m.cipher.Seal(id, data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealed)
+}
+
+// walItem returns the item JSON of a create or update entry, see walData.
+func (m *Manager[T]) walItem(entry walEntry) ([]byte, error) {
+	if len(entry.Data) == 0 || entry.Data[0] != '"' {
+		return entry.Data, nil
+	}
+	var sealed []byte
+	if err := json.Unmarshal(entry.Data, &sealed); err != nil {
+		return nil, err
+	}
+	if m.cipher == nil {
+		return nil, errNoCipher
+	}
+	return m.cipher.Open(entry.ID, sealed)
+}
+
+// Stale returns the number of items whose files are not sealed with the
+// active data key.
+func (m *Manager[T]) Stale() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.stale)
+}
+
+// Reencrypt seals the items that are stored as plaintext or with an older
+// data key with the active one, and returns how many it rewrote. Like
+// Reshard, it rewrites each item under its own lock, so the collection
+// stays usable while it runs, and stops early when ctx is done.
+func (m *Manager[T]) Reencrypt(ctx context.Context) (int, error) {
+	if m.cipher == nil {
+		return 0, errors.New("collection has no cipher")
+	}
+
+	m.mu.RLock()
+	ids := make([]uuid.UUID, 0, len(m.stale))
+	for id := range m.stale {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+
+	rewritten := 0
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return rewritten, err
+		}
+		ok, err := m.reencryptItemFile(id)
+		if err != nil {
+			return rewritten, fmt.Errorf("error re-encrypting item %s: %w", id, err)
+		}
+		if ok {
+			rewritten++
+		}
+	}
+	return rewritten, nil
+}
+
+// reencryptItemFile seals the stored file of a stale item again. It works
+// on the file rather than the in-memory item, which callers may have
+// modified without updating it yet.
+func (m *Manager[T]) reencryptItemFile(id uuid.UUID) (bool, error) {
+	mutex := m.getOrCreateMutex(id)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	m.walGate.RLock()
+	defer m.walGate.RUnlock()
+
+	m.mu.RLock()
+	_, ok := m.stale[id]
+	m.mu.RUnlock()
+	if !ok {
+		// Written or deleted since Reencrypt started.
+		return false, nil
+	}
+
+	file, err := os.ReadFile(m.filePath(id))
+	if err != nil {
+		return false, err
+	}
+	data, err := m.cipher.Open(id, file)
+	if err != nil {
+		return false, err
+	}
+	if data, err = m.cipher.Seal(id, data); err != nil {
+		return false, err
+	}
+	if err := m.writeFile(m.itemPath(id), data); err != nil {
+		return false, err
+	}
+	m.fresh(id)
+	return true, m.placed(id)
+}
+
+// reencryptInBackground runs Reencrypt until it is done or Close stops it.
+func (m *Manager[T]) reencryptInBackground() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	m.stopReencrypt = func() {
+		cancel()
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+		rewritten, err := m.Reencrypt(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			fmt.Printf("collection_manager: re-encryption of %s failed after %d items: %v\n", m.baseDir, rewritten, err)
+			return
+		}
+		if rewritten > 0 {
+			fmt.Printf("collection_manager: re-encrypted %d items in %s\n", rewritten, m.baseDir)
+		}
+	}()
+}
@@ -0,0 +1,124 @@
+package collection_manager
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+)
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := filepath.Join(t.TempDir(), "master.keys")
+	if _, err := encryption.AddMasterKey(keyfile); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := encryption.LoadKeyfile(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := encryption.OpenDataKeys(ring, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Items stored as plaintext before encryption was enabled.
+	plain, err := New[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uuid.UUID
+	for i := 0; i < 3; i++ {
+		msg, err := plain.Create(&message.Message{Caption: "plaintext caption"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	if err := plain.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err := New[*message.Message](dir, WithCipher(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Reencrypt(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if manager.Stale() != 0 {
+		t.Fatalf("%d items stale after Reencrypt, want 0", manager.Stale())
+	}
+	msg, err := manager.Create(&message.Message{Caption: "secret caption"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids, msg.ID)
+
+	// Neither the item files nor the log hold any caption.
+	files := []string{filepath.Join(dir, walFileName)}
+	for _, id := range ids {
+		files = append(files, manager.itemPath(id))
+	}
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("caption")) {
+			t.Fatalf("%s is stored as plaintext", filepath.Base(path))
+		}
+	}
+	if err := manager.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a rotation, every item is stale until it is sealed again.
+	if _, err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	manager, err = New[*message.Message](dir, WithCipher(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Reencrypt(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if manager.Stale() != 0 {
+		t.Fatalf("%d items stale after Reencrypt, want 0", manager.Stale())
+	}
+	for _, id := range ids {
+		data, err := os.ReadFile(manager.itemPath(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !keys.Current(data) {
+			t.Fatalf("item %s is not sealed with the active key", id)
+		}
+	}
+	msg, err = manager.Read(ids[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Caption != "secret caption" {
+		t.Fatalf("caption = %q, want %q", msg.Caption, "secret caption")
+	}
+	if err := manager.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the cipher, sealed items cannot be read.
+	manager, err = New[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	if manager.Count() != 0 {
+		t.Fatalf("read %d sealed items without a cipher", manager.Count())
+	}
+}
@@ -0,0 +1,376 @@
+package collection_manager
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// KeyFunc extracts the index keys of an item. An item may have several keys,
+// for example one per chat member, or none.
+type KeyFunc[T any] func(item T) []any
+
+// secondaryIndex maps normalized keys to the IDs of the items that have them.
+// Distinct keys are also kept sorted, so range queries walk only the keys
+// inside the range instead of every item.
+type secondaryIndex[T any] struct {
+	name     string
+	keys     KeyFunc[T]
+	entries  map[any]map[uuid.UUID]struct{}
+	sorted   []any
+	itemKeys map[uuid.UUID][]any
+}
+
+func newSecondaryIndex[T any](name string, keys KeyFunc[T]) *secondaryIndex[T] {
+	return &secondaryIndex[T]{
+		name:     name,
+		keys:     keys,
+		entries:  make(map[any]map[uuid.UUID]struct{}),
+		itemKeys: make(map[uuid.UUID][]any),
+	}
+}
+
+func (ix *secondaryIndex[T]) add(id uuid.UUID, item T) {
+	ix.remove(id)
+
+	raw := ix.keys(item)
+	keys := make([]any, 0, len(raw))
+	for _, k := range raw {
+		key := normalizeKey(k)
+		ids, ok := ix.entries[key]
+		if !ok {
+			ids = make(map[uuid.UUID]struct{})
+			ix.entries[key] = ids
+			ix.insertSorted(key)
+		}
+		ids[id] = struct{}{}
+		keys = append(keys, key)
+	}
+	ix.itemKeys[id] = keys
+}
+
+func (ix *secondaryIndex[T]) remove(id uuid.UUID) {
+	keys, ok := ix.itemKeys[id]
+	if !ok {
+		return
+	}
+	for _, key := range keys {
+		ids := ix.entries[key]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(ix.entries, key)
+			ix.removeSorted(key)
+		}
+	}
+	delete(ix.itemKeys, id)
+}
+
+func (ix *secondaryIndex[T]) insertSorted(key any) {
+	i := sort.Search(len(ix.sorted), func(i int) bool { return compareKeys(ix.sorted[i], key) >= 0 })
+	ix.sorted = append(ix.sorted, nil)
+	copy(ix.sorted[i+1:], ix.sorted[i:])
+	ix.sorted[i] = key
+}
+
+func (ix *secondaryIndex[T]) removeSorted(key any) {
+	i := sort.Search(len(ix.sorted), func(i int) bool { return compareKeys(ix.sorted[i], key) >= 0 })
+	if i < len(ix.sorted) && compareKeys(ix.sorted[i], key) == 0 {
+		ix.sorted = append(ix.sorted[:i], ix.sorted[i+1:]...)
+	}
+}
+
+func (ix *secondaryIndex[T]) lookup(value any) []uuid.UUID {
+	ids := ix.entries[normalizeKey(value)]
+	result := make([]uuid.UUID, 0, len(ids))
+	for id := range ids {
+		result = append(result, id)
+	}
+	sortIDs(result)
+	return result
+}
+
+// lookupRange returns the IDs whose key lies in [from, to]. A nil bound is open.
+func (ix *secondaryIndex[T]) lookupRange(from, to any) []uuid.UUID {
+	start := 0
+	if from != nil {
+		lo := normalizeKey(from)
+		start = sort.Search(len(ix.sorted), func(i int) bool { return compareKeys(ix.sorted[i], lo) >= 0 })
+	}
+
+	var hi any
+	if to != nil {
+		hi = normalizeKey(to)
+	}
+
+	var result []uuid.UUID
+	for _, key := range ix.sorted[start:] {
+		if hi != nil && compareKeys(key, hi) > 0 {
+			break
+		}
+		ids := make([]uuid.UUID, 0, len(ix.entries[key]))
+		for id := range ix.entries[key] {
+			ids = append(ids, id)
+		}
+		sortIDs(ids)
+		result = append(result, ids...)
+	}
+	return result
+}
+
+// ---
+// indexSet holds every secondary index of a Manager.
+
+type indexSet[T any] struct {
+	indexes map[string]*secondaryIndex[T]
+	mu      sync.RWMutex
+}
+
+// newIndexSet creates an index for every struct field of T tagged with
+// `index:"true"`, except the primary ID.
+func newIndexSet[T any]() *indexSet[T] {
+	set := &indexSet[T]{indexes: make(map[string]*secondaryIndex[T])}
+
+	var zero T
+	itemType := reflect.TypeOf(zero)
+	if itemType == nil {
+		return set
+	}
+	if itemType.Kind() == reflect.Ptr {
+		itemType = itemType.Elem()
+	}
+	if itemType.Kind() != reflect.Struct {
+		return set
+	}
+
+	for i := 0; i < itemType.NumField(); i++ {
+		field := itemType.Field(i)
+		if field.Tag.Get("index") != "true" || field.Name == "ID" {
+			continue
+		}
+		fieldIndex := i
+		set.indexes[field.Name] = newSecondaryIndex[T](field.Name, func(item T) []any {
+			value := reflect.ValueOf(item)
+			if value.Kind() == reflect.Ptr {
+				if value.IsNil() {
+					return nil
+				}
+				value = value.Elem()
+			}
+			return []any{value.Field(fieldIndex).Interface()}
+		})
+	}
+
+	return set
+}
+
+func (s *indexSet[T]) add(id uuid.UUID, item T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ix := range s.indexes {
+		ix.add(id, item)
+	}
+}
+
+func (s *indexSet[T]) remove(id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ix := range s.indexes {
+		ix.remove(id)
+	}
+}
+
+func (s *indexSet[T]) get(name string) (*secondaryIndex[T], error) {
+	ix, ok := s.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("no index on field %q", name)
+	}
+	return ix, nil
+}
+
+// ---
+// Public query API on the Manager.
+
+// AddIndex registers an index computed by keys, for lookups that are not a
+// single tagged field, such as the members of a chat. The index is built
+// from the items already loaded.
+func (m *Manager[T]) AddIndex(name string, keys KeyFunc[T]) error {
+	m.indexes.mu.Lock()
+	defer m.indexes.mu.Unlock()
+
+	if _, exists := m.indexes.indexes[name]; exists {
+		return fmt.Errorf("index %q already exists", name)
+	}
+
+	ix := newSecondaryIndex[T](name, keys)
+	m.items.mu.RLock()
+	for id, item := range m.items.items {
+		ix.add(id, item)
+	}
+	m.items.mu.RUnlock()
+
+	m.indexes.indexes[name] = ix
+	return nil
+}
+
+// Indexes returns the names of all secondary indexes.
+func (m *Manager[T]) Indexes() []string {
+	m.indexes.mu.RLock()
+	defer m.indexes.mu.RUnlock()
+
+	names := make([]string, 0, len(m.indexes.indexes))
+	for name := range m.indexes.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FindBy returns the items whose indexed field equals value, in ID order.
+// Field is the Go struct field name, for example "ChatID".
+func (m *Manager[T]) FindBy(field string, value any) ([]T, error) {
+	m.indexes.mu.RLock()
+	ix, err := m.indexes.get(field)
+	if err != nil {
+		m.indexes.mu.RUnlock()
+		return nil, err
+	}
+	ids := ix.lookup(value)
+	m.indexes.mu.RUnlock()
+
+	return m.itemsByID(ids), nil
+}
+
+// FindRange returns the items whose indexed field lies in [from, to],
+// ordered by that field. Pass nil for an open bound.
+func (m *Manager[T]) FindRange(field string, from, to any) ([]T, error) {
+	m.indexes.mu.RLock()
+	ix, err := m.indexes.get(field)
+	if err != nil {
+		m.indexes.mu.RUnlock()
+		return nil, err
+	}
+	ids := ix.lookupRange(from, to)
+	m.indexes.mu.RUnlock()
+
+	return m.itemsByID(ids), nil
+}
+
+func (m *Manager[T]) itemsByID(ids []uuid.UUID) []T {
+	m.items.mu.RLock()
+	defer m.items.mu.RUnlock()
+
+	result := make([]T, 0, len(ids))
+	for _, id := range ids {
+		if item, ok := m.items.items[id]; ok {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// ---
+// Key normalization and ordering.
+
+// normalizeKey turns values that are equal in meaning into the same map key:
+// integers become int64, floats float64, and times their UnixNano, since
+// time.Time values with different locations do not compare equal.
+func normalizeKey(value any) any {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UnixNano()
+	case *time.Time:
+		if v == nil {
+			return nil
+		}
+		return v.UnixNano()
+	case *uuid.UUID:
+		if v == nil {
+			return nil
+		}
+		return *v
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case float32:
+		return float64(v)
+	}
+	return value
+}
+
+// compareKeys orders normalized keys. Keys of different kinds are ordered
+// by type name so the sorted slice stays consistent.
+func compareKeys(a, b any) int {
+	switch x := a.(type) {
+	case int64:
+		if y, ok := b.(int64); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y)
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case !x:
+				return -1
+			}
+			return 1
+		}
+	case uuid.UUID:
+		if y, ok := b.(uuid.UUID); ok {
+			return bytes.Compare(x[:], y[:])
+		}
+	}
+	return strings.Compare(fmt.Sprintf("%T:%v", a, a), fmt.Sprintf("%T:%v", b, b))
+}
+
+func sortIDs(ids []uuid.UUID) {
+	sort.Slice(ids, func(i, j int) bool {
+		return compareIDs(ids[i], ids[j]) < 0
+	})
+}
+
+// compareIDs orders IDs by their bytes, which is creation order for UUID v7.
+func compareIDs(a, b uuid.UUID) int {
+	return bytes.Compare(a[:], b[:])
+}
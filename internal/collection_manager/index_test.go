@@ -0,0 +1,129 @@
+package collection_manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func TestFindBy(t *testing.T) {
+
+	manager, err := New[*message.Message](t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.New()
+	pinned := &message.Message{ID: uuid.New(), UserID: userID, IsPinned: true}
+	plain := &message.Message{ID: uuid.New(), UserID: uuid.New()}
+	for _, msg := range []*message.Message{pinned, plain} {
+		if _, err := manager.Create(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := manager.FindBy("UserID", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].ID != pinned.ID {
+		t.Errorf("FindBy(UserID) = %v, want [%s]", found, pinned.ID)
+	}
+
+	// Updating an item must move it between keys.
+	plain.IsPinned = true
+	if _, err := manager.Update(plain); err != nil {
+		t.Fatal(err)
+	}
+	found, err = manager.FindBy("IsPinned", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Errorf("FindBy(IsPinned) returned %d items, want 2", len(found))
+	}
+
+	if err := manager.Delete(pinned.ID); err != nil {
+		t.Fatal(err)
+	}
+	found, err = manager.FindBy("UserID", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Errorf("deleted item still indexed: %v", found)
+	}
+
+	if _, err := manager.FindBy("Caption", "x"); err == nil {
+		t.Error("FindBy on an unindexed field succeeded")
+	}
+}
+
+func TestFindRange(t *testing.T) {
+
+	manager, err := New[*message.Message](t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		msg := &message.Message{ID: uuid.New(), CreatedAt: start.Add(time.Duration(i) * time.Hour)}
+		if _, err := manager.Create(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := manager.FindRange("CreatedAt", start.Add(2*time.Hour), start.Add(4*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 {
+		t.Fatalf("FindRange returned %d items, want 3", len(found))
+	}
+	for i := 1; i < len(found); i++ {
+		if found[i].CreatedAt.Before(found[i-1].CreatedAt) {
+			t.Errorf("results not ordered by CreatedAt")
+		}
+	}
+
+	open, err := manager.FindRange("CreatedAt", start.Add(8*time.Hour), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(open) != 2 {
+		t.Errorf("open-ended FindRange returned %d items, want 2", len(open))
+	}
+}
+
+func TestAddIndex(t *testing.T) {
+
+	manager, err := New[*chat.Chat](t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.New()
+	member := &chat.Chat{ID: uuid.New(), Members: []chat.Member{{UserID: userID}, {UserID: uuid.New()}}}
+	other := &chat.Chat{ID: uuid.New(), Members: []chat.Member{{UserID: uuid.New()}}}
+	for _, c := range []*chat.Chat{member, other} {
+		if _, err := manager.Create(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := manager.AddIndex("members", chat.MemberUserIDs); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := manager.FindBy("members", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].ID != member.ID {
+		t.Errorf("FindBy(members) = %v, want [%s]", found, member.ID)
+	}
+}
@@ -0,0 +1,119 @@
+package collection_manager
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func TestIterateFrom(t *testing.T) {
+
+	manager, err := New[*message.Message](t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Random IDs, so the registry has to keep them sorted itself.
+	var ids []uuid.UUID
+	for i := 0; i < 2*iterateBatchSize+10; i++ {
+		msg, err := manager.Create(&message.Message{ID: uuid.New()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	slices.SortFunc(ids, compareIDs)
+
+	var got []uuid.UUID
+	err = manager.Iterate(context.Background(), func(msg *message.Message) bool {
+		got = append(got, msg.ID)
+		// Deleting an item the cursor has not reached yet hides it.
+		if len(got) == 1 {
+			if err := manager.Delete(ids[len(ids)-1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, ids[:len(ids)-1]) {
+		t.Fatalf("Iterate visited %d items out of ID order", len(got))
+	}
+
+	from := iterateBatchSize + 3
+	got = got[:0]
+	err = manager.IterateFrom(context.Background(), ids[from], func(msg *message.Message) bool {
+		got = append(got, msg.ID)
+		return len(got) < 5
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, ids[from:from+5]) {
+		t.Fatalf("IterateFrom = %v, want %v", got, ids[from:from+5])
+	}
+}
+
+// countingIterator counts the messages a search reads.
+type countingIterator struct {
+	message.Iterator
+	read int
+}
+
+func (c *countingIterator) IterateFrom(ctx context.Context, from uuid.UUID, fn func(*message.Message) bool) error {
+	return c.Iterator.IterateFrom(ctx, from, func(msg *message.Message) bool {
+		c.read++
+		return fn(msg)
+	})
+}
+
+func TestSearchIterStopsAfterPage(t *testing.T) {
+
+	manager, err := New[*message.Message](t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if _, err := manager.Create(&message.Message{IsPinned: i%2 == 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := manager.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := true
+	first := &message.SearchOptions{IsPinned: &pinned, Size: 10}
+	it := &countingIterator{Iterator: manager}
+	page, err := message.SearchIter(context.Background(), it, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := message.Search(all, &message.SearchOptions{IsPinned: &pinned, Size: 10})
+	if !slices.Equal(page, want) {
+		t.Fatalf("SearchIter returned a different page than Search")
+	}
+	if it.read != 19 {
+		t.Fatalf("SearchIter read %d messages for a page of 10, want 19", it.read)
+	}
+
+	// The next page continues from the cursor instead of skipping the first,
+	// reading the cursor message and the 20 messages after it.
+	next := &message.SearchOptions{IsPinned: &pinned, Size: 10, After: page[len(page)-1].ID}
+	it.read = 0
+	page, err = message.SearchIter(context.Background(), it, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = message.Search(all, &message.SearchOptions{IsPinned: &pinned, Size: 10, Page: 10})
+	if !slices.Equal(page, want) || it.read != 21 {
+		t.Fatalf("second page read %d messages and matched Search: %v", it.read, slices.Equal(page, want))
+	}
+}
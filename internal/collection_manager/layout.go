@@ -0,0 +1,340 @@
+package collection_manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+)
+
+// Layout decides where under the base directory an item file is stored.
+// A single directory with hundreds of thousands of files slows down every
+// lookup in it, so large collections spread their items over shards.
+type Layout string
+
+const (
+	// LayoutFlat stores every item directly in the base directory.
+	LayoutFlat Layout = "flat"
+	// LayoutHex shards items on the last two bytes of their ID in hex,
+	// e.g. 98/46/...4698.json, for up to 65536 evenly filled directories.
+	// The leading bytes of a UUID v7 are its timestamp, which would put
+	// weeks of items in the same directory.
+	LayoutHex Layout = "hex"
+	// LayoutTime shards items on the creation day of their UUID v7 ID,
+	// e.g. 2025/09/14/0199...json, so old items end up in cold directories.
+	// Items with other IDs are stored as with LayoutHex.
+	LayoutTime Layout = "time"
+)
+
+// shardDirPattern matches the directory names of every sharded layout. A
+// manager reads the items of all layouts, so a collection stays readable
+// while it is resharded.
+var shardDirPattern = regexp.MustCompile(`^([0-9a-f]{2}|[0-9]{4})$`)
+
+// maxShardDepth is the directory depth of the deepest layout.
+const maxShardDepth = 3
+
+// ParseLayout returns the layout with the given name. An empty name is
+// LayoutFlat.
+func ParseLayout(name string) (Layout, error) {
+	switch layout := Layout(name); layout {
+	case "":
+		return LayoutFlat, nil
+	case LayoutFlat, LayoutHex, LayoutTime:
+		return layout, nil
+	default:
+		return "", fmt.Errorf("unknown layout %q", name)
+	}
+}
+
+// relPath returns the path of an item file relative to the base directory.
+func (l Layout) relPath(id uuid.UUID) string {
+	s := id.String()
+	name := s + ".json"
+	hex := s[len(s)-4:]
+
+	switch l {
+	case LayoutHex:
+		return filepath.Join(hex[:2], hex[2:], name)
+	case LayoutTime:
+		if id.Version() != 7 {
+			return filepath.Join(hex[:2], hex[2:], name)
+		}
+		day := time.Unix(id.Time().UnixTime()).UTC()
+		return filepath.Join(day.Format("2006"), day.Format("01"), day.Format("02"), name)
+	default:
+		return name
+	}
+}
+
+type options struct {
+	layout     Layout
+	background bool
+	cipher     encryption.Cipher
+}
+
+// Option configures how New opens a collection.
+type Option func(*options)
+
+// WithLayout stores new and updated items with the given layout. Items
+// stored with another layout are still read, and move to the new one when
+// they are next written or the collection is resharded.
+func WithLayout(layout Layout) Option {
+	return func(o *options) { o.layout = layout }
+}
+
+// WithBackgroundReshard reshards the collection in the background after
+// it is opened, see Reshard. Close stops it.
+func WithBackgroundReshard() Option {
+	return func(o *options) { o.background = true }
+}
+
+// scanItemFiles lists the item files of the manager, see ItemFiles, and
+// records the ones stored outside their layout path for Reshard.
+func (m *Manager[T]) scanItemFiles() (map[uuid.UUID]string, error) {
+	files, err := ItemFiles(m.baseDir, m.layout)
+	if err != nil {
+		return nil, err
+	}
+
+	misplaced := make(map[uuid.UUID]string)
+	for id, path := range files {
+		if path != m.itemPath(id) {
+			misplaced[id] = path
+		}
+	}
+
+	m.mu.Lock()
+	m.misplaced = misplaced
+	m.mu.Unlock()
+	return files, nil
+}
+
+// ItemFiles returns the path of every item file under dir, stored in the
+// flat layout or any sharded one. When a crash while an item was moved
+// left it in two places, the copy at its path in layout is kept, since it
+// is the one written last, and the other one is removed.
+func ItemFiles(dir string, layout Layout) (map[uuid.UUID]string, error) {
+	files := make(map[uuid.UUID]string)
+	if err := scanDir(dir, dir, layout, 0, files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func scanDir(baseDir, dir string, layout Layout, depth int, files map[uuid.UUID]string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if depth < maxShardDepth && shardDirPattern.MatchString(entry.Name()) {
+				if err := scanDir(baseDir, path, layout, depth+1, files); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		filename := strings.TrimSuffix(entry.Name(), ".json")
+		id, err := uuid.Parse(filename)
+		if err != nil {
+			fmt.Printf("collection_manager: skipping file with invalid UUID filename: %s, error: %v\n", entry.Name(), err)
+			continue
+		}
+
+		if other, exists := files[id]; exists {
+			keep, drop := other, path
+			if path == filepath.Join(baseDir, layout.relPath(id)) {
+				keep, drop = path, other
+			}
+			fmt.Printf("collection_manager: item %s stored twice, keeping %s\n", id, keep)
+			if err := os.Remove(drop); err != nil {
+				return err
+			}
+			files[id] = keep
+			continue
+		}
+		files[id] = path
+	}
+	return nil
+}
+
+// filePath returns where the file of an item is stored, which is its
+// layout path unless it has not been moved there yet.
+func (m *Manager[T]) filePath(id uuid.UUID) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if path, ok := m.misplaced[id]; ok {
+		return path
+	}
+	return m.itemPath(id)
+}
+
+// placed records that an item is stored at its layout path, and removes the
+// file it had elsewhere.
+func (m *Manager[T]) placed(id uuid.UUID) error {
+	m.mu.Lock()
+	old, ok := m.misplaced[id]
+	delete(m.misplaced, id)
+	m.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(old); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	m.touchDir(filepath.Dir(old))
+	return nil
+}
+
+// removeItemFile removes the file of an item wherever it is stored. A
+// missing file is not an error.
+func (m *Manager[T]) removeItemFile(id uuid.UUID) error {
+	path := m.filePath(id)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	m.touchDir(filepath.Dir(path))
+	m.fresh(id)
+	return m.placed(id)
+}
+
+// touchDir records a directory whose entries changed, so the next
+// checkpoint syncs it.
+func (m *Manager[T]) touchDir(dir string) {
+	m.dirtyMu.Lock()
+	defer m.dirtyMu.Unlock()
+	m.dirtyDirs[dir] = struct{}{}
+}
+
+// syncDirs syncs the directories changed since the last call.
+func (m *Manager[T]) syncDirs() error {
+	m.dirtyMu.Lock()
+	dirs := m.dirtyDirs
+	m.dirtyDirs = make(map[string]struct{})
+	m.dirtyMu.Unlock()
+
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			m.dirtyMu.Lock()
+			for dir := range dirs {
+				m.dirtyDirs[dir] = struct{}{}
+			}
+			m.dirtyMu.Unlock()
+			return err
+		}
+	}
+	return syncDir(m.baseDir)
+}
+
+// Misplaced returns the number of items not stored at their layout path.
+func (m *Manager[T]) Misplaced() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.misplaced)
+}
+
+// Reshard moves the items stored outside their layout path, such as those
+// of a collection created with another layout, and returns how many it
+// moved. Items stay readable and writable while it runs: each one is moved
+// under its own lock, by copying its file and then removing the old one.
+// It stops early when ctx is done.
+func (m *Manager[T]) Reshard(ctx context.Context) (int, error) {
+	m.mu.RLock()
+	ids := make([]uuid.UUID, 0, len(m.misplaced))
+	for id := range m.misplaced {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+
+	moved := 0
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return moved, err
+		}
+		ok, err := m.moveItemFile(id)
+		if err != nil {
+			return moved, fmt.Errorf("error moving item %s: %w", id, err)
+		}
+		if ok {
+			moved++
+		}
+	}
+
+	if moved > 0 {
+		if err := m.Checkpoint(); err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// moveItemFile copies the file of a misplaced item to its layout path
+// as is, without re-encoding it, and removes the old file.
+func (m *Manager[T]) moveItemFile(id uuid.UUID) (bool, error) {
+	mutex := m.getOrCreateMutex(id)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	m.walGate.RLock()
+	defer m.walGate.RUnlock()
+
+	m.mu.RLock()
+	old, ok := m.misplaced[id]
+	m.mu.RUnlock()
+	if !ok {
+		// Written or deleted since Reshard started.
+		return false, nil
+	}
+
+	data, err := os.ReadFile(old)
+	if err != nil {
+		return false, err
+	}
+	if err := m.writeFile(m.itemPath(id), data); err != nil {
+		return false, err
+	}
+	// The move is not logged, so the new file must be durable before the
+	// old one is removed.
+	if err := m.syncDirs(); err != nil {
+		return false, err
+	}
+	return true, m.placed(id)
+}
+
+// reshardInBackground runs Reshard until it is done or Close stops it.
+func (m *Manager[T]) reshardInBackground() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	m.stopReshard = func() {
+		cancel()
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+		moved, err := m.Reshard(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			fmt.Printf("collection_manager: reshard of %s failed after %d items: %v\n", m.baseDir, moved, err)
+			return
+		}
+		if moved > 0 {
+			fmt.Printf("collection_manager: resharded %d items in %s\n", moved, m.baseDir)
+		}
+	}()
+}
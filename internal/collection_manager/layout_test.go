@@ -0,0 +1,99 @@
+package collection_manager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func TestReshard(t *testing.T) {
+
+	dir := t.TempDir()
+	flat, err := New[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uuid.UUID
+	for i := 0; i < 5; i++ {
+		msg, err := flat.Create(&message.Message{Caption: "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	if err := flat.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The flat files are read through the new layout.
+	manager, err := New[*message.Message](dir, WithLayout(LayoutHex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := manager.ReadAll(); len(got) != len(ids) {
+		t.Fatalf("read %d items, want %d", len(got), len(ids))
+	}
+	if manager.Misplaced() != len(ids) {
+		t.Fatalf("%d items misplaced, want %d", manager.Misplaced(), len(ids))
+	}
+
+	// A write moves an item, and a delete finds it in the old layout.
+	updated, _ := manager.Read(ids[0])
+	updated, _ = Clone(updated)
+	updated.Caption = "moved"
+	if _, err := manager.Update(updated); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids[:2] {
+		if _, err := os.Stat(filepath.Join(dir, id.String()+".json")); !os.IsNotExist(err) {
+			t.Fatalf("flat file of %s left behind: %v", id, err)
+		}
+	}
+
+	moved, err := manager.Reshard(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 3 || manager.Misplaced() != 0 {
+		t.Fatalf("moved %d items with %d misplaced, want 3 and 0", moved, manager.Misplaced())
+	}
+	if err := manager.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ItemFiles(dir, LayoutHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("%d item files, want 4", len(files))
+	}
+	for id, path := range files {
+		if path != filepath.Join(dir, LayoutHex.relPath(id)) {
+			t.Fatalf("%s stored at %s after reshard", id, path)
+		}
+	}
+
+	// Reopening with another layout and a background reshard moves them again.
+	manager, err = New[*message.Message](dir, WithLayout(LayoutTime), WithBackgroundReshard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := manager.Read(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Caption != "moved" {
+		t.Fatalf("caption = %q, want %q", msg.Caption, "moved")
+	}
+	if err := manager.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
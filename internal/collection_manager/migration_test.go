@@ -0,0 +1,61 @@
+package collection_manager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/migration"
+)
+
+func TestLoadMigratesLegacyItems(t *testing.T) {
+
+	dir := t.TempDir()
+	id := uuid.New()
+	// Written before pinnedMessageId became a string, with no schema version.
+	legacy := `{"id": "` + id.String() + `", "title": "legacy", "pinnedMessageId": 42}`
+	path := filepath.Join(dir, id.String()+".json")
+	if err := os.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := migration.File[*chat.Chat](path, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("dry run reported no change for the legacy file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != legacy {
+		t.Fatal("dry run rewrote the file")
+	}
+
+	manager, err := New[*chat.Chat](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	item, err := manager.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.PinnedMessageID != "42" || item.Title != "legacy" {
+		t.Fatalf("migrated chat = %q %q, want pinned message 42 and title legacy", item.PinnedMessageID, item.Title)
+	}
+
+	// The file was written back at the latest version.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"schemaVersion": 1`) {
+		t.Fatalf("migrated file has no schema version:\n%s", data)
+	}
+	if changed, err := migration.File[*chat.Chat](path, nil, true); err != nil || changed {
+		t.Fatalf("second dry run reported %v, %v; want no change", changed, err)
+	}
+}
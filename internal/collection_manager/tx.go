@@ -0,0 +1,492 @@
+package collection_manager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/version"
+)
+
+// txDirName holds commit decisions of transactions that span several managers.
+const txDirName = ".tx"
+
+var (
+	ErrTxDone = errors.New("transaction has already been committed or rolled back")
+)
+
+// participant is the untyped side of a Manager that a Tx drives during commit.
+type participant interface {
+	dir() string
+	lockItems(ids []uuid.UUID) func()
+	validate(ops []*stagedOp) error
+	prepare(txID uuid.UUID, coordinator string, ops []*stagedOp) error
+	commitMarker(txID uuid.UUID) error
+	apply(ops []*stagedOp) error
+}
+
+type stagedOp struct {
+	owner participant
+	op    walOp
+	id    uuid.UUID
+	item  any
+	data  []byte
+	// previous is the version of item before commit changed it, kept to
+	// set it back when the commit fails, see restore.
+	previous string
+	changed  bool
+}
+
+// keep records the version of the item before commit changes it.
+func (op *stagedOp) keep() {
+	if v, ok := op.item.(version.Item); ok {
+		op.previous, op.changed = v.GetVersion(), true
+	}
+}
+
+// restore sets back the version of the item after a failed commit.
+func (op *stagedOp) restore() {
+	if op.changed {
+		version.Reset(op.item, op.previous)
+		op.changed = false
+	}
+}
+
+// remarshal refreshes data after the item was changed during commit.
+func (op *stagedOp) remarshal() error {
+	if _, ok := op.item.(version.Item); !ok {
+		return nil
+	}
+	data, err := json.Marshal(op.item)
+	if err != nil {
+		return fmt.Errorf("error marshaling item: %w", err)
+	}
+	op.data = data
+	return nil
+}
+
+// Tx stages Create, Update and Delete operations on one or more managers
+// and applies them all-or-nothing on Commit. Nothing touches disk or memory
+// until Commit, so Rollback only drops the staged operations.
+//
+// A Tx that spans several managers records its commit decision in the
+// first manager's directory; managers recovering from a crash consult it
+// for transactions that were prepared but not yet marked committed locally.
+type Tx struct {
+	id           uuid.UUID
+	ops          []*stagedOp
+	participants []participant
+	done         bool
+	mu           sync.Mutex
+}
+
+// NewTx starts an empty transaction. Enlist managers with Join.
+func NewTx() *Tx {
+	id, err := uuid.NewV7()
+	if err != nil {
+		id = uuid.New()
+	}
+	return &Tx{id: id}
+}
+
+// ID returns the transaction ID that is written to the write-ahead logs.
+func (tx *Tx) ID() uuid.UUID {
+	return tx.id
+}
+
+func (tx *Tx) stage(op *stagedOp) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+
+	found := false
+	for _, p := range tx.participants {
+		if p == op.owner {
+			found = true
+			break
+		}
+	}
+	if !found {
+		tx.participants = append(tx.participants, op.owner)
+	}
+
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+// Rollback discards every staged operation.
+func (tx *Tx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.ops = nil
+	return nil
+}
+
+// Commit applies every staged operation atomically.
+//
+// The steps are: lock all touched items, validate against current state,
+// log the operations to each manager's write-ahead log, record the commit
+// point, then apply. A crash before the commit point loses the whole
+// transaction; a crash after it is finished by write-ahead log replay.
+func (tx *Tx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	// Lock in directory order so two transactions never wait on each other.
+	participants := append([]participant(nil), tx.participants...)
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].dir() < participants[j].dir()
+	})
+
+	byOwner := make(map[participant][]*stagedOp)
+	for _, op := range tx.ops {
+		byOwner[op.owner] = append(byOwner[op.owner], op)
+	}
+
+	for _, p := range participants {
+		ids := make([]uuid.UUID, 0, len(byOwner[p]))
+		for _, op := range byOwner[p] {
+			ids = append(ids, op.id)
+		}
+		unlock := p.lockItems(ids)
+		defer unlock()
+	}
+
+	// Versions set by validate only stick once the transaction commits.
+	committed := false
+	defer func() {
+		if !committed {
+			for i := len(tx.ops) - 1; i >= 0; i-- {
+				tx.ops[i].restore()
+			}
+		}
+	}()
+
+	for _, p := range participants {
+		if err := p.validate(byOwner[p]); err != nil {
+			return err
+		}
+	}
+
+	coordinator := tx.participants[0].dir()
+	for _, p := range participants {
+		if err := p.prepare(tx.id, coordinator, byOwner[p]); err != nil {
+			return fmt.Errorf("failed to prepare transaction: %w", err)
+		}
+	}
+
+	// Commit point. With a single manager its own commit entry decides;
+	// otherwise the decision file in the coordinator's directory does.
+	multi := len(participants) > 1
+	if multi {
+		if err := writeTxDecision(coordinator, tx.id); err != nil {
+			return fmt.Errorf("failed to record commit decision: %w", err)
+		}
+		committed = true
+	}
+
+	for _, p := range participants {
+		if err := p.commitMarker(tx.id); err != nil {
+			return fmt.Errorf("transaction %s committed but not marked, it will be finished on restart: %w", tx.id, err)
+		}
+		committed = true
+		if err := p.apply(byOwner[p]); err != nil {
+			return fmt.Errorf("transaction %s committed but not applied, it will be finished on restart: %w", tx.id, err)
+		}
+	}
+
+	if multi {
+		if err := removeTxDecision(coordinator, tx.id); err != nil {
+			fmt.Printf("collection_manager: failed to remove commit decision %s: %v\n", tx.id, err)
+		}
+	}
+
+	return nil
+}
+
+// ---
+// Commit decisions for transactions that span several managers.
+
+func txDecisionPath(coordinator string, txID uuid.UUID) string {
+	return filepath.Join(coordinator, txDirName, txID.String()+".commit")
+}
+
+func writeTxDecision(coordinator string, txID uuid.UUID) error {
+	dir := filepath.Join(coordinator, txDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(txDecisionPath(coordinator, txID), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func removeTxDecision(coordinator string, txID uuid.UUID) error {
+	err := os.Remove(txDecisionPath(coordinator, txID))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// txDecided reports whether the coordinator recorded a commit decision.
+// Decisions left behind by a crash are kept, since other participants may
+// still need them when they are opened later.
+func txDecided(coordinator string, txID uuid.UUID) bool {
+	if coordinator == "" {
+		return false
+	}
+	_, err := os.Stat(txDecisionPath(coordinator, txID))
+	return err == nil
+}
+
+// ---
+// Typed staging on a Manager.
+
+// Txn is a Manager's view of a Tx. Operations staged through it belong to
+// the shared Tx and are committed together with those of other managers.
+type Txn[T collectionItem] struct {
+	tx *Tx
+	m  *Manager[T]
+}
+
+// Begin starts a transaction on this manager alone.
+func (m *Manager[T]) Begin() *Txn[T] {
+	return m.Join(NewTx())
+}
+
+// Join enlists this manager in an existing transaction, so a single Commit
+// covers changes to several collections.
+func (m *Manager[T]) Join(tx *Tx) *Txn[T] {
+	return &Txn[T]{tx: tx, m: m}
+}
+
+// Tx returns the underlying transaction, for joining further managers.
+func (t *Txn[T]) Tx() *Tx {
+	return t.tx
+}
+
+// Create stages a new item. Like Manager.Create, it gives an item without
+// an ID a UUID v7.
+func (t *Txn[T]) Create(newItem T) error {
+	if reflect.ValueOf(newItem).IsNil() {
+		return errors.New("cannot create nil item")
+	}
+	if err := assignID(newItem); err != nil {
+		return err
+	}
+	return t.stageItem(walOpCreate, newItem)
+}
+
+// Update stages a new version of an existing item.
+func (t *Txn[T]) Update(updatedItem T) error {
+	if reflect.ValueOf(updatedItem).IsNil() {
+		return errors.New("cannot update with nil item")
+	}
+	return t.stageItem(walOpUpdate, updatedItem)
+}
+
+// Delete stages the removal of an item.
+func (t *Txn[T]) Delete(id uuid.UUID) error {
+	return t.tx.stage(&stagedOp{owner: t.m, op: walOpDelete, id: id})
+}
+
+// Commit commits the underlying transaction.
+func (t *Txn[T]) Commit() error {
+	return t.tx.Commit()
+}
+
+// Rollback rolls back the underlying transaction.
+func (t *Txn[T]) Rollback() error {
+	return t.tx.Rollback()
+}
+
+func (t *Txn[T]) stageItem(op walOp, item T) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("error marshaling item: %w", err)
+	}
+	return t.tx.stage(&stagedOp{owner: t.m, op: op, id: item.GetID(), item: item, data: data})
+}
+
+// ---
+// participant implementation.
+
+func (m *Manager[T]) dir() string {
+	return m.baseDir
+}
+
+// lockItems takes the item mutexes in ID order and holds the write-ahead
+// log gate, so a checkpoint cannot run while the transaction is applied.
+func (m *Manager[T]) lockItems(ids []uuid.UUID) func() {
+	unique := make(map[uuid.UUID]struct{}, len(ids))
+	sorted := make([]uuid.UUID, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := unique[id]; !ok {
+			unique[id] = struct{}{}
+			sorted = append(sorted, id)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+
+	mutexes := make([]*sync.Mutex, 0, len(sorted))
+	for _, id := range sorted {
+		mutex := m.getOrCreateMutex(id)
+		mutex.Lock()
+		mutexes = append(mutexes, mutex)
+	}
+	m.walGate.RLock()
+
+	return func() {
+		m.walGate.RUnlock()
+		for i := len(mutexes) - 1; i >= 0; i-- {
+			mutexes[i].Unlock()
+		}
+	}
+}
+
+// validate replays the staged operations against the current items, so a
+// later operation may act on an item created earlier in the same transaction.
+// It also sets the versions of the staged items, as Create and Update do,
+// and Commit sets them back if it fails.
+func (m *Manager[T]) validate(ops []*stagedOp) error {
+	exists := make(map[uuid.UUID]bool)
+	// latest holds the items as staged so far, for versions.
+	latest := make(map[uuid.UUID]any)
+	for _, op := range ops {
+		present, seen := exists[op.id]
+		if !seen {
+			_, err := m.items.read(op.id)
+			present = err == nil
+		}
+		if _, ok := latest[op.id]; present && !ok && op.op == walOpUpdate {
+			// Callers may have changed the item they read in place, so
+			// versions are checked against the item as stored.
+			stored, err := m.readItemFromDisk(op.id)
+			if err != nil {
+				return fmt.Errorf("failed to read item %s: %w", op.id, err)
+			}
+			latest[op.id] = stored
+		}
+
+		switch op.op {
+		case walOpCreate:
+			if present {
+				return fmt.Errorf("item with ID %s already exists", op.id.String())
+			}
+			exists[op.id] = true
+			op.keep()
+			version.Init(op.item)
+			if err := op.remarshal(); err != nil {
+				return err
+			}
+			latest[op.id] = op.item
+		case walOpUpdate:
+			if !present {
+				return fmt.Errorf("item with ID %s does not exist", op.id.String())
+			}
+			if err := version.Check(op.id, latest[op.id], op.item); err != nil {
+				return err
+			}
+			op.keep()
+			version.Bump(op.item)
+			if err := op.remarshal(); err != nil {
+				return err
+			}
+			latest[op.id] = op.item
+		case walOpDelete:
+			if !present {
+				return fmt.Errorf("item with ID %s does not exist", op.id.String())
+			}
+			exists[op.id] = false
+			delete(latest, op.id)
+		}
+	}
+	return nil
+}
+
+func (m *Manager[T]) prepare(txID uuid.UUID, coordinator string, ops []*stagedOp) error {
+	entries := make([]*walEntry, 0, len(ops))
+	for _, op := range ops {
+		data, err := m.walData(op.id, op.data)
+		if err != nil {
+			return fmt.Errorf("error sealing item: %w", err)
+		}
+		entries = append(entries, &walEntry{
+			Op:          op.op,
+			ID:          op.id,
+			Data:        data,
+			TxID:        txID,
+			Coordinator: coordinator,
+		})
+	}
+	return m.wal.appendBatch(entries)
+}
+
+func (m *Manager[T]) commitMarker(txID uuid.UUID) error {
+	return m.wal.append(&walEntry{Op: walOpCommit, TxID: txID})
+}
+
+func (m *Manager[T]) apply(ops []*stagedOp) error {
+	for _, op := range ops {
+		var before any
+		if op.op != walOpCreate {
+			before = m.stored(op.id)
+		}
+
+		switch op.op {
+		case walOpCreate, walOpUpdate:
+			item := op.item.(T)
+			if err := m.writeItemToDisk(item); err != nil {
+				return err
+			}
+			m.items.update(op.id, item)
+			m.indexes.add(op.id, item)
+			m.publish(op.op, op.id, before, item)
+		case walOpDelete:
+			if err := m.removeItemFile(op.id); err != nil {
+				return err
+			}
+			m.items.delete(op.id)
+			m.indexes.remove(op.id)
+			m.publish(op.op, op.id, before, nil)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package collection_manager
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func TestTxCommitAcrossCollections(t *testing.T) {
+
+	dir := t.TempDir()
+
+	chats, err := New[*chat.Chat](filepath.Join(dir, "chats"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := New[*message.Message](filepath.Join(dir, "messages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newChat := &chat.Chat{ID: uuid.New(), Title: "with first message"}
+	first := &message.Message{ID: uuid.New(), ChatID: newChat.ID, Caption: "hello"}
+
+	tx := NewTx()
+	if err := chats.Join(tx).Create(newChat); err != nil {
+		t.Fatal(err)
+	}
+	if err := messages.Join(tx).Create(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := chats.Read(newChat.ID); err != nil {
+		t.Errorf("chat not created: %v", err)
+	}
+	if _, err := messages.Read(first.ID); err != nil {
+		t.Errorf("message not created: %v", err)
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Errorf("second commit error = %v, want ErrTxDone", err)
+	}
+}
+
+func TestTxCreateAssignsIDs(t *testing.T) {
+
+	manager, err := New[*message.Message](t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := &message.Message{Caption: "first"}
+	second := &message.Message{Caption: "second"}
+
+	tx := manager.Begin()
+	if err := tx.Create(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Create(second); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if first.ID == uuid.Nil || first.ID == second.ID {
+		t.Fatalf("IDs = %s, %s, want distinct IDs", first.ID, second.ID)
+	}
+	if first.ID.Version() != 7 {
+		t.Errorf("ID version = %d, want 7", first.ID.Version())
+	}
+	for _, msg := range []*message.Message{first, second} {
+		got, err := manager.Read(msg.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Caption != msg.Caption {
+			t.Errorf("caption = %q, want %q", got.Caption, msg.Caption)
+		}
+	}
+}
+
+func TestTxValidationFailureAppliesNothing(t *testing.T) {
+
+	manager, err := New[*message.Message](t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	existing := &message.Message{ID: uuid.New(), Caption: "before"}
+	if _, err := manager.Create(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := manager.Begin()
+	if err := tx.Update(&message.Message{ID: existing.ID, Caption: "after"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Update(&message.Message{ID: uuid.New(), Caption: "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Fatal("commit with a missing item succeeded")
+	}
+
+	got, err := manager.Read(existing.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Caption != "before" {
+		t.Errorf("caption = %q, want unchanged %q", got.Caption, "before")
+	}
+}
+
+func TestTxRecovery(t *testing.T) {
+
+	dir := t.TempDir()
+	chatsDir := filepath.Join(dir, "chats")
+	messagesDir := filepath.Join(dir, "messages")
+
+	chats, err := New[*chat.Chat](chatsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := New[*message.Message](messagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A transaction that crashed after its decision but before any local
+	// commit marker, and one that crashed before its decision.
+	decided := uuid.New()
+	undecided := uuid.New()
+	committedChat := &chat.Chat{ID: uuid.New(), Title: "decided"}
+	committedMessage := &message.Message{ID: uuid.New(), Caption: "decided"}
+	droppedMessage := &message.Message{ID: uuid.New(), Caption: "undecided"}
+
+	chatOps := []*stagedOp{{op: walOpCreate, id: committedChat.ID, data: mustMarshal(t, committedChat)}}
+	if err := chats.prepare(decided, chatsDir, chatOps); err != nil {
+		t.Fatal(err)
+	}
+	messageOps := []*stagedOp{{op: walOpCreate, id: committedMessage.ID, data: mustMarshal(t, committedMessage)}}
+	if err := messages.prepare(decided, chatsDir, messageOps); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTxDecision(chatsDir, decided); err != nil {
+		t.Fatal(err)
+	}
+	droppedOps := []*stagedOp{{op: walOpCreate, id: droppedMessage.ID, data: mustMarshal(t, droppedMessage)}}
+	if err := messages.prepare(undecided, chatsDir, droppedOps); err != nil {
+		t.Fatal(err)
+	}
+	chats.wal.close()
+	messages.wal.close()
+
+	chats, err = New[*chat.Chat](chatsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err = New[*message.Message](messagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := chats.Read(committedChat.ID); err != nil {
+		t.Errorf("decided chat not recovered: %v", err)
+	}
+	if _, err := messages.Read(committedMessage.ID); err != nil {
+		t.Errorf("decided message not recovered: %v", err)
+	}
+	if _, err := messages.Read(droppedMessage.ID); err == nil {
+		t.Errorf("undecided message was applied")
+	}
+}
+
+func mustMarshal(t *testing.T, item any) []byte {
+	t.Helper()
+	data, err := json.Marshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,121 @@
+package collection_manager
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/version"
+)
+
+func TestVersionCompareAndSwap(t *testing.T) {
+
+	manager, err := New[*chat.Chat](t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	created, err := manager.Create(&chat.Chat{Title: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Version != "1" {
+		t.Fatalf("version after create = %q, want 1", created.Version)
+	}
+
+	// Two clients start from the same version; the second one loses.
+	alice, _ := Clone(created)
+	bob, _ := Clone(created)
+
+	alice.Title = "alice"
+	if _, err := manager.Update(alice); err != nil {
+		t.Fatal(err)
+	}
+	if alice.Version != "2" {
+		t.Fatalf("version after update = %q, want 2", alice.Version)
+	}
+
+	bob.Title = "bob"
+	_, err = manager.Update(bob)
+	var conflict *version.ConflictError
+	if !errors.As(err, &conflict) || conflict.Expected != "1" || conflict.Current != "2" {
+		t.Fatalf("stale update returned %v, want a conflict from version 1 to 2", err)
+	}
+
+	// Transactions check versions at commit.
+	tx := manager.Begin()
+	if err := tx.Update(bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, version.ErrConflict) {
+		t.Fatalf("stale commit returned %v, want a version conflict", err)
+	}
+
+	bob.Version = "2"
+	tx = manager.Begin()
+	if err := tx.Update(bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := manager.Read(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != "bob" || stored.Version != "3" {
+		t.Fatalf("stored %q at version %q, want bob at 3", stored.Title, stored.Version)
+	}
+}
+
+// TestVersionInPlaceUpdate checks that an item changed in place after Read
+// is still checked against the stored version, and that a failed commit
+// leaves the versions it set as they were.
+func TestVersionInPlaceUpdate(t *testing.T) {
+
+	manager, err := New[*chat.Chat](t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	created, err := manager.Create(&chat.Chat{Title: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A stale version set on the item the registry holds is caught.
+	held, err := manager.Read(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	held.Version = "7"
+	if _, err := manager.Update(held); !errors.Is(err, version.ErrConflict) {
+		t.Fatalf("in-place update from a stale version returned %v, want a conflict", err)
+	}
+
+	held.Version = "1"
+	tx := manager.Begin()
+	if err := tx.Update(held); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete(uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Fatal("commit deleting a missing item succeeded")
+	}
+	if held.Version != "1" {
+		t.Fatalf("version after a failed commit = %q, want 1", held.Version)
+	}
+
+	if _, err := manager.Update(held); err != nil {
+		t.Fatal(err)
+	}
+	if held.Version != "2" {
+		t.Fatalf("version after update = %q, want 2", held.Version)
+	}
+}
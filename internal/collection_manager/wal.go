@@ -0,0 +1,372 @@
+package collection_manager
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+const (
+	walFileName = "wal.log"
+	// walFrameHeaderSize is the [length uint32][crc32 uint32] prefix of every frame.
+	walFrameHeaderSize = 8
+	// walCheckpointSize is the log size after which the manager checkpoints on its own.
+	walCheckpointSize = 4 << 20 // 4 MB
+)
+
+type walOp string
+
+const (
+	walOpCreate walOp = "create"
+	walOpUpdate walOp = "update"
+	walOpDelete walOp = "delete"
+	walOpCommit walOp = "commit"
+	// walOpAbort cancels the entry numbered Aborts, a change that failed
+	// to apply after it was logged.
+	walOpAbort walOp = "abort"
+)
+
+// walEntry is a single logged mutation. Data holds the JSON of the item
+// for create and update, sealed as a base64 string if the manager has a
+// cipher, and is empty for delete.
+//
+// Entries written by a transaction carry its TxID and only take effect once
+// a commit entry for that TxID follows them, or, for transactions spanning
+// several managers, once the coordinator has recorded its commit decision.
+// Abort entries cancel an earlier entry, which replay then skips.
+type walEntry struct {
+	Seq         uint64          `json:"seq"`
+	Op          walOp           `json:"op"`
+	ID          uuid.UUID       `json:"id"`
+	Data        json.RawMessage `json:"data,omitempty"`
+	TxID        uuid.UUID       `json:"txId,omitempty"`
+	Coordinator string          `json:"coordinator,omitempty"`
+	Aborts      uint64          `json:"aborts,omitempty"`
+}
+
+// wal is an append-only write-ahead log. Every entry is framed as
+// [length][crc32][json] and fsynced before append returns, so a torn
+// tail is detected on replay and everything before it is trusted.
+type wal struct {
+	path string
+	file *os.File
+	size int64
+	seq  uint64
+	mu   sync.Mutex
+}
+
+func openWAL(path string) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening wal: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error getting wal info: %w", err)
+	}
+
+	return &wal{path: path, file: file, size: info.Size()}, nil
+}
+
+// append assigns the next sequence number to the entry and writes it durably.
+func (w *wal) append(entry *walEntry) error {
+	return w.appendBatch([]*walEntry{entry})
+}
+
+// appendBatch writes several entries with a single fsync.
+func (w *wal) appendBatch(entries []*walEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var frames []byte
+	seq := w.seq
+	for _, entry := range entries {
+		seq++
+		entry.Seq = seq
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("error marshaling wal entry: %w", err)
+		}
+
+		frame := make([]byte, walFrameHeaderSize+len(payload))
+		binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+		copy(frame[walFrameHeaderSize:], payload)
+		frames = append(frames, frame...)
+	}
+
+	if _, err := w.file.WriteAt(frames, w.size); err != nil {
+		return fmt.Errorf("error writing wal entry: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing wal: %w", err)
+	}
+
+	w.size += int64(len(frames))
+	w.seq = seq
+	return nil
+}
+
+// readAll returns every intact entry in the log. Reading stops at the first
+// short or corrupt frame, which is what a crash in the middle of append leaves.
+func (w *wal) readAll() ([]walEntry, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	reader := bufio.NewReader(io.NewSectionReader(w.file, 0, w.size))
+	header := make([]byte, walFrameHeaderSize)
+
+	var entries []walEntry
+	var valid int64
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+		if int64(length) > w.size-valid-walFrameHeaderSize {
+			break
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+
+		var entry walEntry
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			break
+		}
+
+		entries = append(entries, entry)
+		valid += walFrameHeaderSize + int64(length)
+		if entry.Seq > w.seq {
+			w.seq = entry.Seq
+		}
+	}
+
+	if valid < w.size {
+		fmt.Printf("collection_manager: discarding %d bytes of torn wal tail in %s\n", w.size-valid, w.path)
+		if err := w.file.Truncate(valid); err != nil {
+			return nil, fmt.Errorf("error truncating torn wal tail: %w", err)
+		}
+		w.size = valid
+	}
+
+	return entries, nil
+}
+
+// checkpoint empties the log. Callers must make sure every logged entry has
+// already been applied to durable storage.
+func (w *wal) checkpoint() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size == 0 {
+		return nil
+	}
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating wal: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing wal: %w", err)
+	}
+
+	w.size = 0
+	return nil
+}
+
+func (w *wal) length() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// ---
+// Recovery and checkpointing for the Manager.
+
+// replayWAL re-applies every logged entry to the item files. Entries are
+// idempotent: creates and updates rewrite the whole item, and deletes of a
+// missing file are ignored. Transaction entries are held back until their
+// commit entry, and dropped if the transaction never reached its commit point.
+// Aborted entries are skipped.
+func (m *Manager[T]) replayWAL() error {
+	entries, err := m.wal.readAll()
+	if err != nil {
+		return err
+	}
+
+	aborted := make(map[uint64]bool)
+	for _, entry := range entries {
+		if entry.Op == walOpAbort {
+			aborted[entry.Aborts] = true
+		}
+	}
+
+	pending := make(map[uuid.UUID][]walEntry)
+	var order []uuid.UUID
+
+	for _, entry := range entries {
+		switch {
+		case entry.Op == walOpAbort || aborted[entry.Seq]:
+		case entry.Op == walOpCommit:
+			for _, staged := range pending[entry.TxID] {
+				if err := m.applyWALEntry(staged); err != nil {
+					return fmt.Errorf("error replaying wal entry %d: %w", staged.Seq, err)
+				}
+			}
+			delete(pending, entry.TxID)
+		case entry.TxID != uuid.Nil:
+			if _, ok := pending[entry.TxID]; !ok {
+				order = append(order, entry.TxID)
+			}
+			pending[entry.TxID] = append(pending[entry.TxID], entry)
+		default:
+			if err := m.applyWALEntry(entry); err != nil {
+				return fmt.Errorf("error replaying wal entry %d: %w", entry.Seq, err)
+			}
+		}
+	}
+
+	// Transactions without a local commit entry still count as committed
+	// when their coordinator recorded the decision before the crash.
+	for _, txID := range order {
+		staged, ok := pending[txID]
+		if !ok {
+			continue
+		}
+		if !txDecided(staged[0].Coordinator, txID) {
+			fmt.Printf("collection_manager: discarding uncommitted transaction %s in %s\n", txID, m.baseDir)
+			continue
+		}
+		for _, entry := range staged {
+			if err := m.applyWALEntry(entry); err != nil {
+				return fmt.Errorf("error replaying wal entry %d: %w", entry.Seq, err)
+			}
+		}
+	}
+
+	if len(entries) > 0 {
+		fmt.Printf("collection_manager: replayed %d wal entries in %s\n", len(entries), m.baseDir)
+	}
+	return nil
+}
+
+func (m *Manager[T]) applyWALEntry(entry walEntry) error {
+	switch entry.Op {
+	case walOpCreate, walOpUpdate:
+		data, err := m.walItem(entry)
+		if err != nil {
+			return err
+		}
+		var item T
+		if err := json.Unmarshal(data, &item); err != nil {
+			return err
+		}
+		return m.writeItemToDisk(item)
+	case walOpDelete:
+		return m.removeItemFile(entry.ID)
+	default:
+		return fmt.Errorf("unknown wal op %q", entry.Op)
+	}
+}
+
+// logChange appends a mutation to the write-ahead log before it is applied,
+// and returns the sequence number of its entry.
+func (m *Manager[T]) logChange(op walOp, id uuid.UUID, item T) (uint64, error) {
+	entry := &walEntry{Op: op, ID: id}
+	if op != walOpDelete {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return 0, err
+		}
+		if entry.Data, err = m.walData(id, data); err != nil {
+			return 0, err
+		}
+	}
+	if err := m.wal.append(entry); err != nil {
+		return 0, err
+	}
+	return entry.Seq, nil
+}
+
+// abortChange cancels the logged change numbered seq after applying it
+// failed with err, so replay does not apply it either, and returns err.
+func (m *Manager[T]) abortChange(seq uint64, err error) error {
+	if abortErr := m.wal.append(&walEntry{Op: walOpAbort, Aborts: seq}); abortErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to abort wal entry %d, it will be applied on restart: %w", seq, abortErr))
+	}
+	return err
+}
+
+// Checkpoint flushes the directory entries of applied items to disk and
+// empties the write-ahead log. It waits for in-flight writes to finish.
+func (m *Manager[T]) Checkpoint() error {
+	m.walGate.Lock()
+	defer m.walGate.Unlock()
+	return m.checkpoint()
+}
+
+// Pause checkpoints the write-ahead log and holds every write back until
+// resume is called, a background reshard or re-encryption included, so the
+// files of the collection do not change meanwhile. Reads go on.
+func (m *Manager[T]) Pause() (resume func(), err error) {
+	m.walGate.Lock()
+	if err := m.checkpoint(); err != nil {
+		m.walGate.Unlock()
+		return nil, err
+	}
+	return m.walGate.Unlock, nil
+}
+
+func (m *Manager[T]) checkpoint() error {
+	if err := m.syncDirs(); err != nil {
+		return fmt.Errorf("error syncing directory: %w", err)
+	}
+	return m.wal.checkpoint()
+}
+
+// maybeCheckpoint checkpoints once the log has grown past walCheckpointSize.
+// It never waits: if other writers are active the next change tries again.
+func (m *Manager[T]) maybeCheckpoint() {
+	if m.wal.length() < walCheckpointSize {
+		return
+	}
+	if !m.walGate.TryLock() {
+		return
+	}
+	defer m.walGate.Unlock()
+
+	if err := m.checkpoint(); err != nil {
+		fmt.Printf("collection_manager: checkpoint failed in %s: %v\n", m.baseDir, err)
+	}
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,178 @@
+package collection_manager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func TestWALReplay(t *testing.T) {
+
+	dir := t.TempDir()
+
+	manager, err := New[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := &message.Message{ID: uuid.New(), Caption: "kept"}
+	if _, err := manager.Create(kept); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash: changes reach the log but never the item files.
+	lost := &message.Message{ID: uuid.New(), Caption: "only in wal"}
+	if _, err := manager.logChange(walOpCreate, lost.ID, lost); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.logChange(walOpDelete, kept.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	manager.wal.close()
+
+	recovered, err := New[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+
+	if _, err := recovered.Read(kept.ID); err == nil {
+		t.Errorf("deleted item %s survived recovery", kept.ID)
+	}
+	got, err := recovered.Read(lost.ID)
+	if err != nil {
+		t.Fatalf("logged item was not recovered: %v", err)
+	}
+	if got.Caption != lost.Caption {
+		t.Errorf("caption = %q, want %q", got.Caption, lost.Caption)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("wal size after checkpoint = %d, want 0", info.Size())
+	}
+}
+
+// TestWALAbortedWrite checks that a change which failed after it was logged
+// is not applied on recovery.
+func TestWALAbortedWrite(t *testing.T) {
+
+	dir := t.TempDir()
+
+	manager, err := New[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A non-empty directory at the item path makes the write fail.
+	failed := &message.Message{ID: uuid.New(), Caption: "failed"}
+	blocker := manager.itemPath(failed.ID)
+	if err := os.MkdirAll(filepath.Join(blocker, "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Create(failed); err == nil {
+		t.Fatal("create over a directory succeeded")
+	}
+	manager.wal.close()
+
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(blocker + ".tmp")
+
+	recovered, err := New[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+
+	if _, err := recovered.Read(failed.ID); err == nil {
+		t.Errorf("failed create of %s was applied on recovery", failed.ID)
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+
+	dir := t.TempDir()
+
+	manager, err := New[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &message.Message{ID: uuid.New(), Caption: "before tear"}
+	if _, err := manager.logChange(walOpCreate, msg.ID, msg); err != nil {
+		t.Fatal(err)
+	}
+	manager.wal.close()
+
+	// A half-written frame at the end of the log must be ignored.
+	file, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte{0xff, 0x00, 0x00, 0x00, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	recovered, err := New[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+
+	if recovered.Count() != 1 {
+		t.Errorf("count = %d, want 1", recovered.Count())
+	}
+}
+
+// TestPause checks that a paused collection has an empty log and holds
+// writes back until it is resumed.
+func TestPause(t *testing.T) {
+
+	dir := t.TempDir()
+	manager, err := New[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	if _, err := manager.Create(&message.Message{ID: uuid.New()}); err != nil {
+		t.Fatal(err)
+	}
+
+	resume, err := manager.Pause()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Fatalf("wal size while paused = %d, want 0", info.Size())
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := manager.Create(&message.Message{ID: uuid.New()})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("write went through while paused: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	resume()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
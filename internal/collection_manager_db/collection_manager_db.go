@@ -2,16 +2,19 @@ package collection_manager_db
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
 	"sync"
 
 	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/version"
 )
 
 const (
@@ -22,21 +25,32 @@ const (
 
 // FileHandler is a struct for managing resources
 type FileHandler struct {
-	file  *os.File
-	index map[uuid.UUID]int64 // Map UUID to the data file offset
-	mu    sync.RWMutex
+	file      *os.File
+	index     map[uuid.UUID]int64 // Map UUID to the data file offset
+	mu        sync.RWMutex
+	indexPath string
 }
 
 // NewFileHandler opens/creates the data and index files
 func NewFileHandler() (*FileHandler, error) {
-	file, err := os.OpenFile(dataFileName, os.O_RDWR|os.O_CREATE, 0644)
+	return NewFileHandlerAt(".")
+}
+
+// NewFileHandlerAt opens/creates the data and index files in dir.
+func NewFileHandlerAt(dir string) (*FileHandler, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, dataFileName), os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("error opening data file: %w", err)
 	}
 
 	handler := &FileHandler{
-		file:  file,
-		index: make(map[uuid.UUID]int64),
+		file:      file,
+		index:     make(map[uuid.UUID]int64),
+		indexPath: filepath.Join(dir, indexFileName),
 	}
 
 	// Load the index from disk
@@ -62,7 +76,7 @@ func (h *FileHandler) saveIndex() error {
 	if err != nil {
 		return fmt.Errorf("error serializing index: %w", err)
 	}
-	return os.WriteFile(indexFileName, data, 0644)
+	return os.WriteFile(h.indexPath, data, 0644)
 }
 
 // loadIndex loads the index from the JSON file
@@ -70,7 +84,7 @@ func (h *FileHandler) loadIndex() {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	data, err := os.ReadFile(indexFileName)
+	data, err := os.ReadFile(h.indexPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Println("Index file does not exist, creating a new index.")
@@ -86,28 +100,34 @@ func (h *FileHandler) loadIndex() {
 
 // WriteRecord writes a new record and returns a UUID
 func (h *FileHandler) WriteRecord(data []byte) (uuid.UUID, error) {
+	// Create a Version 7 UUID
+	u, err := uuid.NewV7()
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("error creating Version 7 UUID: %w", err)
+	}
+
+	if err := h.WriteRecordID(u, data); err != nil {
+		return uuid.Nil, err
+	}
+	return u, nil
+}
+
+// WriteRecordID appends a record under the given UUID. An existing record
+// with the same UUID is replaced; its old block is left unused in the file.
+func (h *FileHandler) WriteRecordID(u uuid.UUID, data []byte) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	if len(data) > recordSize {
-		return uuid.Nil, fmt.Errorf("data size is larger than max record size (2KB)")
+		return fmt.Errorf("data size is larger than max record size (2KB)")
 	}
 
 	// Seek to the end of the file to write the new record
 	offset, err := h.file.Seek(0, io.SeekEnd)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("error seeking to end of file: %w", err)
-	}
-
-	// Create a Version 7 UUID
-	u, err := uuid.NewV7()
-	if err != nil {
-		return uuid.Nil, fmt.Errorf("error creating Version 7 UUID: %w", err)
+		return fmt.Errorf("error seeking to end of file: %w", err)
 	}
 
-	// Store the offset in the index
-	h.index[u] = offset
-
 	// Create a 2KB buffer
 	recordBuffer := make([]byte, recordSize)
 	copy(recordBuffer, data)
@@ -115,10 +135,25 @@ func (h *FileHandler) WriteRecord(data []byte) (uuid.UUID, error) {
 
 	// Write the full buffer to the data file
 	if _, err := h.file.Write(recordBuffer); err != nil {
-		return uuid.Nil, fmt.Errorf("error writing record: %w", err)
+		return fmt.Errorf("error writing record: %w", err)
 	}
 
-	return u, nil
+	// Store the offset in the index once the record is written
+	h.index[u] = offset
+	return nil
+}
+
+// DeleteRecord removes a record from the index. Its block is left unused in
+// the data file.
+func (h *FileHandler) DeleteRecord(recordUUID uuid.UUID) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.index[recordUUID]; !ok {
+		return fmt.Errorf("UUID not found: %s", recordUUID)
+	}
+	delete(h.index, recordUUID)
+	return nil
 }
 
 // ReadRecord reads a record by its UUID
@@ -227,6 +262,28 @@ func (r *registry[T]) readAll() []T {
 	return result
 }
 
+// readFrom returns the items whose key is from or after it, in key order.
+func (r *registry[T]) readFrom(from uuid.UUID) []T {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]uuid.UUID, 0, len(r.items))
+	for key := range r.items {
+		if bytes.Compare(key[:], from[:]) >= 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+
+	result := make([]T, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, r.items[key])
+	}
+	return result
+}
+
 func (r *registry[T]) update(key uuid.UUID, newValue T) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -271,8 +328,13 @@ type Manager[T collectionItem] struct {
 
 // New creates a new instance of Manager.
 func New[T collectionItem]() (*Manager[T], error) {
+	return NewAt[T](".")
+}
 
-	fh, err := NewFileHandler()
+// NewAt creates a new instance of Manager for the collection stored in dir.
+func NewAt[T collectionItem](dir string) (*Manager[T], error) {
+
+	fh, err := NewFileHandlerAt(dir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file handler: %w", err)
 	}
@@ -310,6 +372,22 @@ func (m *Manager[T]) Create(newItem T) (T, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	// Keep an ID set by the caller, otherwise create a Version 7 UUID
+	id := newItem.GetID()
+	if id == uuid.Nil {
+		var err error
+		if id, err = uuid.NewV7(); err != nil {
+			var zero T
+			return zero, fmt.Errorf("error creating Version 7 UUID: %w", err)
+		}
+		newItem.SetID(id)
+	} else if _, err := m.items.read(id); err == nil {
+		var zero T
+		return zero, fmt.Errorf("item with ID %s already exists", id)
+	}
+
+	version.Init(newItem)
+
 	// Marshal the item to JSON
 	data, err := json.Marshal(newItem)
 	if err != nil {
@@ -318,14 +396,12 @@ func (m *Manager[T]) Create(newItem T) (T, error) {
 	}
 
 	// Write to file
-	id, err := m.fh.WriteRecord(data)
-	if err != nil {
+	if err := m.fh.WriteRecordID(id, data); err != nil {
 		var zero T
 		return zero, fmt.Errorf("error writing record: %w", err)
 	}
 
-	// Set the ID and store in memory
-	newItem.SetID(id)
+	// Store in memory
 	m.items.create(id, newItem)
 
 	return newItem, nil
@@ -345,45 +421,98 @@ func (m *Manager[T]) ReadAll() ([]T, error) {
 	return m.items.readAll(), nil
 }
 
-// Update an existing item in the collection.
+// Iterate calls fn for every item in the collection in ID order until fn
+// returns false or ctx is cancelled.
+func (m *Manager[T]) Iterate(ctx context.Context, fn func(item T) bool) error {
+	return m.IterateFrom(ctx, uuid.Nil, fn)
+}
+
+// IterateFrom calls fn for every item whose ID is from or after it, in ID
+// order, until fn returns false or ctx is cancelled.
+func (m *Manager[T]) IterateFrom(ctx context.Context, from uuid.UUID, fn func(item T) bool) error {
+	m.mu.RLock()
+	items := m.items.readFrom(from)
+	m.mu.RUnlock()
+
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !fn(item) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Update an existing item in the collection. Items that carry a version
+// must be based on the stored one, which is then incremented; a failed
+// update keeps the version it had.
 func (m *Manager[T]) Update(updatedItem T) (T, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	id := updatedItem.GetID()
+	if _, err := m.items.read(id); err != nil {
+		var zero T
+		return zero, fmt.Errorf("item with ID %s not found", id)
+	}
+
+	// Callers may have changed the item they read in place, so the version
+	// is checked against the record as stored rather than the registry.
+	current, err := m.readStored(id)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	if err := version.Check(id, current, updatedItem); err != nil {
+		var zero T
+		return zero, err
+	}
+	previous := version.Bump(updatedItem)
 
 	// Marshal the updated item to JSON
 	data, err := json.Marshal(updatedItem)
 	if err != nil {
+		version.Reset(updatedItem, previous)
 		var zero T
 		return zero, fmt.Errorf("error marshaling item: %w", err)
 	}
 
-	// Write to file (this will create a new record)
-	newID, err := m.fh.WriteRecord(data)
-	if err != nil {
+	// Write to file (this appends a new record under the same ID)
+	if err := m.fh.WriteRecordID(id, data); err != nil {
+		version.Reset(updatedItem, previous)
 		var zero T
 		return zero, fmt.Errorf("error writing record: %w", err)
 	}
 
-	// Update the ID if it changed
-	if newID != id {
-		updatedItem.SetID(newID)
-		m.items.delete(id)
-	}
-
-	m.items.create(newID, updatedItem)
+	m.items.update(id, updatedItem)
 	return updatedItem, nil
 }
 
+// readStored decodes the record of an item from disk.
+func (m *Manager[T]) readStored(id uuid.UUID) (T, error) {
+	var item T
+	data, err := m.fh.ReadRecord(id)
+	if err != nil {
+		return item, fmt.Errorf("error reading record: %w", err)
+	}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return item, fmt.Errorf("error unmarshaling record %s: %w", id, err)
+	}
+	return item, nil
+}
+
 // Delete an item from the collection by its ID.
 func (m *Manager[T]) Delete(id uuid.UUID) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Note: This only removes from memory, not from the data file
-	// To fully remove from disk, we would need to implement a deletion mechanism
-	// in the FileHandler that can handle record deletion and compaction
+	// The record is dropped from the index; its block stays in the data
+	// file until the file is rewritten.
+	if err := m.fh.DeleteRecord(id); err != nil {
+		return err
+	}
 	m.items.delete(id)
 	return nil
 }
@@ -3,6 +3,7 @@ package collection_manager_db
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -122,3 +123,36 @@ func TestReadMessages(t *testing.T) {
 
 	fmt.Println(msg.Caption)
 }
+
+// TestUpdateFailedWrite checks that an update that fails to be written
+// keeps the version of the item, so that retrying it does not conflict.
+func TestUpdateFailedWrite(t *testing.T) {
+
+	db, err := NewAt[*message.Message](t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	msg, err := db.Create(&message.Message{Caption: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A record larger than a slot cannot be written.
+	msg.Caption = strings.Repeat("x", 1<<20)
+	if _, err := db.Update(msg); err == nil {
+		t.Fatal("update of an oversized record succeeded")
+	}
+	if msg.Version != "1" {
+		t.Fatalf("version after a failed update = %q, want 1", msg.Version)
+	}
+
+	msg.Caption = "second"
+	if _, err := db.Update(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Version != "2" {
+		t.Fatalf("version after update = %q, want 2", msg.Version)
+	}
+}
@@ -2,17 +2,21 @@ package collection_manager_generic_index
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"sync"
 
 	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+	"github.com/mahdi-cpp/messages-api/internal/version"
 )
 
 const (
@@ -23,8 +27,9 @@ const (
 )
 
 const (
-	StatusActive  = 0x00
-	StatusDeleted = 0x01
+	StatusActive   = 0x00
+	StatusDeleted  = 0x01
+	StatusOverflow = 0x02
 )
 
 type collectionItem interface {
@@ -45,16 +50,44 @@ type FileHandler struct {
 	mu        sync.RWMutex
 	dataPath  string
 	indexPath string
+	// indexStale is set when index.db had to be reset and must be rebuilt
+	// from data.db, for example after migrating a legacy data file.
+	indexStale bool
+	// free and freeIndex hold reusable data pages and index slots, sorted so
+	// the lowest offsets are reused first and the files can shrink from the end.
+	free      []int64
+	freeIndex []int64
+	// chains maps the head page of every record to all of its pages, and
+	// owners maps every page in use back to its head page.
+	chains map[int64][]int64
+	owners map[int64]int64
+	// dataMap and indexMap read the files, through a memory map when
+	// WithMmap is set, see mmap.go.
+	dataMap  *mappedFile
+	indexMap *mappedFile
+
+	// Writes of new records and index slots go through the group-commit
+	// writer, see groupcommit.go.
+	opts       options
+	requests   chan *writeRequest
+	closing    chan struct{}
+	closeOnce  sync.Once
+	writerDone chan struct{}
 }
 
 func NewFileHandler() (*FileHandler, error) {
+	return NewFileHandlerAt(dirName)
+}
+
+// NewFileHandlerAt opens or creates data.db and index.db in dir.
+func NewFileHandlerAt(dir string, opts ...Option) (*FileHandler, error) {
 
-	if err := os.MkdirAll(dirName, os.ModePerm); err != nil {
-		return nil, fmt.Errorf("error creating directory %s: %w", dirName, err)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating directory %s: %w", dir, err)
 	}
 
-	dataFileName := filepath.Join(dirName, "data.db")
-	indexFileName := filepath.Join(dirName, "index.db")
+	dataFileName := filepath.Join(dir, "data.db")
+	indexFileName := filepath.Join(dir, "index.db")
 
 	dataFile, err := os.OpenFile(dataFileName, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
@@ -67,18 +100,58 @@ func NewFileHandler() (*FileHandler, error) {
 		return nil, fmt.Errorf("error opening index file: %w", err)
 	}
 
-	return &FileHandler{
-		dataFile:  dataFile,
-		indexFile: indexFile,
-		dataPath:  dataFileName,
-		indexPath: indexFileName,
-	}, nil
+	h := &FileHandler{
+		dataFile:   dataFile,
+		indexFile:  indexFile,
+		dataPath:   dataFileName,
+		indexPath:  indexFileName,
+		chains:     make(map[int64][]int64),
+		owners:     make(map[int64]int64),
+		opts:       options{batchSize: defaultBatchSize, maxDelay: defaultMaxDelay},
+		requests:   make(chan *writeRequest),
+		closing:    make(chan struct{}),
+		writerDone: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&h.opts)
+	}
+
+	if err := h.prepareFormat(); err != nil {
+		h.dataFile.Close()
+		h.indexFile.Close()
+		return nil, err
+	}
+
+	if h.opts.mmap {
+		h.dataMap, h.indexMap = mapFile(h.dataFile), mapFile(h.indexFile)
+	} else {
+		h.dataMap, h.indexMap = &mappedFile{file: h.dataFile}, &mappedFile{file: h.indexFile}
+	}
+
+	if err := h.loadPages(); err != nil {
+		h.dataMap.unmap()
+		h.indexMap.unmap()
+		h.dataFile.Close()
+		h.indexFile.Close()
+		return nil, err
+	}
+
+	go h.runWriter()
+	return h, nil
 }
 
+// Close stops the writer, after the batch it is committing, and closes the
+// files. Writes waiting for the writer fail with ErrClosed.
 func (h *FileHandler) Close() error {
+	h.closeOnce.Do(func() { close(h.closing) })
+	<-h.writerDone
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	h.dataMap.unmap()
+	h.indexMap.unmap()
+
 	var errs []error
 	if err := h.dataFile.Close(); err != nil {
 		errs = append(errs, fmt.Errorf("error closing data file: %w", err))
@@ -94,77 +167,191 @@ func (h *FileHandler) Close() error {
 	return nil
 }
 
+// WriteRecord stores data of any length and returns the offset of its head
+// page once it is synced to disk.
 func (h *FileHandler) WriteRecord(data []byte) (int64, error) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+	if len(data) > maxRecordLength {
+		return -1, fmt.Errorf("data size is larger than max record size (%d bytes)", maxRecordLength)
+	}
+	return h.submit(&writeRequest{data: data})
+}
 
-	if len(data) > recordSize-recordStatusSize {
-		return -1, fmt.Errorf("data size is larger than max record size (%d bytes)", recordSize-recordStatusSize)
+// writeRecord writes a record directly, without syncing it. Callers hold
+// h.mu or have not started the writer yet.
+func (h *FileHandler) writeRecord(data []byte) (int64, error) {
+	if len(data) > maxRecordLength {
+		return -1, fmt.Errorf("data size is larger than max record size (%d bytes)", maxRecordLength)
 	}
 
-	offset, err := h.dataFile.Seek(0, io.SeekEnd)
+	offsets, err := h.allocatePages(pagesFor(len(data)))
 	if err != nil {
-		return -1, fmt.Errorf("error seeking to end of data file: %w", err)
+		return -1, err
 	}
 
-	recordBuffer := make([]byte, recordSize)
-	recordBuffer[0] = StatusActive
-	copy(recordBuffer[recordStatusSize:], data)
-
-	if _, err := h.dataFile.Write(recordBuffer); err != nil {
+	if err := h.writeChain(offsets, data); err != nil {
+		h.releasePages(offsets)
 		return -1, fmt.Errorf("error writing record: %w", err)
 	}
 
-	return offset, nil
+	h.trackChain(offsets)
+	return offsets[0], nil
 }
 
-func (h *FileHandler) ReadRecord(offset int64) ([]byte, error) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// allocatePages reserves n pages, reusing free pages before growing the
+// data file. The pages of a chain do not need to be contiguous.
+func (h *FileHandler) allocatePages(n int) ([]int64, error) {
+	end := int64(-1)
+	return h.allocatePagesFrom(n, &end)
+}
 
-	if offset < 0 {
-		return nil, fmt.Errorf("invalid offset: %d", offset)
+// allocatePagesFrom is allocatePages for a batch of records allocated before
+// any of them is written. *end is the end of the data file including the
+// pages already handed out; it is read from the file while negative.
+func (h *FileHandler) allocatePagesFrom(n int, end *int64) ([]int64, error) {
+	offsets := h.takeFree(n)
+	if len(offsets) == n {
+		return offsets, nil
 	}
 
-	recordBuffer := make([]byte, recordSize)
-	n, err := h.dataFile.ReadAt(recordBuffer, offset)
-	if err != nil && err != io.EOF {
-		return nil, fmt.Errorf("error reading block from data file at offset %d: %w", offset, err)
+	if *end < 0 {
+		size, err := h.dataFile.Seek(0, io.SeekEnd)
+		if err != nil {
+			h.releasePages(offsets)
+			return nil, fmt.Errorf("error seeking to end of data file: %w", err)
+		}
+		*end = size
+	}
+
+	for len(offsets) < n {
+		offsets = append(offsets, *end)
+		*end += pageSize
 	}
+	return offsets, nil
+}
 
-	if n == 0 {
-		return nil, fmt.Errorf("no data read at offset %d", offset)
+// writeChain writes data across the given pages. Overflow pages are written
+// before the head page, so a head page never points at unwritten pages.
+func (h *FileHandler) writeChain(offsets []int64, data []byte) error {
+	pages := encodeChain(offsets, data)
+	for i := len(pages) - 1; i >= 0; i-- {
+		if _, err := h.dataFile.WriteAt(pages[i].data, pages[i].offset); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// encodeChain returns the pages storing data at the given offsets.
+func encodeChain(offsets []int64, data []byte) []pageWrite {
+	pages := make([]pageWrite, len(offsets))
+	for i := range offsets {
+		start := i * pagePayloadSize
+		end := start + pagePayloadSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[start:end]
 
-	if recordBuffer[0] == StatusDeleted {
-		return nil, fmt.Errorf("record at offset %d is marked as deleted", offset)
+		var next int64
+		if i+1 < len(offsets) {
+			next = offsets[i+1]
+		}
+
+		var page []byte
+		if i == 0 {
+			page = encodePage(StatusActive, len(data), next, checksum(data), chunk)
+		} else {
+			page = encodePage(StatusOverflow, len(chunk), next, 0, chunk)
+		}
+		pages[i] = pageWrite{offset: offsets[i], data: page}
 	}
+	return pages
+}
 
-	dataLength := bytes.IndexByte(recordBuffer[recordStatusSize:], 0)
-	if dataLength == -1 {
-		dataLength = recordSize - recordStatusSize
-	} else if dataLength == 0 {
-		return nil, fmt.Errorf("empty data at offset %d", offset)
+// readChain reads the record whose head page is at offset and returns its
+// data together with the offsets of every page it occupies. The data is
+// checked against the checksum stored in the head page. It may be a slice
+// of the memory map, valid only while h.mu is held.
+func (h *FileHandler) readChain(offset int64) ([]byte, []int64, error) {
+	data, pages, head, err := readChainAt(h.dataMap, offset, pageHeaderSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if checksum(data) != head.crc {
+		return nil, nil, fmt.Errorf("record at offset %d: %w", offset, ErrChecksumMismatch)
 	}
+	return data, pages, nil
+}
+
+// ReadRecord returns a copy of the data of the record at offset.
+func (h *FileHandler) ReadRecord(offset int64) ([]byte, error) {
+	var data []byte
+	err := h.ViewRecord(offset, func(view []byte) error {
+		data = bytes.Clone(view)
+		return nil
+	})
+	return data, err
+}
+
+// ViewRecord calls fn with the data of the record at offset. With
+// memory-mapped reads a record on a single page is passed without being
+// copied, so fn must not keep data after it returns.
+func (h *FileHandler) ViewRecord(offset int64, fn func(data []byte) error) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 
-	return recordBuffer[recordStatusSize : recordStatusSize+dataLength], nil
+	data, _, err := h.readChain(offset)
+	if err != nil {
+		return err
+	}
+	return fn(data)
 }
 
+// UpdateRecord rewrites the record at offset in place. The head page keeps
+// its offset; the chain grows with newly allocated pages or releases the
+// pages it no longer needs.
 func (h *FileHandler) UpdateRecord(offset int64, data []byte) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if len(data) > recordSize-recordStatusSize {
-		return fmt.Errorf("data size is larger than max record size (%d bytes)", recordSize-recordStatusSize)
+	if len(data) > maxRecordLength {
+		return fmt.Errorf("data size is larger than max record size (%d bytes)", maxRecordLength)
 	}
 
-	recordBuffer := make([]byte, recordSize)
-	recordBuffer[0] = StatusActive
-	copy(recordBuffer[recordStatusSize:], data)
+	_, pages, err := h.readChain(offset)
+	if err != nil {
+		return fmt.Errorf("error updating record in data file: %w", err)
+	}
 
-	if _, err := h.dataFile.WriteAt(recordBuffer, offset); err != nil {
+	var released []int64
+	need := pagesFor(len(data))
+	grown := need > len(pages)
+	if grown {
+		extra, err := h.allocatePages(need - len(pages))
+		if err != nil {
+			return err
+		}
+		pages = append(pages, extra...)
+	} else if need < len(pages) {
+		released = pages[need:]
+		pages = pages[:need]
+	}
+
+	if err := h.writeChain(pages, data); err != nil {
 		return fmt.Errorf("error updating record in data file: %w", err)
 	}
+	if grown {
+		h.dataMap.remap()
+	}
+
+	// Pages dropped from the chain are released only once the head page no
+	// longer points at them.
+	h.untrackChain(offset)
+	h.trackChain(pages)
+	if err := h.markPages(released, StatusDeleted); err != nil {
+		return fmt.Errorf("error releasing overflow pages: %w", err)
+	}
+	h.releasePages(released)
 
 	return nil
 }
@@ -173,43 +360,77 @@ func (h *FileHandler) DeleteRecord(offset int64) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if _, err := h.dataFile.WriteAt([]byte{StatusDeleted}, offset); err != nil {
+	_, pages, err := h.readChain(offset)
+	if err != nil {
+		// Fall back to flagging the head page, as a broken chain cannot be walked.
+		pages = []int64{offset}
+	}
+
+	if err := h.markPages(pages, StatusDeleted); err != nil {
 		return fmt.Errorf("error marking record as deleted: %w", err)
 	}
+
+	h.untrackChain(offset)
+	h.releasePages(pages)
 	return nil
 }
 
-func (h *FileHandler) WriteIndexRecord(id uuid.UUID, offset int64, indexData []byte) (int64, error) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+func (h *FileHandler) markPages(pages []int64, status byte) error {
+	for _, page := range pages {
+		if _, err := h.dataFile.WriteAt([]byte{status}, page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if len(indexData) > indexRecordSize-26 {
+// WriteIndexRecord stores the index slot of the record id at offset and
+// returns the offset of the slot once it is synced to disk.
+func (h *FileHandler) WriteIndexRecord(id uuid.UUID, offset int64, indexData []byte) (int64, error) {
+	if len(indexData) > maxIndexDataSize {
 		return -1, fmt.Errorf("index data size exceeds maximum allowed size")
 	}
+	return h.submit(&writeRequest{index: true, id: id, offset: offset, data: indexData})
+}
 
-	position, err := h.indexFile.Seek(0, io.SeekEnd)
-	if err != nil {
-		return -1, fmt.Errorf("error seeking to end of index file: %w", err)
+// allocateIndexSlot reserves an index slot, reusing free slots before
+// growing the index file. *end works as in allocatePagesFrom.
+func (h *FileHandler) allocateIndexSlot(end *int64) (int64, error) {
+	if slot, ok := h.takeIndexSlot(); ok {
+		return slot, nil
 	}
 
-	record := make([]byte, indexRecordSize)
-	copy(record[0:16], id[:])
-	binary.LittleEndian.PutUint64(record[16:24], uint64(offset))
-	binary.LittleEndian.PutUint16(record[24:26], uint16(len(indexData)))
-	copy(record[26:], indexData)
+	if *end < 0 {
+		size, err := h.indexFile.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -1, fmt.Errorf("error seeking to end of index file: %w", err)
+		}
+		*end = size
+	}
 
-	if _, err := h.indexFile.Write(record); err != nil {
-		return -1, fmt.Errorf("error writing index record: %w", err)
+	slot := *end
+	*end += indexRecordSize
+	return slot, nil
+}
+
+// DeleteIndexRecord clears the index slot at indexOffset and makes it reusable.
+func (h *FileHandler) DeleteIndexRecord(indexOffset int64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, err := h.indexFile.WriteAt(make([]byte, indexRecordSize), indexOffset); err != nil {
+		return fmt.Errorf("error deleting index record: %w", err)
 	}
 
-	return position, nil
+	h.releaseIndexSlot(indexOffset)
+	return nil
 }
 
 func (h *FileHandler) UpdateIndexRecord(indexOffset int64, id uuid.UUID, offset int64, indexData []byte) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if len(indexData) > indexRecordSize-26 {
+	if len(indexData) > maxIndexDataSize {
 		return fmt.Errorf("index data size exceeds maximum allowed size")
 	}
 
@@ -217,11 +438,7 @@ func (h *FileHandler) UpdateIndexRecord(indexOffset int64, id uuid.UUID, offset
 		return fmt.Errorf("error seeking to index offset %d: %w", indexOffset, err)
 	}
 
-	record := make([]byte, indexRecordSize)
-	copy(record[0:16], id[:])
-	binary.LittleEndian.PutUint64(record[16:24], uint64(offset))
-	binary.LittleEndian.PutUint16(record[24:26], uint16(len(indexData)))
-	copy(record[26:], indexData)
+	record := encodeIndexRecord(id, offset, indexData)
 
 	if _, err := h.indexFile.Write(record); err != nil {
 		return fmt.Errorf("error updating index record: %w", err)
@@ -236,10 +453,26 @@ type Manager[T collectionItem, I collectionItem] struct {
 	mu           sync.RWMutex
 	primaryIndex map[uuid.UUID]IndexEntry[I]
 	closed       bool
+	metrics      compactionStats
+	stop         chan struct{}
+	// pending holds the IDs of the items being created. Create writes
+	// without holding mu, so concurrent creates share group commits, and
+	// creates counts them so Close can wait for them.
+	pending map[uuid.UUID]struct{}
+	creates sync.WaitGroup
+	// cipher seals the records of data.db, see WithCipher.
+	cipher encryption.Cipher
 }
 
 func New[T collectionItem, I collectionItem]() (*Manager[T, I], error) {
-	fh, err := NewFileHandler()
+	return NewAt[T, I](dirName)
+}
+
+// NewAt opens the collection stored in dir. The options tune the
+// group-commit writer of its files, how they are read and whether records
+// are sealed.
+func NewAt[T collectionItem, I collectionItem](dir string, opts ...Option) (*Manager[T, I], error) {
+	fh, err := NewFileHandlerAt(dir, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file handler: %w", err)
 	}
@@ -247,33 +480,55 @@ func New[T collectionItem, I collectionItem]() (*Manager[T, I], error) {
 	manager := &Manager[T, I]{
 		fh:           fh,
 		primaryIndex: make(map[uuid.UUID]IndexEntry[I]),
+		stop:         make(chan struct{}),
+		pending:      make(map[uuid.UUID]struct{}),
+		cipher:       fh.opts.cipher,
 	}
 
 	if err := manager.loadPrimaryIndex(); err != nil {
 		return nil, fmt.Errorf("failed to load primary index: %w", err)
 	}
 
+	heads := make(map[int64]bool, len(manager.primaryIndex))
+	for _, entry := range manager.primaryIndex {
+		heads[entry.Offset] = true
+	}
+	if err := fh.releaseUnreferenced(heads); err != nil {
+		return nil, fmt.Errorf("failed to release unreferenced records: %w", err)
+	}
+
+	go manager.startCompactionRoutine()
+	if manager.cipher != nil {
+		go manager.reencryptInBackground()
+	}
 	return manager, nil
 }
 
 func (m *Manager[T, I]) Close() error {
 	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	if m.closed {
+		m.mu.Unlock()
 		return nil
 	}
 	m.closed = true
+	close(m.stop)
+	m.mu.Unlock()
 
+	m.creates.Wait()
 	return m.fh.Close()
 }
 
 func (m *Manager[T, I]) loadPrimaryIndex() error {
-	if _, err := os.Stat(filepath.Join(dirName, "index.db")); os.IsNotExist(err) {
+	if m.fh.indexStale {
+		m.fh.indexStale = false
 		return m.rebuildIndex()
 	}
 
 	indexMap, err := m.readAllIndexRecords()
+	if errors.Is(err, ErrChecksumMismatch) {
+		log.Printf("Corrupt index in %s, rebuilding from data file: %v", m.fh.indexPath, err)
+		return m.rebuildIndex()
+	}
 	if err != nil {
 		return fmt.Errorf("error reading index records: %w", err)
 	}
@@ -295,47 +550,42 @@ func (m *Manager[T, I]) readAllIndexRecords() (map[uuid.UUID]IndexEntry[I], erro
 
 	result := make(map[uuid.UUID]IndexEntry[I])
 
-	if _, err := m.fh.indexFile.Seek(0, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("error seeking to start of index file: %w", err)
+	info, err := m.fh.indexFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error getting index file info: %w", err)
 	}
 
-	record := make([]byte, indexRecordSize)
-	currentOffset := int64(0)
-
-	for {
-		n, err := m.fh.indexFile.Read(record)
+	buf := make([]byte, indexRecordSize)
+	for currentOffset := int64(indexHeaderSize); currentOffset+indexRecordSize <= info.Size(); currentOffset += indexRecordSize {
+		record, _, err := m.fh.indexMap.view(currentOffset, indexRecordSize, buf)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
 			return nil, fmt.Errorf("error reading index record: %w", err)
 		}
 
-		if n < indexRecordSize {
-			break
+		id, dataOffset, data, err := decodeIndexRecord(record)
+		if err != nil {
+			return nil, fmt.Errorf("index record at offset %d: %w", currentOffset, err)
 		}
 
-		if record[0] == 0 {
-			currentOffset += indexRecordSize
+		if id == uuid.Nil {
+			m.fh.releaseIndexSlot(currentOffset)
 			continue
 		}
 
-		id, err := uuid.FromBytes(record[0:16])
-		if err != nil {
-			log.Printf("Error parsing UUID at offset %d: %v", currentOffset, err)
-			currentOffset += indexRecordSize
+		// A compaction interrupted between copying an index slot and clearing
+		// the old one leaves two slots for the same ID; the first one is kept.
+		if _, exists := result[id]; exists {
+			if _, err := m.fh.indexFile.WriteAt(make([]byte, indexRecordSize), currentOffset); err != nil {
+				log.Printf("Error clearing duplicate index record for ID %s at offset %d: %v", id, currentOffset, err)
+			} else {
+				m.fh.releaseIndexSlot(currentOffset)
+			}
 			continue
 		}
 
-		dataOffset := int64(binary.LittleEndian.Uint64(record[16:24]))
-		dataSize := binary.LittleEndian.Uint16(record[24:26])
-		data := make([]byte, dataSize)
-		copy(data, record[26:26+dataSize])
-
 		var indexData I
 		if err := json.Unmarshal(data, &indexData); err != nil {
 			log.Printf("Error unmarshaling index data for ID %s at offset %d: %v", id, currentOffset, err)
-			currentOffset += indexRecordSize
 			continue
 		}
 
@@ -344,8 +594,6 @@ func (m *Manager[T, I]) readAllIndexRecords() (map[uuid.UUID]IndexEntry[I], erro
 			IndexOffset: currentOffset,
 			IndexData:   indexData,
 		}
-
-		currentOffset += indexRecordSize
 	}
 
 	return result, nil
@@ -359,48 +607,62 @@ func (m *Manager[T, I]) rebuildIndex() error {
 	}
 	fileSize := fileInfo.Size()
 
-	if fileSize == 0 {
+	if fileSize <= dataHeaderSize {
 		log.Println("Data file is empty, no index to rebuild")
 		return nil
 	}
 
-	if err := m.fh.indexFile.Truncate(0); err != nil {
-		return fmt.Errorf("error truncating index file: %w", err)
-	}
-	if _, err := m.fh.indexFile.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("error seeking to start of index file: %w", err)
+	if err := m.fh.resetIndexFile(); err != nil {
+		return err
 	}
 
-	for offset := int64(0); offset < fileSize; offset += recordSize {
-		recordBuffer := make([]byte, recordSize)
-		n, err := m.fh.dataFile.ReadAt(recordBuffer, offset)
-		if err != nil && err != io.EOF {
-			log.Printf("Error reading record at offset %d: %v", offset, err)
-			continue
-		}
-
-		if n == 0 {
-			continue
+	// Index slots are written in batches of rebuildBatchSize, with one sync
+	// per batch instead of one per record. Entries are added to the primary
+	// index when queued and get their slot when the batch is written.
+	var batch []*writeRequest
+	flush := func() {
+		for i, res := range m.fh.commitNow(batch) {
+			id := batch[i].id
+			if res.err != nil {
+				log.Printf("Error writing index record for ID %s: %v", id, res.err)
+				delete(m.primaryIndex, id)
+				continue
+			}
+			entry := m.primaryIndex[id]
+			entry.IndexOffset = res.offset
+			m.primaryIndex[id] = entry
 		}
+		batch = batch[:0]
+	}
 
-		if recordBuffer[0] == StatusDeleted {
+	buf := make([]byte, recordStatusSize)
+	for offset := int64(dataHeaderSize); offset < fileSize; offset += pageSize {
+		status, _, err := m.fh.dataMap.view(offset, recordStatusSize, buf)
+		if err != nil {
+			log.Printf("Error reading record at offset %d: %v", offset, err)
 			continue
 		}
 
-		dataLength := bytes.IndexByte(recordBuffer[recordStatusSize:], 0)
-		if dataLength == -1 {
-			dataLength = recordSize - recordStatusSize
-		}
-
-		if dataLength == 0 {
+		// Only head pages start a record; deleted and overflow pages are skipped.
+		if status[0] != StatusActive {
 			continue
 		}
 
-		data := recordBuffer[recordStatusSize : recordStatusSize+dataLength]
-
 		var dataItem T
-		if err := json.Unmarshal(data, &dataItem); err != nil {
-			log.Printf("Error unmarshaling data at offset %d: %v", offset, err)
+		err = m.fh.ViewRecord(offset, func(data []byte) error {
+			data, err := m.open(uuid.Nil, data)
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(data, &dataItem); err != nil {
+				return fmt.Errorf("error unmarshaling data: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			// The record stays out of the index and is quarantined once the
+			// index is loaded.
+			log.Printf("Error reading record at offset %d: %v", offset, err)
 			continue
 		}
 
@@ -411,6 +673,11 @@ func (m *Manager[T, I]) rebuildIndex() error {
 		}
 
 		id := dataItem.GetID()
+		if _, exists := m.primaryIndex[id]; exists {
+			// An older copy left by an interrupted compaction; it is released
+			// as unreferenced once the index is loaded.
+			continue
+		}
 		if id != uuid.Nil {
 			indexData, err := json.Marshal(indexItem)
 			if err != nil {
@@ -418,19 +685,14 @@ func (m *Manager[T, I]) rebuildIndex() error {
 				continue
 			}
 
-			indexOffset, err := m.fh.WriteIndexRecord(id, offset, indexData)
-			if err != nil {
-				log.Printf("Error writing index record for ID %s: %v", id, err)
-				continue
-			}
-
-			m.primaryIndex[id] = IndexEntry[I]{
-				Offset:      offset,
-				IndexOffset: indexOffset,
-				IndexData:   indexItem,
+			batch = append(batch, &writeRequest{index: true, id: id, offset: offset, data: indexData})
+			m.primaryIndex[id] = IndexEntry[I]{Offset: offset, IndexData: indexItem}
+			if len(batch) == rebuildBatchSize {
+				flush()
 			}
 		}
 	}
+	flush()
 
 	log.Printf("Rebuilt primary index with %d entries", len(m.primaryIndex))
 	return nil
@@ -511,24 +773,62 @@ func createIndexItem[T, I any](dataItem T) (I, error) {
 }
 
 func (m *Manager[T, I]) Create(item T) (T, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	var zero T
+
+	m.mu.Lock()
 	if m.closed {
+		m.mu.Unlock()
 		return zero, fmt.Errorf("manager is closed")
 	}
 
-	id, err := uuid.NewV7()
+	// Keep an ID set by the caller, otherwise generate a UUID v7.
+	id := item.GetID()
+	if id == uuid.Nil {
+		var err error
+		if id, err = uuid.NewV7(); err != nil {
+			m.mu.Unlock()
+			return zero, fmt.Errorf("error generating UUID v7: %w", err)
+		}
+		item.SetID(id)
+	} else if _, exists := m.primaryIndex[id]; exists {
+		m.mu.Unlock()
+		return zero, fmt.Errorf("item with ID %s already exists", id)
+	} else if _, exists := m.pending[id]; exists {
+		m.mu.Unlock()
+		return zero, fmt.Errorf("item with ID %s already exists", id)
+	}
+	m.pending[id] = struct{}{}
+	m.creates.Add(1)
+	m.mu.Unlock()
+	defer m.creates.Done()
+
+	entry, err := m.writeNew(id, item)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pending, id)
 	if err != nil {
-		return zero, fmt.Errorf("error generating UUID v7: %w", err)
+		return zero, err
 	}
-	item.SetID(id)
+	m.primaryIndex[id] = entry
+
+	return item, nil
+}
+
+// writeNew stores the record and index slot of a new item. It runs without
+// m.mu, so the writes of concurrent creates are committed together.
+func (m *Manager[T, I]) writeNew(id uuid.UUID, item T) (IndexEntry[I], error) {
+	var zero IndexEntry[I]
+
+	version.Init(item)
 
 	data, err := json.Marshal(item)
 	if err != nil {
 		return zero, fmt.Errorf("error marshaling item: %w", err)
 	}
+	if data, err = m.seal(id, data); err != nil {
+		return zero, err
+	}
 
 	offset, err := m.fh.WriteRecord(data)
 	if err != nil {
@@ -553,16 +853,17 @@ func (m *Manager[T, I]) Create(item T) (T, error) {
 		return zero, fmt.Errorf("failed to write index record: %w", err)
 	}
 
-	m.primaryIndex[id] = IndexEntry[I]{
+	return IndexEntry[I]{
 		Offset:      offset,
 		IndexOffset: indexOffset,
 		IndexData:   indexItem,
-	}
-
-	return item, nil
+	}, nil
 }
 
-func (m *Manager[T, I]) Update(item T) (T, error) {
+// Update an existing item. Items that carry a version must be based on the
+// stored one, which is then incremented; a failed update keeps the version
+// it had.
+func (m *Manager[T, I]) Update(item T) (_ T, err error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -573,6 +874,22 @@ func (m *Manager[T, I]) Update(item T) (T, error) {
 		return zero, fmt.Errorf("item with ID %s does not exist", id.String())
 	}
 
+	if _, versioned := any(item).(version.Item); versioned {
+		current, readErr := m.readItem(id, entry.Offset)
+		if readErr != nil {
+			return zero, readErr
+		}
+		if conflict := version.Check(id, current, item); conflict != nil {
+			return zero, conflict
+		}
+		previous := version.Bump(item)
+		defer func() {
+			if err != nil {
+				version.Reset(item, previous)
+			}
+		}()
+	}
+
 	indexItem, err := createIndexItem[T, I](item)
 	if err != nil {
 		return zero, fmt.Errorf("failed to create index item: %w", err)
@@ -582,6 +899,9 @@ func (m *Manager[T, I]) Update(item T) (T, error) {
 	if err != nil {
 		return zero, fmt.Errorf("error marshaling item: %w", err)
 	}
+	if data, err = m.seal(id, data); err != nil {
+		return zero, err
+	}
 
 	if err := m.fh.UpdateRecord(entry.Offset, data); err != nil {
 		return zero, fmt.Errorf("error updating record: %w", err)
@@ -618,9 +938,8 @@ func (m *Manager[T, I]) Delete(id uuid.UUID) error {
 		return err
 	}
 
-	emptyRecord := make([]byte, indexRecordSize)
-	if _, err := m.fh.indexFile.WriteAt(emptyRecord, entry.IndexOffset); err != nil {
-		return fmt.Errorf("error deleting index record: %w", err)
+	if err := m.fh.DeleteIndexRecord(entry.IndexOffset); err != nil {
+		return err
 	}
 
 	delete(m.primaryIndex, id)
@@ -638,20 +957,96 @@ func (m *Manager[T, I]) Read(id uuid.UUID) (T, error) {
 		return zero, fmt.Errorf("item not found with ID: %s", id)
 	}
 
-	data, err := m.fh.ReadRecord(entry.Offset)
+	loadedItem, err := m.readItem(id, entry.Offset)
 	if err != nil {
-		return zero, fmt.Errorf("error reading item from disk: %w", err)
-	}
-
-	var loadedItem T
-	if err := json.Unmarshal(data, &loadedItem); err != nil {
-		return zero, fmt.Errorf("error unmarshaling item: %w", err)
+		return zero, err
 	}
 
 	loadedItem.SetID(id)
 	return loadedItem, nil
 }
 
+// readItem decodes the item id stored at offset. A plaintext record is
+// decoded where it lies in the memory map, without copying it first.
+func (m *Manager[T, I]) readItem(id uuid.UUID, offset int64) (T, error) {
+	var (
+		item      T
+		decodeErr error
+	)
+	err := m.fh.ViewRecord(offset, func(data []byte) error {
+		data, err := m.open(id, data)
+		if err != nil {
+			return err
+		}
+		decodeErr = json.Unmarshal(data, &item)
+		return nil
+	})
+	if err != nil {
+		return item, fmt.Errorf("error reading item from disk: %w", err)
+	}
+	if decodeErr != nil {
+		return item, fmt.Errorf("error unmarshaling item: %w", decodeErr)
+	}
+	return item, nil
+}
+
+// ReadAll reads every item in the collection from disk.
+func (m *Manager[T, I]) ReadAll() ([]T, error) {
+	items := make([]T, 0, m.Count())
+	err := m.Iterate(context.Background(), func(item T) bool {
+		items = append(items, item)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// Iterate calls fn for every item in the collection in ID order until fn
+// returns false or ctx is cancelled.
+func (m *Manager[T, I]) Iterate(ctx context.Context, fn func(item T) bool) error {
+	return m.IterateFrom(ctx, uuid.Nil, fn)
+}
+
+// IterateFrom calls fn for every item whose ID is from or after it, in ID
+// order, until fn returns false or ctx is cancelled. Items are read from
+// disk one at a time, and items deleted during the iteration are skipped.
+func (m *Manager[T, I]) IterateFrom(ctx context.Context, from uuid.UUID, fn func(item T) bool) error {
+	m.mu.RLock()
+	ids := make([]uuid.UUID, 0, len(m.primaryIndex))
+	for id := range m.primaryIndex {
+		if bytes.Compare(id[:], from[:]) >= 0 {
+			ids = append(ids, id)
+		}
+	}
+	m.mu.RUnlock()
+
+	slices.SortFunc(ids, func(a, b uuid.UUID) int {
+		return bytes.Compare(a[:], b[:])
+	})
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		item, err := m.Read(id)
+		if err != nil {
+			m.mu.RLock()
+			_, exists := m.primaryIndex[id]
+			m.mu.RUnlock()
+			if !exists {
+				continue
+			}
+			return err
+		}
+		if !fn(item) {
+			return nil
+		}
+	}
+	return nil
+}
+
 func (m *Manager[T, I]) ReadIndex(id uuid.UUID) (I, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
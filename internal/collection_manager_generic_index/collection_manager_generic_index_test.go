@@ -2,6 +2,7 @@ package collection_manager_generic_index
 
 import (
 	"fmt"
+	"os"
 	"strconv"
 	"testing"
 	"time"
@@ -315,3 +316,43 @@ func TestReadMessages(t *testing.T) {
 	//fmt.Println("single  read duration: ", duration)
 
 }
+
+// TestUpdateFailedWrite checks that an update that fails to be written
+// keeps the version of the item, so that retrying it does not conflict.
+func TestUpdateFailedWrite(t *testing.T) {
+
+	db, err := NewAt[*message.Message, *message.Index](t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	msg, err := db.Create(&message.Message{Caption: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Records cannot be written while the data file is open read-only.
+	writable := db.fh.dataFile
+	readOnly, err := os.Open(db.fh.dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.fh.dataFile = readOnly
+	msg.Caption = "second"
+	if _, err := db.Update(msg); err == nil {
+		t.Fatal("update to a read-only data file succeeded")
+	}
+	if msg.Version != "1" {
+		t.Fatalf("version after a failed update = %q, want 1", msg.Version)
+	}
+	db.fh.dataFile = writable
+	readOnly.Close()
+
+	if _, err := db.Update(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Version != "2" {
+		t.Fatalf("version after update = %q, want 2", msg.Version)
+	}
+}
@@ -0,0 +1,593 @@
+package collection_manager_generic_index
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// compactBatchSize is how many records a compaction step moves while
+	// holding the manager lock; reads and writes run between steps.
+	compactBatchSize = 64
+	// compactCheckInterval is how often the background routine looks at
+	// how much of the files is free space.
+	compactCheckInterval = 1 * time.Minute
+	// A background compaction starts once free space reaches both limits.
+	compactMinFreeBytes = 1 << 20 // 1 MB
+	compactMinFreeRatio = 0.25
+)
+
+// CompactionMetrics describes the work done by compaction so far and the
+// space currently waiting to be reused or reclaimed.
+type CompactionMetrics struct {
+	Runs             int64
+	RelocatedRecords int64
+	ReclaimedBytes   int64
+	FreeBytes        int64
+	FileBytes        int64
+	LastRun          time.Time
+	LastDuration     time.Duration
+}
+
+type compactionStats struct {
+	mu      sync.Mutex
+	metrics CompactionMetrics
+}
+
+func (s *compactionStats) record(start time.Time, relocated int, reclaimed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics.Runs++
+	s.metrics.RelocatedRecords += int64(relocated)
+	s.metrics.ReclaimedBytes += reclaimed
+	s.metrics.LastRun = start
+	s.metrics.LastDuration = time.Since(start)
+}
+
+func (s *compactionStats) snapshot() CompactionMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metrics
+}
+
+// ---
+// Page and index slot bookkeeping. Callers hold h.mu.
+
+// loadPages scans every page header of data.db to find the chain of each
+// record and the pages that are free. Overflow pages that no head page
+// reaches, left by a crash in the middle of a write, are free as well.
+func (h *FileHandler) loadPages() error {
+	h.free = nil
+	h.chains = make(map[int64][]int64)
+	h.owners = make(map[int64]int64)
+
+	info, err := h.dataFile.Stat()
+	if err != nil {
+		return fmt.Errorf("error getting data file info: %w", err)
+	}
+
+	headers := make(map[int64]pageHeader)
+	buf := make([]byte, pageHeaderSize)
+	for offset := int64(dataHeaderSize); offset+pageHeaderSize <= info.Size(); offset += pageSize {
+		header, _, err := h.dataMap.view(offset, pageHeaderSize, buf)
+		if err != nil {
+			return fmt.Errorf("error reading page header at offset %d: %w", offset, err)
+		}
+		headers[offset] = decodePageHeader(header)
+	}
+
+	for offset, header := range headers {
+		if header.status != StatusActive || header.length == 0 {
+			continue
+		}
+
+		pages := []int64{offset}
+		remaining := int(header.length) - pagePayloadSize
+		next := header.next
+		for remaining > 0 && next != 0 {
+			overflow, ok := headers[next]
+			if !ok || overflow.status != StatusOverflow {
+				break
+			}
+			pages = append(pages, next)
+			remaining -= int(overflow.length)
+			next = overflow.next
+		}
+		if remaining > 0 {
+			log.Printf("Record at offset %d has a broken overflow chain", offset)
+		}
+		h.trackChain(pages)
+	}
+
+	for offset := range headers {
+		if _, used := h.owners[offset]; !used {
+			h.free = append(h.free, offset)
+		}
+	}
+	sort.Slice(h.free, func(i, j int) bool { return h.free[i] < h.free[j] })
+
+	return nil
+}
+
+// releaseUnreferenced frees records whose head page is not in the index,
+// such as a record written just before a crash that never got an index slot.
+// Records that fail their checksum are copied to the quarantine directory
+// first, so corrupt data is never dropped without a trace.
+func (h *FileHandler) releaseUnreferenced(heads map[int64]bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var released int
+	for head, pages := range h.chains {
+		if heads[head] {
+			continue
+		}
+		if _, _, err := h.readChain(head); err != nil {
+			path, qerr := h.quarantine(head, pages)
+			if qerr != nil {
+				return fmt.Errorf("error quarantining record at offset %d: %w", head, qerr)
+			}
+			log.Printf("Quarantined unreadable record at offset %d to %s: %v", head, path, err)
+		}
+		if err := h.markPages(pages, StatusDeleted); err != nil {
+			return err
+		}
+		h.untrackChain(head)
+		h.releasePages(pages)
+		released++
+	}
+
+	if released > 0 {
+		log.Printf("Released %d unreferenced records in %s", released, h.dataPath)
+	}
+	return nil
+}
+
+func (h *FileHandler) trackChain(pages []int64) {
+	if len(pages) == 0 {
+		return
+	}
+	head := pages[0]
+	h.chains[head] = append([]int64(nil), pages...)
+	for _, page := range pages {
+		h.owners[page] = head
+	}
+}
+
+func (h *FileHandler) untrackChain(head int64) {
+	for _, page := range h.chains[head] {
+		delete(h.owners, page)
+	}
+	delete(h.chains, head)
+}
+
+func (h *FileHandler) releasePages(pages []int64) {
+	for _, page := range pages {
+		h.free = insertOffset(h.free, page)
+	}
+}
+
+// takeFree removes up to n of the lowest free pages from the free list.
+func (h *FileHandler) takeFree(n int) []int64 {
+	if n > len(h.free) {
+		n = len(h.free)
+	}
+	taken := append([]int64(nil), h.free[:n]...)
+	h.free = h.free[n:]
+	return taken
+}
+
+func (h *FileHandler) releaseIndexSlot(offset int64) {
+	h.freeIndex = insertOffset(h.freeIndex, offset)
+}
+
+func (h *FileHandler) takeIndexSlot() (int64, bool) {
+	if len(h.freeIndex) == 0 {
+		return 0, false
+	}
+	slot := h.freeIndex[0]
+	h.freeIndex = h.freeIndex[1:]
+	return slot, true
+}
+
+func insertOffset(offsets []int64, offset int64) []int64 {
+	i := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= offset })
+	if i < len(offsets) && offsets[i] == offset {
+		return offsets
+	}
+	offsets = append(offsets, 0)
+	copy(offsets[i+1:], offsets[i:])
+	offsets[i] = offset
+	return offsets
+}
+
+// ---
+// Incremental compaction steps on the FileHandler.
+
+// trimData truncates free pages at the end of data.db and returns the
+// number of bytes reclaimed.
+func (h *FileHandler) trimData() (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	info, err := h.dataFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	end := info.Size()
+	// A partial page can only be the tail of an interrupted append.
+	if tail := (end - dataHeaderSize) % pageSize; tail != 0 {
+		end -= tail
+	}
+	for len(h.free) > 0 && h.free[len(h.free)-1] == end-pageSize {
+		h.free = h.free[:len(h.free)-1]
+		end -= pageSize
+	}
+
+	if end == info.Size() {
+		return 0, nil
+	}
+	if err := h.dataFile.Truncate(end); err != nil {
+		return 0, fmt.Errorf("error truncating data file: %w", err)
+	}
+	h.dataMap.remap()
+	return info.Size() - end, nil
+}
+
+// tailRecord returns the head page of the record that owns the last page
+// of data.db, if there are enough free pages below it to move it there.
+// It expects free pages at the end to have been trimmed already.
+func (h *FileHandler) tailRecord() (int64, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	info, err := h.dataFile.Stat()
+	if err != nil || len(h.free) == 0 {
+		return 0, false
+	}
+
+	size := info.Size() - (info.Size()-dataHeaderSize)%pageSize
+	last := size - pageSize
+	head, ok := h.owners[last]
+	if !ok || h.free[0] > last {
+		return 0, false
+	}
+	if len(h.chains[head]) > len(h.free) {
+		return 0, false
+	}
+	return head, true
+}
+
+// relocateRecord copies the record at head into free pages and returns its
+// data and new head. The old pages stay intact until releaseRecord, so the
+// index can be pointed at the copy first.
+func (h *FileHandler) relocateRecord(head int64) ([]byte, int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	view, _, err := h.readChain(head)
+	if err != nil {
+		return nil, 0, err
+	}
+	data := bytes.Clone(view)
+
+	offsets := h.takeFree(pagesFor(len(data)))
+	if len(offsets) < pagesFor(len(data)) {
+		h.releasePages(offsets)
+		return nil, 0, fmt.Errorf("not enough free pages to move record at offset %d", head)
+	}
+	if err := h.writeChain(offsets, data); err != nil {
+		h.releasePages(offsets)
+		return nil, 0, err
+	}
+
+	h.trackChain(offsets)
+	return data, offsets[0], nil
+}
+
+// releaseRecord frees every page of the record at head.
+func (h *FileHandler) releaseRecord(head int64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	pages := h.chains[head]
+	if err := h.markPages(pages, StatusDeleted); err != nil {
+		return err
+	}
+	h.untrackChain(head)
+	h.releasePages(pages)
+	return nil
+}
+
+// trimIndex truncates free slots at the end of index.db and returns the
+// number of bytes reclaimed.
+func (h *FileHandler) trimIndex() (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	info, err := h.indexFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	end := info.Size()
+	if tail := (end - indexHeaderSize) % indexRecordSize; tail != 0 {
+		end -= tail
+	}
+	for len(h.freeIndex) > 0 && h.freeIndex[len(h.freeIndex)-1] == end-indexRecordSize {
+		h.freeIndex = h.freeIndex[:len(h.freeIndex)-1]
+		end -= indexRecordSize
+	}
+
+	if end == info.Size() {
+		return 0, nil
+	}
+	if err := h.indexFile.Truncate(end); err != nil {
+		return 0, fmt.Errorf("error truncating index file: %w", err)
+	}
+	h.indexMap.remap()
+	return info.Size() - end, nil
+}
+
+// tailIndexSlot returns the last slot of index.db if a free slot below it
+// exists, together with the ID stored in it.
+func (h *FileHandler) tailIndexSlot() (int64, uuid.UUID, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	info, err := h.indexFile.Stat()
+	if err != nil || len(h.freeIndex) == 0 {
+		return 0, uuid.Nil, false
+	}
+
+	last := info.Size() - indexRecordSize
+	if last < indexHeaderSize || h.freeIndex[0] >= last {
+		return 0, uuid.Nil, false
+	}
+
+	id := make([]byte, 16)
+	if _, err := h.indexFile.ReadAt(id, last); err != nil {
+		return 0, uuid.Nil, false
+	}
+	return last, uuid.UUID(id), true
+}
+
+// freeSpace returns the free bytes and total size of both files.
+func (h *FileHandler) freeSpace() (free, total int64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	free = int64(len(h.free))*pageSize + int64(len(h.freeIndex))*indexRecordSize
+	if info, err := h.dataFile.Stat(); err == nil {
+		total += info.Size()
+	}
+	if info, err := h.indexFile.Stat(); err == nil {
+		total += info.Size()
+	}
+	return free, total
+}
+
+// ---
+// Compaction on the Manager.
+
+// Compact shrinks data.db and index.db by moving the records at the end of
+// each file into free space nearer the start, then truncating the tail.
+// It works in small steps and releases the manager lock between them, so
+// reads and writes continue while it runs. A crash between steps leaves a
+// consistent store: a moved record's old copy is only released after the
+// index points at the new one.
+func (m *Manager[T, I]) Compact(ctx context.Context) error {
+	start := time.Now()
+	var relocated int
+	var reclaimed int64
+
+	defer func() {
+		m.metrics.record(start, relocated, reclaimed)
+	}()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return fmt.Errorf("manager is closed")
+		}
+		moved, freed, done, err := m.compactStep(compactBatchSize)
+		m.mu.Unlock()
+
+		relocated += moved
+		reclaimed += freed
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+	}
+
+	if relocated > 0 || reclaimed > 0 {
+		log.Printf("Compaction moved %d records and reclaimed %d bytes", relocated, reclaimed)
+	}
+	return nil
+}
+
+// compactStep moves up to limit records or index slots, truncating the
+// free tail of both files after every move. Callers hold m.mu.
+func (m *Manager[T, I]) compactStep(limit int) (moved int, reclaimed int64, done bool, err error) {
+	trim := func() error {
+		for _, trimFile := range []func() (int64, error){m.fh.trimData, m.fh.trimIndex} {
+			freed, err := trimFile()
+			if err != nil {
+				return err
+			}
+			reclaimed += freed
+		}
+		return nil
+	}
+
+	if err := trim(); err != nil {
+		return moved, reclaimed, false, err
+	}
+
+	for moved < limit {
+		movedRecord, err := m.moveTailRecord()
+		if err != nil {
+			return moved, reclaimed, false, err
+		}
+		movedSlot, err := m.moveTailIndexSlot()
+		if err != nil {
+			return moved, reclaimed, false, err
+		}
+		if !movedRecord && !movedSlot {
+			return moved, reclaimed, true, nil
+		}
+		if movedRecord {
+			moved++
+		}
+		if movedSlot {
+			moved++
+		}
+
+		if err := trim(); err != nil {
+			return moved, reclaimed, false, err
+		}
+	}
+
+	return moved, reclaimed, false, nil
+}
+
+func (m *Manager[T, I]) moveTailRecord() (bool, error) {
+	head, ok := m.fh.tailRecord()
+	if !ok {
+		return false, nil
+	}
+
+	data, newHead, err := m.fh.relocateRecord(head)
+	if err != nil {
+		return false, fmt.Errorf("error moving record at offset %d: %w", head, err)
+	}
+
+	var item T
+	if data, err = m.open(uuid.Nil, data); err == nil {
+		err = json.Unmarshal(data, &item)
+	}
+	if err != nil {
+		m.fh.releaseRecord(newHead)
+		return false, fmt.Errorf("error unmarshaling record at offset %d: %w", head, err)
+	}
+
+	id := item.GetID()
+	if _, creating := m.pending[id]; creating {
+		// The record of a create in flight is moved by a later run.
+		m.fh.releaseRecord(newHead)
+		return false, nil
+	}
+	entry, ok := m.primaryIndex[id]
+	if !ok || entry.Offset != head {
+		m.fh.releaseRecord(newHead)
+		return false, fmt.Errorf("record at offset %d is not in the index", head)
+	}
+
+	indexData, err := json.Marshal(entry.IndexData)
+	if err != nil {
+		m.fh.releaseRecord(newHead)
+		return false, fmt.Errorf("failed to marshal index item: %w", err)
+	}
+	if err := m.fh.UpdateIndexRecord(entry.IndexOffset, id, newHead, indexData); err != nil {
+		m.fh.releaseRecord(newHead)
+		return false, fmt.Errorf("failed to update index record: %w", err)
+	}
+
+	entry.Offset = newHead
+	m.primaryIndex[id] = entry
+
+	if err := m.fh.releaseRecord(head); err != nil {
+		return false, fmt.Errorf("error releasing record at offset %d: %w", head, err)
+	}
+	return true, nil
+}
+
+func (m *Manager[T, I]) moveTailIndexSlot() (bool, error) {
+	last, id, ok := m.fh.tailIndexSlot()
+	if !ok {
+		return false, nil
+	}
+
+	if _, creating := m.pending[id]; creating {
+		return false, nil
+	}
+	entry, ok := m.primaryIndex[id]
+	if !ok || entry.IndexOffset != last {
+		return false, fmt.Errorf("index slot at offset %d does not match the primary index", last)
+	}
+
+	indexData, err := json.Marshal(entry.IndexData)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal index item: %w", err)
+	}
+
+	// WriteIndexRecord takes the lowest free slot, which lies below last.
+	newSlot, err := m.fh.WriteIndexRecord(id, entry.Offset, indexData)
+	if err != nil {
+		return false, err
+	}
+
+	entry.IndexOffset = newSlot
+	m.primaryIndex[id] = entry
+
+	if err := m.fh.DeleteIndexRecord(last); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Metrics returns compaction counters and the current free space.
+func (m *Manager[T, I]) Metrics() CompactionMetrics {
+	metrics := m.metrics.snapshot()
+	metrics.FreeBytes, metrics.FileBytes = m.fh.freeSpace()
+	return metrics
+}
+
+// startCompactionRoutine compacts in the background whenever enough of the
+// files is free space, until the manager is closed.
+func (m *Manager[T, I]) startCompactionRoutine() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-m.stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(compactCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+
+		free, total := m.fh.freeSpace()
+		if free < compactMinFreeBytes || float64(free) < compactMinFreeRatio*float64(total) {
+			continue
+		}
+
+		log.Println("Starting compaction routine...")
+		if err := m.Compact(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Compaction failed: %v", err)
+		}
+	}
+}
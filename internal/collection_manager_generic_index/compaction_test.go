@@ -0,0 +1,164 @@
+package collection_manager_generic_index
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestFreePageReuse(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := NewAt[*message.Message, *message.Index](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	chatID := uuid.New()
+	var ids []uuid.UUID
+	for i := 0; i < 10; i++ {
+		msg, err := db.Create(newLargeMessage(chatID, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	for _, id := range ids[:5] {
+		if err := db.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dataSize := fileSize(t, filepath.Join(dir, "data.db"))
+	indexSize := fileSize(t, filepath.Join(dir, "index.db"))
+
+	for i := 0; i < 5; i++ {
+		if _, err := db.Create(newLargeMessage(chatID, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := fileSize(t, filepath.Join(dir, "data.db")); got != dataSize {
+		t.Fatalf("data.db grew from %d to %d bytes although free pages were available", dataSize, got)
+	}
+	if got := fileSize(t, filepath.Join(dir, "index.db")); got != indexSize {
+		t.Fatalf("index.db grew from %d to %d bytes although free slots were available", indexSize, got)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := NewAt[*message.Message, *message.Index](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chatID := uuid.New()
+	var ids []uuid.UUID
+	for i := 0; i < 200; i++ {
+		medias := 1
+		if i%10 == 0 {
+			medias = 60 // spans several pages
+		}
+		msg, err := db.Create(newLargeMessage(chatID, medias))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+
+	var kept []uuid.UUID
+	for i, id := range ids {
+		if i%4 == 3 || i < 100 {
+			kept = append(kept, id)
+			continue
+		}
+		if err := db.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Free the front of the file, so the records at the end have to move.
+	for _, id := range kept[:50] {
+		if err := db.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kept = kept[50:]
+
+	before := fileSize(t, filepath.Join(dir, "data.db")) + fileSize(t, filepath.Join(dir, "index.db"))
+
+	// Reads keep working while compaction runs.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, id := range kept {
+				if _, err := db.Read(id); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	wg.Wait()
+
+	after := fileSize(t, filepath.Join(dir, "data.db")) + fileSize(t, filepath.Join(dir, "index.db"))
+	metrics := db.Metrics()
+	if after >= before {
+		t.Fatalf("files did not shrink: %d bytes before, %d after", before, after)
+	}
+	if metrics.ReclaimedBytes != before-after {
+		t.Fatalf("got %d reclaimed bytes in metrics, want %d", metrics.ReclaimedBytes, before-after)
+	}
+	// Only gaps too small for the multi-page records at the end may remain.
+	if metrics.RelocatedRecords == 0 || metrics.FreeBytes >= 4*pageSize {
+		t.Fatalf("unexpected metrics after compaction: %+v", metrics)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewAt[*message.Message, *message.Index](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if db.Count() != len(kept) {
+		t.Fatalf("got %d records after reopening, want %d", db.Count(), len(kept))
+	}
+	for _, id := range kept {
+		if _, err := db.Read(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
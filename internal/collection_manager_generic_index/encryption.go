@@ -0,0 +1,170 @@
+package collection_manager_generic_index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+)
+
+// errNoCipher is returned for a sealed record read by a manager opened
+// without a cipher.
+var errNoCipher = errors.New("record is encrypted, but the store has no cipher")
+
+// WithCipher seals the records of data.db with c. index.db is not sealed,
+// so the index type should hold no more than the fields needed to find
+// items. Plaintext records written before are still read, and are sealed in
+// the background, as are records sealed with a data key that is no longer
+// active, see Reencrypt.
+func WithCipher(c encryption.Cipher) Option {
+	return func(o *options) { o.cipher = c }
+}
+
+// seal returns the stored form of the record of the item id.
+func (m *Manager[T, I]) seal(id uuid.UUID, data []byte) ([]byte, error) {
+	if m.cipher == nil {
+		return data, nil
+	}
+	sealed, err := m.cipher.Seal(id, data)
+	if err != nil {
+		return nil, fmt.Errorf("error sealing record: %w", err)
+	}
+	return sealed, nil
+}
+
+// open returns the JSON of a stored record. A nil id takes the ID from the
+// record header, for callers that only learn it from the record.
+func (m *Manager[T, I]) open(id uuid.UUID, data []byte) ([]byte, error) {
+	if !encryption.IsSealed(data) {
+		return data, nil
+	}
+	if m.cipher == nil {
+		return nil, errNoCipher
+	}
+	if id == uuid.Nil {
+		id, _ = encryption.SealedID(data)
+	}
+	return m.cipher.Open(id, data)
+}
+
+// Reencrypt seals the records that are stored as plaintext or with an
+// older data key with the active one, and returns how many it rewrote.
+// Like Compact, it holds the manager lock for one record at a time, so
+// reads and writes continue while it runs.
+func (m *Manager[T, I]) Reencrypt(ctx context.Context) (int, error) {
+	if m.cipher == nil {
+		return 0, errors.New("store has no cipher")
+	}
+
+	m.mu.RLock()
+	ids := make([]uuid.UUID, 0, len(m.primaryIndex))
+	for id := range m.primaryIndex {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+
+	rewritten := 0
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return rewritten, err
+		}
+
+		// Most records are current, and checking them needs only a read lock.
+		m.mu.RLock()
+		stale, err := m.stale(id)
+		m.mu.RUnlock()
+		if err != nil {
+			return rewritten, err
+		}
+		if !stale {
+			continue
+		}
+
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return rewritten, ErrClosed
+		}
+		ok, err := m.reencryptRecord(id)
+		m.mu.Unlock()
+
+		if err != nil {
+			return rewritten, fmt.Errorf("error re-encrypting item %s: %w", id, err)
+		}
+		if ok {
+			rewritten++
+		}
+	}
+	return rewritten, nil
+}
+
+// stale reports whether the record of id is not sealed with the active
+// data key. Callers hold m.mu.
+func (m *Manager[T, I]) stale(id uuid.UUID) (bool, error) {
+	if m.closed {
+		return false, ErrClosed
+	}
+	entry, ok := m.primaryIndex[id]
+	if !ok {
+		return false, nil
+	}
+	var stale bool
+	err := m.fh.ViewRecord(entry.Offset, func(data []byte) error {
+		stale = !m.cipher.Current(data)
+		return nil
+	})
+	return stale, err
+}
+
+// reencryptRecord rewrites the record of id if it is not sealed with the
+// active data key. Callers hold m.mu.
+func (m *Manager[T, I]) reencryptRecord(id uuid.UUID) (bool, error) {
+	entry, ok := m.primaryIndex[id]
+	if !ok {
+		// Deleted since Reencrypt started.
+		return false, nil
+	}
+
+	var sealed []byte
+	err := m.fh.ViewRecord(entry.Offset, func(data []byte) error {
+		if m.cipher.Current(data) {
+			return nil
+		}
+		plaintext, err := m.open(id, data)
+		if err != nil {
+			return err
+		}
+		sealed, err = m.seal(id, plaintext)
+		return err
+	})
+	if err != nil || sealed == nil {
+		return false, err
+	}
+	if err := m.fh.UpdateRecord(entry.Offset, sealed); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// reencryptInBackground runs Reencrypt once until it is done or the
+// manager is closed.
+func (m *Manager[T, I]) reencryptInBackground() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-m.stop
+		cancel()
+	}()
+
+	rewritten, err := m.Reencrypt(ctx)
+	if err != nil && !errors.Is(err, ErrClosed) && ctx.Err() == nil {
+		log.Printf("Re-encryption failed after %d records: %v", rewritten, err)
+		return
+	}
+	if rewritten > 0 {
+		log.Printf("Re-encrypted %d records", rewritten)
+	}
+}
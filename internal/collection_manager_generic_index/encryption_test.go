@@ -0,0 +1,101 @@
+package collection_manager_generic_index
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+)
+
+// TestEncryptedRecords checks that sealed records stay opaque in data.db
+// and survive an index rebuild, verification and a key rotation.
+func TestEncryptedRecords(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := filepath.Join(t.TempDir(), "master.keys")
+	if _, err := encryption.AddMasterKey(keyfile); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := encryption.LoadKeyfile(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := encryption.OpenDataKeys(ring, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewAt[*message.Message, *message.Index](dir, WithCipher(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatID := uuid.New()
+	var ids []uuid.UUID
+	for i := 0; i < 20; i++ {
+		msg := newLargeMessage(chatID, i%3*20)
+		msg.Caption = "secret caption"
+		if msg, err = db.Create(msg); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret caption")) {
+		t.Fatal("data.db holds plaintext")
+	}
+	report, err := Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("verify reported %v", report.Corrupt)
+	}
+
+	// Rebuild index.db from the sealed records after a rotation.
+	if _, err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "index.db")); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewAt[*message.Message, *message.Index](dir, WithCipher(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Count() != len(ids) {
+		t.Fatalf("rebuilt index has %d entries, want %d", db.Count(), len(ids))
+	}
+
+	if _, err := db.Reencrypt(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		msg, err := db.Read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Caption != "secret caption" {
+			t.Fatalf("caption = %q, want %q", msg.Caption, "secret caption")
+		}
+		entry, _ := db.GetIndexEntry(id)
+		record, err := db.fh.ReadRecord(entry.Offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !keys.Current(record) {
+			t.Fatalf("record of %s is not sealed with the active key", id)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package collection_manager_generic_index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+// Page layout of data.db. A record starts on a head page and continues on
+// overflow pages chained through the next pointer:
+//
+//	[status 1][length 4][next 8][crc 4][payload ...]
+//
+// On the head page length is the total record length and crc the CRC32C of
+// the whole record; on overflow pages length is the length of the chunk
+// stored there and crc is unused. next is 0 on the last page.
+const (
+	pageSize        = recordSize
+	pageHeaderSize  = recordStatusSize + 4 + 8 + 4
+	pagePayloadSize = pageSize - pageHeaderSize
+	// maxRecordLength guards against following a corrupt length field.
+	maxRecordLength = 64 << 20 // 64 MB
+	// pageHeaderSizeV1 is the page header of version 1, without the crc.
+	pageHeaderSizeV1 = recordStatusSize + 4 + 8
+)
+
+// Layout of an index.db slot:
+//
+//	[id 16][offset 8][length 2][crc 4][index data ...]
+//
+// crc is the CRC32C of everything in the slot before it and of the data.
+const (
+	indexEntryHeaderSize = 16 + 8 + 2 + 4
+	maxIndexDataSize     = indexRecordSize - indexEntryHeaderSize
+)
+
+// File format versions. Version 0 is the original headerless layout with
+// one fixed 4096-byte slot per record, version 1 added overflow pages and
+// version 2 checksums. Older files are migrated on open.
+const (
+	formatVersionLegacy = 0
+	formatVersionPages  = 1
+	formatVersion       = 2
+	dataMagic           = "IRISDATA"
+	indexMagic          = "IRISINDX"
+	dataHeaderSize      = pageSize
+	indexHeaderSize     = indexRecordSize
+)
+
+// ErrChecksumMismatch is returned when a record or index entry does not
+// match its stored checksum, which points at a torn write or bit rot.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+// pageHeader is the decoded fixed part of a data page.
+type pageHeader struct {
+	status byte
+	length uint32
+	next   int64
+	crc    uint32
+}
+
+func decodePageHeader(page []byte) pageHeader {
+	return pageHeader{
+		status: page[0],
+		length: binary.LittleEndian.Uint32(page[1:5]),
+		next:   int64(binary.LittleEndian.Uint64(page[5:13])),
+		crc:    binary.LittleEndian.Uint32(page[13:17]),
+	}
+}
+
+func encodePage(status byte, length int, next int64, crc uint32, chunk []byte) []byte {
+	page := make([]byte, pageSize)
+	page[0] = status
+	binary.LittleEndian.PutUint32(page[1:5], uint32(length))
+	binary.LittleEndian.PutUint64(page[5:13], uint64(next))
+	binary.LittleEndian.PutUint32(page[13:17], crc)
+	copy(page[pageHeaderSize:], chunk)
+	return page
+}
+
+// readChainAt follows the chain of the record whose head page is at offset.
+// headerSize selects the page layout, so version 1 files can be read during
+// migration. The returned data is not checked against the crc.
+// A record on a single page is returned as a slice of the page, which for
+// a memory-mapped file is a slice of the map.
+func readChainAt(file *mappedFile, offset int64, headerSize int) ([]byte, []int64, pageHeader, error) {
+	var head pageHeader
+	if offset < dataHeaderSize {
+		return nil, nil, head, fmt.Errorf("invalid offset: %d", offset)
+	}
+
+	payloadSize := pageSize - headerSize
+	var buf []byte
+	if !file.mapped() {
+		buf = make([]byte, pageSize)
+	}
+	page, n, err := file.view(offset, pageSize, buf)
+	if err != nil {
+		return nil, nil, head, fmt.Errorf("error reading block from data file at offset %d: %w", offset, err)
+	}
+	if n < headerSize {
+		return nil, nil, head, fmt.Errorf("no data read at offset %d", offset)
+	}
+
+	head = decodePageHeader(page)
+	switch head.status {
+	case StatusActive:
+	case StatusDeleted:
+		return nil, nil, head, fmt.Errorf("record at offset %d is marked as deleted", offset)
+	default:
+		return nil, nil, head, fmt.Errorf("offset %d is not the start of a record", offset)
+	}
+
+	if head.length == 0 {
+		return nil, nil, head, fmt.Errorf("empty data at offset %d", offset)
+	}
+	if head.length > maxRecordLength {
+		return nil, nil, head, fmt.Errorf("corrupt record length %d at offset %d", head.length, offset)
+	}
+
+	total := int(head.length)
+	if total <= payloadSize {
+		return page[headerSize : headerSize+total], []int64{offset}, head, nil
+	}
+
+	maxPages := (total + payloadSize - 1) / payloadSize
+	data := make([]byte, 0, total)
+	data = append(data, page[headerSize:headerSize+min(total, payloadSize)]...)
+	pages := []int64{offset}
+
+	next := head.next
+	for len(data) < total {
+		if next == 0 || len(pages) >= maxPages {
+			return nil, nil, head, fmt.Errorf("record at offset %d has a broken overflow chain", offset)
+		}
+
+		if page, _, err = file.view(next, pageSize, buf); err != nil {
+			return nil, nil, head, fmt.Errorf("error reading overflow page at offset %d: %w", next, err)
+		}
+		overflow := decodePageHeader(page)
+		if overflow.status != StatusOverflow || int(overflow.length) > payloadSize || len(data)+int(overflow.length) > total {
+			return nil, nil, head, fmt.Errorf("record at offset %d has a corrupt overflow page at %d", offset, next)
+		}
+
+		data = append(data, page[headerSize:headerSize+int(overflow.length)]...)
+		pages = append(pages, next)
+		next = overflow.next
+	}
+
+	return data, pages, head, nil
+}
+
+func encodeIndexRecord(id uuid.UUID, offset int64, data []byte) []byte {
+	record := make([]byte, indexRecordSize)
+	copy(record[0:16], id[:])
+	binary.LittleEndian.PutUint64(record[16:24], uint64(offset))
+	binary.LittleEndian.PutUint16(record[24:26], uint16(len(data)))
+	copy(record[indexEntryHeaderSize:], data)
+
+	crc := crc32.Update(checksum(record[:26]), crcTable, data)
+	binary.LittleEndian.PutUint32(record[26:30], crc)
+	return record
+}
+
+// decodeIndexRecord returns the fields of an index slot. A cleared slot
+// decodes to uuid.Nil without error.
+func decodeIndexRecord(record []byte) (uuid.UUID, int64, []byte, error) {
+	id, err := uuid.FromBytes(record[0:16])
+	if err != nil {
+		return uuid.Nil, 0, nil, err
+	}
+	if id == uuid.Nil {
+		return uuid.Nil, 0, nil, nil
+	}
+
+	offset := int64(binary.LittleEndian.Uint64(record[16:24]))
+	length := int(binary.LittleEndian.Uint16(record[24:26]))
+	if length > maxIndexDataSize {
+		return uuid.Nil, 0, nil, ErrChecksumMismatch
+	}
+
+	data := make([]byte, length)
+	copy(data, record[indexEntryHeaderSize:indexEntryHeaderSize+length])
+
+	crc := crc32.Update(checksum(record[:26]), crcTable, data)
+	if crc != binary.LittleEndian.Uint32(record[26:30]) {
+		return uuid.Nil, 0, nil, ErrChecksumMismatch
+	}
+	return id, offset, data, nil
+}
+
+// pagesFor returns how many pages a record of n bytes occupies.
+func pagesFor(n int) int {
+	if n == 0 {
+		return 1
+	}
+	return (n + pagePayloadSize - 1) / pagePayloadSize
+}
+
+func encodeFileHeader(magic string, size int) []byte {
+	header := make([]byte, size)
+	copy(header, magic)
+	binary.LittleEndian.PutUint16(header[len(magic):len(magic)+2], formatVersion)
+	return header
+}
+
+// readFileVersion returns the format version of a file, formatVersionLegacy
+// for files written before headers existed, and ok=false for empty files.
+func readFileVersion(file *os.File, magic string) (version uint16, ok bool, err error) {
+	header := make([]byte, len(magic)+2)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	if n == 0 {
+		return 0, false, nil
+	}
+	if n < len(header) || !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		return formatVersionLegacy, true, nil
+	}
+	return binary.LittleEndian.Uint16(header[len(magic):]), true, nil
+}
+
+// prepareFormat writes headers to new files, migrates older files and
+// rejects files written by a newer version.
+func (h *FileHandler) prepareFormat() error {
+	version, ok, err := readFileVersion(h.dataFile, dataMagic)
+	if err != nil {
+		return fmt.Errorf("error reading data file header: %w", err)
+	}
+
+	switch {
+	case !ok:
+		if _, err := h.dataFile.WriteAt(encodeFileHeader(dataMagic, dataHeaderSize), 0); err != nil {
+			return fmt.Errorf("error writing data file header: %w", err)
+		}
+	case version < formatVersion:
+		if err := h.migrateData(version); err != nil {
+			return fmt.Errorf("error migrating data file from version %d: %w", version, err)
+		}
+		h.indexStale = true
+	case version > formatVersion:
+		return fmt.Errorf("data file format version %d is newer than supported version %d", version, formatVersion)
+	}
+
+	version, ok, err = readFileVersion(h.indexFile, indexMagic)
+	if err != nil {
+		return fmt.Errorf("error reading index file header: %w", err)
+	}
+
+	switch {
+	case !ok || version < formatVersion || h.indexStale:
+		// Index offsets of older versions point into the old data layout, so
+		// the index is always rebuilt from data.db after a migration.
+		if err := h.resetIndexFile(); err != nil {
+			return err
+		}
+		if ok {
+			h.indexStale = true
+		}
+	case version > formatVersion:
+		return fmt.Errorf("index file format version %d is newer than supported version %d", version, formatVersion)
+	}
+
+	return nil
+}
+
+// resetIndexFile truncates index.db to an empty file with a header.
+func (h *FileHandler) resetIndexFile() error {
+	if err := h.indexFile.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating index file: %w", err)
+	}
+	h.freeIndex = nil
+	if _, err := h.indexFile.WriteAt(encodeFileHeader(indexMagic, indexHeaderSize), 0); err != nil {
+		return fmt.Errorf("error writing index file header: %w", err)
+	}
+	h.indexMap.remap()
+	return nil
+}
+
+// migrateData rewrites a data file of an older version into the current
+// format. The original file is kept next to the new one with a ".v<version>"
+// suffix.
+func (h *FileHandler) migrateData(version uint16) error {
+	old := h.dataFile
+
+	info, err := old.Stat()
+	if err != nil {
+		return err
+	}
+
+	migratingPath := h.dataPath + ".migrating"
+	migrated, err := os.OpenFile(migratingPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := migrated.WriteAt(encodeFileHeader(dataMagic, dataHeaderSize), 0); err != nil {
+		migrated.Close()
+		return err
+	}
+
+	h.dataFile = migrated
+	count := 0
+	write := func(data []byte) error {
+		if _, err := h.writeRecord(data); err != nil {
+			return err
+		}
+		count++
+		return nil
+	}
+
+	switch version {
+	case formatVersionLegacy:
+		err = forEachLegacyRecord(old, info.Size(), write)
+	case formatVersionPages:
+		err = forEachPagedRecord(old, info.Size(), pageHeaderSizeV1, write)
+	default:
+		err = fmt.Errorf("no migration from data file format version %d", version)
+	}
+	if err == nil {
+		err = migrated.Sync()
+	}
+	if err != nil {
+		h.dataFile = old
+		migrated.Close()
+		os.Remove(migratingPath)
+		return err
+	}
+	old.Close()
+
+	if err := os.Rename(h.dataPath, fmt.Sprintf("%s.v%d", h.dataPath, version)); err != nil {
+		migrated.Close()
+		return err
+	}
+	if err := os.Rename(migratingPath, h.dataPath); err != nil {
+		migrated.Close()
+		return err
+	}
+
+	log.Printf("Migrated %d records in %s from format version %d to %d", count, h.dataPath, version, formatVersion)
+	return nil
+}
+
+// forEachLegacyRecord calls fn with every active record of a version 0
+// data file, which stores zero-padded JSON in fixed slots.
+func forEachLegacyRecord(file *os.File, size int64, fn func([]byte) error) error {
+	slot := make([]byte, recordSize)
+	for offset := int64(0); offset < size; offset += recordSize {
+		n, err := file.ReadAt(slot, offset)
+		if err != nil && err != io.EOF {
+			log.Printf("Error reading legacy record at offset %d: %v", offset, err)
+			continue
+		}
+		if n == 0 || slot[0] == StatusDeleted {
+			continue
+		}
+
+		dataLength := bytes.IndexByte(slot[recordStatusSize:], 0)
+		if dataLength == -1 {
+			dataLength = recordSize - recordStatusSize
+		}
+		if dataLength == 0 {
+			continue
+		}
+
+		if err := fn(slot[recordStatusSize : recordStatusSize+dataLength]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachPagedRecord calls fn with every active record of a paged data file
+// whose pages start with a header of headerSize bytes.
+func forEachPagedRecord(file *os.File, size int64, headerSize int, fn func([]byte) error) error {
+	status := make([]byte, recordStatusSize)
+	for offset := int64(dataHeaderSize); offset < size; offset += pageSize {
+		if _, err := file.ReadAt(status, offset); err != nil {
+			log.Printf("Error reading record at offset %d: %v", offset, err)
+			continue
+		}
+		if status[0] != StatusActive {
+			continue
+		}
+
+		data, _, _, err := readChainAt(&mappedFile{file: file}, offset, headerSize)
+		if err != nil {
+			log.Printf("Error reading record at offset %d: %v", offset, err)
+			continue
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package collection_manager_generic_index
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func newLargeMessage(chatID uuid.UUID, medias int) *message.Message {
+	msg := &message.Message{ChatID: chatID, Caption: strings.Repeat("x", 100)}
+	for i := 0; i < medias; i++ {
+		msg.Medias = append(msg.Medias, &message.Media{
+			ID:          uuid.New(),
+			MimeType:    "image/jpeg",
+			Width:       1080,
+			Height:      1920,
+			Orientation: "portrait",
+		})
+	}
+	return msg
+}
+
+func TestLargeRecordRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := NewAt[*message.Message, *message.Index](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chatID := uuid.New()
+	created, err := db.Create(newLargeMessage(chatID, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := db.Create(newLargeMessage(chatID, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Grow the record across more pages, then shrink it to a single page.
+	for _, medias := range []int{300, 2} {
+		update := newLargeMessage(chatID, medias)
+		update.ID = created.ID
+		update.Version = created.Version
+		updated, err := db.Update(update)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created.Version = updated.Version
+
+		got, err := db.Read(created.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Medias) != medias {
+			t.Fatalf("got %d medias after update, want %d", len(got.Medias), medias)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuilding the index from data.db must skip overflow and released pages.
+	if err := os.Remove(filepath.Join(dir, "index.db")); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewAt[*message.Message, *message.Index](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for id, medias := range map[uuid.UUID]int{created.ID: 2, small.ID: 1} {
+		got, err := db.Read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Medias) != medias {
+			t.Fatalf("got %d medias for %s, want %d", len(got.Medias), id, medias)
+		}
+	}
+}
+
+func TestLegacyDataMigration(t *testing.T) {
+	dir := t.TempDir()
+
+	// A version 0 data file: one 4096-byte slot per record, zero padded.
+	var legacy []byte
+	var ids []uuid.UUID
+	for i := 0; i < 3; i++ {
+		msg := &message.Message{ID: uuid.New(), Caption: "legacy"}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slot := make([]byte, recordSize)
+		copy(slot[recordStatusSize:], data)
+		if i == 1 {
+			slot[0] = StatusDeleted
+		} else {
+			ids = append(ids, msg.ID)
+		}
+		legacy = append(legacy, slot...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data.db"), legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewAt[*message.Message, *message.Index](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, id := range ids {
+		got, err := db.Read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Caption != "legacy" {
+			t.Fatalf("got caption %q, want %q", got.Caption, "legacy")
+		}
+	}
+	if len(db.primaryIndex) != len(ids) {
+		t.Fatalf("got %d indexed records, want %d", len(db.primaryIndex), len(ids))
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "data.db.v0")); err != nil {
+		t.Fatalf("legacy data file was not kept: %v", err)
+	}
+
+	version, ok, err := readFileVersion(db.fh.dataFile, dataMagic)
+	if err != nil || !ok || version != formatVersion {
+		t.Fatalf("got data file version %d (ok=%v, err=%v), want %d", version, ok, err, formatVersion)
+	}
+}
+
+func TestPagedFormatMigration(t *testing.T) {
+	dir := t.TempDir()
+
+	// A version 1 data file: pages without a checksum, one record spanning
+	// a head page and an overflow page.
+	msg := newLargeMessage(uuid.New(), 40)
+	msg.ID = uuid.New()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := pageSize - pageHeaderSizeV1
+	if len(data) <= payload || len(data) > 2*payload {
+		t.Fatalf("test record of %d bytes does not span exactly two pages", len(data))
+	}
+
+	file := make([]byte, dataHeaderSize+2*pageSize)
+	copy(file, dataMagic)
+	binary.LittleEndian.PutUint16(file[len(dataMagic):], formatVersionPages)
+
+	head := file[dataHeaderSize:]
+	head[0] = StatusActive
+	binary.LittleEndian.PutUint32(head[1:5], uint32(len(data)))
+	binary.LittleEndian.PutUint64(head[5:13], uint64(dataHeaderSize+pageSize))
+	copy(head[pageHeaderSizeV1:pageSize], data[:payload])
+
+	overflow := file[dataHeaderSize+pageSize:]
+	overflow[0] = StatusOverflow
+	binary.LittleEndian.PutUint32(overflow[1:5], uint32(len(data)-payload))
+	copy(overflow[pageHeaderSizeV1:], data[payload:])
+
+	if err := os.WriteFile(filepath.Join(dir, "data.db"), file, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewAt[*message.Message, *message.Index](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	got, err := db.Read(msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Medias) != len(msg.Medias) {
+		t.Fatalf("got %d medias, want %d", len(got.Medias), len(msg.Medias))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data.db.v1")); err != nil {
+		t.Fatalf("version 1 data file was not kept: %v", err)
+	}
+}
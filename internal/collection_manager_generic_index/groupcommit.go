@@ -0,0 +1,250 @@
+package collection_manager_generic_index
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+)
+
+// Group commit. WriteRecord and WriteIndexRecord do not write themselves:
+// they hand their record to a single writer goroutine and wait for its
+// offset. The writer takes every request waiting for it, up to the batch
+// size, allocates their pages and index slots, and stores the batch with
+// one write per run of adjacent pages and one fsync per file. Under a burst
+// of concurrent writers the cost of an fsync is shared by the whole batch.
+//
+// The pages of a batch are written in offset order, not overflow pages
+// before head pages as writeChain does. That is safe because no index slot
+// points at a new record before its batch is synced, and a head page
+// without an index slot is released when the files are opened.
+const (
+	defaultBatchSize = 128
+	defaultMaxDelay  = 0
+	// rebuildBatchSize is how many index slots a rebuild of index.db
+	// writes with one sync.
+	rebuildBatchSize = 1024
+)
+
+// ErrClosed is returned by writes to a closed FileHandler.
+var ErrClosed = errors.New("file handler is closed")
+
+type options struct {
+	batchSize int
+	maxDelay  time.Duration
+	mmap      bool
+	cipher    encryption.Cipher
+}
+
+// Option configures how a FileHandler reads and writes its files.
+type Option func(*options)
+
+// WithBatchSize sets how many records the writer stores with one fsync.
+// A size of 1 writes and syncs every record on its own.
+func WithBatchSize(n int) Option {
+	return func(o *options) { o.batchSize = max(n, 1) }
+}
+
+// WithMaxDelay sets how long the writer waits for more records once it has
+// one, while fewer than the batch size are waiting. The default of zero
+// never waits: a batch is whatever queued up during the previous fsync.
+func WithMaxDelay(d time.Duration) Option {
+	return func(o *options) { o.maxDelay = d }
+}
+
+type writeRequest struct {
+	// index is set for an index.db slot, which stores data for the record
+	// id at offset. Otherwise data is a record for data.db.
+	index  bool
+	id     uuid.UUID
+	offset int64
+	data   []byte
+	result chan writeResult
+}
+
+type writeResult struct {
+	offset int64
+	err    error
+}
+
+// pageWrite is a block of bytes to write at an offset of a file.
+type pageWrite struct {
+	offset int64
+	data   []byte
+}
+
+// submit queues req for the writer and waits for its result.
+func (h *FileHandler) submit(req *writeRequest) (int64, error) {
+	req.result = make(chan writeResult, 1)
+	select {
+	case h.requests <- req:
+	case <-h.closing:
+		return -1, ErrClosed
+	}
+	res := <-req.result
+	return res.offset, res.err
+}
+
+// commitNow commits reqs as one batch from the calling goroutine, without
+// the writer, and returns their results.
+func (h *FileHandler) commitNow(reqs []*writeRequest) []writeResult {
+	for _, req := range reqs {
+		req.result = make(chan writeResult, 1)
+	}
+	h.commit(reqs)
+
+	results := make([]writeResult, len(reqs))
+	for i, req := range reqs {
+		results[i] = <-req.result
+	}
+	return results
+}
+
+// runWriter commits batches of requests until the handler is closed. A
+// request the writer received is always committed, since requests are sent
+// on an unbuffered channel.
+func (h *FileHandler) runWriter() {
+	defer close(h.writerDone)
+
+	batch := make([]*writeRequest, 0, h.opts.batchSize)
+	for {
+		select {
+		case req := <-h.requests:
+			batch = append(batch[:0], req)
+		case <-h.closing:
+			return
+		}
+		batch = h.collect(batch)
+		h.commit(batch)
+	}
+}
+
+// collect adds the waiting requests to batch, waiting up to the max delay
+// for more, until it holds the batch size.
+func (h *FileHandler) collect(batch []*writeRequest) []*writeRequest {
+	var timeout <-chan time.Time
+	if h.opts.maxDelay > 0 {
+		timer := time.NewTimer(h.opts.maxDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for len(batch) < h.opts.batchSize {
+		if timeout == nil {
+			select {
+			case req := <-h.requests:
+				batch = append(batch, req)
+			default:
+				return batch
+			}
+			continue
+		}
+		select {
+		case req := <-h.requests:
+			batch = append(batch, req)
+		case <-timeout:
+			return batch
+		}
+	}
+	return batch
+}
+
+// commit writes and syncs a batch and answers every request in it. The
+// data file is synced before the index file, so the slot of a record
+// created in the same batch never outlives its pages.
+func (h *FileHandler) commit(batch []*writeRequest) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var (
+		results     = make([]writeResult, len(batch))
+		chains      = make([][]int64, len(batch))
+		dataWrites  []pageWrite
+		indexWrites []pageWrite
+		dataEnd     = int64(-1)
+		indexEnd    = int64(-1)
+	)
+	for i, req := range batch {
+		if req.index {
+			slot, err := h.allocateIndexSlot(&indexEnd)
+			if err != nil {
+				results[i] = writeResult{offset: -1, err: err}
+				continue
+			}
+			indexWrites = append(indexWrites, pageWrite{offset: slot, data: encodeIndexRecord(req.id, req.offset, req.data)})
+			results[i].offset = slot
+			continue
+		}
+
+		offsets, err := h.allocatePagesFrom(pagesFor(len(req.data)), &dataEnd)
+		if err != nil {
+			results[i] = writeResult{offset: -1, err: err}
+			continue
+		}
+		chains[i] = offsets
+		dataWrites = append(dataWrites, encodeChain(offsets, req.data)...)
+		results[i].offset = offsets[0]
+	}
+
+	dataErr := flushWrites(h.dataFile, dataWrites)
+	if dataErr != nil {
+		dataErr = fmt.Errorf("error writing record: %w", dataErr)
+	}
+	indexErr := flushWrites(h.indexFile, indexWrites)
+	if indexErr != nil {
+		indexErr = fmt.Errorf("error writing index record: %w", indexErr)
+	}
+
+	// The ends are only read from the files when a batch appends to them.
+	if dataEnd >= 0 {
+		h.dataMap.remap()
+	}
+	if indexEnd >= 0 {
+		h.indexMap.remap()
+	}
+
+	for i, req := range batch {
+		switch {
+		case results[i].err != nil:
+		case req.index && indexErr != nil:
+			h.releaseIndexSlot(results[i].offset)
+			results[i] = writeResult{offset: -1, err: indexErr}
+		case !req.index && dataErr != nil:
+			h.releasePages(chains[i])
+			results[i] = writeResult{offset: -1, err: dataErr}
+		case !req.index:
+			h.trackChain(chains[i])
+		}
+		req.result <- results[i]
+	}
+}
+
+// flushWrites writes every block to file, merging blocks that are adjacent
+// into a single write, and syncs the file.
+func flushWrites(file *os.File, writes []pageWrite) error {
+	if len(writes) == 0 {
+		return nil
+	}
+	sort.Slice(writes, func(i, j int) bool { return writes[i].offset < writes[j].offset })
+
+	start := writes[0].offset
+	buf := append([]byte(nil), writes[0].data...)
+	for _, w := range writes[1:] {
+		if w.offset == start+int64(len(buf)) {
+			buf = append(buf, w.data...)
+			continue
+		}
+		if _, err := file.WriteAt(buf, start); err != nil {
+			return err
+		}
+		start, buf = w.offset, append(buf[:0], w.data...)
+	}
+	if _, err := file.WriteAt(buf, start); err != nil {
+		return err
+	}
+	return file.Sync()
+}
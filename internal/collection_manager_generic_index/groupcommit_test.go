@@ -0,0 +1,108 @@
+package collection_manager_generic_index
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func TestGroupCommitConcurrentCreates(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := NewAt[*message.Message, *message.Index](dir, WithMaxDelay(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chatID := uuid.New()
+	const writers, perWriter = 16, 20
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		ids []uuid.UUID
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				// Every third message spans several pages.
+				msg := newLargeMessage(chatID, i%3*40)
+				created, err := db.Create(msg)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				ids = append(ids, created.ID)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewAt[*message.Message, *message.Index](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if got := db.Count(); got != writers*perWriter {
+		t.Fatalf("reopened store has %d items, want %d", got, writers*perWriter)
+	}
+	for _, id := range ids {
+		msg, err := db.Read(id)
+		if err != nil {
+			t.Fatalf("read %s: %v", id, err)
+		}
+		if msg.ChatID != chatID {
+			t.Fatalf("message %s has chat %s, want %s", id, msg.ChatID, chatID)
+		}
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	fh, err := NewFileHandlerAt(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fh.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteRecord([]byte("{}")); err != ErrClosed {
+		t.Fatalf("WriteRecord after Close returned %v, want ErrClosed", err)
+	}
+}
+
+// BenchmarkConcurrentCreate compares one write and fsync per record with
+// group commit, for 16 goroutines per CPU creating messages at once.
+func BenchmarkConcurrentCreate(b *testing.B) {
+	for _, batchSize := range []int{1, 8, defaultBatchSize} {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			db, err := NewAt[*message.Message, *message.Index](b.TempDir(), WithBatchSize(batchSize))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			chatID := uuid.New()
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := db.Create(newLargeMessage(chatID, 1)); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
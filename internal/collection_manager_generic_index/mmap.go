@@ -0,0 +1,120 @@
+package collection_manager_generic_index
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// mmapChunk is the granularity of a memory map. The map is made larger
+// than the file, so appends rarely need a remap; bytes past the end of the
+// file are never read through it.
+const mmapChunk = 64 << 20 // 64 MB
+
+var errMmapUnsupported = errors.New("memory-mapped reads are not supported on this platform")
+
+// mappedFile reads a file through a read-only memory map when one is set
+// up, and with pread otherwise. Reads of a mapped range return a slice of
+// the map instead of copying into a buffer.
+//
+// The map is replaced only by remap, which callers run while holding
+// h.mu for writing, and a slice of it is only valid while h.mu is held.
+// Writes still go through the file; the map sees them through the page
+// cache.
+type mappedFile struct {
+	file *os.File
+	data []byte
+	// size is the length of the file as of the last remap. Reads past it
+	// use pread, so a file that grew since is still read correctly.
+	size int64
+}
+
+// mapFile maps file for reading. When mapping fails, it logs why and
+// returns an unmapped file, which reads with pread.
+func mapFile(file *os.File) *mappedFile {
+	f := &mappedFile{file: file}
+	info, err := file.Stat()
+	if err == nil {
+		err = f.grow(info.Size())
+	}
+	if err != nil {
+		log.Printf("Reading %s without a memory map: %v", file.Name(), err)
+	}
+	return f
+}
+
+func (f *mappedFile) mapped() bool {
+	return f.data != nil
+}
+
+// remap updates the map after the file grew or shrank, mapping a larger
+// range when the file outgrew it. If that fails, the file is read with
+// pread from then on. It does nothing for a file that is not mapped, or
+// not set up yet while the files are prepared.
+func (f *mappedFile) remap() {
+	if f == nil || f.data == nil {
+		return
+	}
+	info, err := f.file.Stat()
+	if err == nil && info.Size() > int64(len(f.data)) {
+		err = f.grow(info.Size())
+	}
+	if err != nil {
+		log.Printf("Reading %s without a memory map: %v", f.file.Name(), err)
+		f.unmap()
+		return
+	}
+	f.size = info.Size()
+}
+
+// grow maps a range of the file large enough for size bytes.
+func (f *mappedFile) grow(size int64) error {
+	length := (size/mmapChunk + 1) * mmapChunk
+	data, err := mmap(f.file, int(length))
+	if err != nil {
+		return fmt.Errorf("error mapping %s: %w", f.file.Name(), err)
+	}
+	f.unmap()
+	f.data, f.size = data, size
+	return nil
+}
+
+// unmap releases the map, after which the file is read with pread.
+func (f *mappedFile) unmap() {
+	if f.data == nil {
+		return
+	}
+	if err := munmap(f.data); err != nil {
+		log.Printf("Error unmapping %s: %v", f.file.Name(), err)
+	}
+	f.data, f.size = nil, 0
+}
+
+// view returns the n bytes at off and how many of them are valid, which is
+// fewer at the end of the file. They are a slice of the map when it holds
+// them, and otherwise read from the file into buf, or into a new buffer if
+// buf is too small. A slice of the map must never be passed back as buf.
+func (f *mappedFile) view(off int64, n int, buf []byte) ([]byte, int, error) {
+	if end := off + int64(n); f.data != nil && off >= 0 && end <= f.size {
+		return f.data[off:end:end], n, nil
+	}
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	n, err := f.file.ReadAt(buf, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return buf, n, err
+}
+
+// WithMmap reads data.db and index.db through read-only memory maps, so
+// record lookups and index loads need neither a system call nor a buffer
+// per page. Where maps are not supported, or mapping a file fails, the
+// file is read with pread as without the option.
+func WithMmap() Option {
+	return func(o *options) { o.mmap = true }
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package collection_manager_generic_index
+
+import "os"
+
+func mmap(file *os.File, length int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,180 @@
+package collection_manager_generic_index
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+// TestMmapReads runs writes that grow and shrink both files against a
+// memory-mapped store and checks every read against the stored medias.
+func TestMmapReads(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := NewAt[*message.Message, *message.Index](dir, WithMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.fh.dataMap.mapped() || !db.fh.indexMap.mapped() {
+		t.Skip("memory maps are not supported on this platform")
+	}
+
+	chatID := uuid.New()
+	medias := make(map[uuid.UUID]int)
+	for i := 0; i < 150; i++ {
+		n := i % 5
+		if i%15 == 0 {
+			n = 60 // spans several pages
+		}
+		msg, err := db.Create(newLargeMessage(chatID, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		medias[msg.ID] = n
+	}
+
+	check := func(when string) {
+		t.Helper()
+		for id, n := range medias {
+			msg, err := db.Read(id)
+			if err != nil {
+				t.Fatalf("%s: read %s: %v", when, id, err)
+			}
+			if len(msg.Medias) != n {
+				t.Fatalf("%s: message %s has %d medias, want %d", when, id, len(msg.Medias), n)
+			}
+		}
+	}
+	check("after creates")
+
+	i := 0
+	for id := range medias {
+		switch i % 3 {
+		case 0:
+			if err := db.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+			delete(medias, id)
+		case 1:
+			current, err := db.Read(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			update := newLargeMessage(chatID, 80)
+			update.ID, update.Version = id, current.Version
+			if _, err := db.Update(update); err != nil {
+				t.Fatal(err)
+			}
+			medias[id] = 80
+		}
+		i++
+	}
+	check("after updates")
+
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check("after compaction")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuild index.db from the mapped data.db.
+	if err := os.Remove(filepath.Join(dir, "index.db")); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewAt[*message.Message, *message.Index](dir, WithMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if db.Count() != len(medias) {
+		t.Fatalf("rebuilt index has %d entries, want %d", db.Count(), len(medias))
+	}
+	check("after rebuild")
+}
+
+func newBenchmarkStore(b *testing.B, n int) (string, []uuid.UUID) {
+	b.Helper()
+	dir := b.TempDir()
+	db, err := NewAt[*message.Message, *message.Index](dir, WithBatchSize(1024))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	chatID := uuid.New()
+	ids := make([]uuid.UUID, n)
+	for i := range ids {
+		msg, err := db.Create(newLargeMessage(chatID, i%4))
+		if err != nil {
+			b.Fatal(err)
+		}
+		ids[i] = msg.ID
+	}
+	if err := db.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return dir, ids
+}
+
+// BenchmarkRandomRead reads random messages with pread and through the
+// memory map.
+func BenchmarkRandomRead(b *testing.B) {
+	dir, ids := newBenchmarkStore(b, 5000)
+
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%t", mmap), func(b *testing.B) {
+			var opts []Option
+			if mmap {
+				opts = append(opts, WithMmap())
+			}
+			db, err := NewAt[*message.Message, *message.Index](dir, opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			rng := rand.New(rand.NewSource(1))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Read(ids[rng.Intn(len(ids))]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRebuildIndex rebuilds index.db from data.db with pread and
+// through the memory map.
+func BenchmarkRebuildIndex(b *testing.B) {
+	dir, _ := newBenchmarkStore(b, 5000)
+	indexPath := filepath.Join(dir, "index.db")
+
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%t", mmap), func(b *testing.B) {
+			var opts []Option
+			if mmap {
+				opts = append(opts, WithMmap())
+			}
+			for i := 0; i < b.N; i++ {
+				if err := os.Remove(indexPath); err != nil {
+					b.Fatal(err)
+				}
+				db, err := NewAt[*message.Message, *message.Index](dir, opts...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				db.Close()
+			}
+		})
+	}
+}
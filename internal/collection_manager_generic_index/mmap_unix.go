@@ -0,0 +1,18 @@
+//go:build linux || darwin
+
+package collection_manager_generic_index
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap maps length bytes of file read-only. Both platforms keep shared
+// maps coherent with writes through the file.
+func mmap(file *os.File, length int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, length, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,212 @@
+package collection_manager_generic_index
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+)
+
+const quarantineDirName = "quarantine"
+
+// Corruption describes a record or index entry that failed verification.
+type Corruption struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+// VerifyReport is the result of Verify and Repair.
+type VerifyReport struct {
+	Records      int
+	IndexEntries int
+	Corrupt      []Corruption
+	// Quarantined lists the files corrupt records were copied to by Repair.
+	Quarantined []string
+}
+
+// OK reports whether no corruption was found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Corrupt) == 0
+}
+
+// Verify checks every record and index entry of the store in dir against
+// its checksum without modifying anything. The store must not be open.
+func Verify(dir string) (*VerifyReport, error) {
+	dataFile, err := os.Open(filepath.Join(dir, "data.db"))
+	if err != nil {
+		return nil, fmt.Errorf("error opening data file: %w", err)
+	}
+	defer dataFile.Close()
+
+	indexFile, err := os.Open(filepath.Join(dir, "index.db"))
+	if err != nil {
+		return nil, fmt.Errorf("error opening index file: %w", err)
+	}
+	defer indexFile.Close()
+
+	for _, f := range []struct {
+		file  *os.File
+		magic string
+	}{{dataFile, dataMagic}, {indexFile, indexMagic}} {
+		version, ok, err := readFileVersion(f.file, f.magic)
+		if err != nil {
+			return nil, fmt.Errorf("error reading header of %s: %w", f.file.Name(), err)
+		}
+		if ok && version != formatVersion {
+			return nil, fmt.Errorf("%s has format version %d, open the store once to migrate it to version %d", f.file.Name(), version, formatVersion)
+		}
+	}
+
+	report, _, err := verifyFiles(dataFile, indexFile)
+	return report, err
+}
+
+// Repair verifies the store in dir like Verify, copies every corrupt record
+// to the quarantine directory, frees its pages and resets the index if
+// needed, so the store opens cleanly and rebuilds its index from the
+// records that are intact. Older formats are migrated first. The store must
+// not be open.
+func Repair(dir string) (*VerifyReport, error) {
+	h, err := NewFileHandlerAt(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	report, corrupt, err := verifyFiles(h.dataFile, h.indexFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, head := range corrupt {
+		pages, ok := h.chains[head]
+		if !ok {
+			pages = []int64{head}
+		}
+
+		path, err := h.quarantine(head, pages)
+		if err != nil {
+			return report, fmt.Errorf("error quarantining record at offset %d: %w", head, err)
+		}
+		report.Quarantined = append(report.Quarantined, path)
+
+		if err := h.markPages(pages, StatusDeleted); err != nil {
+			return report, fmt.Errorf("error releasing record at offset %d: %w", head, err)
+		}
+		h.untrackChain(head)
+		h.releasePages(pages)
+	}
+
+	if !report.OK() {
+		// The index is rebuilt from the remaining records on the next open.
+		if err := h.resetIndexFile(); err != nil {
+			return report, err
+		}
+	}
+	if err := h.dataFile.Sync(); err != nil {
+		return report, fmt.Errorf("error syncing data file: %w", err)
+	}
+
+	return report, nil
+}
+
+// verifyFiles scans both files and returns the report together with the
+// head offsets of corrupt records.
+func verifyFiles(dataFile, indexFile *os.File) (*VerifyReport, []int64, error) {
+	report := &VerifyReport{}
+	dataName := filepath.Base(dataFile.Name())
+	indexName := filepath.Base(indexFile.Name())
+
+	info, err := dataFile.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting data file info: %w", err)
+	}
+
+	var corrupt []int64
+	heads := make(map[int64]bool)
+	status := make([]byte, recordStatusSize)
+	for offset := int64(dataHeaderSize); offset < info.Size(); offset += pageSize {
+		if _, err := dataFile.ReadAt(status, offset); err != nil && err != io.EOF {
+			return nil, nil, fmt.Errorf("error reading page at offset %d: %w", offset, err)
+		}
+		if status[0] != StatusActive {
+			continue
+		}
+
+		report.Records++
+		data, _, head, err := readChainAt(&mappedFile{file: dataFile}, offset, pageHeaderSize)
+		switch {
+		case err != nil:
+		case checksum(data) != head.crc:
+			err = ErrChecksumMismatch
+		case !json.Valid(data) && !encryption.IsSealed(data):
+			err = errors.New("record is not valid JSON")
+		}
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, Corruption{File: dataName, Offset: offset, Reason: err.Error()})
+			corrupt = append(corrupt, offset)
+			continue
+		}
+		heads[offset] = true
+	}
+
+	info, err = indexFile.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting index file info: %w", err)
+	}
+
+	record := make([]byte, indexRecordSize)
+	for offset := int64(indexHeaderSize); offset+indexRecordSize <= info.Size(); offset += indexRecordSize {
+		if _, err := indexFile.ReadAt(record, offset); err != nil {
+			return nil, nil, fmt.Errorf("error reading index record at offset %d: %w", offset, err)
+		}
+
+		id, dataOffset, _, err := decodeIndexRecord(record)
+		if err == nil && id == uuid.Nil {
+			continue
+		}
+		report.IndexEntries++
+		if err == nil && !heads[dataOffset] {
+			err = fmt.Errorf("entry for %s points at offset %d, which holds no intact record", id, dataOffset)
+		}
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, Corruption{File: indexName, Offset: offset, Reason: err.Error()})
+		}
+	}
+
+	return report, corrupt, nil
+}
+
+// quarantine copies the raw pages of a record to the quarantine directory
+// next to data.db and returns the path of the copy. Callers hold h.mu.
+func (h *FileHandler) quarantine(head int64, pages []int64) (string, error) {
+	dir := filepath.Join(filepath.Dir(h.dataPath), quarantineDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	raw := make([]byte, 0, len(pages)*pageSize)
+	page := make([]byte, pageSize)
+	for _, offset := range pages {
+		n, err := h.dataFile.ReadAt(page, offset)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		raw = append(raw, page[:n]...)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("data-%d.bin", head))
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
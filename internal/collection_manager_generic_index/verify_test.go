@@ -0,0 +1,85 @@
+package collection_manager_generic_index
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func TestChecksumVerifyRepair(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := NewAt[*message.Message, *message.Index](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chatID := uuid.New()
+	var ids []uuid.UUID
+	for i := 0; i < 5; i++ {
+		msg, err := db.Create(newLargeMessage(chatID, 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+
+	entry, err := db.GetIndexEntry(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte inside the JSON of the third record.
+	if _, err := db.fh.dataFile.WriteAt([]byte{'#'}, entry.Offset+pageHeaderSize+10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Read(ids[2]); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("got error %v reading a corrupt record, want %v", err, ErrChecksumMismatch)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The corrupt record and the index entry pointing at it.
+	if report.Records != 5 || len(report.Corrupt) != 2 || report.Corrupt[0].Offset != entry.Offset {
+		t.Fatalf("unexpected verify report: %+v", report)
+	}
+
+	report, err = Repair(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Quarantined) != 1 {
+		t.Fatalf("got %d quarantined records, want 1", len(report.Quarantined))
+	}
+	if _, err := os.Stat(filepath.Join(dir, quarantineDirName, filepath.Base(report.Quarantined[0]))); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewAt[*message.Message, *message.Index](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Count() != 4 {
+		t.Fatalf("got %d records after repair, want 4", db.Count())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("store still corrupt after repair: %+v", report)
+	}
+}
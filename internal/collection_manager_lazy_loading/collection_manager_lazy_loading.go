@@ -2,23 +2,24 @@ package collection_manager_lazy_loading
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"sync"
-	"time"
 
 	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/version"
 )
 
 const (
 	recordStatusSize = 1
 	recordSize       = 2048 // 2 KB
-	dataFileName     = "/app/tmp/messages/data.db"
-	indexFileName    = "/app/tmp/messages/index.db"
-	compactInterval  = 1 * time.Hour
+	dirName          = "/app/tmp/messages"
 )
 
 const (
@@ -39,23 +40,57 @@ type collectionIndex interface {
 
 // FileHandler is a struct for managing file resources and the index.
 type FileHandler struct {
-	file  *os.File
-	index map[uuid.UUID]int64
-	mu    sync.RWMutex
+	file      *os.File
+	index     map[uuid.UUID]int64
+	mu        sync.RWMutex
+	dataPath  string
+	indexPath string
+	// indexStale is set when the data file was migrated and the offsets in
+	// index.db no longer apply.
+	indexStale bool
+	// quarantined lists the files corrupt records were copied to.
+	quarantined []string
+	// slots maps every slot in use back to the ID stored there, and free
+	// holds the unused slots, sorted so the lowest ones are reused first.
+	slots   map[int64]uuid.UUID
+	free    []int64
+	metrics compactionStats
+	closed  bool
 }
 
 func NewFileHandler() (*FileHandler, error) {
+	return NewFileHandlerAt(dirName)
+}
+
+// NewFileHandlerAt opens or creates data.db and index.db in dir.
+func NewFileHandlerAt(dir string) (*FileHandler, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+
+	dataFileName := filepath.Join(dir, "data.db")
 	file, err := os.OpenFile(dataFileName, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("error opening data file: %w", err)
 	}
 
 	handler := &FileHandler{
-		file:  file,
-		index: make(map[uuid.UUID]int64),
+		file:      file,
+		index:     make(map[uuid.UUID]int64),
+		dataPath:  dataFileName,
+		indexPath: filepath.Join(dir, "index.db"),
+	}
+
+	if err := handler.prepareFormat(); err != nil {
+		handler.file.Close()
+		return nil, err
 	}
 
 	handler.loadIndex()
+	if err := handler.loadFreeSlots(); err != nil {
+		handler.file.Close()
+		return nil, err
+	}
 	return handler, nil
 }
 
@@ -63,36 +98,50 @@ func (h *FileHandler) Close() error {
 	if err := h.saveIndex(); err != nil {
 		log.Printf("Error saving index on close: %v", err)
 	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
 	return h.file.Close()
 }
 
 func (h *FileHandler) saveIndex() error {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	return h.writeIndex()
+}
 
+// writeIndex atomically replaces index.db. Callers hold h.mu.
+func (h *FileHandler) writeIndex() error {
 	stringIndex := make(map[string]int64)
 	for k, v := range h.index {
 		stringIndex[k.String()] = v
 	}
 
-	data, err := json.Marshal(stringIndex)
+	data, err := encodeIndex(stringIndex)
 	if err != nil {
 		return fmt.Errorf("error serializing index: %w", err)
 	}
 
-	tempFile := indexFileName + ".tmp"
+	tempFile := h.indexPath + ".tmp"
 	if err := os.WriteFile(tempFile, data, 0644); err != nil {
 		return fmt.Errorf("error writing temporary index file: %w", err)
 	}
 
-	return os.Rename(tempFile, indexFileName)
+	return os.Rename(tempFile, h.indexPath)
 }
 
 func (h *FileHandler) loadIndex() {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	data, err := os.ReadFile(indexFileName)
+	if h.indexStale {
+		log.Println("Index does not match the data file, rebuilding.")
+		h.rebuildIndex()
+		return
+	}
+
+	data, err := os.ReadFile(h.indexPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Println("Index file does not exist. A new one will be created.")
@@ -103,15 +152,29 @@ func (h *FileHandler) loadIndex() {
 		return
 	}
 
-	var stringIndex map[string]int64
-	if err := json.Unmarshal(data, &stringIndex); err != nil {
+	stringIndex, err := decodeIndex(data)
+	if err != nil {
 		log.Printf("Error deserializing index, attempting to rebuild: %v", err)
 		h.rebuildIndex()
 		return
 	}
 
+	fileInfo, err := h.file.Stat()
+	if err != nil {
+		log.Printf("Error getting file info, attempting to rebuild: %v", err)
+		h.rebuildIndex()
+		return
+	}
+
 	h.index = make(map[uuid.UUID]int64, len(stringIndex))
 	for k, v := range stringIndex {
+		// An offset outside the file is left by a compaction that truncated
+		// the file after the index was last saved.
+		if v < dataHeaderSize || v%recordSize != 0 || v >= fileInfo.Size() {
+			log.Printf("Index entry %s points outside the data file, attempting to rebuild", k)
+			h.rebuildIndex()
+			return
+		}
 		if id, err := uuid.Parse(k); err == nil {
 			h.index[id] = v
 		} else {
@@ -122,36 +185,71 @@ func (h *FileHandler) loadIndex() {
 	log.Printf("Loaded %d entries from index.", len(h.index))
 }
 
+// loadFreeSlots derives the free list from the index: every slot that no
+// index entry points to can be reused.
+func (h *FileHandler) loadFreeSlots() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fileInfo, err := h.file.Stat()
+	if err != nil {
+		return fmt.Errorf("error getting file info: %w", err)
+	}
+
+	h.slots = make(map[int64]uuid.UUID, len(h.index))
+	for id, offset := range h.index {
+		h.slots[offset] = id
+	}
+
+	h.free = nil
+	for offset := int64(dataHeaderSize); offset+recordSize <= fileInfo.Size(); offset += recordSize {
+		if _, used := h.slots[offset]; !used {
+			h.free = append(h.free, offset)
+		}
+	}
+	return nil
+}
+
 // WriteRecord writes a new record and returns a UUID.
 func (h *FileHandler) WriteRecord(data []byte, id uuid.UUID) (uuid.UUID, error) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if len(data) > recordSize-recordStatusSize {
-		return uuid.Nil, fmt.Errorf("data size is larger than max record size (%d bytes)", recordSize-recordStatusSize)
+	if len(data) > maxDataSize {
+		return uuid.Nil, fmt.Errorf("data size is larger than max record size (%d bytes)", maxDataSize)
 	}
 
-	offset, err := h.file.Seek(0, io.SeekEnd)
-	if err != nil {
-		return uuid.Nil, fmt.Errorf("error seeking to end of file: %w", err)
+	// Reuse the lowest free slot before growing the file.
+	var offset int64
+	if len(h.free) > 0 {
+		offset = h.free[0]
+		h.free = h.free[1:]
+	} else {
+		end, err := h.file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("error seeking to end of file: %w", err)
+		}
+		offset = end
 	}
 
-	recordBuffer := make([]byte, recordSize)
-	recordBuffer[0] = StatusActive
-	copy(recordBuffer[recordStatusSize:], data)
+	recordBuffer := encodeSlot(StatusActive, data)
 
-	if _, err := h.file.Write(recordBuffer); err != nil {
+	if _, err := h.file.WriteAt(recordBuffer, offset); err != nil {
+		h.releaseSlot(offset)
 		return uuid.Nil, fmt.Errorf("error writing record: %w", err)
 	}
 
 	h.index[id] = offset
+	h.slots[offset] = id
 	return id, nil
 }
 
 func (h *FileHandler) ReadRecord(recordUUID uuid.UUID) ([]byte, error) {
+	// The lock is held during the read, as compaction may move the record.
 	h.mu.RLock()
+	defer h.mu.RUnlock()
+
 	offset, ok := h.index[recordUUID]
-	h.mu.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("UUID not found: %s", recordUUID)
 	}
@@ -165,12 +263,11 @@ func (h *FileHandler) ReadRecord(recordUUID uuid.UUID) ([]byte, error) {
 		return nil, fmt.Errorf("record with UUID %s is marked as deleted", recordUUID)
 	}
 
-	dataLength := bytes.IndexByte(recordBuffer[recordStatusSize:], 0)
-	if dataLength == -1 {
-		dataLength = recordSize - recordStatusSize
+	data, err := decodeSlot(recordBuffer)
+	if err != nil {
+		return nil, fmt.Errorf("record with UUID %s at offset %d: %w", recordUUID, offset, err)
 	}
-
-	return recordBuffer[recordStatusSize : recordStatusSize+dataLength], nil
+	return data, nil
 }
 
 func (h *FileHandler) HasRecord(recordUUID uuid.UUID) bool {
@@ -189,13 +286,11 @@ func (h *FileHandler) UpdateRecord(recordUUID uuid.UUID, data []byte) error {
 		return fmt.Errorf("UUID not found: %s", recordUUID)
 	}
 
-	if len(data) > recordSize-recordStatusSize {
-		return fmt.Errorf("data size is larger than max record size (%d bytes)", recordSize-recordStatusSize)
+	if len(data) > maxDataSize {
+		return fmt.Errorf("data size is larger than max record size (%d bytes)", maxDataSize)
 	}
 
-	recordBuffer := make([]byte, recordSize)
-	recordBuffer[0] = StatusActive
-	copy(recordBuffer[recordStatusSize:], data)
+	recordBuffer := encodeSlot(StatusActive, data)
 
 	if _, err := h.file.WriteAt(recordBuffer, offset); err != nil {
 		return fmt.Errorf("error updating record: %w", err)
@@ -218,6 +313,8 @@ func (h *FileHandler) DeleteRecord(recordUUID uuid.UUID) error {
 	}
 
 	delete(h.index, recordUUID)
+	delete(h.slots, offset)
+	h.releaseSlot(offset)
 	return nil
 }
 
@@ -232,10 +329,8 @@ func (h *FileHandler) GetAllUUIDs() []uuid.UUID {
 	return uuids
 }
 
+// rebuildIndex scans the data file for active records. Callers hold h.mu.
 func (h *FileHandler) rebuildIndex() error {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
 	h.index = make(map[uuid.UUID]int64)
 	fileInfo, err := h.file.Stat()
 	if err != nil {
@@ -243,7 +338,7 @@ func (h *FileHandler) rebuildIndex() error {
 	}
 	fileSize := fileInfo.Size()
 
-	for offset := int64(0); offset < fileSize; offset += recordSize {
+	for offset := int64(dataHeaderSize); offset < fileSize; offset += recordSize {
 		recordBuffer := make([]byte, recordSize)
 		n, err := h.file.ReadAt(recordBuffer, offset)
 		if err != nil && err != io.EOF {
@@ -255,11 +350,23 @@ func (h *FileHandler) rebuildIndex() error {
 			continue
 		}
 
-		dataLength := bytes.IndexByte(recordBuffer[recordStatusSize:], 0)
-		if dataLength == -1 {
-			dataLength = recordSize - recordStatusSize
+		data, err := decodeSlot(recordBuffer)
+		if err == nil && !json.Valid(data) {
+			err = fmt.Errorf("record is not valid JSON")
+		}
+		if err != nil {
+			// The slot is about to become free, so keep a copy of it.
+			path, qerr := h.quarantine(offset)
+			if qerr != nil {
+				log.Printf("Error quarantining record at offset %d: %v", offset, qerr)
+				continue
+			}
+			log.Printf("Quarantined unreadable record at offset %d to %s: %v", offset, path, err)
+			if _, err := h.file.WriteAt([]byte{StatusDeleted}, offset); err != nil {
+				log.Printf("Error marking record at offset %d as deleted: %v", offset, err)
+			}
+			continue
 		}
-		data := recordBuffer[recordStatusSize : recordStatusSize+dataLength]
 
 		var item struct {
 			ID uuid.UUID `json:"id"`
@@ -278,57 +385,6 @@ func (h *FileHandler) rebuildIndex() error {
 	return nil
 }
 
-func (h *FileHandler) Compact() error {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	tempFileName := dataFileName + ".tmp"
-	tempFile, err := os.Create(tempFileName)
-	if err != nil {
-		return fmt.Errorf("error creating temporary file: %w", err)
-	}
-	defer tempFile.Close()
-
-	oldIndex := h.index
-	newIndex := make(map[uuid.UUID]int64)
-
-	var currentOffset int64 = 0
-	for u, oldOffset := range oldIndex {
-		recordBuffer := make([]byte, recordSize)
-		_, err := h.file.ReadAt(recordBuffer, oldOffset)
-		if err != nil {
-			log.Printf("Error reading record %s for compaction: %v", u, err)
-			continue
-		}
-
-		if _, err := tempFile.Write(recordBuffer); err != nil {
-			log.Printf("Error writing record %s to temporary file: %v", u, err)
-			continue
-		}
-
-		newIndex[u] = currentOffset
-		currentOffset += recordSize
-	}
-
-	h.file.Close()
-	if err := os.Rename(tempFileName, dataFileName); err != nil {
-		return fmt.Errorf("error renaming temporary file: %w", err)
-	}
-
-	h.file, err = os.OpenFile(dataFileName, os.O_RDWR, 0644)
-	if err != nil {
-		return fmt.Errorf("error reopening data file: %w", err)
-	}
-
-	h.index = newIndex
-	if err := h.saveIndex(); err != nil {
-		log.Printf("Error saving index after compaction: %v", err)
-	}
-
-	log.Printf("Data file compacted. %d active records remain.", len(h.index))
-	return nil
-}
-
 // ---
 
 type registry[T any] struct {
@@ -386,13 +442,20 @@ func (r *registry[T]) count() int {
 
 // Manager is the main struct for managing the collection.
 type Manager[T collectionItem] struct {
-	fh    *FileHandler
-	items *registry[T]
-	mu    sync.RWMutex
+	fh        *FileHandler
+	items     *registry[T]
+	mu        sync.RWMutex
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 func New[T collectionItem]() (*Manager[T], error) {
-	fh, err := NewFileHandler()
+	return NewAt[T](dirName)
+}
+
+// NewAt opens the collection stored in dir.
+func NewAt[T collectionItem](dir string) (*Manager[T], error) {
+	fh, err := NewFileHandlerAt(dir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file handler: %w", err)
 	}
@@ -400,30 +463,30 @@ func New[T collectionItem]() (*Manager[T], error) {
 	manager := &Manager[T]{
 		fh:    fh,
 		items: newRegistry[T](),
+		stop:  make(chan struct{}),
 	}
 
 	go manager.startCompactionRoutine()
 	return manager, nil
 }
 
-func (m *Manager[T]) startCompactionRoutine() {
-	ticker := time.NewTicker(compactInterval)
-	defer ticker.Stop()
-	for range ticker.C {
-		log.Println("Starting compaction routine...")
-		if err := m.fh.Compact(); err != nil {
-			log.Printf("Compaction failed: %v", err)
-		} else {
-			log.Println("Compaction routine finished.")
-		}
-	}
-}
-
 func (m *Manager[T]) Close() error {
+	m.closeOnce.Do(func() { close(m.stop) })
 	return m.fh.Close()
 }
 
 func (m *Manager[T]) loadItemFromDisk(id uuid.UUID) (T, error) {
+	item, err := m.readStored(id)
+	if err != nil {
+		return item, err
+	}
+	m.items.create(id, item)
+
+	return item, nil
+}
+
+// readStored decodes the record of an item from disk, without caching it.
+func (m *Manager[T]) readStored(id uuid.UUID) (T, error) {
 	var zero T
 
 	data, err := m.fh.ReadRecord(id)
@@ -439,8 +502,6 @@ func (m *Manager[T]) loadItemFromDisk(id uuid.UUID) (T, error) {
 	// This is the crucial fix: set the ID on the unmarshaled item
 	item.SetID(id)
 
-	m.items.create(id, item)
-
 	return item, nil
 }
 
@@ -448,15 +509,23 @@ func (m *Manager[T]) Create(newItem T) (T, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Step 1: Generate the UUID
-	id, err := uuid.NewV7()
-	if err != nil {
+	// Step 1: Keep an ID set by the caller, otherwise generate the UUID
+	id := newItem.GetID()
+	if id == uuid.Nil {
+		var err error
+		if id, err = uuid.NewV7(); err != nil {
+			var zero T
+			return zero, fmt.Errorf("error generating UUID: %w", err)
+		}
+
+		// Step 2: Set the UUID on the new item
+		newItem.SetID(id)
+	} else if m.fh.HasRecord(id) {
 		var zero T
-		return zero, fmt.Errorf("error generating UUID: %w", err)
+		return zero, fmt.Errorf("item with ID %s already exists", id)
 	}
 
-	// Step 2: Set the UUID on the new item
-	newItem.SetID(id)
+	version.Init(newItem)
 
 	// Step 3: Marshal the item (now with a UUID) to JSON
 	data, err := json.Marshal(newItem)
@@ -529,6 +598,48 @@ func (m *Manager[T]) ReadAll() ([]T, error) {
 	return items, nil
 }
 
+// Iterate calls fn for every item in the collection in ID order until fn
+// returns false or ctx is cancelled.
+func (m *Manager[T]) Iterate(ctx context.Context, fn func(item T) bool) error {
+	return m.IterateFrom(ctx, uuid.Nil, fn)
+}
+
+// IterateFrom calls fn for every item whose ID is from or after it, in ID
+// order, until fn returns false or ctx is cancelled. Items are loaded from
+// disk one at a time, and items deleted during the iteration are skipped.
+func (m *Manager[T]) IterateFrom(ctx context.Context, from uuid.UUID, fn func(item T) bool) error {
+	m.mu.RLock()
+	uuids := m.fh.GetAllUUIDs()
+	m.mu.RUnlock()
+
+	uuids = slices.DeleteFunc(uuids, func(id uuid.UUID) bool {
+		return bytes.Compare(id[:], from[:]) < 0
+	})
+	slices.SortFunc(uuids, func(a, b uuid.UUID) int {
+		return bytes.Compare(a[:], b[:])
+	})
+
+	for _, id := range uuids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		item, err := m.Read(id)
+		if err != nil {
+			if !m.fh.HasRecord(id) {
+				continue
+			}
+			return err
+		}
+		if !fn(item) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Update an existing item. Items that carry a version must be based on the
+// stored one, which is then incremented; a failed update keeps the version
+// it had.
 func (m *Manager[T]) Update(updatedItem T) (T, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -540,13 +651,28 @@ func (m *Manager[T]) Update(updatedItem T) (T, error) {
 		return zero, fmt.Errorf("item with ID %s does not exist", id.String())
 	}
 
+	// Callers may have changed the cached item in place, so the version is
+	// checked against the record as stored.
+	current, err := m.readStored(id)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	if err := version.Check(id, current, updatedItem); err != nil {
+		var zero T
+		return zero, err
+	}
+	previous := version.Bump(updatedItem)
+
 	data, err := json.Marshal(updatedItem)
 	if err != nil {
+		version.Reset(updatedItem, previous)
 		var zero T
 		return zero, fmt.Errorf("error marshaling item: %w", err)
 	}
 
 	if err := m.fh.UpdateRecord(id, data); err != nil {
+		version.Reset(updatedItem, previous)
 		var zero T
 		return zero, fmt.Errorf("error updating record: %w", err)
 	}
@@ -0,0 +1,249 @@
+package collection_manager_lazy_loading
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// compactBatchSize is how many records a compaction step moves while
+	// holding the handler lock; reads and writes run between steps.
+	compactBatchSize = 64
+	// compactCheckInterval is how often the background routine looks at
+	// how much of the data file is free space.
+	compactCheckInterval = 1 * time.Minute
+	// A background compaction starts once free space reaches both limits.
+	compactMinFreeBytes = 1 << 20 // 1 MB
+	compactMinFreeRatio = 0.25
+)
+
+// CompactionMetrics describes the work done by compaction so far and the
+// space currently waiting to be reused or reclaimed.
+type CompactionMetrics struct {
+	Runs             int64
+	RelocatedRecords int64
+	ReclaimedBytes   int64
+	FreeBytes        int64
+	FileBytes        int64
+	LastRun          time.Time
+	LastDuration     time.Duration
+}
+
+type compactionStats struct {
+	mu      sync.Mutex
+	metrics CompactionMetrics
+}
+
+func (s *compactionStats) record(start time.Time, relocated int, reclaimed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics.Runs++
+	s.metrics.RelocatedRecords += int64(relocated)
+	s.metrics.ReclaimedBytes += reclaimed
+	s.metrics.LastRun = start
+	s.metrics.LastDuration = time.Since(start)
+}
+
+func (s *compactionStats) snapshot() CompactionMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metrics
+}
+
+// releaseSlot adds a slot to the free list. Callers hold h.mu.
+func (h *FileHandler) releaseSlot(offset int64) {
+	i := sort.Search(len(h.free), func(i int) bool { return h.free[i] >= offset })
+	if i < len(h.free) && h.free[i] == offset {
+		return
+	}
+	h.free = append(h.free, 0)
+	copy(h.free[i+1:], h.free[i:])
+	h.free[i] = offset
+}
+
+// Compact shrinks the data file by moving the records in its last slots
+// into free slots nearer the start, then truncating the tail. It works in
+// small steps and releases the lock between them, so reads and writes
+// continue while it runs.
+//
+// Within a step the moved records are copied first and the index is saved
+// before their old slots are released, so a crash at any point leaves an
+// index that points at intact records.
+func (h *FileHandler) Compact(ctx context.Context) error {
+	start := time.Now()
+	var relocated int
+	var reclaimed int64
+
+	defer func() {
+		h.metrics.record(start, relocated, reclaimed)
+	}()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		moved, freed, done, err := h.compactStep(compactBatchSize)
+		relocated += moved
+		reclaimed += freed
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+	}
+
+	if relocated > 0 || reclaimed > 0 {
+		log.Printf("Data file compacted. Moved %d records and reclaimed %d bytes, %d active records remain.", relocated, reclaimed, h.Count())
+	}
+	return nil
+}
+
+func (h *FileHandler) compactStep(limit int) (moved int, reclaimed int64, done bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return 0, 0, false, fmt.Errorf("file handler is closed")
+	}
+
+	fileInfo, err := h.file.Stat()
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("error getting file info: %w", err)
+	}
+	size := fileInfo.Size() - fileInfo.Size()%recordSize
+	end := size
+
+	// Copy the records at the end of the file into the lowest free slots.
+	var released []int64
+	recordBuffer := make([]byte, recordSize)
+	for moved < limit && end > dataHeaderSize {
+		last := end - recordSize
+		if n := len(h.free); n > 0 && h.free[n-1] == last {
+			h.free = h.free[:n-1]
+			end = last
+			continue
+		}
+		if len(h.free) == 0 || h.free[0] > last {
+			break
+		}
+
+		id, ok := h.slots[last]
+		if !ok {
+			break
+		}
+		target := h.free[0]
+
+		if _, err := h.file.ReadAt(recordBuffer, last); err != nil {
+			return moved, reclaimed, false, fmt.Errorf("error reading record %s for compaction: %w", id, err)
+		}
+		if _, err := h.file.WriteAt(recordBuffer, target); err != nil {
+			return moved, reclaimed, false, fmt.Errorf("error writing record %s during compaction: %w", id, err)
+		}
+
+		h.free = h.free[1:]
+		h.index[id] = target
+		h.slots[target] = id
+		delete(h.slots, last)
+		released = append(released, last)
+		end = last
+		moved++
+	}
+
+	if moved > 0 {
+		if err := h.file.Sync(); err != nil {
+			return moved, reclaimed, false, fmt.Errorf("error syncing data file: %w", err)
+		}
+		if err := h.writeIndex(); err != nil {
+			return moved, reclaimed, false, fmt.Errorf("error saving index during compaction: %w", err)
+		}
+	}
+
+	// The old slots all lie past end; they are flagged first so that a
+	// failed truncate leaves nothing that a rebuild would pick up twice.
+	for _, offset := range released {
+		if _, err := h.file.WriteAt([]byte{StatusDeleted}, offset); err != nil {
+			return moved, reclaimed, false, fmt.Errorf("error releasing slot at offset %d: %w", offset, err)
+		}
+	}
+
+	if end < fileInfo.Size() {
+		if err := h.file.Truncate(end); err != nil {
+			return moved, reclaimed, false, fmt.Errorf("error truncating data file: %w", err)
+		}
+		reclaimed = fileInfo.Size() - end
+	}
+
+	return moved, reclaimed, moved < limit, nil
+}
+
+// Count returns the number of active records.
+func (h *FileHandler) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.index)
+}
+
+// Metrics returns compaction counters and the current free space.
+func (h *FileHandler) Metrics() CompactionMetrics {
+	metrics := h.metrics.snapshot()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	metrics.FreeBytes = int64(len(h.free)) * recordSize
+	if fileInfo, err := h.file.Stat(); err == nil {
+		metrics.FileBytes = fileInfo.Size()
+	}
+	return metrics
+}
+
+// ---
+
+// Compact compacts the data file while the collection stays available.
+func (m *Manager[T]) Compact(ctx context.Context) error {
+	return m.fh.Compact(ctx)
+}
+
+// Metrics returns compaction counters and the current free space.
+func (m *Manager[T]) Metrics() CompactionMetrics {
+	return m.fh.Metrics()
+}
+
+// startCompactionRoutine compacts in the background whenever enough of the
+// data file is free space, until the manager is closed.
+func (m *Manager[T]) startCompactionRoutine() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-m.stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(compactCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+
+		metrics := m.fh.Metrics()
+		if metrics.FreeBytes < compactMinFreeBytes || float64(metrics.FreeBytes) < compactMinFreeRatio*float64(metrics.FileBytes) {
+			continue
+		}
+
+		log.Println("Starting compaction routine...")
+		if err := m.Compact(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Compaction failed: %v", err)
+		} else {
+			log.Println("Compaction routine finished.")
+		}
+	}
+}
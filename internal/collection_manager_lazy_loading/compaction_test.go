@@ -0,0 +1,106 @@
+package collection_manager_lazy_loading
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func TestCompactWhileReading(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := NewAt[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []uuid.UUID
+	for i := 0; i < 300; i++ {
+		msg, err := db.Create(&message.Message{Caption: "compact"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+
+	var kept []uuid.UUID
+	for i, id := range ids {
+		if i%3 == 0 {
+			kept = append(kept, id)
+			continue
+		}
+		if err := db.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A new record takes a free slot instead of growing the file.
+	dataPath := filepath.Join(dir, "data.db")
+	before, err := os.Stat(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := db.Create(&message.Message{Caption: "reused"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept = append(kept, msg.ID)
+	if info, err := os.Stat(dataPath); err != nil || info.Size() != before.Size() {
+		t.Fatalf("data file grew although free slots were available")
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, id := range kept {
+				if _, err := db.fh.ReadRecord(id); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	wg.Wait()
+
+	metrics := db.Metrics()
+	if want := dataHeaderSize + int64(len(kept))*recordSize; metrics.FileBytes != want {
+		t.Fatalf("got %d bytes after compaction, want %d", metrics.FileBytes, want)
+	}
+	if metrics.ReclaimedBytes != before.Size()-metrics.FileBytes || metrics.FreeBytes != 0 {
+		t.Fatalf("unexpected metrics after compaction: %+v", metrics)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewAt[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, id := range kept {
+		if _, err := db.Read(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
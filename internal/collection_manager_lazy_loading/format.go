@@ -0,0 +1,209 @@
+package collection_manager_lazy_loading
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+)
+
+// Slot layout of data.db. Every record takes one fixed slot:
+//
+//	[status 1][length 2][crc 4][json ...][zero padding]
+//
+// crc is the CRC32C of the JSON. The first slot of the file holds the file
+// header with the magic and format version instead of a record.
+const (
+	slotHeaderSize = recordStatusSize + 2 + 4
+	maxDataSize    = recordSize - slotHeaderSize
+	dataHeaderSize = recordSize
+)
+
+// File format versions. Version 0 is the original headerless layout of
+// zero-padded JSON without a checksum; such files are migrated on open.
+const (
+	formatVersionLegacy = 0
+	formatVersion       = 1
+	dataMagic           = "IRISLAZY"
+)
+
+// ErrChecksumMismatch is returned when a record or the index does not match
+// its stored checksum, which points at a torn write or bit rot.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+func encodeSlot(status byte, data []byte) []byte {
+	slot := make([]byte, recordSize)
+	slot[0] = status
+	binary.LittleEndian.PutUint16(slot[1:3], uint16(len(data)))
+	binary.LittleEndian.PutUint32(slot[3:7], checksum(data))
+	copy(slot[slotHeaderSize:], data)
+	return slot
+}
+
+// decodeSlot returns the record data of a slot after checking its checksum.
+func decodeSlot(slot []byte) ([]byte, error) {
+	if len(slot) < slotHeaderSize {
+		return nil, fmt.Errorf("truncated record: %w", ErrChecksumMismatch)
+	}
+	length := int(binary.LittleEndian.Uint16(slot[1:3]))
+	if length == 0 || length > maxDataSize || slotHeaderSize+length > len(slot) {
+		return nil, fmt.Errorf("invalid record length %d: %w", length, ErrChecksumMismatch)
+	}
+
+	data := slot[slotHeaderSize : slotHeaderSize+length]
+	if checksum(data) != binary.LittleEndian.Uint32(slot[3:7]) {
+		return nil, ErrChecksumMismatch
+	}
+	return data, nil
+}
+
+// indexFile is the JSON document stored in index.db. CRC covers the JSON
+// encoding of Entries, which is deterministic since map keys are sorted.
+type indexFile struct {
+	Version int              `json:"version"`
+	CRC     uint32           `json:"crc"`
+	Entries map[string]int64 `json:"entries"`
+}
+
+func encodeIndex(entries map[string]int64) ([]byte, error) {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(indexFile{Version: formatVersion, CRC: checksum(data), Entries: entries})
+}
+
+// decodeIndex parses index.db. Index files written before checksums were
+// added hold the plain ID to offset map and are accepted as they are.
+func decodeIndex(data []byte) (map[string]int64, error) {
+	var file indexFile
+	if err := json.Unmarshal(data, &file); err == nil && file.Entries != nil {
+		entries, err := json.Marshal(file.Entries)
+		if err != nil {
+			return nil, err
+		}
+		if checksum(entries) != file.CRC {
+			return nil, ErrChecksumMismatch
+		}
+		return file.Entries, nil
+	}
+
+	var legacy map[string]int64
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, err
+	}
+	return legacy, nil
+}
+
+// prepareFormat writes the header to a new data file, migrates legacy files
+// and rejects files written by a newer version.
+func (h *FileHandler) prepareFormat() error {
+	header := make([]byte, len(dataMagic)+2)
+	n, err := h.file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("error reading data file header: %w", err)
+	}
+
+	switch {
+	case n == 0:
+		slot := make([]byte, dataHeaderSize)
+		copy(slot, dataMagic)
+		binary.LittleEndian.PutUint16(slot[len(dataMagic):], formatVersion)
+		if _, err := h.file.WriteAt(slot, 0); err != nil {
+			return fmt.Errorf("error writing data file header: %w", err)
+		}
+	case n < len(header) || !bytes.Equal(header[:len(dataMagic)], []byte(dataMagic)):
+		if err := h.migrateLegacyData(); err != nil {
+			return fmt.Errorf("error migrating legacy data file: %w", err)
+		}
+		h.indexStale = true
+	default:
+		if version := binary.LittleEndian.Uint16(header[len(dataMagic):]); version > formatVersion {
+			return fmt.Errorf("data file format version %d is newer than supported version %d", version, formatVersion)
+		}
+	}
+	return nil
+}
+
+// migrateLegacyData rewrites a version 0 data file into the current format.
+// The original file is kept next to the new one with a ".v0" suffix.
+func (h *FileHandler) migrateLegacyData() error {
+	legacy := h.file
+
+	info, err := legacy.Stat()
+	if err != nil {
+		return err
+	}
+
+	migratingPath := h.dataPath + ".migrating"
+	migrated, err := os.OpenFile(migratingPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, dataHeaderSize)
+	copy(header, dataMagic)
+	binary.LittleEndian.PutUint16(header[len(dataMagic):], formatVersion)
+	if _, err := migrated.WriteAt(header, 0); err != nil {
+		migrated.Close()
+		return err
+	}
+
+	count := 0
+	slot := make([]byte, recordSize)
+	offset := int64(dataHeaderSize)
+	for old := int64(0); old < info.Size(); old += recordSize {
+		n, err := legacy.ReadAt(slot, old)
+		if err != nil && err != io.EOF {
+			log.Printf("Error reading legacy record at offset %d: %v", old, err)
+			continue
+		}
+		if n == 0 || slot[0] == StatusDeleted {
+			continue
+		}
+
+		dataLength := bytes.IndexByte(slot[recordStatusSize:], 0)
+		if dataLength == -1 {
+			dataLength = recordSize - recordStatusSize
+		}
+		if dataLength == 0 || dataLength > maxDataSize {
+			log.Printf("Skipping legacy record at offset %d with length %d, it stays in %s.v0", old, dataLength, h.dataPath)
+			continue
+		}
+
+		if _, err := migrated.WriteAt(encodeSlot(StatusActive, slot[recordStatusSize:recordStatusSize+dataLength]), offset); err != nil {
+			migrated.Close()
+			return err
+		}
+		offset += recordSize
+		count++
+	}
+
+	if err := migrated.Sync(); err != nil {
+		migrated.Close()
+		return err
+	}
+	legacy.Close()
+	h.file = migrated
+
+	if err := os.Rename(h.dataPath, h.dataPath+".v0"); err != nil {
+		return err
+	}
+	if err := os.Rename(migratingPath, h.dataPath); err != nil {
+		return err
+	}
+
+	log.Printf("Migrated %d records in %s from format version %d to %d", count, h.dataPath, formatVersionLegacy, formatVersion)
+	return nil
+}
@@ -0,0 +1,207 @@
+package collection_manager_lazy_loading
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+const quarantineDirName = "quarantine"
+
+// Corruption describes a record or index entry that failed verification.
+type Corruption struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+// VerifyReport is the result of Verify and Repair.
+type VerifyReport struct {
+	Records      int
+	IndexEntries int
+	Corrupt      []Corruption
+	// Quarantined lists the files corrupt records were copied to by Repair.
+	Quarantined []string
+}
+
+// OK reports whether no corruption was found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Corrupt) == 0
+}
+
+// Verify checks every record of the store in dir and its index against
+// their checksums without modifying anything. The store must not be open.
+func Verify(dir string) (*VerifyReport, error) {
+	file, err := os.Open(filepath.Join(dir, "data.db"))
+	if err != nil {
+		return nil, fmt.Errorf("error opening data file: %w", err)
+	}
+	defer file.Close()
+
+	header := make([]byte, len(dataMagic)+2)
+	if _, err := file.ReadAt(header, 0); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading data file header: %w", err)
+	}
+	if !bytes.Equal(header[:len(dataMagic)], []byte(dataMagic)) {
+		return nil, fmt.Errorf("%s has format version %d, open the store once to migrate it to version %d", file.Name(), formatVersionLegacy, formatVersion)
+	}
+	if version := binary.LittleEndian.Uint16(header[len(dataMagic):]); version != formatVersion {
+		return nil, fmt.Errorf("%s has unsupported format version %d", file.Name(), version)
+	}
+
+	report, intact, _, err := verifyData(file)
+	if err != nil {
+		return nil, err
+	}
+
+	indexPath := filepath.Join(dir, "index.db")
+	data, err := os.ReadFile(indexPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return report, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading index file: %w", err)
+	}
+
+	entries, err := decodeIndex(data)
+	if err != nil {
+		report.Corrupt = append(report.Corrupt, Corruption{File: filepath.Base(indexPath), Reason: err.Error()})
+		return report, nil
+	}
+	for id, offset := range entries {
+		report.IndexEntries++
+		if !intact[offset] {
+			report.Corrupt = append(report.Corrupt, Corruption{
+				File:   filepath.Base(indexPath),
+				Offset: offset,
+				Reason: fmt.Sprintf("entry for %s points at offset %d, which holds no intact record", id, offset),
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// Repair verifies the store in dir, copies every corrupt record to the
+// quarantine directory and frees its slot, and rewrites the index from the
+// records that are intact. A legacy store is migrated first. The store must
+// not be open.
+func Repair(dir string) (*VerifyReport, error) {
+	// Verify before opening, since opening may already rebuild the index and
+	// quarantine records on its own. A legacy store is verified once migrated.
+	report, verifyErr := Verify(dir)
+
+	h, err := NewFileHandlerAt(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	current, _, corrupt, err := verifyData(h.file)
+	if err != nil {
+		return nil, err
+	}
+	if verifyErr != nil {
+		report = current
+	}
+	defer func() {
+		report.Quarantined = h.quarantined
+	}()
+
+	for _, offset := range corrupt {
+		if _, err := h.quarantine(offset); err != nil {
+			return report, fmt.Errorf("error quarantining record at offset %d: %w", offset, err)
+		}
+
+		if _, err := h.file.WriteAt([]byte{StatusDeleted}, offset); err != nil {
+			return report, fmt.Errorf("error releasing record at offset %d: %w", offset, err)
+		}
+	}
+
+	if err := h.rebuildIndex(); err != nil {
+		return report, err
+	}
+	h.slots = make(map[int64]uuid.UUID, len(h.index))
+	for id, offset := range h.index {
+		h.slots[offset] = id
+	}
+	if err := h.writeIndex(); err != nil {
+		return report, err
+	}
+	if err := h.file.Sync(); err != nil {
+		return report, fmt.Errorf("error syncing data file: %w", err)
+	}
+
+	return report, nil
+}
+
+// verifyData scans every active slot and returns the report, the offsets of
+// intact records and the offsets of corrupt ones.
+func verifyData(file *os.File) (*VerifyReport, map[int64]bool, []int64, error) {
+	report := &VerifyReport{}
+	name := filepath.Base(file.Name())
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error getting file info: %w", err)
+	}
+
+	intact := make(map[int64]bool)
+	var corrupt []int64
+	slot := make([]byte, recordSize)
+	for offset := int64(dataHeaderSize); offset < info.Size(); offset += recordSize {
+		n, err := file.ReadAt(slot, offset)
+		if err != nil && err != io.EOF {
+			return nil, nil, nil, fmt.Errorf("error reading record at offset %d: %w", offset, err)
+		}
+		if n == 0 || slot[0] == StatusDeleted {
+			continue
+		}
+
+		report.Records++
+		data, err := decodeSlot(slot[:n])
+		if err == nil && !json.Valid(data) {
+			err = errors.New("record is not valid JSON")
+		}
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, Corruption{File: name, Offset: offset, Reason: err.Error()})
+			corrupt = append(corrupt, offset)
+			continue
+		}
+		intact[offset] = true
+	}
+
+	return report, intact, corrupt, nil
+}
+
+// quarantine copies the raw slot at offset to the quarantine directory next
+// to data.db and returns the path of the copy. Callers hold h.mu.
+func (h *FileHandler) quarantine(offset int64) (string, error) {
+	dir := filepath.Join(filepath.Dir(h.dataPath), quarantineDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	slot := make([]byte, recordSize)
+	n, err := h.file.ReadAt(slot, offset)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("data-%d.bin", offset))
+	if err := os.WriteFile(path, slot[:n], 0644); err != nil {
+		return "", err
+	}
+	h.quarantined = append(h.quarantined, path)
+	return path, nil
+}
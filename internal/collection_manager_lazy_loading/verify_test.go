@@ -0,0 +1,84 @@
+package collection_manager_lazy_loading
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func TestChecksumVerifyRepair(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := NewAt[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []uuid.UUID
+	for i := 0; i < 5; i++ {
+		msg, err := db.Create(&message.Message{Caption: "verify"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+
+	// Flip a byte inside the JSON of the third record.
+	offset := db.fh.index[ids[2]]
+	if _, err := db.fh.file.WriteAt([]byte{'#'}, offset+slotHeaderSize+10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.fh.ReadRecord(ids[2]); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("got error %v reading a corrupt record, want %v", err, ErrChecksumMismatch)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The corrupt record and the index entry pointing at it.
+	if report.Records != 5 || len(report.Corrupt) != 2 || report.Corrupt[0].Offset != offset {
+		t.Fatalf("unexpected verify report: %+v", report)
+	}
+
+	report, err = Repair(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Quarantined) != 1 {
+		t.Fatalf("got %d quarantined records, want 1", len(report.Quarantined))
+	}
+	if _, err := os.Stat(report.Quarantined[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Records != 4 {
+		t.Fatalf("store still corrupt after repair: %+v", report)
+	}
+
+	db, err = NewAt[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i, id := range ids {
+		_, err := db.Read(id)
+		if i == 2 && err == nil {
+			t.Fatalf("quarantined record %s is still readable", id)
+		}
+		if i != 2 && err != nil {
+			t.Fatal(err)
+		}
+	}
+}
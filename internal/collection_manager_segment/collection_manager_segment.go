@@ -0,0 +1,670 @@
+// Package collection_manager_segment stores a collection as an append-only
+// log of segments, for items such as chat messages that are mostly
+// appended in ID order and read newest first.
+//
+// Writes are appended to the active log, NNNNNN.log, as length-prefixed
+// records keyed by ID; an update appends the new version and a delete
+// appends a tombstone. Once the log reaches its size limit it is sealed:
+// the latest record of every ID is written, sorted by ID, to NNNNNN.seg
+// with a sparse index of every indexInterval-th record, and a new log is
+// started. Sealed segments never change, and a record in a newer segment
+// shadows the records of the same ID in older ones.
+//
+// Only the sparse indexes and the offsets of the active log are kept in
+// memory. Since UUID v7 IDs grow over time, the segments cover mostly
+// disjoint ID ranges, so reading the items before or after an ID touches
+// only the one or two segments around it.
+package collection_manager_segment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/version"
+)
+
+// defaultSegmentSize is the size at which the active log is sealed.
+const defaultSegmentSize = 4 << 20 // 4 MB
+
+// collectionItem is the interface that every item in the collection must implement.
+type collectionItem interface {
+	SetID(uuid.UUID)
+	GetID() uuid.UUID
+}
+
+// Manager is a collection stored as segments in a directory.
+type Manager[T collectionItem] struct {
+	dir string
+	mu  sync.RWMutex
+	// sealed holds the sealed segments, oldest first.
+	sealed []*segment
+	active *activeLog
+	// count is the number of live items.
+	count       int
+	segmentSize int64
+	closed      bool
+}
+
+// NewAt opens the collection stored in dir, creating it if needed.
+func NewAt[T collectionItem](dir string) (*Manager[T], error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager[T]{dir: dir, segmentSize: defaultSegmentSize}
+	var logs []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Left by a crash while a segment was written.
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		ext := filepath.Ext(name)
+		num, err := strconv.Atoi(strings.TrimSuffix(name, ext))
+		if err != nil || (ext != segmentExt && ext != logExt) {
+			continue
+		}
+
+		if ext == logExt {
+			logs = append(logs, num)
+			continue
+		}
+		s, err := openSegment(filepath.Join(dir, name), num)
+		if err != nil {
+			m.closeFiles()
+			return nil, err
+		}
+		m.sealed = append(m.sealed, s)
+	}
+	slices.SortFunc(m.sealed, func(a, b *segment) int { return a.num - b.num })
+
+	next := 1
+	if len(m.sealed) > 0 {
+		next = m.sealed[len(m.sealed)-1].num + 1
+	}
+
+	// A log whose segment exists was sealed, but a crash kept it from being
+	// removed.
+	logs = slices.DeleteFunc(logs, func(num int) bool {
+		if num >= next {
+			return false
+		}
+		if err := os.Remove(segmentName(dir, num, logExt)); err != nil {
+			log.Printf("Error removing sealed log %d in %s: %v", num, dir, err)
+		}
+		return true
+	})
+	if len(logs) > 1 {
+		m.closeFiles()
+		return nil, fmt.Errorf("found %d active logs in %s, want one", len(logs), dir)
+	}
+	if len(logs) == 1 {
+		next = logs[0]
+	}
+
+	m.active, err = openActiveLog(segmentName(dir, next, logExt), next)
+	if err != nil {
+		m.closeFiles()
+		return nil, fmt.Errorf("error opening active log: %w", err)
+	}
+
+	for _, s := range m.sealed {
+		m.count += int(s.delta)
+	}
+	delta, err := m.activeDelta()
+	if err != nil {
+		m.closeFiles()
+		return nil, err
+	}
+	m.count += delta
+
+	return m, nil
+}
+
+// Close closes the segment files.
+func (m *Manager[T]) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	return m.closeFiles()
+}
+
+func (m *Manager[T]) closeFiles() error {
+	var errs []error
+	for _, s := range m.sealed {
+		errs = append(errs, s.file.Close())
+	}
+	if m.active != nil {
+		errs = append(errs, m.active.file.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// ---
+// Lookups. Callers hold m.mu.
+
+// lookup returns the latest record of id, which may be a tombstone.
+func (m *Manager[T]) lookup(id uuid.UUID) (record, bool, error) {
+	if e, ok := m.active.entries[id]; ok {
+		r, err := m.active.read(id, e)
+		return r, err == nil, err
+	}
+	return m.lookupSealed(id)
+}
+
+func (m *Manager[T]) lookupSealed(id uuid.UUID) (record, bool, error) {
+	for i := len(m.sealed) - 1; i >= 0; i-- {
+		r, found, err := m.sealed[i].lookup(id)
+		if err != nil || found {
+			return r, found, err
+		}
+	}
+	return record{}, false, nil
+}
+
+// existsSealed reports whether id is live in the sealed segments.
+func (m *Manager[T]) existsSealed(id uuid.UUID) (bool, error) {
+	r, found, err := m.lookupSealed(id)
+	return found && !r.tombstone(), err
+}
+
+// activeDelta returns the change in live items made by the active log.
+func (m *Manager[T]) activeDelta() (int, error) {
+	delta := 0
+	for id, e := range m.active.entries {
+		existed, err := m.existsSealed(id)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case e.tombstone && existed:
+			delta--
+		case !e.tombstone && !existed:
+			delta++
+		}
+	}
+	return delta, nil
+}
+
+func (m *Manager[T]) decode(r record) (T, error) {
+	var item T
+	if err := json.Unmarshal(r.data, &item); err != nil {
+		var zero T
+		return zero, fmt.Errorf("error unmarshaling item %s: %w", r.id, err)
+	}
+	return item, nil
+}
+
+// ---
+// Writes. Callers hold m.mu.
+
+// write appends a record to the active log and seals it once full.
+func (m *Manager[T]) write(r record) error {
+	if m.closed {
+		return errors.New("collection is closed")
+	}
+	if err := m.active.append(r); err != nil {
+		return err
+	}
+	if m.active.size >= m.segmentSize {
+		// The record is written either way, so a failed seal only leaves
+		// the log to grow until the next attempt.
+		if err := m.seal(); err != nil {
+			log.Printf("Error sealing segment %d in %s: %v", m.active.num, m.dir, err)
+		}
+	}
+	return nil
+}
+
+// seal writes the latest record of every ID in the active log to a new
+// sealed segment and starts the next log. Tombstones are only kept when
+// they shadow a live record in an older segment.
+func (m *Manager[T]) seal() error {
+	var (
+		records []record
+		delta   int32
+	)
+	for _, id := range m.active.sortedIDs() {
+		r, err := m.active.read(id, m.active.entries[id])
+		if err != nil {
+			return err
+		}
+		existed, err := m.existsSealed(id)
+		if err != nil {
+			return err
+		}
+		switch {
+		case r.tombstone() && existed:
+			delta--
+		case r.tombstone():
+			continue
+		case !existed:
+			delta++
+		}
+		records = append(records, r)
+	}
+
+	num := m.active.num
+	path := segmentName(m.dir, num, segmentExt)
+	var sealed *segment
+	if len(records) > 0 {
+		if err := writeSegment(path, records, delta); err != nil {
+			return fmt.Errorf("error writing segment: %w", err)
+		}
+		if err := syncDir(m.dir); err != nil {
+			return err
+		}
+		var err error
+		if sealed, err = openSegment(path, num); err != nil {
+			os.Remove(path)
+			return err
+		}
+	}
+
+	next, err := openActiveLog(segmentName(m.dir, num+1, logExt), num+1)
+	if err != nil {
+		// Keep writing to the current log, which must not have a segment.
+		if sealed != nil {
+			sealed.file.Close()
+			os.Remove(path)
+		}
+		return fmt.Errorf("error opening active log: %w", err)
+	}
+	if sealed != nil {
+		m.sealed = append(m.sealed, sealed)
+	}
+	old := m.active
+	m.active = next
+
+	if err := os.Remove(old.path); err != nil {
+		log.Printf("Error removing sealed log %s: %v", old.path, err)
+	}
+	old.sealed = true
+	if old.refs == 0 {
+		old.file.Close()
+	}
+	return syncDir(m.dir)
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// ---
+
+// Create appends a new item. Items without an ID get a UUID v7.
+func (m *Manager[T]) Create(newItem T) (T, error) {
+	var zero T
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := newItem.GetID()
+	if id == uuid.Nil {
+		var err error
+		if id, err = uuid.NewV7(); err != nil {
+			return zero, fmt.Errorf("error generating UUID: %w", err)
+		}
+		newItem.SetID(id)
+	} else {
+		r, found, err := m.lookup(id)
+		if err != nil {
+			return zero, err
+		}
+		if found && !r.tombstone() {
+			return zero, fmt.Errorf("item with ID %s already exists", id)
+		}
+	}
+
+	version.Init(newItem)
+
+	data, err := json.Marshal(newItem)
+	if err != nil {
+		return zero, fmt.Errorf("error marshaling item: %w", err)
+	}
+	if err := m.write(record{id: id, kind: kindPut, data: data}); err != nil {
+		return zero, err
+	}
+	m.count++
+	return newItem, nil
+}
+
+// Read returns the item with the given ID, decoded from its latest record.
+func (m *Manager[T]) Read(id uuid.UUID) (T, error) {
+	m.mu.RLock()
+	r, found, err := m.lookup(id)
+	m.mu.RUnlock()
+
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	if !found || r.tombstone() {
+		var zero T
+		return zero, fmt.Errorf("item with ID %s does not exist", id)
+	}
+	return m.decode(r)
+}
+
+// ReadAll returns every item in ID order.
+func (m *Manager[T]) ReadAll() ([]T, error) {
+	var items []T
+	err := m.Iterate(context.Background(), func(item T) bool {
+		items = append(items, item)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// Update appends a new version of an existing item. Items that carry a
+// version must be based on the stored one, which is then incremented; a
+// failed update keeps the version it had.
+func (m *Manager[T]) Update(updatedItem T) (T, error) {
+	var zero T
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := updatedItem.GetID()
+	r, found, err := m.lookup(id)
+	if err != nil {
+		return zero, err
+	}
+	if !found || r.tombstone() {
+		return zero, fmt.Errorf("item with ID %s does not exist", id)
+	}
+	current, err := m.decode(r)
+	if err != nil {
+		return zero, err
+	}
+	if err := version.Check(id, current, updatedItem); err != nil {
+		return zero, err
+	}
+	previous := version.Bump(updatedItem)
+
+	data, err := json.Marshal(updatedItem)
+	if err != nil {
+		version.Reset(updatedItem, previous)
+		return zero, fmt.Errorf("error marshaling item: %w", err)
+	}
+	if err := m.write(record{id: id, kind: kindPut, data: data}); err != nil {
+		version.Reset(updatedItem, previous)
+		return zero, err
+	}
+	return updatedItem, nil
+}
+
+// Delete appends a tombstone for an existing item.
+func (m *Manager[T]) Delete(id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, found, err := m.lookup(id)
+	if err != nil {
+		return err
+	}
+	if !found || r.tombstone() {
+		return fmt.Errorf("item with ID %s does not exist", id)
+	}
+	if err := m.write(record{id: id, kind: kindTombstone}); err != nil {
+		return err
+	}
+	m.count--
+	return nil
+}
+
+// Count returns the number of items.
+func (m *Manager[T]) Count() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.count
+}
+
+// MemorySize estimates the memory held by the collection: the sparse
+// indexes of the sealed segments and the offsets of the active log.
+func (m *Manager[T]) MemorySize() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Map entries take about three times their key and value.
+	size := int64(len(m.active.entries)) * 3 * (16 + 24)
+	for _, s := range m.sealed {
+		size += int64(len(s.index)) * indexEntrySize
+	}
+	return size
+}
+
+// ---
+// Iteration merges the segments in ID order, reading each one only once
+// the merge reaches its ID range.
+
+// Iterate calls fn for every item in ID order until fn returns false or
+// ctx is cancelled.
+func (m *Manager[T]) Iterate(ctx context.Context, fn func(item T) bool) error {
+	return m.iterate(ctx, uuid.Nil, false, fn)
+}
+
+// IterateFrom calls fn for every item whose ID is from or after it, in ID
+// order, until fn returns false or ctx is cancelled.
+func (m *Manager[T]) IterateFrom(ctx context.Context, from uuid.UUID, fn func(item T) bool) error {
+	return m.iterate(ctx, from, false, fn)
+}
+
+// IterateBefore calls fn for every item whose ID is before before, newest
+// first, until fn returns false or ctx is cancelled. A nil before starts at
+// the newest item.
+func (m *Manager[T]) IterateBefore(ctx context.Context, before uuid.UUID, fn func(item T) bool) error {
+	return m.iterate(ctx, before, true, fn)
+}
+
+// source is a segment waiting to join a merge.
+type source struct {
+	priority int
+	min, max uuid.UUID
+	open     func() (cursor, error)
+}
+
+// head is the next record of a segment in a merge.
+type head struct {
+	priority int
+	rec      record
+	cur      cursor
+}
+
+func (m *Manager[T]) iterate(ctx context.Context, bound uuid.UUID, reverse bool, fn func(item T) bool) error {
+	sources, release, err := m.sources(bound, reverse)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// reaches reports whether a source can hold a record that comes before
+	// id in the merge.
+	reaches := func(s source, id uuid.UUID) bool {
+		if reverse {
+			return compareIDs(s.max, id) >= 0
+		}
+		return compareIDs(s.min, id) <= 0
+	}
+	before := func(a, b uuid.UUID) bool {
+		if reverse {
+			return compareIDs(a, b) > 0
+		}
+		return compareIDs(a, b) < 0
+	}
+
+	var heads []*head
+	best := func() *head {
+		var h *head
+		for _, candidate := range heads {
+			if h == nil || before(candidate.rec.id, h.rec.id) {
+				h = candidate
+			}
+		}
+		return h
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		for len(sources) > 0 {
+			if h := best(); h != nil && !reaches(sources[0], h.rec.id) {
+				break
+			}
+			s := sources[0]
+			sources = sources[1:]
+			cur, err := s.open()
+			if err != nil {
+				return err
+			}
+			r, ok, err := cur.next()
+			if err != nil {
+				return err
+			}
+			if ok {
+				heads = append(heads, &head{priority: s.priority, rec: r, cur: cur})
+			}
+		}
+
+		h := best()
+		if h == nil {
+			return nil
+		}
+
+		// The newest segment holding the ID has its latest record.
+		id, winner := h.rec.id, h
+		for _, other := range heads {
+			if other.rec.id == id && other.priority > winner.priority {
+				winner = other
+			}
+		}
+		latest := winner.rec
+
+		kept := heads[:0]
+		for _, other := range heads {
+			if other.rec.id == id {
+				r, ok, err := other.cur.next()
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				other.rec = r
+			}
+			kept = append(kept, other)
+		}
+		heads = kept
+
+		if latest.tombstone() {
+			continue
+		}
+		item, err := m.decode(latest)
+		if err != nil {
+			return err
+		}
+		if !fn(item) {
+			return nil
+		}
+	}
+}
+
+// sources returns the segments that can hold records past bound, in the
+// order a merge reaches them, and a function to call once the merge is
+// done. The active log is captured as it is now, and stays readable until
+// then even if it is sealed in the meantime.
+func (m *Manager[T]) sources(bound uuid.UUID, reverse bool) ([]source, func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, nil, errors.New("collection is closed")
+	}
+
+	outside := func(min, max uuid.UUID) bool {
+		if reverse {
+			return bound != uuid.Nil && compareIDs(min, bound) >= 0
+		}
+		return compareIDs(max, bound) < 0
+	}
+
+	var sources []source
+	for _, s := range m.sealed {
+		if outside(s.minID, s.maxID) {
+			continue
+		}
+		sources = append(sources, source{
+			priority: s.num,
+			min:      s.minID,
+			max:      s.maxID,
+			open: func() (cursor, error) {
+				return newSegmentCursor(s, bound, reverse)
+			},
+		})
+	}
+
+	active := m.active
+	snap := &activeSnapshot{log: active, ids: active.sortedIDs()}
+	snap.entries = make([]activeEntry, len(snap.ids))
+	for i, id := range snap.ids {
+		snap.entries[i] = active.entries[id]
+	}
+	active.refs++
+	release := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		active.refs--
+		if active.sealed && active.refs == 0 {
+			active.file.Close()
+		}
+	}
+
+	if n := len(snap.ids); n > 0 && !outside(snap.ids[0], snap.ids[n-1]) {
+		sources = append(sources, source{
+			priority: active.num,
+			min:      snap.ids[0],
+			max:      snap.ids[n-1],
+			open: func() (cursor, error) {
+				return newActiveCursor(snap, bound, reverse), nil
+			},
+		})
+	}
+
+	slices.SortStableFunc(sources, func(a, b source) int {
+		if reverse {
+			return compareIDs(b.max, a.max)
+		}
+		return compareIDs(a.min, b.min)
+	})
+	return sources, release, nil
+}
@@ -0,0 +1,196 @@
+package collection_manager_segment
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+// openSmall opens dir with segments of size bytes, so a test spans many
+// segments.
+func openSmall(t *testing.T, dir string, size int64) *Manager[*message.Message] {
+	t.Helper()
+	m, err := NewAt[*message.Message](dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.segmentSize = size
+	return m
+}
+
+func TestReadBeforeTouchesFewSegments(t *testing.T) {
+
+	// Roughly a hundred messages per segment.
+	m := openSmall(t, t.TempDir(), 32<<10)
+	defer m.Close()
+
+	var ids []uuid.UUID
+	for i := 0; i < 1000; i++ {
+		msg, err := m.Create(&message.Message{Caption: "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	if len(m.sealed) < 5 {
+		t.Fatalf("%d sealed segments, want at least 5", len(m.sealed))
+	}
+
+	reads := func() []int64 {
+		var n []int64
+		for _, s := range m.sealed {
+			n = append(n, s.blockReads.Load())
+		}
+		return n
+	}
+	start := reads()
+
+	var got []uuid.UUID
+	err := m.IterateBefore(context.Background(), ids[600], func(msg *message.Message) bool {
+		got = append(got, msg.ID)
+		return len(got) < 50
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := slices.Clone(ids[550:600])
+	slices.Reverse(want)
+	if !slices.Equal(got, want) {
+		t.Fatalf("IterateBefore returned %d messages, want the 50 before the cursor newest first", len(got))
+	}
+
+	// Searches sorted by descending ID page back the same way.
+	page, err := message.SearchIter(context.Background(), m, &message.SearchOptions{
+		Sort: "id", SortOrder: "end", Before: ids[600], Size: 50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 50 || page[0].ID != ids[599] || page[49].ID != ids[550] {
+		t.Fatalf("search returned %d messages, want the 50 before the cursor newest first", len(page))
+	}
+
+	touched := 0
+	for i, n := range reads() {
+		if n > start[i] {
+			touched++
+		}
+	}
+	if touched > 2 {
+		t.Fatalf("reading 50 messages touched %d of %d segments, want at most 2", touched, len(m.sealed))
+	}
+}
+
+func TestTombstonesAndReopen(t *testing.T) {
+
+	dir := t.TempDir()
+	m := openSmall(t, dir, 2<<10)
+
+	var ids []uuid.UUID
+	for i := 0; i < 100; i++ {
+		msg, err := m.Create(&message.Message{Caption: "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+
+	// Shadow records in sealed segments from the active log.
+	if _, err := m.Update(&message.Message{ID: ids[0], Caption: "edited", Version: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(ids[1]); err == nil {
+		t.Fatal("deleted an item twice")
+	}
+	if _, err := m.Create(&message.Message{ID: ids[2]}); err == nil {
+		t.Fatal("created an item with an existing ID")
+	}
+	if m.Count() != 99 {
+		t.Fatalf("count = %d, want 99", m.Count())
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn record at the end of the active log is dropped on open.
+	logs, _ := filepath.Glob(filepath.Join(dir, "*"+logExt))
+	if len(logs) != 1 {
+		t.Fatalf("found logs %v, want one", logs)
+	}
+	file, err := os.OpenFile(logs[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0x40, 0, 0, 0, 1, 2})
+	file.Close()
+
+	m = openSmall(t, dir, 2<<10)
+	defer m.Close()
+
+	if m.Count() != 99 {
+		t.Fatalf("count after reopening = %d, want 99", m.Count())
+	}
+	msg, err := m.Read(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Caption != "edited" {
+		t.Fatalf("caption = %q, want %q", msg.Caption, "edited")
+	}
+	if _, err := m.Read(ids[1]); err == nil {
+		t.Fatal("deleted item is readable")
+	}
+
+	all, err := m.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 99 || all[0].ID != ids[0] || all[1].ID != ids[2] {
+		t.Fatalf("ReadAll returned %d items, want 99 in ID order without the deleted one", len(all))
+	}
+}
+
+// TestUpdateFailedWrite checks that an update that fails to be written
+// keeps the version of the item, so that retrying it does not conflict.
+func TestUpdateFailedWrite(t *testing.T) {
+
+	m := openSmall(t, t.TempDir(), defaultSegmentSize)
+	defer m.Close()
+
+	msg, err := m.Create(&message.Message{Caption: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Appends fail while the active log is open read-only.
+	writable := m.active.file
+	readOnly, err := os.Open(m.active.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.active.file = readOnly
+	msg.Caption = "second"
+	if _, err := m.Update(msg); err == nil {
+		t.Fatal("update to a read-only log succeeded")
+	}
+	if msg.Version != "1" {
+		t.Fatalf("version after a failed update = %q, want 1", msg.Version)
+	}
+	m.active.file = writable
+	readOnly.Close()
+
+	if _, err := m.Update(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Version != "2" {
+		t.Fatalf("version after update = %q, want 2", msg.Version)
+	}
+}
@@ -0,0 +1,175 @@
+package collection_manager_segment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/google/uuid"
+)
+
+// Record frames, shared by the active log and the sealed segments:
+//
+//	[length 4][crc 4][kind 1][id 16][json ...]
+//
+// length counts the bytes after the crc, and crc is the CRC32C of them.
+// A tombstone has no JSON.
+const (
+	frameHeaderSize = 8
+	recordKeySize   = 1 + 16
+	// maxRecordSize bounds a frame length read from disk, so a corrupt
+	// length cannot make a reader allocate gigabytes.
+	maxRecordSize = 16 << 20
+)
+
+const (
+	kindPut       byte = 1
+	kindTombstone byte = 2
+)
+
+// Sealed segment layout:
+//
+//	[records sorted by ID][sparse index][footer]
+//
+// The sparse index holds the ID and offset of every indexInterval-th
+// record, starting with the first, so a lookup reads one block of at most
+// indexInterval records. The footer is fixed size:
+//
+//	[magic 4][version 4][count 4][delta 4][index offset 8][index count 4]
+//	[min id 16][max id 16][crc 4]
+//
+// crc is the CRC32C of the sparse index and the footer before it. delta is
+// the change in live items the segment made to the segments before it.
+const (
+	segmentMagic   = 0x4745534d // "MSEG"
+	segmentVersion = 1
+	footerSize     = 64
+	indexEntrySize = 16 + 8
+	indexInterval  = 64
+)
+
+// ErrChecksumMismatch is returned when a record or a segment footer does
+// not match its stored checksum, which points at a torn write or bit rot.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type record struct {
+	id   uuid.UUID
+	kind byte
+	data []byte
+}
+
+func (r record) tombstone() bool {
+	return r.kind == kindTombstone
+}
+
+func encodeRecord(r record) []byte {
+	length := recordKeySize + len(r.data)
+	frame := make([]byte, frameHeaderSize+length)
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(length))
+	frame[8] = r.kind
+	copy(frame[9:25], r.id[:])
+	copy(frame[25:], r.data)
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(frame[frameHeaderSize:], crcTable))
+	return frame
+}
+
+// decodeRecord decodes the frame at the start of buf and returns its size.
+// The record data aliases buf.
+func decodeRecord(buf []byte) (record, int, error) {
+	if len(buf) < frameHeaderSize {
+		return record{}, 0, fmt.Errorf("truncated record: %w", ErrChecksumMismatch)
+	}
+	length := int(binary.LittleEndian.Uint32(buf[0:4]))
+	if length < recordKeySize || length > maxRecordSize || frameHeaderSize+length > len(buf) {
+		return record{}, 0, fmt.Errorf("invalid record length %d: %w", length, ErrChecksumMismatch)
+	}
+
+	body := buf[frameHeaderSize : frameHeaderSize+length]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(buf[4:8]) {
+		return record{}, 0, ErrChecksumMismatch
+	}
+
+	r := record{kind: body[0], data: body[recordKeySize:]}
+	copy(r.id[:], body[1:recordKeySize])
+	if r.kind != kindPut && r.kind != kindTombstone {
+		return record{}, 0, fmt.Errorf("unknown record kind %d: %w", r.kind, ErrChecksumMismatch)
+	}
+	return r, frameHeaderSize + length, nil
+}
+
+type indexEntry struct {
+	id     uuid.UUID
+	offset int64
+}
+
+type footer struct {
+	count       uint32
+	delta       int32
+	indexOffset int64
+	indexCount  uint32
+	minID       uuid.UUID
+	maxID       uuid.UUID
+}
+
+func encodeIndex(entries []indexEntry, f footer) []byte {
+	buf := make([]byte, len(entries)*indexEntrySize+footerSize)
+	for i, e := range entries {
+		entry := buf[i*indexEntrySize:]
+		copy(entry[0:16], e.id[:])
+		binary.LittleEndian.PutUint64(entry[16:24], uint64(e.offset))
+	}
+
+	tail := buf[len(entries)*indexEntrySize:]
+	binary.LittleEndian.PutUint32(tail[0:4], segmentMagic)
+	binary.LittleEndian.PutUint32(tail[4:8], segmentVersion)
+	binary.LittleEndian.PutUint32(tail[8:12], f.count)
+	binary.LittleEndian.PutUint32(tail[12:16], uint32(f.delta))
+	binary.LittleEndian.PutUint64(tail[16:24], uint64(f.indexOffset))
+	binary.LittleEndian.PutUint32(tail[24:28], f.indexCount)
+	copy(tail[28:44], f.minID[:])
+	copy(tail[44:60], f.maxID[:])
+	binary.LittleEndian.PutUint32(tail[60:64], crc32.Checksum(buf[:len(buf)-4], crcTable))
+	return buf
+}
+
+// decodeFooter decodes the last footerSize bytes of a segment.
+func decodeFooter(tail []byte) (footer, error) {
+	if len(tail) != footerSize || binary.LittleEndian.Uint32(tail[0:4]) != segmentMagic {
+		return footer{}, errors.New("not a segment file")
+	}
+	if v := binary.LittleEndian.Uint32(tail[4:8]); v != segmentVersion {
+		return footer{}, fmt.Errorf("unsupported segment version %d", v)
+	}
+
+	f := footer{
+		count:       binary.LittleEndian.Uint32(tail[8:12]),
+		delta:       int32(binary.LittleEndian.Uint32(tail[12:16])),
+		indexOffset: int64(binary.LittleEndian.Uint64(tail[16:24])),
+		indexCount:  binary.LittleEndian.Uint32(tail[24:28]),
+	}
+	copy(f.minID[:], tail[28:44])
+	copy(f.maxID[:], tail[44:60])
+	return f, nil
+}
+
+// decodeIndex decodes the sparse index and footer and checks their crc.
+func decodeIndex(buf []byte, f footer) ([]indexEntry, error) {
+	if crc32.Checksum(buf[:len(buf)-4], crcTable) != binary.LittleEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, ErrChecksumMismatch
+	}
+	entries := make([]indexEntry, f.indexCount)
+	for i := range entries {
+		entry := buf[i*indexEntrySize:]
+		copy(entries[i].id[:], entry[0:16])
+		entries[i].offset = int64(binary.LittleEndian.Uint64(entry[16:24]))
+	}
+	return entries, nil
+}
+
+func compareIDs(a, b uuid.UUID) int {
+	return bytes.Compare(a[:], b[:])
+}
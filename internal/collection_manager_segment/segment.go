@@ -0,0 +1,415 @@
+package collection_manager_segment
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+const (
+	segmentExt = ".seg"
+	logExt     = ".log"
+)
+
+func segmentName(dir string, num int, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", num, ext))
+}
+
+// ---
+// Sealed segments.
+
+// segment is an immutable file of records sorted by ID. Only its sparse
+// index is kept in memory; records are read a block at a time.
+type segment struct {
+	num   int
+	path  string
+	file  *os.File
+	index []indexEntry
+	footer
+	// blockReads counts the blocks read from the file.
+	blockReads atomic.Int64
+}
+
+func openSegment(path string, num int) (*segment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() < footerSize {
+		file.Close()
+		return nil, fmt.Errorf("segment %s is truncated", path)
+	}
+
+	tail := make([]byte, footerSize)
+	if _, err := file.ReadAt(tail, info.Size()-footerSize); err != nil {
+		file.Close()
+		return nil, err
+	}
+	f, err := decodeFooter(tail)
+	if err == nil && f.indexOffset+int64(f.indexCount)*indexEntrySize+footerSize != info.Size() {
+		err = fmt.Errorf("index of %d entries at %d does not fit", f.indexCount, f.indexOffset)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("segment %s: %w", path, err)
+	}
+
+	buf := make([]byte, info.Size()-f.indexOffset)
+	if _, err := file.ReadAt(buf, f.indexOffset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	index, err := decodeIndex(buf, f)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("segment %s: %w", path, err)
+	}
+
+	return &segment{num: num, path: path, file: file, index: index, footer: f}, nil
+}
+
+// writeSegment writes records, sorted by ID, as the sealed segment path.
+// The file is written under a temporary name and renamed once synced, so a
+// crash never leaves a partial segment.
+func writeSegment(path string, records []record, delta int32) error {
+	tempFile := path + ".tmp"
+	file, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	var (
+		offset int64
+		index  []indexEntry
+		buf    []byte
+	)
+	for i, r := range records {
+		if i%indexInterval == 0 {
+			index = append(index, indexEntry{id: r.id, offset: offset})
+		}
+		frame := encodeRecord(r)
+		buf = append(buf, frame...)
+		offset += int64(len(frame))
+	}
+	f := footer{
+		count:       uint32(len(records)),
+		delta:       delta,
+		indexOffset: offset,
+		indexCount:  uint32(len(index)),
+		minID:       records[0].id,
+		maxID:       records[len(records)-1].id,
+	}
+	buf = append(buf, encodeIndex(index, f)...)
+
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		os.Remove(tempFile)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tempFile)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	return os.Rename(tempFile, path)
+}
+
+// contains reports whether id is inside the ID range of the segment.
+func (s *segment) contains(id uuid.UUID) bool {
+	return compareIDs(id, s.minID) >= 0 && compareIDs(id, s.maxID) <= 0
+}
+
+// blockFor returns the block that holds id if the segment has it.
+func (s *segment) blockFor(id uuid.UUID) int {
+	i, found := slices.BinarySearchFunc(s.index, id, func(e indexEntry, id uuid.UUID) int {
+		return compareIDs(e.id, id)
+	})
+	if found {
+		return i
+	}
+	return max(i-1, 0)
+}
+
+// readBlock reads and decodes the records of block i.
+func (s *segment) readBlock(i int) ([]record, error) {
+	start := s.index[i].offset
+	end := s.indexOffset
+	if i+1 < len(s.index) {
+		end = s.index[i+1].offset
+	}
+
+	buf := make([]byte, end-start)
+	if _, err := s.file.ReadAt(buf, start); err != nil {
+		return nil, fmt.Errorf("error reading block at %d of %s: %w", start, s.path, err)
+	}
+	s.blockReads.Add(1)
+
+	records := make([]record, 0, indexInterval)
+	for pos := 0; pos < len(buf); {
+		r, n, err := decodeRecord(buf[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("record at %d of %s: %w", start+int64(pos), s.path, err)
+		}
+		records = append(records, r)
+		pos += n
+	}
+	return records, nil
+}
+
+// lookup returns the record of id in the segment.
+func (s *segment) lookup(id uuid.UUID) (record, bool, error) {
+	if !s.contains(id) {
+		return record{}, false, nil
+	}
+	records, err := s.readBlock(s.blockFor(id))
+	if err != nil {
+		return record{}, false, err
+	}
+	i, found := slices.BinarySearchFunc(records, id, func(r record, id uuid.UUID) int {
+		return compareIDs(r.id, id)
+	})
+	if !found {
+		return record{}, false, nil
+	}
+	return records[i], true, nil
+}
+
+// ---
+// The active log.
+
+// activeLog is the segment being written. Records are appended in write
+// order, and every ID is mapped to the offset of its latest record.
+type activeLog struct {
+	num     int
+	path    string
+	file    *os.File
+	size    int64
+	entries map[uuid.UUID]activeEntry
+	// refs counts the cursors reading the log. A sealed log is closed once
+	// the last one is done, see release.
+	refs   int
+	sealed bool
+}
+
+type activeEntry struct {
+	offset    int64
+	length    int
+	tombstone bool
+}
+
+// openActiveLog opens or creates the log at path and indexes its records.
+// A torn record at the end, left by a crash during an append, is dropped.
+func openActiveLog(path string, num int) (*activeLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	l := &activeLog{num: num, path: path, file: file, entries: make(map[uuid.UUID]activeEntry)}
+	for int(l.size) < len(data) {
+		r, n, err := decodeRecord(data[l.size:])
+		if err != nil {
+			log.Printf("Discarding %d bytes of torn tail in %s: %v", int64(len(data))-l.size, path, err)
+			if err := file.Truncate(l.size); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("error truncating torn tail: %w", err)
+			}
+			break
+		}
+		l.entries[r.id] = activeEntry{offset: l.size, length: n, tombstone: r.tombstone()}
+		l.size += int64(n)
+	}
+	return l, nil
+}
+
+// append writes a record to the end of the log and syncs it.
+func (l *activeLog) append(r record) error {
+	frame := encodeRecord(r)
+	if _, err := l.file.WriteAt(frame, l.size); err != nil {
+		return fmt.Errorf("error writing record: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing log: %w", err)
+	}
+	l.entries[r.id] = activeEntry{offset: l.size, length: len(frame), tombstone: r.tombstone()}
+	l.size += int64(len(frame))
+	return nil
+}
+
+func (l *activeLog) read(id uuid.UUID, e activeEntry) (record, error) {
+	buf := make([]byte, e.length)
+	if _, err := l.file.ReadAt(buf, e.offset); err != nil {
+		return record{}, fmt.Errorf("error reading record at %d of %s: %w", e.offset, l.path, err)
+	}
+	r, _, err := decodeRecord(buf)
+	if err != nil {
+		return record{}, fmt.Errorf("record at %d of %s: %w", e.offset, l.path, err)
+	}
+	if r.id != id {
+		return record{}, fmt.Errorf("record at %d of %s has ID %s, want %s", e.offset, l.path, r.id, id)
+	}
+	return r, nil
+}
+
+// sortedIDs returns the IDs in the log in ascending order.
+func (l *activeLog) sortedIDs() []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(l.entries))
+	for id := range l.entries {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, compareIDs)
+	return ids
+}
+
+// ---
+// Cursors visit the records of one segment in ID order, forwards or
+// backwards, reading only the blocks they reach.
+
+type cursor interface {
+	// next returns the next record, or false at the end.
+	next() (record, bool, error)
+}
+
+type segmentCursor struct {
+	s       *segment
+	reverse bool
+	block   int
+	records []record
+	pos     int
+	done    bool
+}
+
+// newSegmentCursor returns a cursor over the records of s from from
+// onwards or, in reverse, before before. A nil bound is unbounded.
+func newSegmentCursor(s *segment, bound uuid.UUID, reverse bool) (*segmentCursor, error) {
+	c := &segmentCursor{s: s, reverse: reverse}
+
+	if !reverse {
+		c.block = s.blockFor(bound)
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+		for c.pos < len(c.records) && compareIDs(c.records[c.pos].id, bound) < 0 {
+			c.pos++
+		}
+		return c, nil
+	}
+
+	c.block = len(s.index) - 1
+	if bound != uuid.Nil {
+		c.block = s.blockFor(bound)
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if bound != uuid.Nil {
+		for c.pos >= 0 && compareIDs(c.records[c.pos].id, bound) >= 0 {
+			c.pos--
+		}
+	}
+	return c, nil
+}
+
+func (c *segmentCursor) load() error {
+	records, err := c.s.readBlock(c.block)
+	if err != nil {
+		return err
+	}
+	c.records = records
+	c.pos = 0
+	if c.reverse {
+		c.pos = len(records) - 1
+	}
+	return nil
+}
+
+func (c *segmentCursor) next() (record, bool, error) {
+	for !c.done {
+		if c.pos >= 0 && c.pos < len(c.records) {
+			r := c.records[c.pos]
+			if c.reverse {
+				c.pos--
+			} else {
+				c.pos++
+			}
+			return r, true, nil
+		}
+
+		if c.reverse {
+			c.block--
+		} else {
+			c.block++
+		}
+		if c.block < 0 || c.block >= len(c.s.index) {
+			c.done = true
+			break
+		}
+		if err := c.load(); err != nil {
+			return record{}, false, err
+		}
+	}
+	return record{}, false, nil
+}
+
+type activeCursor struct {
+	m       *activeSnapshot
+	reverse bool
+	pos     int
+}
+
+// activeSnapshot is the state of the active log when an iteration started.
+type activeSnapshot struct {
+	log     *activeLog
+	ids     []uuid.UUID
+	entries []activeEntry
+}
+
+func (c *activeCursor) next() (record, bool, error) {
+	if c.pos < 0 || c.pos >= len(c.m.ids) {
+		return record{}, false, nil
+	}
+	id, entry := c.m.ids[c.pos], c.m.entries[c.pos]
+	if c.reverse {
+		c.pos--
+	} else {
+		c.pos++
+	}
+	r, err := c.m.log.read(id, entry)
+	if err != nil {
+		return record{}, false, err
+	}
+	return r, true, nil
+}
+
+// newActiveCursor returns a cursor over the snapshot, bounded as in
+// newSegmentCursor.
+func newActiveCursor(snap *activeSnapshot, bound uuid.UUID, reverse bool) *activeCursor {
+	i, _ := slices.BinarySearchFunc(snap.ids, bound, compareIDs)
+	if reverse {
+		if bound == uuid.Nil {
+			i = len(snap.ids)
+		}
+		return &activeCursor{m: snap, reverse: true, pos: i - 1}
+	}
+	return &activeCursor{m: snap, pos: i}
+}
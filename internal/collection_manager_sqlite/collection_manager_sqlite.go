@@ -0,0 +1,465 @@
+package collection_manager_sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/version"
+	_ "modernc.org/sqlite"
+)
+
+// FileName is the database file the store keeps in a collection directory.
+const FileName = "data.sqlite"
+
+const tableName = "items"
+
+// collectionItem is the interface that every item in the collection must implement.
+type collectionItem interface {
+	SetID(uuid.UUID)
+	GetID() uuid.UUID
+}
+
+var (
+	uuidType = reflect.TypeOf(uuid.UUID{})
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+// column is a struct field of T tagged with `index:"true"`. Its value is
+// kept in a column of its own next to the JSON document, with an index.
+type column struct {
+	field string // Go field name
+	name  string // JSON name, used as the column name
+	index []int
+	kind  string // SQL column type
+}
+
+// Manager keeps a collection in a SQLite database, one row per item. The
+// item is stored as JSON, and every field tagged with `index:"true"` also
+// gets an indexed column so searches on it can be answered by SQLite.
+type Manager[T collectionItem] struct {
+	db      *sql.DB
+	path    string
+	columns []column
+	// fields maps the Go name of every JSON field of T to its JSON name.
+	fields map[string]string
+	// itemType is the struct type behind T.
+	itemType reflect.Type
+}
+
+// New opens the collection stored in the SQLite database at path, creating
+// the database and its schema if needed.
+func New[T collectionItem](path string) (*Manager[T], error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating directory for %s: %w", path, err)
+	}
+
+	dsn := "file:" + path + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database %s: %w", path, err)
+	}
+
+	m := &Manager[T]{db: db, path: path}
+	if err := m.describe(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := m.createSchema(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// describe reads the JSON fields and indexed columns of T.
+func (m *Manager[T]) describe() error {
+	var zero T
+	itemType := reflect.TypeOf(zero)
+	if itemType == nil || itemType.Kind() != reflect.Ptr || itemType.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("collection item %v must be a pointer to a struct", itemType)
+	}
+	m.itemType = itemType.Elem()
+	m.fields = make(map[string]string)
+
+	for i := 0; i < m.itemType.NumField(); i++ {
+		field := m.itemType.Field(i)
+		name := jsonName(field)
+		if name == "" {
+			continue
+		}
+		m.fields[field.Name] = name
+
+		if field.Tag.Get("index") != "true" || field.Name == "ID" {
+			continue
+		}
+		kind, ok := columnKind(field.Type)
+		if !ok {
+			return fmt.Errorf("indexed field %s has unsupported type %v", field.Name, field.Type)
+		}
+		m.columns = append(m.columns, column{field: field.Name, name: name, index: field.Index, kind: kind})
+	}
+	return nil
+}
+
+// jsonName returns the name of field in the JSON document, or "" if the
+// field is not encoded.
+func jsonName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return field.Name
+	}
+	return name
+}
+
+func columnKind(t reflect.Type) (string, bool) {
+	switch {
+	case t == uuidType:
+		return "TEXT", true
+	case t == timeType:
+		// Unix nanoseconds, so ranges compare correctly across time zones.
+		return "INTEGER", true
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return "INTEGER", true
+	case reflect.Float32, reflect.Float64:
+		return "REAL", true
+	case reflect.String:
+		return "TEXT", true
+	}
+	return "", false
+}
+
+// sqlValue converts a Go value to the form it is stored in a column.
+func sqlValue(v any) any {
+	switch v := v.(type) {
+	case uuid.UUID:
+		return v.String()
+	case time.Time:
+		return v.UnixNano()
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	}
+	return v
+}
+
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// createSchema creates the items table and its indexes. Columns for fields
+// tagged after the table was created are added and filled from the stored
+// documents.
+func (m *Manager[T]) createSchema() error {
+	defs := []string{"id TEXT PRIMARY KEY", "data BLOB NOT NULL"}
+	for _, c := range m.columns {
+		defs = append(defs, quote(c.name)+" "+c.kind)
+	}
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", tableName, strings.Join(defs, ", "))
+	if _, err := m.db.Exec(create); err != nil {
+		return fmt.Errorf("error creating table: %w", err)
+	}
+
+	existing, err := m.tableColumns()
+	if err != nil {
+		return err
+	}
+
+	var added []column
+	for _, c := range m.columns {
+		if existing[c.name] {
+			continue
+		}
+		alter := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tableName, quote(c.name), c.kind)
+		if _, err := m.db.Exec(alter); err != nil {
+			return fmt.Errorf("error adding column %s: %w", c.name, err)
+		}
+		added = append(added, c)
+	}
+	if len(added) > 0 {
+		if err := m.refreshColumns(); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range m.columns {
+		index := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)",
+			quote(tableName+"_"+c.name), tableName, quote(c.name))
+		if _, err := m.db.Exec(index); err != nil {
+			return fmt.Errorf("error creating index on %s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+func (m *Manager[T]) tableColumns() (map[string]bool, error) {
+	rows, err := m.db.Query("SELECT name FROM pragma_table_info('" + tableName + "')")
+	if err != nil {
+		return nil, fmt.Errorf("error reading table columns: %w", err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// refreshColumns rewrites the indexed columns of every row from its document.
+func (m *Manager[T]) refreshColumns() error {
+	items, err := m.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, item := range items {
+		if err := m.write(tx, "UPDATE", item); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// write stores item with an INSERT, INSERT OR REPLACE or UPDATE statement.
+// An UPDATE only changes the row if it also matches the where conditions.
+func (m *Manager[T]) write(db execer, verb string, item T, where ...Cond) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("error marshaling item: %w", err)
+	}
+
+	names := []string{"id", "data"}
+	args := []any{item.GetID().String(), data}
+	value := reflect.ValueOf(item).Elem()
+	for _, c := range m.columns {
+		names = append(names, quote(c.name))
+		args = append(args, sqlValue(value.FieldByIndex(c.index).Interface()))
+	}
+
+	var query string
+	if verb == "UPDATE" {
+		sets := make([]string, 0, len(names)-1)
+		for _, name := range names[1:] {
+			sets = append(sets, name+" = ?")
+		}
+		query = fmt.Sprintf("UPDATE %s SET %s WHERE id = ?", tableName, strings.Join(sets, ", "))
+		args = append(args[1:], args[0])
+		// Conditions compare the stored row, before the SET applies.
+		for _, c := range where {
+			expr, value, err := m.fieldExpr(c.Field, c.Value)
+			if err != nil {
+				return err
+			}
+			query += " AND " + expr + " " + c.Op + " ?"
+			args = append(args, value)
+		}
+	} else {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")
+		query = fmt.Sprintf("%s INTO %s (%s) VALUES (%s)", verb, tableName, strings.Join(names, ", "), placeholders)
+	}
+
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("item with ID %s not found", item.GetID())
+	}
+	return nil
+}
+
+func (m *Manager[T]) decode(id string, data []byte) (T, error) {
+	var item T
+	if err := json.Unmarshal(data, &item); err != nil {
+		var zero T
+		return zero, fmt.Errorf("error unmarshaling item %s: %w", id, err)
+	}
+	return item, nil
+}
+
+// Close closes the database.
+func (m *Manager[T]) Close() error {
+	return m.db.Close()
+}
+
+// Create adds an item. An ID set by the caller is kept, otherwise a UUID v7
+// is assigned.
+func (m *Manager[T]) Create(newItem T) (T, error) {
+	var zero T
+	if reflect.ValueOf(newItem).IsNil() {
+		return zero, errors.New("cannot create nil item")
+	}
+
+	if newItem.GetID() == uuid.Nil {
+		id, err := uuid.NewV7()
+		if err != nil {
+			return zero, fmt.Errorf("error generating UUID v7: %w", err)
+		}
+		newItem.SetID(id)
+	} else {
+		var exists int
+		err := m.db.QueryRow("SELECT COUNT(*) FROM "+tableName+" WHERE id = ?", newItem.GetID().String()).Scan(&exists)
+		if err != nil {
+			return zero, fmt.Errorf("error checking item %s: %w", newItem.GetID(), err)
+		}
+		if exists > 0 {
+			return zero, fmt.Errorf("item with ID %s already exists", newItem.GetID())
+		}
+	}
+
+	version.Init(newItem)
+	if err := m.write(m.db, "INSERT", newItem); err != nil {
+		return zero, fmt.Errorf("error inserting item %s: %w", newItem.GetID(), err)
+	}
+	return newItem, nil
+}
+
+// Read returns the item with the given ID.
+func (m *Manager[T]) Read(id uuid.UUID) (T, error) {
+	var data []byte
+	err := m.db.QueryRow("SELECT data FROM "+tableName+" WHERE id = ?", id.String()).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		var zero T
+		return zero, fmt.Errorf("item with ID %s not found", id)
+	}
+	if err != nil {
+		var zero T
+		return zero, fmt.Errorf("error reading item %s: %w", id, err)
+	}
+	return m.decode(id.String(), data)
+}
+
+// ReadAll returns every item in ID order.
+func (m *Manager[T]) ReadAll() ([]T, error) {
+	items := make([]T, 0, m.Count())
+	err := m.Iterate(context.Background(), func(item T) bool {
+		items = append(items, item)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// Iterate calls fn for every item in ID order until fn returns false or ctx
+// is cancelled. Items are decoded one row at a time.
+func (m *Manager[T]) Iterate(ctx context.Context, fn func(item T) bool) error {
+	return m.IterateFrom(ctx, uuid.Nil, fn)
+}
+
+// IterateFrom calls fn for every item whose ID is from or after it, in ID
+// order, until fn returns false or ctx is cancelled.
+func (m *Manager[T]) IterateFrom(ctx context.Context, from uuid.UUID, fn func(item T) bool) error {
+	return m.query(ctx, "SELECT id, data FROM "+tableName+" WHERE id >= ? ORDER BY id", []any{from.String()}, fn)
+}
+
+func (m *Manager[T]) query(ctx context.Context, query string, args []any, fn func(item T) bool) error {
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("error querying items: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return fmt.Errorf("error scanning item: %w", err)
+		}
+		item, err := m.decode(id, data)
+		if err != nil {
+			return err
+		}
+		if !fn(item) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+// Update replaces an existing item. Items that carry a version must be
+// based on the stored one, see version.Check.
+func (m *Manager[T]) Update(updatedItem T) (T, error) {
+	var zero T
+	if _, versioned := any(updatedItem).(version.Item); !versioned {
+		if err := m.write(m.db, "UPDATE", updatedItem); err != nil {
+			return zero, fmt.Errorf("error updating item %s: %w", updatedItem.GetID(), err)
+		}
+		return updatedItem, nil
+	}
+
+	// The version is compared in the UPDATE itself, so concurrent updates
+	// cannot both pass the check.
+	expected := version.Bump(updatedItem)
+	err := m.write(m.db, "UPDATE", updatedItem, Cond{Field: "Version", Op: "=", Value: expected})
+	if err == nil {
+		return updatedItem, nil
+	}
+	version.Reset(updatedItem, expected)
+
+	current, readErr := m.Read(updatedItem.GetID())
+	if readErr != nil {
+		return zero, fmt.Errorf("error updating item %s: %w", updatedItem.GetID(), err)
+	}
+	if conflict := version.Check(updatedItem.GetID(), current, updatedItem); conflict != nil {
+		return zero, conflict
+	}
+	return zero, fmt.Errorf("error updating item %s: %w", updatedItem.GetID(), err)
+}
+
+// Delete removes the item with the given ID.
+func (m *Manager[T]) Delete(id uuid.UUID) error {
+	result, err := m.db.Exec("DELETE FROM "+tableName+" WHERE id = ?", id.String())
+	if err != nil {
+		return fmt.Errorf("error deleting item %s: %w", id, err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("item with ID %s not found", id)
+	}
+	return nil
+}
+
+// Count returns the number of items in the collection.
+func (m *Manager[T]) Count() int {
+	var count int
+	if err := m.db.QueryRow("SELECT COUNT(*) FROM " + tableName).Scan(&count); err != nil {
+		return 0
+	}
+	return count
+}
@@ -0,0 +1,157 @@
+package collection_manager_sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func ids[T collectionItem](items []T) []uuid.UUID {
+	out := make([]uuid.UUID, len(items))
+	for i, item := range items {
+		out[i] = item.GetID()
+	}
+	return out
+}
+
+func equalIDs(a, b []uuid.UUID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSearchMessagesMatchesSearch(t *testing.T) {
+	db, err := New[*message.Message](filepath.Join(t.TempDir(), FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 50; i++ {
+		_, err := db.Create(&message.Message{
+			Caption:   []string{"hello", "bye"}[i%2],
+			IsPinned:  i%3 == 0,
+			IsEdited:  i%5 == 0,
+			CreatedAt: start.Add(time.Duration(i) * time.Hour).In(time.FixedZone("", (i%4)*3600)),
+			UpdatedAt: start.Add(time.Duration(50-i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	yes := true
+	after := start.Add(10 * time.Hour)
+	before := start.Add(40 * time.Hour)
+	cases := map[string]message.SearchOptions{
+		"flags":      {IsPinned: &yes, Sort: "createdAt"},
+		"content":    {Content: "hello", Sort: "createdAt", SortOrder: "end", Page: 3, Size: 5},
+		"date range": {CreatedAfter: &after, CreatedBefore: &before, IsEdited: &yes, Sort: "createdAt"},
+		"in memory":  {Sort: "updatedAt", Size: 10},
+	}
+
+	all, err := db.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, with := range cases {
+		want := message.Search(all, &with)
+		got, err := SearchMessages(context.Background(), db, &with)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(want) == 0 || !equalIDs(ids(got), ids(want)) {
+			t.Fatalf("%s: got %d messages %v, want %d %v", name, len(got), ids(got), len(want), ids(want))
+		}
+	}
+}
+
+func TestSearchChatsByMember(t *testing.T) {
+	db, err := New[*chat.Chat](filepath.Join(t.TempDir(), FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	user := uuid.New()
+	var want []uuid.UUID
+	for i := 0; i < 6; i++ {
+		c := &chat.Chat{Title: "chat", UpdatedAt: time.Now().Add(time.Duration(-i) * time.Minute)}
+		c.Members = []chat.Member{{UserID: uuid.New()}}
+		if i%2 == 0 {
+			c.Members = append(c.Members, chat.Member{UserID: user})
+		}
+		created, err := db.Create(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			want = append([]uuid.UUID{created.ID}, want...)
+		}
+	}
+
+	got, err := SearchChats(context.Background(), db, user, &chat.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalIDs(ids(got), want) {
+		t.Fatalf("got chats %v, want %v ordered by last update", ids(got), want)
+	}
+}
+
+func TestImport(t *testing.T) {
+	src := t.TempDir()
+	from, err := collection_manager.New[*message.Message](src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer from.Close()
+
+	for i := 0; i < importBatchSize+10; i++ {
+		if _, err := from.Create(&message.Message{Caption: "imported", IsPinned: i%2 == 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := filepath.Join(t.TempDir(), FileName)
+	to, err := New[*message.Message](dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+
+	// Running the import twice leaves a single copy of every message.
+	for range 2 {
+		count, err := Import[*message.Message](context.Background(), to, from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != from.Count() {
+			t.Fatalf("imported %d messages, want %d", count, from.Count())
+		}
+	}
+	if to.Count() != from.Count() {
+		t.Fatalf("got %d messages after import, want %d", to.Count(), from.Count())
+	}
+
+	pinned, err := to.FindBy("IsPinned", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pinned) != from.Count()/2 {
+		t.Fatalf("got %d pinned messages, want %d", len(pinned), from.Count()/2)
+	}
+}
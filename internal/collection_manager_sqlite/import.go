@@ -0,0 +1,66 @@
+package collection_manager_sqlite
+
+import (
+	"context"
+	"fmt"
+)
+
+// importBatchSize is the number of items written per transaction by Import.
+const importBatchSize = 1000
+
+// Source is a collection Import can read from, such as a collection_manager
+// JSON directory.
+type Source[T any] interface {
+	Iterate(ctx context.Context, fn func(item T) bool) error
+}
+
+// Import copies every item of src into m and returns how many were copied.
+// Items that already exist in m are replaced, so an interrupted import can
+// be run again.
+func Import[T collectionItem](ctx context.Context, m *Manager[T], src Source[T]) (int, error) {
+	var batch []T
+	count := 0
+
+	flush := func() error {
+		tx, err := m.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("error starting transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		for _, item := range batch {
+			if err := m.write(tx, "INSERT OR REPLACE", item); err != nil {
+				return fmt.Errorf("error importing item %s: %w", item.GetID(), err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing import: %w", err)
+		}
+		count += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	var flushErr error
+	err := src.Iterate(ctx, func(item T) bool {
+		batch = append(batch, item)
+		if len(batch) < importBatchSize {
+			return true
+		}
+		flushErr = flush()
+		return flushErr == nil
+	})
+	if flushErr != nil {
+		return count, flushErr
+	}
+	if err != nil {
+		return count, fmt.Errorf("error reading source: %w", err)
+	}
+
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
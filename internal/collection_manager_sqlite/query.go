@@ -0,0 +1,211 @@
+package collection_manager_sqlite
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Cond is one filter of a Query on a field of T, by its Go name.
+//
+// Fields tagged with `index:"true"` are compared through their indexed
+// column. Other fields are read from the JSON document, which supports
+// equality on strings, numbers, bools and UUIDs, but not time ranges.
+type Cond struct {
+	Field string
+	// Op is one of =, !=, <, <=, > and >=.
+	Op    string
+	Value any
+	// Elem, when set, makes the condition match items where Field is an
+	// array holding at least one element whose Elem field equals Value.
+	Elem string
+}
+
+// Query selects items in SQL instead of loading the collection.
+type Query struct {
+	Where []Cond
+	// OrderBy is the Go name of an indexed field, or "" for ID order.
+	OrderBy string
+	Desc    bool
+	// Limit of 0 returns every matching item.
+	Limit  int
+	Offset int
+}
+
+var operators = map[string]bool{"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// Select returns the items matching q.
+func (m *Manager[T]) Select(ctx context.Context, q Query) ([]T, error) {
+	query, args, err := m.build(q)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []T
+	err = m.query(ctx, query, args, func(item T) bool {
+		items = append(items, item)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// FindBy returns the items whose field equals value.
+func (m *Manager[T]) FindBy(field string, value any) ([]T, error) {
+	return m.Select(context.Background(), Query{Where: []Cond{{Field: field, Op: "=", Value: value}}})
+}
+
+// FindRange returns the items whose field is within [from, to]. A nil bound
+// is open.
+func (m *Manager[T]) FindRange(field string, from, to any) ([]T, error) {
+	q := Query{OrderBy: field}
+	if from != nil {
+		q.Where = append(q.Where, Cond{Field: field, Op: ">=", Value: from})
+	}
+	if to != nil {
+		q.Where = append(q.Where, Cond{Field: field, Op: "<=", Value: to})
+	}
+	return m.Select(context.Background(), q)
+}
+
+// CanOrderBy reports whether Select can sort on field.
+func (m *Manager[T]) CanOrderBy(field string) bool {
+	_, ok := m.column(field)
+	return ok || field == "ID"
+}
+
+func (m *Manager[T]) build(q Query) (string, []any, error) {
+	var where []string
+	var args []any
+
+	for _, c := range q.Where {
+		if !operators[c.Op] {
+			return "", nil, fmt.Errorf("unsupported operator %q", c.Op)
+		}
+
+		if c.Elem != "" {
+			expr, err := m.elemExpr(c.Field, c.Elem)
+			if err != nil {
+				return "", nil, err
+			}
+			value, err := jsonValue(c.Elem, c.Value)
+			if err != nil {
+				return "", nil, err
+			}
+			where = append(where, fmt.Sprintf(expr, c.Op))
+			args = append(args, value)
+			continue
+		}
+
+		expr, value, err := m.fieldExpr(c.Field, c.Value)
+		if err != nil {
+			return "", nil, err
+		}
+		where = append(where, expr+" "+c.Op+" ?")
+		args = append(args, value)
+	}
+
+	query := "SELECT id, data FROM " + tableName
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	order := "id"
+	if q.OrderBy != "" && q.OrderBy != "ID" {
+		c, ok := m.column(q.OrderBy)
+		if !ok {
+			return "", nil, fmt.Errorf("cannot order by %s: field is not indexed", q.OrderBy)
+		}
+		// Ties are broken by ID, so pages do not overlap.
+		order = quote(c.name) + ", id"
+	}
+	if q.Desc {
+		order = strings.ReplaceAll(order, ",", " DESC,") + " DESC"
+	}
+	query += " ORDER BY " + order
+
+	if q.Limit > 0 || q.Offset > 0 {
+		limit := q.Limit
+		if limit <= 0 {
+			limit = -1
+		}
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, q.Offset)
+	}
+	return query, args, nil
+}
+
+func (m *Manager[T]) column(field string) (column, bool) {
+	for _, c := range m.columns {
+		if c.field == field {
+			return c, true
+		}
+	}
+	return column{}, false
+}
+
+// fieldExpr returns the SQL expression for field and value converted for it.
+func (m *Manager[T]) fieldExpr(field string, value any) (string, any, error) {
+	if field == "ID" {
+		return "id", sqlValue(value), nil
+	}
+	if c, ok := m.column(field); ok {
+		return quote(c.name), sqlValue(value), nil
+	}
+
+	name, ok := m.fields[field]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown field %s", field)
+	}
+	v, err := jsonValue(field, value)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("json_extract(data, '$.%s')", name), v, nil
+}
+
+// elemExpr returns an EXISTS expression over the elements of the array
+// field, with a %s for the operator.
+func (m *Manager[T]) elemExpr(field, elem string) (string, error) {
+	sf, ok := m.itemType.FieldByName(field)
+	if !ok || m.fields[field] == "" {
+		return "", fmt.Errorf("unknown field %s", field)
+	}
+	elemType := sf.Type
+	if elemType.Kind() != reflect.Slice && elemType.Kind() != reflect.Array {
+		return "", fmt.Errorf("field %s is not an array", field)
+	}
+	elemType = elemType.Elem()
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	ef, ok := elemType.FieldByName(elem)
+	if !ok || jsonName(ef) == "" {
+		return "", fmt.Errorf("unknown field %s.%s", field, elem)
+	}
+
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(data, '$.%s') WHERE json_extract(value, '$.%s') %%s ?)",
+		m.fields[field], jsonName(ef)), nil
+}
+
+// jsonValue converts value to the form json_extract returns for it.
+func jsonValue(field string, value any) (any, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return nil, fmt.Errorf("cannot compare %s: time fields must be indexed", field)
+	case uuid.UUID:
+		return v.String(), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,135 @@
+package collection_manager_sqlite
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+// sortFields maps the sort keys of message and chat search options to the
+// fields they order by.
+var sortFields = map[string]string{
+	"id":        "ID",
+	"createdAt": "CreatedAt",
+	"updatedAt": "UpdatedAt",
+}
+
+func flagConds(flags map[string]*bool) []Cond {
+	var where []Cond
+	for field, value := range flags {
+		if value != nil {
+			where = append(where, Cond{Field: field, Op: "=", Value: *value})
+		}
+	}
+	return where
+}
+
+// SearchMessages gives the same results as message.Search, with the filters,
+// sorting and pagination done by SQLite. When the sort field has no column,
+// the filtered messages are sorted and paginated in memory instead.
+func SearchMessages(ctx context.Context, m *Manager[*message.Message], with *message.SearchOptions) ([]*message.Message, error) {
+	where := flagConds(map[string]*bool{
+		"IsEdited":  with.IsEdited,
+		"IsPinned":  with.IsPinned,
+		"IsDeleted": with.IsDeleted,
+	})
+	if with.MessageID != uuid.Nil {
+		where = append(where, Cond{Field: "ID", Op: "=", Value: with.MessageID})
+	}
+	if with.After != uuid.Nil {
+		where = append(where, Cond{Field: "ID", Op: ">", Value: with.After})
+	}
+	if with.Before != uuid.Nil {
+		where = append(where, Cond{Field: "ID", Op: "<", Value: with.Before})
+	}
+	if with.Content != "" {
+		where = append(where, Cond{Field: "Caption", Op: "=", Value: with.Content})
+	}
+	if with.CreatedAfter != nil {
+		where = append(where, Cond{Field: "CreatedAt", Op: ">=", Value: *with.CreatedAfter})
+	}
+	if with.CreatedBefore != nil {
+		where = append(where, Cond{Field: "CreatedAt", Op: "<=", Value: *with.CreatedBefore})
+	}
+
+	if with.Size == 0 { // if not set default is MAX_LIMIT
+		with.Size = message.MaxLimit
+	}
+
+	q := Query{Where: where, Limit: with.Size, Offset: with.Page}
+	if field, ok := sortFields[with.Sort]; ok {
+		if !m.CanOrderBy(field) {
+			found, err := m.Select(ctx, Query{Where: where})
+			if err != nil {
+				return nil, err
+			}
+			return message.Search(found, with), nil
+		}
+		q.OrderBy = field
+		q.Desc = with.SortOrder == "end"
+	}
+
+	found, err := m.Select(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		found = []*message.Message{}
+	}
+	return found, nil
+}
+
+// SearchChats gives the same results as chat.Search over the chats userID
+// is a member of, with the filters, sorting and pagination done by SQLite.
+// Without a sort option the chats are ordered by their last update. A nil
+// userID searches every chat.
+func SearchChats(ctx context.Context, m *Manager[*chat.Chat], userID uuid.UUID, with *chat.SearchOptions) ([]*chat.Chat, error) {
+	where := flagConds(map[string]*bool{
+		"CanSetStickerSet": with.CanSetStickerSet,
+		"IsVerified":       with.IsVerified,
+		"IsRestricted":     with.IsRestricted,
+		"IsCreator":        with.IsCreator,
+		"IsScam":           with.IsScam,
+		"IsFake":           with.IsFake,
+	})
+	if userID != uuid.Nil {
+		where = append(where, Cond{Field: "Members", Elem: "UserID", Op: "=", Value: userID})
+	}
+	if with.ChatID != uuid.Nil {
+		where = append(where, Cond{Field: "ID", Op: "=", Value: with.ChatID})
+	}
+	if with.CreatedAfter != nil {
+		where = append(where, Cond{Field: "CreatedAt", Op: ">=", Value: *with.CreatedAfter})
+	}
+	if with.CreatedBefore != nil {
+		where = append(where, Cond{Field: "CreatedAt", Op: "<=", Value: *with.CreatedBefore})
+	}
+
+	if with.Size == 0 { // if not set default is MAX_LIMIT
+		with.Size = chat.MaxLimit
+	}
+
+	q := Query{Where: where, OrderBy: "UpdatedAt", Limit: with.Size, Offset: with.Page}
+	if field, ok := sortFields[with.Sort]; ok {
+		if !m.CanOrderBy(field) {
+			found, err := m.Select(ctx, Query{Where: where})
+			if err != nil {
+				return nil, err
+			}
+			return chat.Search(found, with), nil
+		}
+		q.OrderBy = field
+		q.Desc = with.SortOrder == "end"
+	}
+
+	found, err := m.Select(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		found = []*chat.Chat{}
+	}
+	return found, nil
+}
@@ -0,0 +1,19 @@
+package chat
+
+import (
+	"github.com/goccy/go-json"
+	"github.com/mahdi-cpp/messages-api/internal/migration"
+)
+
+func init() {
+	// Version 0 to 1: pinnedMessageId and linkedChatId were numbers before
+	// they became strings.
+	migration.Register[Chat](0, func(doc map[string]any) error {
+		for _, field := range []string{"pinnedMessageId", "linkedChatId"} {
+			if number, ok := doc[field].(json.Number); ok {
+				doc[field] = number.String()
+			}
+		}
+		return nil
+	})
+}
@@ -9,6 +9,9 @@ import (
 func (c *Chat) SetID(id uuid.UUID) { c.ID = id }
 func (c *Chat) GetID() uuid.UUID   { return c.ID }
 
+func (c *Chat) SetVersion(version string) { c.Version = version }
+func (c *Chat) GetVersion() string        { return c.Version }
+
 type Chat struct {
 	ID                    uuid.UUID       `json:"id"`
 	Type                  string          `json:"type"`
@@ -35,13 +38,13 @@ type Chat struct {
 	ActiveUsernames       []string        `json:"activeUsernames,omitempty"`
 	AvailableReactions    []string        `json:"availableReactions,omitempty"`
 	Theme                 string          `json:"theme,omitempty"`
-	UnreadCount           int             `json:"unreadCount,omitempty"`
+	UnreadCount           int             `json:"unreadCount,omitempty"` // Per user, from the read cursor of the member
 	LastMessage           *MessagePreview `json:"lastMessage,omitempty"`
 	IsPinned              bool            `json:"isPinned,omitempty"`
 	PinOrder              int             `json:"pinOrder,omitempty"`
 	MuteUntil             *time.Time      `json:"muteUntil,omitempty"`
-	CreatedAt             time.Time       `json:"createdAt"`
-	UpdatedAt             time.Time       `json:"updatedAt"`
+	CreatedAt             time.Time       `json:"createdAt" index:"true"`
+	UpdatedAt             time.Time       `json:"updatedAt" index:"true"`
 	DeletedAt             *time.Time      `json:"deletedAt,omitempty"`
 	Version               string          `json:"version"`
 }
@@ -53,6 +56,21 @@ type Member struct {
 	IsActive    bool      `json:"isActive"`
 	LastActive  time.Time `json:"lastActive"` // Added for sorting by activity
 	JoinedAt    time.Time `json:"joinedAt"`
+
+	// Receipt cursors of the member, only set in the chats returned to
+	// clients. They are kept with the messages of the chat, see
+	// chat_manager.Manager.Acknowledge, so stored chats have none, except
+	// for those written before, and ClearCursors drops the ones clients send.
+	*Cursors
+}
+
+// Cursors are the receipt cursors of a member: the last message delivered
+// to a device of the member and the last one the member read.
+type Cursors struct {
+	DeliveredUpTo uuid.UUID `json:"deliveredUpTo"`
+	DeliveredSeq  int64     `json:"deliveredSeq,omitempty"`
+	ReadUpTo      uuid.UUID `json:"readUpTo"`
+	ReadSeq       int64     `json:"readSeq,omitempty"`
 }
 
 type Permissions struct {
@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Receipt is what a member acknowledges about the messages of a chat.
+type Receipt string
+
+const (
+	ReceiptDelivered Receipt = "delivered"
+	ReceiptRead      Receipt = "read"
+)
+
+// ErrNotMember is returned for a receipt of a user that is not a member.
+var ErrNotMember = errors.New("user is not a member of the chat")
+
+// Acknowledge moves the cursors up to the message messageID, numbered seq
+// in the chat. Reading a message also delivers it. Cursors only move
+// forward; Acknowledge reports whether one moved.
+func (c *Cursors) Acknowledge(receipt Receipt, messageID uuid.UUID, seq int64) (bool, error) {
+	advanced := false
+	switch receipt {
+	case ReceiptRead:
+		if seq > c.ReadSeq {
+			c.ReadUpTo, c.ReadSeq = messageID, seq
+			advanced = true
+		}
+		fallthrough
+	case ReceiptDelivered:
+		if seq > c.DeliveredSeq {
+			c.DeliveredUpTo, c.DeliveredSeq = messageID, seq
+			advanced = true
+		}
+	default:
+		return false, fmt.Errorf("unknown receipt %q", receipt)
+	}
+	return advanced, nil
+}
+
+// ClearCursors drops the receipt cursors of members sent by a client
+// before they are stored, see Member.
+func ClearCursors(members []Member) {
+	for i := range members {
+		members[i].Cursors = nil
+	}
+}
+
+// Member returns a copy of the member with userID, if there is one.
+func (c *Chat) Member(userID uuid.UUID) (Member, bool) {
+	if member := c.member(userID); member != nil {
+		return *member, true
+	}
+	return Member{}, false
+}
+
+func (c *Chat) member(userID uuid.UUID) *Member {
+	for i := range c.Members {
+		if c.Members[i].UserID == userID {
+			return &c.Members[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+func TestAcknowledge(t *testing.T) {
+	var cursors Cursors
+	first, second := uuid.New(), uuid.New()
+
+	if advanced, err := cursors.Acknowledge(ReceiptRead, second, 2); err != nil || !advanced {
+		t.Fatalf("read receipt advanced %v, err %v", advanced, err)
+	}
+	if cursors.ReadUpTo != second || cursors.DeliveredSeq != 2 {
+		t.Fatalf("cursors %+v after reading seq 2", cursors)
+	}
+
+	// Cursors do not move back.
+	if advanced, err := cursors.Acknowledge(ReceiptDelivered, first, 1); err != nil || advanced {
+		t.Fatalf("older receipt advanced %v, err %v", advanced, err)
+	}
+	if _, err := cursors.Acknowledge("seen", second, 3); err == nil {
+		t.Fatal("unknown receipt accepted")
+	}
+}
+
+func TestMemberCursorsJSON(t *testing.T) {
+	data, err := json.Marshal(Member{UserID: uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "UpTo") {
+		t.Fatalf("member without cursors encoded with them: %s", data)
+	}
+
+	// Chats stored before receipts were kept with the messages hold them.
+	readUpTo := uuid.New()
+	var member Member
+	if err := json.Unmarshal([]byte(`{"readUpTo": "`+readUpTo.String()+`", "readSeq": 3}`), &member); err != nil {
+		t.Fatal(err)
+	}
+	if member.Cursors == nil || member.ReadUpTo != readUpTo || member.ReadSeq != 3 {
+		t.Fatalf("decoded cursors %+v, want read up to seq 3", member.Cursors)
+	}
+}
@@ -175,6 +175,16 @@ func HasMemberWith(memberCriteria search.Criteria[*Member]) search.Criteria[*Cha
 	}
 }
 
+// MemberUserIDs returns the user IDs of all members of a chat. It is the key
+// function of the "members" index on the chat collection.
+func MemberUserIDs(chat *Chat) []any {
+	ids := make([]any, 0, len(chat.Members))
+	for _, member := range chat.Members {
+		ids = append(ids, member.UserID)
+	}
+	return ids
+}
+
 // Member-specific criteria functions
 // ---------------------------------------------------------------------
 
@@ -31,6 +31,10 @@ type UpdateOptions struct {
 	AddMembers     []Member
 	RemoveMembers  []Member
 	MembersUpdates []update.NestedFieldUpdate[Member]
+
+	// IfVersion, when set, makes the update fail with a version conflict
+	// unless the chat is still at this version. It comes from If-Match.
+	IfVersion string `json:"-"`
 }
 
 // Key extractors for nested structs
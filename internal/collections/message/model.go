@@ -9,6 +9,9 @@ import (
 func (a *Message) SetID(id uuid.UUID) { a.ID = id }
 func (a *Message) GetID() uuid.UUID   { return a.ID }
 
+func (a *Message) SetVersion(version string) { a.Version = version }
+func (a *Message) GetVersion() string        { return a.Version }
+
 func (i *Index) SetID(id uuid.UUID) { i.ID = id }
 func (i *Index) GetID() uuid.UUID   { return i.ID }
 
@@ -27,6 +30,8 @@ type Index struct {
 type Message struct {
 	ID        uuid.UUID `json:"id" index:"true"`
 	ChatID    uuid.UUID `json:"chatId" index:"true"`
+	Seq       int64     `json:"seq,omitempty" index:"true"`       // Order of the message in its chat
+	ChangeSeq int64     `json:"changeSeq,omitempty" index:"true"` // Sequence number of its last edit, Seq until edited
 	UserID    uuid.UUID `json:"userId" index:"true"`
 	Caption   string    `json:"caption"`
 	Directory string    `json:"directory"`
@@ -1,6 +1,8 @@
 package message
 
 import (
+	"bytes"
+	"context"
 	"time"
 
 	"github.com/google/uuid"
@@ -31,6 +33,15 @@ type SearchOptions struct {
 	// Pagination
 	Page int `form:"page,omitempty"`
 	Size int `form:"size,omitempty"`
+	// After is a cursor: only messages with a later ID are returned. Passing
+	// the ID of the last message of a page gives the next page without
+	// scanning the pages before it.
+	After uuid.UUID `form:"after,omitempty"`
+	// Before is a cursor: only messages with an earlier ID are returned.
+	// With sort=id and sortOrder=end it pages back from the newest message,
+	// reading only the messages of the page on stores that can iterate
+	// backwards.
+	Before uuid.UUID `form:"before,omitempty"`
 }
 
 var LessFunks = map[string]search.LessFunction[*Message]{
@@ -60,6 +71,12 @@ func BuildMessageCriteria(with *SearchOptions) search.Criteria[*Message] {
 		if with.MessageID != uuid.Nil && c.ID != with.MessageID {
 			return false
 		}
+		if with.After != uuid.Nil && bytes.Compare(c.ID[:], with.After[:]) <= 0 {
+			return false
+		}
+		if with.Before != uuid.Nil && bytes.Compare(c.ID[:], with.Before[:]) >= 0 {
+			return false
+		}
 		if with.Content != "" && c.Caption != with.Content {
 			return false
 		}
@@ -127,3 +144,162 @@ func Search(chats []*Message, with *SearchOptions) []*Message {
 	}
 	return final[start:end]
 }
+
+// Iterator is a message collection that can be visited in ID order, which
+// is creation order for UUID v7 IDs.
+type Iterator interface {
+	IterateFrom(ctx context.Context, from uuid.UUID, fn func(msg *Message) bool) error
+}
+
+// ReverseIterator is a message collection that can be visited in
+// descending ID order, newest first.
+type ReverseIterator interface {
+	IterateBefore(ctx context.Context, before uuid.UUID, fn func(msg *Message) bool) error
+}
+
+// SearchIter gives the same results as Search, but reads the messages from
+// it one at a time. Without a sort option, or when sorting by ID, the scan
+// starts at with.After and stops once the page is full, so only the
+// messages up to the end of the page are read. Sorting by descending ID
+// does the same backwards from with.Before when it is a ReverseIterator.
+// Other sort options need every match, which are then sorted and
+// paginated as in Search.
+func SearchIter(ctx context.Context, it Iterator, with *SearchOptions) ([]*Message, error) {
+
+	criteria := BuildMessageCriteria(with)
+
+	_, sorted := LessFunks[with.Sort]
+	if with.Sort == "id" && with.SortOrder != "end" {
+		sorted = false
+	}
+
+	iterate := func(fn func(msg *Message) bool) error {
+		return it.IterateFrom(ctx, with.After, fn)
+	}
+	if reverse, ok := it.(ReverseIterator); ok && with.Sort == "id" && with.SortOrder == "end" {
+		sorted = false
+		iterate = func(fn func(msg *Message) bool) error {
+			return reverse.IterateBefore(ctx, with.Before, func(msg *Message) bool {
+				if with.After != uuid.Nil && bytes.Compare(msg.ID[:], with.After[:]) <= 0 {
+					return false
+				}
+				return fn(msg)
+			})
+		}
+	}
+
+	if with.Size == 0 { // if not set default is MAX_LIMIT
+		with.Size = MaxLimit
+	}
+
+	skip := with.Page
+	var found []*Message
+	err := iterate(func(msg *Message) bool {
+		if !criteria(msg) {
+			return true
+		}
+		if sorted {
+			found = append(found, msg)
+			return true
+		}
+		if skip > 0 {
+			skip--
+			return true
+		}
+		found = append(found, msg)
+		return len(found) < with.Size
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if sorted {
+		return Search(found, with), nil
+	}
+	if found == nil {
+		found = []*Message{}
+	}
+	return found, nil
+}
+
+// Finder is a message collection that keeps secondary indexes on the
+// fields of Message tagged with `index:"true"`.
+type Finder interface {
+	Iterator
+	FindBy(field string, value any) ([]*Message, error)
+	FindRange(field string, from, to any) ([]*Message, error)
+}
+
+// SearchIndexed gives the same results as Search, but first narrows the
+// candidates with the indexes of f, so only messages that can match are
+// scanned. It falls back to SearchIter when no indexed filter is set.
+func SearchIndexed(f Finder, with *SearchOptions) ([]*Message, error) {
+
+	var sets [][]*Message
+
+	flags := map[string]*bool{
+		"IsEdited":  with.IsEdited,
+		"IsPinned":  with.IsPinned,
+		"IsDeleted": with.IsDeleted,
+	}
+	for field, value := range flags {
+		if value == nil {
+			continue
+		}
+		found, err := f.FindBy(field, *value)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, found)
+	}
+
+	if with.CreatedAfter != nil || with.CreatedBefore != nil {
+		var from, to any
+		if with.CreatedAfter != nil {
+			from = *with.CreatedAfter
+		}
+		if with.CreatedBefore != nil {
+			to = *with.CreatedBefore
+		}
+		found, err := f.FindRange("CreatedAt", from, to)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, found)
+	}
+
+	if len(sets) == 0 {
+		return SearchIter(context.Background(), f, with)
+	}
+
+	return Search(intersect(sets), with), nil
+}
+
+// intersect returns the messages present in every set, starting from the smallest.
+func intersect(sets [][]*Message) []*Message {
+	smallest := 0
+	for i, set := range sets {
+		if len(set) < len(sets[smallest]) {
+			smallest = i
+		}
+	}
+
+	result := sets[smallest]
+	for i, set := range sets {
+		if i == smallest {
+			continue
+		}
+		ids := make(map[uuid.UUID]struct{}, len(set))
+		for _, msg := range set {
+			ids[msg.ID] = struct{}{}
+		}
+		filtered := result[:0:0]
+		for _, msg := range result {
+			if _, ok := ids[msg.ID]; ok {
+				filtered = append(filtered, msg)
+			}
+		}
+		result = filtered
+	}
+	return result
+}
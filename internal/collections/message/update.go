@@ -28,6 +28,10 @@ type UpdateOptions struct {
 	Poll     *Poll     `json:"poll,omitempty"`
 	Location *Location `json:"location,omitempty"`
 	Contact  *Contact  `json:"contact,omitempty"`
+
+	// IfVersion, when set, makes the update fail with a version conflict
+	// unless the message is still at this version. It comes from If-Match.
+	IfVersion string `json:"-"`
 }
 
 // Initialize updater
@@ -3,7 +3,11 @@ package config
 import (
 	"fmt"
 	"log"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -11,6 +15,34 @@ import (
 const RootDir = "/app/iris/com.iris.messages"
 const usersDir = "users"
 
+// storeEngines is the storage engine of each collection, see store.Open.
+// It can be changed per collection with the MESSAGES_STORE_<COLLECTION>
+// environment variable, e.g. MESSAGES_STORE_MESSAGES=segment. Updating and
+// deleting chats needs transactions, which only collection_manager supports,
+// so with another engine they fail with store.ErrNotTransactional.
+var storeEngines = map[string]string{
+	"chats":    "collection_manager",
+	"messages": "collection_manager",
+}
+
+// itemLayouts is the file layout of each collection stored with the JSON
+// engine, see collection_manager.Layout. It can be changed per collection
+// with the MESSAGES_LAYOUT_<COLLECTION> environment variable.
+var itemLayouts = map[string]string{
+	"chats":    "flat",
+	"messages": "hex",
+}
+
+// defaultChatCacheBytes is the memory budget for loaded chat messages, see
+// ChatCacheBytes.
+const defaultChatCacheBytes = 256 << 20
+
+// Retention defaults, see RetentionInterval and RetentionSoftDeleteGrace.
+const (
+	defaultRetentionInterval        = time.Hour
+	defaultRetentionSoftDeleteGrace = 30 * 24 * time.Hour
+)
+
 var (
 	Mahdi  uuid.UUID
 	Parsa  uuid.UUID
@@ -98,6 +130,95 @@ func GetPath(file string) string {
 	return filepath.Join(RootDir, file)
 }
 
+// StoreEngine returns the storage engine configured for a collection.
+func StoreEngine(collection string) string {
+	if engine := os.Getenv("MESSAGES_STORE_" + strings.ToUpper(collection)); engine != "" {
+		return engine
+	}
+	return storeEngines[collection]
+}
+
+// ItemLayout returns the file layout configured for a collection.
+func ItemLayout(collection string) string {
+	if layout := os.Getenv("MESSAGES_LAYOUT_" + strings.ToUpper(collection)); layout != "" {
+		return layout
+	}
+	return itemLayouts[collection]
+}
+
+// ChatCacheBytes returns the memory budget, in bytes, for the message
+// collections of loaded chats. Above it, the least recently used chats are
+// unloaded. It can be changed with the MESSAGES_CHAT_CACHE_BYTES
+// environment variable.
+func ChatCacheBytes() int64 {
+	if value := os.Getenv("MESSAGES_CHAT_CACHE_BYTES"); value != "" {
+		budget, err := strconv.ParseInt(value, 10, 64)
+		if err == nil && budget > 0 {
+			return budget
+		}
+		log.Printf("invalid MESSAGES_CHAT_CACHE_BYTES %q, using %d", value, defaultChatCacheBytes)
+	}
+	return defaultChatCacheBytes
+}
+
+// RetentionInterval returns how often old messages are purged, set with
+// MESSAGES_RETENTION_INTERVAL, e.g. "30m". Zero disables purging.
+func RetentionInterval() time.Duration {
+	return durationEnv("MESSAGES_RETENTION_INTERVAL", defaultRetentionInterval)
+}
+
+// RetentionSoftDeleteGrace returns how long soft-deleted messages are kept
+// before they are purged, set with MESSAGES_RETENTION_SOFT_DELETE_GRACE.
+// Zero keeps them.
+func RetentionSoftDeleteGrace() time.Duration {
+	return durationEnv("MESSAGES_RETENTION_SOFT_DELETE_GRACE", defaultRetentionSoftDeleteGrace)
+}
+
+// RetentionMaxAge returns the age after which the messages of every chat
+// are purged, set with MESSAGES_RETENTION_MAX_AGE. Zero, the default,
+// keeps them.
+func RetentionMaxAge() time.Duration {
+	return durationEnv("MESSAGES_RETENTION_MAX_AGE", 0)
+}
+
+// RetentionMaxCount returns how many messages every chat keeps at most,
+// set with MESSAGES_RETENTION_MAX_COUNT. Zero, the default, keeps all.
+func RetentionMaxCount() int {
+	if value := os.Getenv("MESSAGES_RETENTION_MAX_COUNT"); value != "" {
+		count, err := strconv.Atoi(value)
+		if err == nil && count >= 0 {
+			return count
+		}
+		log.Printf("invalid MESSAGES_RETENTION_MAX_COUNT %q, keeping all messages", value)
+	}
+	return 0
+}
+
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	if value := os.Getenv(name); value != "" {
+		d, err := time.ParseDuration(value)
+		if err == nil && d >= 0 {
+			return d
+		}
+		log.Printf("invalid %s %q, using %s", name, value, fallback)
+	}
+	return fallback
+}
+
+// Keyfile returns the path of the master keyfile, set with the
+// MESSAGES_KEYFILE environment variable. Stored chats and messages are
+// encrypted when it is set, and written as plaintext when it is empty.
+func Keyfile() string {
+	return os.Getenv("MESSAGES_KEYFILE")
+}
+
+// AdminToken returns the bearer token of the admin routes, set with the
+// MESSAGES_ADMIN_TOKEN environment variable. The admin routes are not
+// served when it is empty.
+func AdminToken() string {
+	return os.Getenv("MESSAGES_ADMIN_TOKEN")
+}
+
 func GetUserPath(phone string, file string) string {
 	pp := filepath.Join(RootDir, usersDir, phone, file)
 	fmt.Println(pp)
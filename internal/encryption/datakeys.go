@@ -0,0 +1,280 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+// KeysFileName is the file of wrapped data keys in a collection directory.
+// It holds JSON, but is not named .json, which stores take for items.
+const KeysFileName = "data.keys"
+
+type keysFile struct {
+	Active uint32       `json:"active"`
+	Keys   []wrappedKey `json:"keys"`
+}
+
+type wrappedKey struct {
+	Version uint32    `json:"version"`
+	Master  uint32    `json:"master"`
+	Wrapped []byte    `json:"wrapped"`
+	Created time.Time `json:"created"`
+}
+
+// DataKeys is the Cipher of one collection directory. Its data keys are
+// stored in data.keys in the directory, wrapped with a master key of the
+// keyring. Every version ever used is kept, so records sealed before a
+// rotation still open.
+type DataKeys struct {
+	ring *Keyring
+	path string
+
+	mu     sync.RWMutex
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+var _ Cipher = (*DataKeys)(nil)
+
+// OpenDataKeys opens the data keys of dir, creating the first one if the
+// directory has none. Keys wrapped with an older master key are rewrapped
+// with the active one.
+func OpenDataKeys(ring *Keyring, dir string) (*DataKeys, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory: %w", err)
+	}
+	k := &DataKeys{ring: ring, path: filepath.Join(dir, KeysFileName)}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	if len(k.keys) == 0 {
+		if _, err := k.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// load reads data.keys. A missing file leaves k without keys. Callers hold
+// k.mu.
+func (k *DataKeys) load() error {
+	file, err := k.read()
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[uint32]cipher.AEAD, len(file.Keys))
+	rewrap := false
+	for i, wk := range file.Keys {
+		key, err := k.ring.unwrap(wk.Master, wk.Version, wk.Wrapped)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k.path, err)
+		}
+		if keys[wk.Version], err = newAEAD(key); err != nil {
+			return err
+		}
+		if wk.Master != k.ring.Active() {
+			if file.Keys[i].Master, file.Keys[i].Wrapped, err = k.ring.wrap(wk.Version, key); err != nil {
+				return err
+			}
+			rewrap = true
+		}
+	}
+	if len(keys) > 0 && keys[file.Active] == nil {
+		return fmt.Errorf("%s: active data key %d is missing", k.path, file.Active)
+	}
+
+	if rewrap {
+		if err := k.write(file); err != nil {
+			return fmt.Errorf("error rewrapping data keys: %w", err)
+		}
+	}
+	k.keys, k.active = keys, file.Active
+	return nil
+}
+
+func (k *DataKeys) read() (keysFile, error) {
+	var file keysFile
+	data, err := os.ReadFile(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return file, nil
+	}
+	if err != nil {
+		return file, fmt.Errorf("error reading data keys: %w", err)
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return file, fmt.Errorf("error decoding %s: %w", k.path, err)
+	}
+	return file, nil
+}
+
+// write replaces data.keys through a synced temporary file, so a crash
+// never loses a key that records may already be sealed with.
+func (k *DataKeys) write(file keysFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempFile := k.path + ".tmp"
+	f, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile, k.path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(k.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Rotate adds a new data key and makes it active, and returns its version.
+// Records sealed with the previous keys stay readable; stores re-encrypt
+// them when they are next opened.
+func (k *DataKeys) Rotate() (uint32, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// Pick up keys added by another process first.
+	if err := k.load(); err != nil {
+		return 0, err
+	}
+	return k.rotate()
+}
+
+func (k *DataKeys) rotate() (uint32, error) {
+	file, err := k.read()
+	if err != nil {
+		return 0, err
+	}
+
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return 0, fmt.Errorf("error generating data key: %w", err)
+	}
+	version := k.active + 1
+	master, wrapped, err := k.ring.wrap(version, key)
+	if err != nil {
+		return 0, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return 0, err
+	}
+
+	file.Active = version
+	file.Keys = append(file.Keys, wrappedKey{Version: version, Master: master, Wrapped: wrapped, Created: time.Now().UTC()})
+	if err := k.write(file); err != nil {
+		return 0, fmt.Errorf("error writing data keys: %w", err)
+	}
+
+	if k.keys == nil {
+		k.keys = make(map[uint32]cipher.AEAD)
+	}
+	k.keys[version], k.active = aead, version
+	return version, nil
+}
+
+// Active returns the version of the active data key.
+func (k *DataKeys) Active() uint32 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// Seal encrypts the record of the item id with the active data key.
+func (k *DataKeys) Seal(id uuid.UUID, plaintext []byte) ([]byte, error) {
+	k.mu.RLock()
+	version, aead := k.active, k.keys[k.active]
+	k.mu.RUnlock()
+
+	record := header{version: version, id: id}.encode()
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	record = append(record, nonce...)
+	return aead.Seal(record, nonce, plaintext, record[:headerSize]), nil
+}
+
+// Open decrypts a record sealed for the item id, see Cipher.
+func (k *DataKeys) Open(id uuid.UUID, data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	h, err := decodeHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if h.id != id {
+		return nil, fmt.Errorf("record of item %s read for item %s: %w", h.id, id, ErrDecrypt)
+	}
+
+	aead, err := k.key(h.version)
+	if err != nil {
+		return nil, err
+	}
+	nonce := data[headerSize : headerSize+nonceSize]
+	plaintext, err := aead.Open(nil, nonce, data[headerSize+nonceSize:], data[:headerSize])
+	if err != nil {
+		return nil, fmt.Errorf("record of item %s: %w", id, ErrDecrypt)
+	}
+	return plaintext, nil
+}
+
+// key returns the data key of version, reloading data.keys once when it
+// is unknown, as another process may have rotated the keys.
+func (k *DataKeys) key(version uint32) (cipher.AEAD, error) {
+	k.mu.RLock()
+	aead := k.keys[version]
+	k.mu.RUnlock()
+	if aead != nil {
+		return aead, nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if aead := k.keys[version]; aead != nil {
+		return aead, nil
+	}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	if aead := k.keys[version]; aead != nil {
+		return aead, nil
+	}
+	return nil, fmt.Errorf("data key %d of %s: %w", version, k.path, ErrUnknownKey)
+}
+
+// Current reports whether data is sealed with the active data key.
+func (k *DataKeys) Current(data []byte) bool {
+	h, err := decodeHeader(data)
+	return err == nil && h.version == k.Active()
+}
@@ -0,0 +1,94 @@
+// Package encryption seals stored records with AES-GCM. Every collection
+// directory has its own data keys, kept in data.keys wrapped by a master
+// key from a local keyfile, so the records of one chat cannot be read with
+// the keys of another. Data keys are rotated by adding a new version: new
+// records are sealed with it, and stores re-encrypt older records in the
+// background.
+package encryption
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Cipher seals records before a store writes them and opens them after it
+// reads them. The ID of the item is bound to its record, so a record moved
+// to another item fails to open.
+type Cipher interface {
+	Seal(id uuid.UUID, plaintext []byte) ([]byte, error)
+	// Open returns the plaintext of a sealed record. Records that are not
+	// sealed are returned as they are, so a store written before encryption
+	// was enabled stays readable until its records are re-encrypted.
+	Open(id uuid.UUID, data []byte) ([]byte, error)
+	// Current reports whether data is sealed with the active data key.
+	// Stores re-encrypt the records for which it is false.
+	Current(data []byte) bool
+}
+
+// Sealed record layout:
+//
+//	[magic 4][format 1][key version 4][id 16][nonce 12][ciphertext + tag]
+//
+// The header before the nonce is the additional data of the seal, so the
+// key version and the ID cannot be changed without failing to open.
+const (
+	recordMagic   = "MENC"
+	recordFormat  = 1
+	nonceSize     = 12
+	headerSize    = len(recordMagic) + 1 + 4 + 16
+	minRecordSize = headerSize + nonceSize + 16
+)
+
+var (
+	// ErrDecrypt is returned for a sealed record that fails authentication,
+	// because it was modified or sealed for another item.
+	ErrDecrypt = errors.New("record failed to decrypt")
+	// ErrUnknownKey is returned for a record sealed with a data key that is
+	// not in data.keys.
+	ErrUnknownKey = errors.New("record is sealed with an unknown data key")
+)
+
+// IsSealed reports whether data is a sealed record.
+func IsSealed(data []byte) bool {
+	return len(data) >= minRecordSize && bytes.HasPrefix(data, []byte(recordMagic))
+}
+
+// SealedID returns the item ID stored in the header of a sealed record,
+// for callers that need it before they can open the record.
+func SealedID(data []byte) (uuid.UUID, bool) {
+	if !IsSealed(data) {
+		return uuid.Nil, false
+	}
+	id, _ := uuid.FromBytes(data[headerSize-16 : headerSize])
+	return id, true
+}
+
+type header struct {
+	version uint32
+	id      uuid.UUID
+}
+
+func (h header) encode() []byte {
+	buf := make([]byte, headerSize, headerSize+nonceSize)
+	copy(buf, recordMagic)
+	buf[4] = recordFormat
+	binary.LittleEndian.PutUint32(buf[5:9], h.version)
+	copy(buf[9:25], h.id[:])
+	return buf
+}
+
+func decodeHeader(data []byte) (header, error) {
+	if !IsSealed(data) {
+		return header{}, errors.New("not a sealed record")
+	}
+	if data[4] != recordFormat {
+		return header{}, fmt.Errorf("unsupported record format %d", data[4])
+	}
+	h := header{version: binary.LittleEndian.Uint32(data[5:9])}
+	copy(h.id[:], data[9:25])
+	return h, nil
+}
@@ -0,0 +1,161 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func newKeyring(t *testing.T) (*Keyring, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "master.keys")
+	if _, err := AddMasterKey(path); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := LoadKeyfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring, path
+}
+
+func TestSealOpen(t *testing.T) {
+	ring, _ := newKeyring(t)
+	keys, err := OpenDataKeys(ring, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := uuid.New()
+	plaintext := []byte(`{"id":"x","text":"hello"}`)
+	sealed, err := keys.Seal(id, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("hello")) {
+		t.Fatal("sealed record contains the plaintext")
+	}
+	if !IsSealed(sealed) || !keys.Current(sealed) {
+		t.Fatal("sealed record is not sealed with the active key")
+	}
+	if got, ok := SealedID(sealed); !ok || got != id {
+		t.Fatalf("SealedID = %s, %t, want %s", got, ok, id)
+	}
+
+	opened, err := keys.Open(id, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Fatalf("opened %q, want %q", opened, plaintext)
+	}
+
+	// Plaintext passes through, so stores written before stay readable.
+	if opened, err := keys.Open(id, plaintext); err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("Open of plaintext = %q, %v", opened, err)
+	}
+
+	if _, err := keys.Open(uuid.New(), sealed); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("Open for another item: got %v, want ErrDecrypt", err)
+	}
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := keys.Open(id, tampered); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("Open of tampered record: got %v, want ErrDecrypt", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	ring, _ := newKeyring(t)
+	dir := t.TempDir()
+	keys, err := OpenDataKeys(ring, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second process that opened the keys before the rotation.
+	other, err := OpenDataKeys(ring, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := uuid.New()
+	old, err := keys.Seal(id, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := keys.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("rotated to version %d, want 2", version)
+	}
+	if keys.Current(old) {
+		t.Fatal("record sealed before the rotation is current")
+	}
+	if _, err := keys.Open(id, old); err != nil {
+		t.Fatalf("record sealed before the rotation: %v", err)
+	}
+
+	sealed, err := keys.Seal(id, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Open(id, sealed); err != nil {
+		t.Fatalf("open with a key added by another process: %v", err)
+	}
+}
+
+func TestMasterKeyRotation(t *testing.T) {
+	ring, path := newKeyring(t)
+	dir := t.TempDir()
+	keys, err := OpenDataKeys(ring, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.New()
+	sealed, err := keys.Seal(id, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AddMasterKey(path); err != nil {
+		t.Fatal(err)
+	}
+	ring, err = LoadKeyfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.Active() != 2 {
+		t.Fatalf("active master key %d, want 2", ring.Active())
+	}
+	// Opening rewraps the data keys with master key 2.
+	if _, err := OpenDataKeys(ring, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Master key 1 is no longer needed.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if err := os.WriteFile(path, lines[1], 0600); err != nil {
+		t.Fatal(err)
+	}
+	ring, err = LoadKeyfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err = OpenDataKeys(ring, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Open(id, sealed); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,155 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// KeySize is the size of master and data keys, for AES-256.
+const KeySize = 32
+
+// Keyring holds the master keys of a keyfile. The keyfile has one key per
+// line, as a numeric ID and the key in hex:
+//
+//	1 4f1c...e2
+//	2 9ab0...17
+//
+// The key with the highest ID is active: data keys are wrapped with it, and
+// data keys wrapped with an older one are rewrapped when they are opened.
+// Older keys must stay in the file until that has happened everywhere.
+type Keyring struct {
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+// LoadKeyfile reads the master keys from the keyfile at path.
+func LoadKeyfile(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keyfile: %w", err)
+	}
+
+	ring := &Keyring{keys: make(map[uint32]cipher.AEAD)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("keyfile %s line %d: want an ID and a key", path, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("keyfile %s line %d: invalid key ID %q", path, line, fields[0])
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("keyfile %s line %d: key must be %d bytes in hex", path, line, KeySize)
+		}
+		if _, exists := ring.keys[uint32(id)]; exists {
+			return nil, fmt.Errorf("keyfile %s line %d: duplicate key ID %d", path, line, id)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		ring.keys[uint32(id)] = aead
+		ring.active = max(ring.active, uint32(id))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading keyfile: %w", err)
+	}
+	if len(ring.keys) == 0 {
+		return nil, fmt.Errorf("keyfile %s has no keys", path)
+	}
+	return ring, nil
+}
+
+// AddMasterKey appends a new random master key to the keyfile at path,
+// creating it if needed, and returns its ID. The new key becomes active
+// the next time the keyfile is loaded.
+func AddMasterKey(path string) (uint32, error) {
+	var next uint32 = 1
+	if ring, err := LoadKeyfile(path); err == nil {
+		next = ring.active + 1
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return 0, fmt.Errorf("error generating key: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("error opening keyfile: %w", err)
+	}
+	if _, err := fmt.Fprintf(file, "%d %s\n", next, hex.EncodeToString(key)); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("error writing keyfile: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("error syncing keyfile: %w", err)
+	}
+	return next, file.Close()
+}
+
+// Active returns the ID of the active master key.
+func (r *Keyring) Active() uint32 {
+	return r.active
+}
+
+// wrap seals a data key with the active master key. The data key version
+// is bound to it, so wrapped keys cannot be swapped in data.keys.
+func (r *Keyring) wrap(version uint32, key []byte) (uint32, []byte, error) {
+	aead := r.keys[r.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	return r.active, aead.Seal(nonce, nonce, key, wrapData(version)), nil
+}
+
+// unwrap opens a data key wrapped with the master key master.
+func (r *Keyring) unwrap(master, version uint32, wrapped []byte) ([]byte, error) {
+	aead, ok := r.keys[master]
+	if !ok {
+		return nil, fmt.Errorf("data key %d is wrapped with master key %d, which is not in the keyfile", version, master)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("data key %d is truncated", version)
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, wrapData(version))
+	if err != nil {
+		return nil, fmt.Errorf("data key %d does not open with master key %d: %w", version, master, err)
+	}
+	return key, nil
+}
+
+func wrapData(version uint32) []byte {
+	return []byte("messages data key " + strconv.FormatUint(uint64(version), 10))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -10,24 +10,36 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-// Client represents a connected user
+// Client represents one connected device of a user
 type Client struct {
-	hub    *Hub
-	conn   *websocket.Conn
-	userID uuid.UUID
-	send   chan []byte
-	chats  map[uuid.UUID]bool // Track which chats the user is in
-	mutex  sync.RWMutex
+	hub      *Hub
+	conn     *websocket.Conn
+	userID   uuid.UUID
+	deviceID string
+	platform string
+	send     chan []byte
+
+	// resuming holds the live events of the chats being replayed to the
+	// client, delivered once the replay is sent, see Hub.HandleResume.
+	mutex    sync.Mutex
+	resuming map[uuid.UUID][]event
 }
 
-// NewClient creates a new chat_client instance
-func NewClient(hub *Hub, conn *websocket.Conn, userID uuid.UUID) *Client {
+// NewClient creates a new chat_client instance for a device of a user. A
+// device that does not identify itself gets a random ID, so it never
+// replaces another connection of the user.
+func NewClient(hub *Hub, conn *websocket.Conn, userID uuid.UUID, deviceID, platform string) *Client {
+	if deviceID == "" {
+		deviceID = uuid.NewString()
+	}
 	return &Client{
-		hub:    hub,
-		conn:   conn,
-		userID: userID,
-		send:   make(chan []byte, 256),
-		chats:  make(map[uuid.UUID]bool),
+		hub:      hub,
+		conn:     conn,
+		userID:   userID,
+		deviceID: deviceID,
+		platform: platform,
+		send:     make(chan []byte, 256),
+		resuming: make(map[uuid.UUID][]event),
 	}
 }
 
@@ -37,29 +49,14 @@ func (c *Client) handleMessage(rawMessage []byte) {
 	c.hub.HandleClientMessage(c, rawMessage)
 }
 
-// IsInChat checks if the chat_client is in a specific chat
+// IsInChat checks if the chat_client's user is in a specific chat
 func (c *Client) IsInChat(chatID uuid.UUID) bool {
-	_, ok := c.chats[chatID]
-	return ok
-}
-
-// JoinChat adds the chat_client to a chat
-func (c *Client) JoinChat(chatID uuid.UUID) {
-	c.chats[chatID] = true
-}
-
-// LeaveChat removes the chat_client from a chat
-func (c *Client) LeaveChat(chatID uuid.UUID) {
-	delete(c.chats, chatID)
+	return c.hub.IsUserInChat(c.userID, chatID)
 }
 
-// GetChats returns all chats the chat_client is in
+// GetChats returns all chats the chat_client's user is in
 func (c *Client) GetChats() []uuid.UUID {
-	chats := make([]uuid.UUID, 0, len(c.chats))
-	for chatID := range c.chats {
-		chats = append(chats, chatID)
-	}
-	return chats
+	return c.hub.GetUserChats(c.userID)
 }
 
 // SendMessage sends a message directly to this chat_client
@@ -89,6 +86,16 @@ func (c *Client) UserID() uuid.UUID {
 	return c.userID
 }
 
+// DeviceID returns the ID of the chat_client's device
+func (c *Client) DeviceID() string {
+	return c.deviceID
+}
+
+// Platform returns the platform the chat_client's device reported
+func (c *Client) Platform() string {
+	return c.platform
+}
+
 // ReadPump handles message from the WebSocket connection
 func (c *Client) ReadPump() {
 
@@ -96,7 +103,7 @@ func (c *Client) ReadPump() {
 		// Clean up when chat_client disconnects
 		c.hub.UnregisterClient(c)
 		c.conn.Close()
-		log.Printf("Client %s disconnected", c.userID)
+		log.Printf("Client %s on %s disconnected", c.userID, c.deviceID)
 	}()
 
 	// Configure connection settings
@@ -5,4 +5,5 @@ import "errors"
 // ErrClientSendBufferFull Custom errors
 var (
 	ErrClientSendBufferFull = errors.New("chat_client send buffer is full")
+	ErrNotChatMember        = errors.New("user is not a member of the chat")
 )
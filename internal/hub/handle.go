@@ -1,13 +1,12 @@
 package hub
 
 import (
-	"fmt"
 	"github.com/goccy/go-json"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/mahdi-cpp/messages-api/internal/helpers"
 )
 
 // HandleClientMessage processes a message from a chat_client
@@ -17,6 +16,12 @@ func (h *Hub) HandleClientMessage(client *Client, rawMessage []byte) {
 		ChatID  uuid.UUID `json:"chatId"`
 		Type    string    `json:"type"`
 		Content string    `json:"content"`
+		// MessageID is the message receipts acknowledge up to.
+		MessageID uuid.UUID `json:"messageId"`
+		// Cursors holds the last sequence number received per chat, for resume.
+		Cursors map[uuid.UUID]int64 `json:"cursors"`
+		// TempID is the client's own ID of a message, returned in its ack.
+		TempID string `json:"tempId"`
 	}
 
 	if err := json.Unmarshal(rawMessage, &message); err != nil {
@@ -27,11 +32,15 @@ func (h *Hub) HandleClientMessage(client *Client, rawMessage []byte) {
 	switch message.Type {
 	case "message":
 		//h.HandleChatMessage(client, message.Caption, message.ChatID)
-		h.handleForSave(client.UserID(), message.ChatID, message.Content)
+		h.handleForSave(client, message.ChatID, message.Content, message.TempID)
 	case "typing":
 		h.HandleTypingIndicator(client, message.Content, message.ChatID)
+	case "delivered", "read":
+		h.HandleReceipt(client, message.Type, message.ChatID, message.MessageID)
 	case "seen":
-		h.HandleSeenIndicator(client, message.Content, message.ChatID)
+		// Older clients send seen, without a message, for what is now a
+		// read receipt of the whole chat.
+		h.HandleReceipt(client, "read", message.ChatID, uuid.Nil)
 	case "join_chat":
 		h.HandleJoinChat(client, message.ChatID)
 	case "leave_chat":
@@ -42,22 +51,72 @@ func (h *Hub) HandleClientMessage(client *Client, rawMessage []byte) {
 		h.HandleOpenChat(client, message.ChatID)
 	case "get_chats":
 		h.HandleGetChats(client)
+	case "resume":
+		h.HandleResume(client, message.Cursors)
 	default:
 		log.Printf("Unknown message type from chat_client %s: %s", client.userID, message.Type)
 	}
 }
 
-func (h *Hub) handleForSave(userID, chatID uuid.UUID, content string) {
+// handleForSave validates a message of a client and hands it to the
+// Manager, which stores it and then acks and broadcasts it, see AckMessage.
+func (h *Hub) handleForSave(client *Client, chatID uuid.UUID, content, tempID string) {
 
 	msg := &Message{
-		UserID:  userID,
-		ChatID:  chatID,
-		Content: content,
+		UserID:   client.userID,
+		ChatID:   chatID,
+		Content:  content,
+		DeviceID: client.deviceID,
+		TempID:   tempID,
+	}
+
+	if !h.IsUserInChat(client.userID, chatID) {
+		h.RejectMessage(msg, ErrNotChatMember.Error())
+		return
+	}
+	if strings.TrimSpace(content) == "" {
+		h.RejectMessage(msg, "message is empty")
+		return
 	}
 
 	h.messagesToManager <- msg
 }
 
+// AckMessage tells the device that sent msg that it was stored as the
+// message messageID, numbered seq in its chat.
+func (h *Hub) AckMessage(msg *Message, messageID uuid.UUID, seq int64) {
+	h.replyTo(msg, map[string]interface{}{
+		"type":      "ack",
+		"chatId":    msg.ChatID,
+		"tempId":    msg.TempID,
+		"messageId": messageID,
+		"seq":       seq,
+		"success":   true,
+	})
+}
+
+// RejectMessage tells the device that sent msg that it was not stored.
+func (h *Hub) RejectMessage(msg *Message, reason string) {
+	h.replyTo(msg, map[string]interface{}{
+		"type":    "error",
+		"chatId":  msg.ChatID,
+		"tempId":  msg.TempID,
+		"message": reason,
+		"success": false,
+	})
+}
+
+func (h *Hub) replyTo(msg *Message, response map[string]interface{}) {
+	client, ok := h.GetClient(msg.UserID, msg.DeviceID)
+	if !ok {
+		// The device disconnected since; it learns the outcome on resume.
+		return
+	}
+	if err := client.SendMessage(response); err != nil {
+		log.Printf("Failed to send %s to chat_client %s: %v", response["type"], msg.UserID, err)
+	}
+}
+
 // HandleChatMessage processes and broadcasts chat message
 //func (h *Hub) HandleChatMessage(client *Client, content, chatID string) {
 //
@@ -100,21 +159,13 @@ func (h *Hub) HandleTypingIndicator(client *Client, typing string, chatID uuid.U
 	h.BroadcastToChat(chatID, typingMessage)
 }
 
-func (h *Hub) HandleSeenIndicator(client *Client, typing string, chatID uuid.UUID) {
-	typingMessage := map[string]interface{}{
-		"type":      "seen",
-		"userId":    client.userID,
-		"chatId":    chatID,
-		"timestamp": time.Now(),
-	}
-
-	h.BroadcastToChat(chatID, typingMessage)
-}
-
-// HandleJoinChat handles chat joining
+// HandleJoinChat handles chat joining by a member of the chat
 func (h *Hub) HandleJoinChat(client *Client, chatID uuid.UUID) {
 
-	h.JoinChat(chatID, client.userID, client)
+	if !h.authorizeJoin(client, chatID) {
+		return
+	}
+	h.JoinChat(chatID, client.userID)
 
 	// Notify chat about new user
 	joinMessage := map[string]interface{}{
@@ -128,6 +179,18 @@ func (h *Hub) HandleJoinChat(client *Client, chatID uuid.UUID) {
 	h.BroadcastToChat(chatID, joinMessage)
 }
 
+// authorizeJoin checks that the client's user is a member of a chat, and
+// tells the client why not otherwise.
+func (h *Hub) authorizeJoin(client *Client, chatID uuid.UUID) bool {
+	err := h.authorize(chatID, client.userID)
+	if err == nil {
+		return true
+	}
+	log.Printf("Join of chat %s refused for user %s: %v", chatID, client.userID, err)
+	h.sendError(client, chatID, ErrNotChatMember.Error())
+	return false
+}
+
 // HandleLeaveChat handles chat leaving
 func (h *Hub) HandleLeaveChat(client *Client, chatID uuid.UUID) {
 	h.LeaveChat(chatID, client.userID)
@@ -143,19 +206,27 @@ func (h *Hub) HandleLeaveChat(client *Client, chatID uuid.UUID) {
 	h.BroadcastToChat(chatID, leaveMessage)
 }
 
-// HandleCreateChat handles chat creation
+// HandleCreateChat creates a chat with the user of the client as its
+// member. The chat is persisted through the chat creator, so it is subject
+// to the same membership checks as every other chat.
 func (h *Hub) HandleCreateChat(client *Client, chatName string) {
 
-	chatID, err := helpers.GenerateUUID()
+	h.mutex.RLock()
+	createChat := h.createChat
+	h.mutex.RUnlock()
+
+	if createChat == nil {
+		h.sendError(client, uuid.Nil, "creating chats is not supported")
+		return
+	}
+	chatID, err := createChat(client.userID, chatName)
 	if err != nil {
-		fmt.Printf("Error generating chat id: %v", err)
+		log.Printf("Failed to create chat for chat_client %s: %v", client.userID, err)
+		h.sendError(client, uuid.Nil, "failed to create the chat")
 		return
 	}
 
-	h.CreateChat(chatID, chatName)
-	h.JoinChat(chatID, client.userID, client)
-
-	// Notify about chat creation
+	// Notify the members about chat creation
 	chatMessage := map[string]interface{}{
 		"type":      "chat_created",
 		"chatId":    chatID,
@@ -164,12 +235,15 @@ func (h *Hub) HandleCreateChat(client *Client, chatName string) {
 		"timestamp": time.Now(),
 	}
 
-	h.BroadcastToAll(chatMessage)
+	h.BroadcastToChat(chatID, chatMessage)
 }
 
 func (h *Hub) HandleOpenChat(client *Client, chatID uuid.UUID) {
 
-	h.JoinChat(chatID, client.userID, client)
+	if !h.authorizeJoin(client, chatID) {
+		return
+	}
+	h.JoinChat(chatID, client.userID)
 
 	// Notify about chat creation
 	chatMessage := map[string]interface{}{
@@ -12,9 +12,11 @@ import (
 
 // Chat represents a chat
 type Chat struct {
-	ID        uuid.UUID
-	Name      string
-	Clients   map[uuid.UUID]*Client // userID -> Client
+	ID   uuid.UUID
+	Name string
+	// Users holds the IDs of the users in the chat. Messages to the chat go
+	// to every connected device of each of them.
+	Users     map[uuid.UUID]bool
 	CreatedAt time.Time
 }
 
@@ -24,25 +26,46 @@ type Message struct {
 	ChatID  uuid.UUID `json:"chatID"`
 	UserID  uuid.UUID `json:"userID"`
 	Content string    `json:"content"`
+	// DeviceID and TempID say which device sent the message under which
+	// ID of its own, for the ack once it is stored.
+	DeviceID string `json:"deviceID"`
+	TempID   string `json:"tempID"`
 }
 
-// Hub manages all connected clients and chats
+// Hub manages all connected clients and chats. A user can be connected
+// from several devices at once, each with its own Client.
 type Hub struct {
 	chats     map[uuid.UUID]*Chat
-	clients   map[uuid.UUID]*Client // userID -> Client
+	clients   map[uuid.UUID]map[string]*Client // userID -> deviceID -> Client
 	mutex     sync.RWMutex
 	startTime time.Time
 	// Added a channel to send messages to the Manager.
 	// یک کانال برای ارسال پیام‌ها به Manager اضافه شده است.
 	messagesToManager chan *Message
+
+	// membership authorizes joining a chat, see SetMembership.
+	membership MembershipFunc
+	// replay reads the persisted events a client missed, see SetReplay.
+	replay ReplayFunc
+	// receipts persists the receipts of clients, see SetReceipts.
+	receipts ReceiptFunc
+	// createChat persists the chats clients create, see SetChatCreator.
+	createChat ChatCreatorFunc
 }
 
+// MembershipFunc reports whether a user is a member of a persisted chat.
+type MembershipFunc func(chatID, userID uuid.UUID) (bool, error)
+
+// ChatCreatorFunc persists a new chat named name with userID as its member,
+// subscribes the user to it, and returns its ID.
+type ChatCreatorFunc func(userID uuid.UUID, name string) (uuid.UUID, error)
+
 // NewHub creates a new Hub instance
 func NewHub(messages chan *Message) *Hub {
 
 	hub := &Hub{
 		chats:             make(map[uuid.UUID]*Chat),
-		clients:           make(map[uuid.UUID]*Client),
+		clients:           make(map[uuid.UUID]map[string]*Client),
 		startTime:         time.Now(),
 		messagesToManager: messages,
 	}
@@ -53,6 +76,41 @@ func NewHub(messages chan *Message) *Hub {
 	return hub
 }
 
+// SetMembership sets the function join requests are authorized with.
+// Without one, every join request is refused.
+func (h *Hub) SetMembership(fn MembershipFunc) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.membership = fn
+}
+
+// SetChatCreator sets the function create requests persist chats with.
+// Without one, every create request is refused.
+func (h *Hub) SetChatCreator(fn ChatCreatorFunc) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.createChat = fn
+}
+
+// authorize reports whether a user may join a chat.
+func (h *Hub) authorize(chatID, userID uuid.UUID) error {
+	h.mutex.RLock()
+	membership := h.membership
+	h.mutex.RUnlock()
+
+	if membership == nil {
+		return ErrNotChatMember
+	}
+	ok, err := membership(chatID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotChatMember
+	}
+	return nil
+}
+
 // Run starts the hub (maintain for compatibility)
 func (h *Hub) Run() {
 
@@ -66,47 +124,63 @@ func (h *Hub) Run() {
 	}
 }
 
-// RegisterClient adds a chat_client to the hub
+// RegisterClient adds a chat_client to the hub, next to the other devices
+// of its user. A client with the device ID of a connected one replaces it,
+// as that device reconnected, and the old connection is closed.
 func (h *Hub) RegisterClient(client *Client) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
-	h.clients[client.userID] = client
-	log.Printf("Client registered: %s. Total clients: %d", client.userID, len(h.clients))
+	devices, exists := h.clients[client.userID]
+	if !exists {
+		devices = make(map[string]*Client)
+		h.clients[client.userID] = devices
+	}
+	if old, exists := devices[client.deviceID]; exists && old != client {
+		old.disconnect()
+	}
+	devices[client.deviceID] = client
+	log.Printf("Client registered: %s on %s (%s). Devices of user: %d, total users: %d",
+		client.userID, client.deviceID, client.platform, len(devices), len(h.clients))
 }
 
-// UnregisterClient removes a chat_client from the hub and all chats
+// UnregisterClient removes a chat_client from the hub. The user stays in
+// their chats while another of their devices is connected, and is removed
+// from all of them with the last one.
 func (h *Hub) UnregisterClient(client *Client) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
-	// Remove chat_client from all chats
-	for chatID := range client.chats {
-		if chat, exists := h.chats[chatID]; exists {
-			delete(chat.Clients, client.userID)
-			log.Printf("Client %s removed from chat %s", client.userID, chatID)
-		}
+	devices := h.clients[client.userID]
+	if devices[client.deviceID] != client {
+		// Already replaced by a reconnect of the same device.
+		return
+	}
+	delete(devices, client.deviceID)
+	log.Printf("Client unregistered: %s on %s. Devices of user left: %d", client.userID, client.deviceID, len(devices))
+	if len(devices) > 0 {
+		return
 	}
 
-	// Remove chat_client from main clients map
+	// Remove the user from all chats with their last device
 	delete(h.clients, client.userID)
-	log.Printf("Client unregistered: %s. Remaining clients: %d", client.userID, len(h.clients))
+	for chatID, chat := range h.chats {
+		if chat.Users[client.userID] {
+			delete(chat.Users, client.userID)
+			log.Printf("User %s removed from chat %s", client.userID, chatID)
+		}
+	}
 }
 
-// LeaveChat removes a chat_client from a specific chat
+// LeaveChat removes a user, with all of their devices, from a specific chat
 func (h *Hub) LeaveChat(chatID, userID uuid.UUID) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
 	if chat, exists := h.chats[chatID]; exists {
-		if _, clientExists := chat.Clients[userID]; clientExists {
-			delete(chat.Clients, userID)
-			log.Printf("User %s left chat %s. Users remaining: %d", userID, chatID, len(chat.Clients))
-
-			// Also remove from chat_client's chat list
-			if client, clientExists := h.clients[userID]; clientExists {
-				client.LeaveChat(chatID)
-			}
+		if chat.Users[userID] {
+			delete(chat.Users, userID)
+			log.Printf("User %s left chat %s. Users remaining: %d", userID, chatID, len(chat.Users))
 		} else {
 			log.Printf("User %s not found in chat %s", userID, chatID)
 		}
@@ -115,8 +189,8 @@ func (h *Hub) LeaveChat(chatID, userID uuid.UUID) {
 	}
 }
 
-// JoinChat adds a chat_client to a chat
-func (h *Hub) JoinChat(chatID, userID uuid.UUID, client *Client) {
+// JoinChat adds a user, with all of their devices, to a chat
+func (h *Hub) JoinChat(chatID, userID uuid.UUID) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
@@ -126,18 +200,49 @@ func (h *Hub) JoinChat(chatID, userID uuid.UUID, client *Client) {
 		h.chats[chatID] = &Chat{
 			ID:        chatID,
 			Name:      chatID.String(), // Use ID as name for auto-created chats
-			Clients:   make(map[uuid.UUID]*Client),
+			Users:     make(map[uuid.UUID]bool),
 			CreatedAt: time.Now(),
 		}
 	}
 
 	chat := h.chats[chatID]
+	chat.Users[userID] = true
 
-	// Add chat_client to the chat
-	chat.Clients[userID] = client
-	client.JoinChat(chatID)
+	log.Printf("User %s joined chat %s (Total in chat: %d)", userID, chatID, len(chat.Users))
+}
+
+// SyncChatMembers makes the connected users among userIDs the users of a
+// chat, after its persisted members changed. Users without a connected
+// device are subscribed once they connect.
+func (h *Hub) SyncChatMembers(chatID uuid.UUID, userIDs []uuid.UUID) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	chat, exists := h.chats[chatID]
+	if !exists {
+		chat = &Chat{
+			ID:        chatID,
+			Name:      chatID.String(),
+			Users:     make(map[uuid.UUID]bool),
+			CreatedAt: time.Now(),
+		}
+		h.chats[chatID] = chat
+	}
 
-	log.Printf("User %s joined chat %s (Total in chat: %d)", userID, chatID, len(chat.Clients))
+	members := make(map[uuid.UUID]bool, len(userIDs))
+	for _, userID := range userIDs {
+		members[userID] = true
+		if _, connected := h.clients[userID]; connected && !chat.Users[userID] {
+			chat.Users[userID] = true
+			log.Printf("User %s subscribed to chat %s", userID, chatID)
+		}
+	}
+	for userID := range chat.Users {
+		if !members[userID] {
+			delete(chat.Users, userID)
+			log.Printf("User %s unsubscribed from chat %s", userID, chatID)
+		}
+	}
 }
 
 // CreateChat creates a new chat
@@ -149,13 +254,24 @@ func (h *Hub) CreateChat(chatID uuid.UUID, chatName string) {
 		h.chats[chatID] = &Chat{
 			ID:        chatID,
 			Name:      chatName,
-			Clients:   make(map[uuid.UUID]*Client),
+			Users:     make(map[uuid.UUID]bool),
 			CreatedAt: time.Now(),
 		}
 		log.Printf("Chat created: %s (%s). Total chats: %d", chatName, chatID, len(h.chats))
 	}
 }
 
+// RemoveChat drops a deleted chat with the subscriptions of its users.
+func (h *Hub) RemoveChat(chatID uuid.UUID) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if chat, exists := h.chats[chatID]; exists {
+		delete(h.chats, chatID)
+		log.Printf("Chat %s removed, unsubscribed %d users", chatID, len(chat.Users))
+	}
+}
+
 // BroadcastToChat sends a message to all clients in a chat
 func (h *Hub) BroadcastToChat(chatID uuid.UUID, message interface{}) {
 
@@ -170,15 +286,9 @@ func (h *Hub) BroadcastToChat(chatID uuid.UUID, message interface{}) {
 	}
 
 	if chat, exists := h.chats[chatID]; exists {
-		for userID, client := range chat.Clients {
-			// Check if chat_client is still connected and channel is not full
-			select {
-			case client.send <- messageBytes:
-				// Message sent successfully
-				log.Printf("Message sent to user %s in chat %s", userID, chatID)
-			default:
-				// Channel is full, chat_client might be disconnected
-				log.Printf("Client %s send buffer full, potentially disconnected", userID)
+		for userID := range chat.Users {
+			for _, client := range h.clients[userID] {
+				h.send(client, messageBytes)
 			}
 		}
 	} else {
@@ -186,6 +296,60 @@ func (h *Hub) BroadcastToChat(chatID uuid.UUID, message interface{}) {
 	}
 }
 
+// BroadcastEvent sends a persisted event of a chat, numbered seq in the
+// chat, to all users in the chat. Unlike BroadcastToChat, a client too slow
+// to take it is disconnected, so that it resumes from its last event when
+// it reconnects instead of silently missing this one.
+func (h *Hub) BroadcastEvent(chatID uuid.UUID, seq int64, message interface{}) {
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	chat, exists := h.chats[chatID]
+	if !exists {
+		log.Printf("Chat %s not found for broadcasting", chatID)
+		return
+	}
+	for userID := range chat.Users {
+		for _, client := range h.clients[userID] {
+			client.deliver(chatID, event{seq: seq, data: messageBytes})
+		}
+	}
+}
+
+// send queues a message for one device without waiting. Callers hold
+// h.mutex.
+func (h *Hub) send(client *Client, messageBytes []byte) {
+	// Check if chat_client is still connected and channel is not full
+	select {
+	case client.send <- messageBytes:
+		// Message sent successfully
+	default:
+		// Channel is full, chat_client might be disconnected
+		log.Printf("Client %s on %s send buffer full, potentially disconnected", client.userID, client.deviceID)
+	}
+}
+
+// SendToUser sends a message to every connected device of a user
+func (h *Hub) SendToUser(userID uuid.UUID, message interface{}) {
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, client := range h.clients[userID] {
+		h.send(client, messageBytes)
+	}
+}
+
 // GetChatList returns a map of chat IDs to chat names
 func (h *Hub) GetChatList() map[uuid.UUID]string {
 	h.mutex.RLock()
@@ -204,8 +368,8 @@ func (h *Hub) GetChatUsers(chatID uuid.UUID) []uuid.UUID {
 	defer h.mutex.RUnlock()
 
 	if chat, exists := h.chats[chatID]; exists {
-		users := make([]uuid.UUID, 0, len(chat.Clients))
-		for userID := range chat.Clients {
+		users := make([]uuid.UUID, 0, len(chat.Users))
+		for userID := range chat.Users {
 			users = append(users, userID)
 		}
 		return users
@@ -213,8 +377,24 @@ func (h *Hub) GetChatUsers(chatID uuid.UUID) []uuid.UUID {
 	return []uuid.UUID{}
 }
 
-// GetClientCount returns the number of connected clients
+// GetClientCount returns the number of connected clients, counting every
+// device of a user
 func (h *Hub) GetClientCount() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.clientCount()
+}
+
+func (h *Hub) clientCount() int {
+	count := 0
+	for _, devices := range h.clients {
+		count += len(devices)
+	}
+	return count
+}
+
+// GetUserCount returns the number of users with a connected device
+func (h *Hub) GetUserCount() int {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 	return len(h.clients)
@@ -229,7 +409,7 @@ func (h *Hub) GetChatStats() map[string]interface{} {
 	for chatID, chat := range h.chats {
 		stats[chatID.String()] = map[string]interface{}{
 			"name":       chat.Name,
-			"user_count": len(chat.Clients),
+			"user_count": len(chat.Users),
 			"created_at": chat.CreatedAt,
 		}
 	}
@@ -247,7 +427,8 @@ func (h *Hub) GetHubStats() map[string]interface{} {
 	defer h.mutex.RUnlock()
 
 	return map[string]interface{}{
-		"total_clients": len(h.clients),
+		"total_clients": h.clientCount(),
+		"total_users":   len(h.clients),
 		"total_chats":   len(h.chats),
 		"uptime":        time.Since(h.startTime).String(),
 		"start_time":    h.startTime,
@@ -273,15 +454,27 @@ func (h *Hub) ChatExists(chatID uuid.UUID) bool {
 	return exists
 }
 
-// GetClient returns a chat_client by user ID
-func (h *Hub) GetClient(userID uuid.UUID) (*Client, bool) {
+// GetClient returns the chat_client of a user's device
+func (h *Hub) GetClient(userID uuid.UUID, deviceID string) (*Client, bool) {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
-	client, exists := h.clients[userID]
+	client, exists := h.clients[userID][deviceID]
 	return client, exists
 }
 
+// GetClients returns the clients of every connected device of a user
+func (h *Hub) GetClients(userID uuid.UUID) []*Client {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	clients := make([]*Client, 0, len(h.clients[userID]))
+	for _, client := range h.clients[userID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
 // BroadcastToAll sends a message to all connected clients
 func (h *Hub) BroadcastToAll(message interface{}) {
 	h.mutex.RLock()
@@ -293,12 +486,9 @@ func (h *Hub) BroadcastToAll(message interface{}) {
 		return
 	}
 
-	for userID, client := range h.clients {
-		select {
-		case client.send <- messageBytes:
-			// Message sent successfully
-		default:
-			log.Printf("Client %s send buffer full", userID)
+	for _, devices := range h.clients {
+		for _, client := range devices {
+			h.send(client, messageBytes)
 		}
 	}
 }
@@ -309,7 +499,7 @@ func (h *Hub) CleanupInactiveChats() {
 	defer h.mutex.Unlock()
 
 	for chatID, chat := range h.chats {
-		if len(chat.Clients) == 0 && chatID.String() != "general" {
+		if len(chat.Users) == 0 && chatID.String() != "general" {
 			delete(h.chats, chatID)
 			log.Printf("Removed inactive chat: %s", chatID)
 		}
@@ -322,8 +512,8 @@ func (h *Hub) RemoveUserFromAllChats(userID uuid.UUID) {
 	defer h.mutex.Unlock()
 
 	for chatID, chat := range h.chats {
-		if _, exists := chat.Clients[userID]; exists {
-			delete(chat.Clients, userID)
+		if chat.Users[userID] {
+			delete(chat.Users, userID)
 			log.Printf("User %s removed from chat %s", userID, chatID)
 		}
 	}
@@ -336,7 +526,7 @@ func (h *Hub) GetUserChats(userID uuid.UUID) []uuid.UUID {
 
 	var userChats []uuid.UUID
 	for chatID, chat := range h.chats {
-		if _, exists := chat.Clients[userID]; exists {
+		if chat.Users[userID] {
 			userChats = append(userChats, chatID)
 		}
 	}
@@ -349,8 +539,7 @@ func (h *Hub) IsUserInChat(userID, chatID uuid.UUID) bool {
 	defer h.mutex.RUnlock()
 
 	if chat, exists := h.chats[chatID]; exists {
-		_, userExists := chat.Clients[userID]
-		return userExists
+		return chat.Users[userID]
 	}
 	return false
 }
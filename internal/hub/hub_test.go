@@ -0,0 +1,216 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// TestMultiDevice checks that chat traffic reaches every device of a user,
+// and that one device disconnecting keeps the user in their chats.
+func TestMultiDevice(t *testing.T) {
+	h := NewHub(make(chan *Message, 1))
+	alice, bob := uuid.New(), uuid.New()
+	phone := NewClient(h, nil, alice, "phone", "ios")
+	laptop := NewClient(h, nil, alice, "laptop", "web")
+	other := NewClient(h, nil, bob, "", "android")
+	for _, c := range []*Client{phone, laptop, other} {
+		h.RegisterClient(c)
+	}
+	if h.GetClientCount() != 3 || h.GetUserCount() != 2 {
+		t.Fatalf("hub has %d clients of %d users, want 3 of 2", h.GetClientCount(), h.GetUserCount())
+	}
+
+	chatID := uuid.New()
+	h.JoinChat(chatID, alice)
+	h.JoinChat(chatID, bob)
+
+	received := func(c *Client) int {
+		n := len(c.send)
+		for i := 0; i < n; i++ {
+			<-c.send
+		}
+		return n
+	}
+	h.BroadcastToChat(chatID, map[string]string{"type": "message"})
+	for _, c := range []*Client{phone, laptop, other} {
+		if n := received(c); n != 1 {
+			t.Fatalf("device %s received %d messages, want 1", c.DeviceID(), n)
+		}
+	}
+
+	h.UnregisterClient(phone)
+	if !h.IsUserInChat(alice, chatID) {
+		t.Fatal("user left the chat with one of two devices")
+	}
+	h.BroadcastToChat(chatID, map[string]string{"type": "message"})
+	if received(laptop) != 1 || received(phone) != 0 {
+		t.Fatal("broadcast did not reach only the connected device")
+	}
+
+	// A reconnect of a device replaces its old client, and a late
+	// unregister of the old one leaves the new one in place.
+	again := NewClient(h, nil, alice, "laptop", "web")
+	h.RegisterClient(again)
+	h.UnregisterClient(laptop)
+	if c, ok := h.GetClient(alice, "laptop"); !ok || c != again {
+		t.Fatal("reconnected device was dropped")
+	}
+
+	h.UnregisterClient(again)
+	if h.IsUserInChat(alice, chatID) || len(h.GetClients(alice)) != 0 {
+		t.Fatal("user stayed in the chat after their last device left")
+	}
+}
+
+// TestMembership checks that only members join a chat, and that a change
+// of members moves the live subscriptions along.
+func TestMembership(t *testing.T) {
+	h := NewHub(make(chan *Message, 1))
+	member, stranger := uuid.New(), uuid.New()
+	chatID := uuid.New()
+	h.SetMembership(func(id, userID uuid.UUID) (bool, error) {
+		return id == chatID && userID == member, nil
+	})
+	memberClient := NewClient(h, nil, member, "", "")
+	strangerClient := NewClient(h, nil, stranger, "", "")
+	h.RegisterClient(memberClient)
+	h.RegisterClient(strangerClient)
+
+	h.HandleJoinChat(strangerClient, chatID)
+	if h.IsUserInChat(stranger, chatID) || len(strangerClient.send) != 1 {
+		t.Fatal("join of a non-member was not refused")
+	}
+	h.HandleJoinChat(memberClient, chatID)
+	if !h.IsUserInChat(member, chatID) {
+		t.Fatal("member could not join")
+	}
+
+	h.SyncChatMembers(chatID, []uuid.UUID{stranger})
+	if h.IsUserInChat(member, chatID) || !h.IsUserInChat(stranger, chatID) {
+		t.Fatalf("chat users are %v after the members changed", h.GetChatUsers(chatID))
+	}
+}
+
+// TestResume checks that a resuming client gets the missed events first,
+// then the live ones held back meanwhile, each once.
+func TestResume(t *testing.T) {
+	h := NewHub(make(chan *Message, 1))
+	userID, chatID := uuid.New(), uuid.New()
+	client := NewClient(h, nil, userID, "", "")
+	h.RegisterClient(client)
+	h.JoinChat(chatID, userID)
+
+	stored := []Event{{Seq: 1, Message: 1}, {Seq: 2, Message: 2}, {Seq: 3, Message: 3}}
+	h.SetReplay(func(id uuid.UUID, after int64) ([]Event, error) {
+		// Events 3 and 4 are broadcast live while the replay is read.
+		h.BroadcastEvent(chatID, 3, 3)
+		h.BroadcastEvent(chatID, 4, 4)
+		return stored[after:], nil
+	})
+	h.HandleResume(client, map[uuid.UUID]int64{chatID: 1})
+
+	var frames []string
+	for len(client.send) > 0 {
+		frames = append(frames, string(<-client.send))
+	}
+	want := []string{"2", "3", `{"chatId":"` + chatID.String() + `","seq":3,"type":"resumed"}`, "4"}
+	if len(frames) != len(want) {
+		t.Fatalf("got frames %q, want %q", frames, want)
+	}
+	for i := range want {
+		if frames[i] != want[i] {
+			t.Fatalf("got frames %q, want %q", frames, want)
+		}
+	}
+}
+
+// TestReceipt checks that a receipt is stored and told to the chat only
+// when it moves the cursor.
+func TestReceipt(t *testing.T) {
+	h := NewHub(make(chan *Message, 1))
+	userID, chatID, messageID := uuid.New(), uuid.New(), uuid.New()
+	client := NewClient(h, nil, userID, "", "")
+	h.RegisterClient(client)
+	h.JoinChat(chatID, userID)
+
+	var stored []Receipt
+	h.SetReceipts(func(receipt *Receipt) (bool, error) {
+		receipt.Seq = 7
+		stored = append(stored, *receipt)
+		return len(stored) == 1, nil
+	})
+	h.HandleReceipt(client, "read", chatID, messageID)
+	h.HandleReceipt(client, "read", chatID, messageID)
+
+	if len(stored) != 2 || stored[0].MessageID != messageID || stored[0].Kind != "read" {
+		t.Fatalf("stored receipts %+v", stored)
+	}
+	if len(client.send) != 1 {
+		t.Fatalf("chat got %d receipt frames, want 1", len(client.send))
+	}
+}
+
+// TestMessageAck checks that only valid messages are handed on for
+// storing, and that the ack goes to the sending device alone.
+func TestMessageAck(t *testing.T) {
+	messages := make(chan *Message, 1)
+	h := NewHub(messages)
+	userID, chatID := uuid.New(), uuid.New()
+	phone := NewClient(h, nil, userID, "phone", "ios")
+	laptop := NewClient(h, nil, userID, "laptop", "web")
+	h.RegisterClient(phone)
+	h.RegisterClient(laptop)
+
+	h.HandleClientMessage(phone, []byte(`{"type":"message","chatId":"`+chatID.String()+`","content":"hi","tempId":"t1"}`))
+	if len(messages) != 0 || len(phone.send) != 1 {
+		t.Fatal("message to a chat the user is not in was not rejected")
+	}
+	<-phone.send
+
+	h.JoinChat(chatID, userID)
+	h.HandleClientMessage(phone, []byte(`{"type":"message","chatId":"`+chatID.String()+`","content":"hi","tempId":"t1"}`))
+	msg := <-messages
+	if msg.TempID != "t1" || msg.DeviceID != "phone" {
+		t.Fatalf("message handed on as %+v", msg)
+	}
+
+	h.AckMessage(msg, uuid.New(), 1)
+	if len(phone.send) != 1 || len(laptop.send) != 0 {
+		t.Fatal("ack did not go to the sending device alone")
+	}
+}
+
+// TestCreateChat checks that clients only create chats through the chat
+// creator, and that a removed chat drops its subscriptions.
+func TestCreateChat(t *testing.T) {
+	h := NewHub(make(chan *Message, 1))
+	userID := uuid.New()
+	client := NewClient(h, nil, userID, "", "")
+	h.RegisterClient(client)
+
+	create := []byte(`{"type":"create_chat","content":"friends"}`)
+	h.HandleClientMessage(client, create)
+	if len(client.send) != 1 || len(h.GetChatList()) != 1 {
+		t.Fatal("chat was created without a chat creator")
+	}
+	<-client.send
+
+	chatID := uuid.New()
+	h.SetChatCreator(func(id uuid.UUID, name string) (uuid.UUID, error) {
+		if id != userID || name != "friends" {
+			t.Fatalf("chat creator called with %s %q", id, name)
+		}
+		h.SyncChatMembers(chatID, []uuid.UUID{id})
+		return chatID, nil
+	})
+	h.HandleClientMessage(client, create)
+	if !h.IsUserInChat(userID, chatID) || len(client.send) != 1 {
+		t.Fatal("creator was not subscribed to the created chat")
+	}
+
+	h.RemoveChat(chatID)
+	if h.IsUserInChat(userID, chatID) || h.ChatExists(chatID) {
+		t.Fatal("removed chat kept its subscriptions")
+	}
+}
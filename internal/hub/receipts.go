@@ -0,0 +1,69 @@
+package hub
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Receipt acknowledges the messages of a chat up to MessageID, numbered Seq
+// in the chat, as delivered to or read by a user.
+type Receipt struct {
+	ChatID    uuid.UUID `json:"chatId"`
+	UserID    uuid.UUID `json:"userId"`
+	Kind      string    `json:"receipt"` // "delivered" or "read"
+	MessageID uuid.UUID `json:"messageId"`
+	Seq       int64     `json:"seq"`
+}
+
+// ReceiptFunc persists a receipt, setting its Seq, and reports whether it
+// moved the cursor of the user. A receipt without a MessageID is for the
+// last message of the chat, whose ID it sets.
+type ReceiptFunc func(receipt *Receipt) (bool, error)
+
+// SetReceipts sets the function receipts of clients are persisted with.
+func (h *Hub) SetReceipts(fn ReceiptFunc) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.receipts = fn
+}
+
+// HandleReceipt persists a receipt of a client in a chat it is in, and
+// tells the chat when the receipt moved the cursor of the user.
+func (h *Hub) HandleReceipt(client *Client, kind string, chatID, messageID uuid.UUID) {
+	h.mutex.RLock()
+	receipts := h.receipts
+	h.mutex.RUnlock()
+
+	if !h.IsUserInChat(client.userID, chatID) {
+		h.sendError(client, chatID, ErrNotChatMember.Error())
+		return
+	}
+	if receipts == nil {
+		h.sendError(client, chatID, "receipts are not supported")
+		return
+	}
+
+	receipt := &Receipt{ChatID: chatID, UserID: client.userID, Kind: kind, MessageID: messageID}
+	advanced, err := receipts(receipt)
+	if err != nil {
+		log.Printf("Failed to store %s receipt of chat_client %s in chat %s: %v", kind, client.userID, chatID, err)
+		h.sendError(client, chatID, "failed to store the receipt")
+		return
+	}
+	if !advanced {
+		return
+	}
+
+	receiptMessage := map[string]interface{}{
+		"type":      "receipt",
+		"chatId":    chatID,
+		"userId":    client.userID,
+		"receipt":   kind,
+		"messageId": receipt.MessageID,
+		"seq":       receipt.Seq,
+		"timestamp": time.Now(),
+	}
+	h.BroadcastToChat(chatID, receiptMessage)
+}
@@ -0,0 +1,179 @@
+package hub
+
+import (
+	"log"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+// replayWriteWait is how long a replayed event may wait for room in the
+// send buffer of a client before the client is given up.
+const replayWriteWait = 10 * time.Second
+
+// Event is a persisted event of a chat with its sequence number in the chat.
+type Event struct {
+	Seq     int64
+	Message interface{}
+}
+
+// ReplayFunc returns the persisted events of a chat numbered after after,
+// in sequence order.
+type ReplayFunc func(chatID uuid.UUID, after int64) ([]Event, error)
+
+// event is an encoded Event on its way to a client.
+type event struct {
+	seq  int64
+	data []byte
+}
+
+// SetReplay sets the function resume requests read missed events with.
+func (h *Hub) SetReplay(fn ReplayFunc) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.replay = fn
+}
+
+// HandleResume replays to a client the events it missed in each chat of
+// cursors, which maps a chat to the last sequence number the client
+// received in it. Live events of a chat are held back while its gap is
+// replayed and follow once it is, without the ones already replayed. A
+// "resumed" frame with the last sequence number marks the switch.
+func (h *Hub) HandleResume(client *Client, cursors map[uuid.UUID]int64) {
+	h.mutex.RLock()
+	replay := h.replay
+	h.mutex.RUnlock()
+
+	for chatID, after := range cursors {
+		client.startResume(chatID)
+
+		// Resuming a chat also subscribes to it, for members only.
+		if !h.IsUserInChat(client.userID, chatID) {
+			if !h.authorizeJoin(client, chatID) {
+				client.finishResume(chatID, after, nil)
+				continue
+			}
+			h.JoinChat(chatID, client.userID)
+		}
+
+		last := after
+		var events []Event
+		var err error
+		if replay != nil {
+			events, err = replay(chatID, after)
+		}
+		if err != nil {
+			log.Printf("Failed to replay chat %s to chat_client %s: %v", chatID, client.userID, err)
+			h.sendError(client, chatID, "failed to replay the chat")
+			client.finishResume(chatID, after, nil)
+			continue
+		}
+
+		for _, ev := range events {
+			data, err := json.Marshal(ev.Message)
+			if err != nil {
+				log.Printf("Error marshaling message: %v", err)
+				continue
+			}
+			if err := client.sendWait(data, replayWriteWait); err != nil {
+				log.Printf("Replay of chat %s to chat_client %s on %s stopped: %v", chatID, client.userID, client.deviceID, err)
+				client.finishResume(chatID, last, nil)
+				client.disconnect()
+				return
+			}
+			last = ev.Seq
+		}
+
+		resumed, _ := json.Marshal(map[string]interface{}{
+			"type":   "resumed",
+			"chatId": chatID,
+			"seq":    last,
+		})
+		client.finishResume(chatID, last, resumed)
+	}
+}
+
+// sendError tells a client that a request about a chat failed.
+func (h *Hub) sendError(client *Client, chatID uuid.UUID, message string) {
+	response := map[string]interface{}{
+		"type":    "error",
+		"chatId":  chatID,
+		"message": message,
+		"success": false,
+	}
+	if err := client.SendMessage(response); err != nil {
+		log.Printf("Failed to send error to chat_client %s: %v", client.userID, err)
+	}
+}
+
+// deliver sends a live event of a chat to the client, or holds it back
+// while the chat is being replayed.
+func (c *Client) deliver(chatID uuid.UUID, ev event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if pending, ok := c.resuming[chatID]; ok {
+		c.resuming[chatID] = append(pending, ev)
+		return
+	}
+	c.trySend(ev)
+}
+
+// trySend queues an event without waiting, and disconnects the client if
+// its buffer is full. c.mutex must be held.
+func (c *Client) trySend(ev event) {
+	select {
+	case c.send <- ev.data:
+	default:
+		log.Printf("Client %s on %s send buffer full, disconnecting at seq %d", c.userID, c.deviceID, ev.seq)
+		c.disconnect()
+	}
+}
+
+// startResume holds back the live events of a chat until finishResume.
+func (c *Client) startResume(chatID uuid.UUID) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.resuming[chatID]; !ok {
+		c.resuming[chatID] = []event{}
+	}
+}
+
+// finishResume sends marker, if any, and then the live events held back
+// for a chat that are numbered after last, and resumes live delivery.
+func (c *Client) finishResume(chatID uuid.UUID, last int64, marker []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pending := c.resuming[chatID]
+	delete(c.resuming, chatID)
+	if marker != nil {
+		c.trySend(event{seq: last, data: marker})
+	}
+	for _, ev := range pending {
+		if ev.seq > last {
+			c.trySend(ev)
+		}
+	}
+}
+
+// sendWait queues data, waiting up to timeout for room in the buffer.
+func (c *Client) sendWait(data []byte, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case c.send <- data:
+		return nil
+	case <-timer.C:
+		return ErrClientSendBufferFull
+	}
+}
+
+// disconnect closes the connection of the client. Its ReadPump then
+// unregisters it.
+func (c *Client) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
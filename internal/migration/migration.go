@@ -0,0 +1,219 @@
+// Package migration upgrades the stored JSON of collection items when their
+// model changes.
+//
+// Every item file records the schema version it was written with in its
+// schemaVersion field; files from before migrations existed have none and
+// are at version 0. Migrations are registered per item type, each one
+// taking a document from one version to the next, and Upgrade applies the
+// ones a document is missing in order.
+package migration
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/goccy/go-json"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+)
+
+// Field is the JSON field holding the schema version of an item file.
+const Field = "schemaVersion"
+
+// Func upgrades a decoded item document in place, from the version it was
+// registered for to the next. Numbers are json.Number.
+type Func func(doc map[string]any) error
+
+var (
+	mu         sync.RWMutex
+	migrations = make(map[reflect.Type]map[int]Func)
+)
+
+// Register adds the migration of T documents from version from to from+1.
+// T and *T share their migrations.
+// It is meant to be called from init functions, and panics if the versions
+// of T would have a gap or a migration is registered twice.
+func Register[T any](from int, fn Func) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	t := typeOf[T]()
+	if migrations[t] == nil {
+		migrations[t] = make(map[int]Func)
+	}
+	if _, exists := migrations[t][from]; exists {
+		panic(fmt.Sprintf("migration: %s from version %d registered twice", t, from))
+	}
+	if from != len(migrations[t]) {
+		panic(fmt.Sprintf("migration: %s from version %d registered before version %d", t, from, len(migrations[t])))
+	}
+	migrations[t][from] = fn
+}
+
+// Latest returns the current schema version of T, which is 0 when T has no
+// migrations.
+func Latest[T any]() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	return len(migrations[typeOf[T]()])
+}
+
+// Upgrade applies the migrations data is missing and returns the upgraded
+// document, stamped with the latest version, and the version data had.
+// Data already at the latest version is returned as is.
+func Upgrade[T any](data []byte) ([]byte, int, error) {
+	latest := Latest[T]()
+	if latest == 0 {
+		return data, 0, nil
+	}
+
+	var doc map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, 0, fmt.Errorf("error decoding item: %w", err)
+	}
+
+	from, err := version(doc)
+	if err != nil {
+		return nil, 0, err
+	}
+	if from >= latest {
+		return data, from, nil
+	}
+
+	mu.RLock()
+	steps := migrations[typeOf[T]()]
+	mu.RUnlock()
+	for v := from; v < latest; v++ {
+		if err := steps[v](doc); err != nil {
+			return nil, from, fmt.Errorf("error migrating item from version %d: %w", v, err)
+		}
+	}
+
+	doc[Field] = latest
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return nil, from, fmt.Errorf("error encoding migrated item: %w", err)
+	}
+	return upgraded, from, nil
+}
+
+// Stamp records the latest schema version of T in data, a JSON object
+// marshaled from a T. It returns data unchanged when T has no migrations.
+func Stamp[T any](data []byte) []byte {
+	latest := Latest[T]()
+	if latest == 0 {
+		return data
+	}
+
+	open := bytes.IndexByte(data, '{')
+	if open < 0 {
+		return data
+	}
+	field := `"` + Field + `": ` + strconv.Itoa(latest)
+	rest := bytes.TrimLeft(data[open+1:], " \t\r\n")
+	if len(rest) > 0 && rest[0] != '}' {
+		field += ","
+	}
+
+	stamped := make([]byte, 0, len(data)+len(field)+4)
+	stamped = append(stamped, data[:open+1]...)
+	if bytes.HasPrefix(data[open+1:], []byte("\n")) {
+		// Keep the layout of json.MarshalIndent output.
+		stamped = append(stamped, "\n  "...)
+	}
+	stamped = append(stamped, field...)
+	return append(stamped, data[open+1:]...)
+}
+
+// typeOf returns the type migrations of T are registered under, which is
+// the same for a struct and a pointer to it.
+func typeOf[T any]() reflect.Type {
+	t := reflect.TypeFor[T]()
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+func version(doc map[string]any) (int, error) {
+	raw, ok := doc[Field]
+	if !ok {
+		return 0, nil
+	}
+	number, ok := raw.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("invalid %s %v", Field, raw)
+	}
+	v, err := strconv.Atoi(number.String())
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid %s %v", Field, raw)
+	}
+	return v, nil
+}
+
+// File upgrades the item file at path if it is behind the latest version
+// of T, and reports whether it was. With dryRun set it only reports it. The
+// file is rewritten through a temporary file and a rename, so an
+// interrupted run leaves it either migrated or as it was. A sealed file is
+// opened with cipher and sealed again with it; cipher may be nil for a
+// store that is not encrypted.
+//
+// The store the file belongs to must not be open while File runs.
+func File[T any](path string, cipher encryption.Cipher, dryRun bool) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	id, sealed := encryption.SealedID(data)
+	if sealed {
+		if cipher == nil {
+			return false, errors.New("item file is encrypted and no cipher was given")
+		}
+		if data, err = cipher.Open(id, data); err != nil {
+			return false, err
+		}
+	}
+	upgraded, from, err := Upgrade[T](data)
+	if err != nil {
+		return false, err
+	}
+	if from >= Latest[T]() {
+		return false, nil
+	}
+
+	// Decoding into T checks the migrated document fits the model.
+	var item T
+	if err := json.Unmarshal(upgraded, &item); err != nil {
+		return false, err
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	out, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	out = Stamp[T](out)
+	if sealed {
+		if out, err = cipher.Seal(id, out); err != nil {
+			return false, err
+		}
+	}
+
+	tempFile := path + ".tmp"
+	if err := os.WriteFile(tempFile, out, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tempFile, path); err != nil {
+		os.Remove(tempFile)
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,128 @@
+package migration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/encryption"
+)
+
+type doc struct {
+	Name  string `json:"name"`
+	Count string `json:"count"`
+}
+
+func TestUpgrade(t *testing.T) {
+
+	Register[doc](0, func(d map[string]any) error {
+		if n, ok := d["count"].(json.Number); ok {
+			d["count"] = n.String()
+		}
+		return nil
+	})
+	Register[*doc](1, func(d map[string]any) error {
+		d["name"] = d["title"]
+		delete(d, "title")
+		return nil
+	})
+	if Latest[*doc]() != 2 {
+		t.Fatalf("latest = %d, want 2", Latest[*doc]())
+	}
+
+	data, from, err := Upgrade[doc]([]byte(`{"title": "a", "count": 12345678901234567890}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 0 {
+		t.Fatalf("from = %d, want 0", from)
+	}
+	var d doc
+	if err := json.Unmarshal(data, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "a" || d.Count != "12345678901234567890" {
+		t.Fatalf("upgraded = %+v", d)
+	}
+
+	// A stamped document is at the latest version and left alone.
+	stamped := Stamp[doc]([]byte("{\n  \"name\": \"a\"\n}"))
+	if string(stamped) != "{\n  \"schemaVersion\": 2,\n  \"name\": \"a\"\n}" {
+		t.Fatalf("stamped = %s", stamped)
+	}
+	if out, from, err := Upgrade[doc](stamped); err != nil || from != 2 || string(out) != string(stamped) {
+		t.Fatalf("upgrade of a current document = %s, %d, %v", out, from, err)
+	}
+
+	if _, _, err := Upgrade[doc]([]byte(`{"schemaVersion": "x"}`)); err == nil {
+		t.Fatal("invalid schema version accepted")
+	}
+}
+
+type sealedDoc struct {
+	Count string `json:"count"`
+}
+
+// TestFileEncrypted checks that a sealed item file is migrated through the
+// cipher and stays sealed.
+func TestFileEncrypted(t *testing.T) {
+
+	Register[*sealedDoc](0, func(d map[string]any) error {
+		if n, ok := d["count"].(json.Number); ok {
+			d["count"] = n.String()
+		}
+		return nil
+	})
+
+	dir := t.TempDir()
+	keyfile := filepath.Join(dir, "master.keys")
+	if _, err := encryption.AddMasterKey(keyfile); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := encryption.LoadKeyfile(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := encryption.OpenDataKeys(ring, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := uuid.New()
+	sealed, err := keys.Seal(id, []byte(`{"count": 7}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, id.String()+".json")
+	if err := os.WriteFile(path, sealed, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := File[*sealedDoc](path, nil, true); err == nil {
+		t.Fatal("sealed file was read without a cipher")
+	}
+	if changed, err := File[*sealedDoc](path, keys, false); err != nil || !changed {
+		t.Fatalf("migration returned %v, %v; want a change", changed, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encryption.IsSealed(data) {
+		t.Fatal("migrated file is no longer sealed")
+	}
+	plain, err := keys.Open(id, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d sealedDoc
+	if err := json.Unmarshal(plain, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Count != "7" {
+		t.Fatalf("count = %q, want 7", d.Count)
+	}
+}
@@ -0,0 +1,191 @@
+// Package retention purges the messages a chat no longer keeps: messages
+// past the auto-delete time of their chat, messages soft-deleted longer
+// than a grace period ago, and messages beyond a global maximum age or
+// count per chat. Purged messages are deleted from the store for good.
+package retention
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/store"
+)
+
+// Policy decides which messages of a chat are purged. A zero field
+// disables its rule.
+type Policy struct {
+	// AutoDelete purges messages older than it. It is set per chat from
+	// chat.Chat.MessageAutoDeleteTime, see ForChat.
+	AutoDelete time.Duration `json:"autoDelete,omitempty"`
+	// SoftDeleteGrace purges messages marked IsDeleted longer ago than it.
+	SoftDeleteGrace time.Duration `json:"softDeleteGrace,omitempty"`
+	// MaxAge purges messages older than it in every chat.
+	MaxAge time.Duration `json:"maxAge,omitempty"`
+	// MaxCount keeps only the newest MaxCount messages of every chat.
+	MaxCount int `json:"maxCount,omitempty"`
+}
+
+// ForChat returns the global policy with the auto-delete time of c, which
+// is in seconds.
+func ForChat(c *chat.Chat, global Policy) Policy {
+	policy := global
+	if c.MessageAutoDeleteTime > 0 {
+		policy.AutoDelete = time.Duration(c.MessageAutoDeleteTime) * time.Second
+	}
+	return policy
+}
+
+// IsZero reports whether the policy purges nothing.
+func (p Policy) IsZero() bool {
+	return p == Policy{}
+}
+
+// Reason is the rule a message was purged by.
+type Reason string
+
+const (
+	ReasonAutoDelete  Reason = "autoDelete"
+	ReasonSoftDeleted Reason = "softDeleted"
+	ReasonMaxAge      Reason = "maxAge"
+	ReasonMaxCount    Reason = "maxCount"
+)
+
+// Summary is the outcome of purging one chat.
+type Summary struct {
+	ChatID  uuid.UUID      `json:"chatId"`
+	Policy  Policy         `json:"policy"`
+	Scanned int            `json:"scanned"`
+	Purged  map[Reason]int `json:"purged,omitempty"`
+	// Failed counts the messages that were due but could not be deleted.
+	Failed int    `json:"failed,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Total returns the number of purged messages.
+func (s *Summary) Total() int {
+	total := 0
+	for _, n := range s.Purged {
+		total += n
+	}
+	return total
+}
+
+// scanned is a message seen by Purge, with the rule that purges it, empty
+// while none does.
+type scanned struct {
+	id      uuid.UUID
+	created time.Time
+	reason  Reason
+}
+
+// byCreation orders messages by creation, oldest first, and by ID when
+// created at the same time.
+func byCreation(a, b scanned) int {
+	if c := a.created.Compare(b.created); c != 0 {
+		return c
+	}
+	return bytes.Compare(a.id[:], b.id[:])
+}
+
+// Purge deletes the messages of a chat that policy no longer keeps, as of
+// now. A message due under several rules is counted under the first of
+// auto-delete, soft-delete, max age and max count. Messages are deleted
+// oldest first, so a purge cut short leaves the newest of them. Messages
+// that fail to delete are counted, and their errors are returned together
+// once the others are deleted.
+func Purge(ctx context.Context, chatID uuid.UUID, messages store.Store[*message.Message], policy Policy, now time.Time) (*Summary, error) {
+	summary := &Summary{ChatID: chatID, Policy: policy, Purged: make(map[Reason]int)}
+
+	// The store is not changed while it is iterated.
+	var due, keep []scanned
+	err := messages.Iterate(ctx, func(msg *message.Message) bool {
+		summary.Scanned++
+		s := scanned{id: msg.ID, created: createdAt(msg, now)}
+		if reason, ok := policy.expired(msg, now); ok {
+			s.reason = reason
+			due = append(due, s)
+		} else {
+			keep = append(keep, s)
+		}
+		return true
+	})
+	if err != nil {
+		return summary, fmt.Errorf("error scanning messages of chat %s: %w", chatID, err)
+	}
+
+	if policy.MaxCount > 0 && len(keep) > policy.MaxCount {
+		slices.SortFunc(keep, byCreation)
+		for _, k := range keep[:len(keep)-policy.MaxCount] {
+			k.reason = ReasonMaxCount
+			due = append(due, k)
+		}
+	}
+	slices.SortFunc(due, byCreation)
+
+	var errs []error
+	for _, d := range due {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if err := messages.Delete(d.id); err != nil {
+			summary.Failed++
+			errs = append(errs, fmt.Errorf("error purging message %s: %w", d.id, err))
+			continue
+		}
+		summary.Purged[d.reason]++
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		summary.Error = err.Error()
+		return summary, err
+	}
+	return summary, nil
+}
+
+// expired returns the age rule that purges msg, if any.
+func (p Policy) expired(msg *message.Message, now time.Time) (Reason, bool) {
+	age := now.Sub(createdAt(msg, now))
+	switch {
+	case p.AutoDelete > 0 && age > p.AutoDelete:
+		return ReasonAutoDelete, true
+	case p.SoftDeleteGrace > 0 && msg.IsDeleted && now.Sub(deletedAt(msg, now)) > p.SoftDeleteGrace:
+		return ReasonSoftDeleted, true
+	case p.MaxAge > 0 && age > p.MaxAge:
+		return ReasonMaxAge, true
+	}
+	return "", false
+}
+
+// createdAt returns when msg was created, from the time of its UUID v7 ID
+// for messages stored without CreatedAt.
+func createdAt(msg *message.Message, now time.Time) time.Time {
+	if !msg.CreatedAt.IsZero() {
+		return msg.CreatedAt
+	}
+	if msg.ID.Version() == 7 {
+		return time.Unix(msg.ID.Time().UnixTime())
+	}
+	// Without either, the message is never too old.
+	return now
+}
+
+// deletedAt returns when msg was soft-deleted. Messages marked deleted
+// without DeletedAt count from their last update.
+func deletedAt(msg *message.Message, now time.Time) time.Time {
+	switch {
+	case !msg.DeletedAt.IsZero():
+		return msg.DeletedAt
+	case !msg.UpdatedAt.IsZero():
+		return msg.UpdatedAt
+	default:
+		return createdAt(msg, now)
+	}
+}
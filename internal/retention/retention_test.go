@@ -0,0 +1,198 @@
+package retention
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/store"
+)
+
+func TestPurge(t *testing.T) {
+	messages, err := store.Open[*message.Message](store.EngineJSON, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer messages.Close()
+
+	now := time.Now()
+	chatID := uuid.New()
+	create := func(caption string, age time.Duration, deletedAgo time.Duration) {
+		t.Helper()
+		msg := &message.Message{ChatID: chatID, Caption: caption, CreatedAt: now.Add(-age)}
+		if deletedAgo > 0 {
+			msg.IsDeleted, msg.DeletedAt = true, now.Add(-deletedAgo)
+		}
+		if _, err := messages.Create(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	create("auto-deleted", 3*time.Hour, 0)
+	create("soft-deleted", time.Minute, 48*time.Hour)
+	create("recently deleted", time.Minute, time.Hour)
+	for i := 0; i < 5; i++ {
+		create("kept", time.Duration(i+1)*time.Minute, 0)
+	}
+
+	c := &chat.Chat{ID: chatID, MessageAutoDeleteTime: int((2 * time.Hour).Seconds())}
+	policy := ForChat(c, Policy{SoftDeleteGrace: 24 * time.Hour, MaxCount: 4})
+	summary, err := Purge(context.Background(), chatID, messages, policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[Reason]int{ReasonAutoDelete: 1, ReasonSoftDeleted: 1, ReasonMaxCount: 2}
+	for reason, n := range want {
+		if summary.Purged[reason] != n {
+			t.Fatalf("purged %v, want %v", summary.Purged, want)
+		}
+	}
+	if summary.Scanned != 8 || messages.Count() != 4 {
+		t.Fatalf("scanned %d and kept %d messages, want 8 and 4", summary.Scanned, messages.Count())
+	}
+
+	// The newest messages are kept, including the recently deleted one.
+	err = messages.Iterate(context.Background(), func(msg *message.Message) bool {
+		if now.Sub(msg.CreatedAt) > 3*time.Minute {
+			t.Errorf("message %q of age %s kept", msg.Caption, now.Sub(msg.CreatedAt))
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cancelingStore cancels a purge once it has deleted after messages.
+type cancelingStore struct {
+	store.Store[*message.Message]
+	after  int
+	cancel context.CancelFunc
+}
+
+func (s *cancelingStore) Delete(id uuid.UUID) error {
+	if err := s.Store.Delete(id); err != nil {
+		return err
+	}
+	if s.after--; s.after == 0 {
+		s.cancel()
+	}
+	return nil
+}
+
+func TestPurgeCanceledDeletesOldestFirst(t *testing.T) {
+	messages, err := store.Open[*message.Message](store.EngineJSON, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer messages.Close()
+
+	now := time.Now()
+	chatID := uuid.New()
+	// Created newest first, so creation order differs from ID order.
+	for i := 0; i < 6; i++ {
+		msg := &message.Message{ChatID: chatID, CreatedAt: now.Add(-time.Duration(i+1) * time.Hour)}
+		if _, err := messages.Create(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	canceling := &cancelingStore{Store: messages, after: 2, cancel: cancel}
+
+	summary, err := Purge(ctx, chatID, canceling, Policy{MaxAge: time.Minute}, now)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Purge = %v, want context.Canceled", err)
+	}
+	if summary.Purged[ReasonMaxAge] != 2 || messages.Count() != 4 {
+		t.Fatalf("purged %v and kept %d messages, want 2 and 4", summary.Purged, messages.Count())
+	}
+
+	// The two oldest messages are gone.
+	err = messages.Iterate(context.Background(), func(msg *message.Message) bool {
+		if now.Sub(msg.CreatedAt) > 4*time.Hour {
+			t.Errorf("message of age %s kept, a newer one was purged", now.Sub(msg.CreatedAt))
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceAudit(t *testing.T) {
+	dir := t.TempDir()
+	chats, err := store.Open[*chat.Chat](store.EngineJSON, filepath.Join(dir, "chats"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chats.Close()
+
+	stores := make(map[uuid.UUID]store.Store[*message.Message])
+	for i := 0; i < 2; i++ {
+		c, err := chats.Create(&chat.Chat{MessageAutoDeleteTime: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages, err := store.Open[*message.Message](store.EngineJSON, filepath.Join(dir, c.ID.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer messages.Close()
+		stores[c.ID] = messages
+
+		for _, age := range []time.Duration{time.Hour, time.Second} {
+			if _, err := messages.Create(&message.Message{ChatID: c.ID, CreatedAt: time.Now().Add(-age)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	withMessages := func(chatID uuid.UUID, fn func(messages store.Store[*message.Message]) error) error {
+		return fn(stores[chatID])
+	}
+	auditPath := filepath.Join(dir, "retention", "audit.log")
+	service := NewService(chats, withMessages, Policy{}, time.Hour, auditPath)
+
+	cycle, err := service.RunCycle(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cycle.Chats != 2 || cycle.Purged[ReasonAutoDelete] != 2 || len(cycle.Summaries) != 2 {
+		t.Fatalf("cycle checked %d chats and purged %v, want 2 chats and 2 auto-deleted", cycle.Chats, cycle.Purged)
+	}
+	if _, err := service.RunCycle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every cycle is audited, also one that purged nothing.
+	file, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var audited []Cycle
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var c Cycle
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		audited = append(audited, c)
+	}
+	if len(audited) != 2 {
+		t.Fatalf("audit log has %d cycles, want 2", len(audited))
+	}
+	if audited[0].Total() != 2 || audited[1].Total() != 0 {
+		t.Fatalf("audited %d and %d purged messages, want 2 and 0", audited[0].Total(), audited[1].Total())
+	}
+}
@@ -0,0 +1,192 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collections/chat"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/store"
+)
+
+// Cycle is the audit summary of one purge over every chat.
+type Cycle struct {
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Chats    int            `json:"chats"`
+	Purged   map[Reason]int `json:"purged,omitempty"`
+	Failed   int            `json:"failed,omitempty"`
+	// Summaries holds the chats that had messages purged or failed.
+	Summaries []*Summary `json:"summaries,omitempty"`
+}
+
+// Total returns the number of messages purged in the cycle.
+func (c *Cycle) Total() int {
+	total := 0
+	for _, n := range c.Purged {
+		total += n
+	}
+	return total
+}
+
+func (c *Cycle) add(s *Summary) {
+	c.Chats++
+	for reason, n := range s.Purged {
+		c.Purged[reason] += n
+	}
+	c.Failed += s.Failed
+	if s.Total() > 0 || s.Error != "" {
+		c.Summaries = append(c.Summaries, s)
+	}
+}
+
+// WithMessagesFunc calls fn with the messages of a chat, see
+// chat_manager.Manager.Purge.
+type WithMessagesFunc func(chatID uuid.UUID, fn func(messages store.Store[*message.Message]) error) error
+
+// Service purges every chat once per interval and appends the summary of
+// each cycle to an audit log of JSON lines.
+type Service struct {
+	chats        store.Store[*chat.Chat]
+	withMessages WithMessagesFunc
+	policy       Policy
+	interval     time.Duration
+	auditPath    string
+
+	mu   sync.Mutex // serializes cycles and audit writes
+	stop func()
+}
+
+// NewService returns a service that purges the chats in chats with the
+// global policy, and writes its audit log to auditPath.
+func NewService(chats store.Store[*chat.Chat], withMessages WithMessagesFunc, policy Policy, interval time.Duration, auditPath string) *Service {
+	return &Service{
+		chats:        chats,
+		withMessages: withMessages,
+		policy:       policy,
+		interval:     interval,
+		auditPath:    auditPath,
+	}
+}
+
+// Start runs a cycle every interval in the background until Stop.
+func (s *Service) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.stop = func() {
+		cancel()
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if _, err := s.RunCycle(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("retention: purge cycle failed: %v", err)
+			}
+		}
+	}()
+}
+
+// Stop stops the background cycles, waiting for a running one to finish
+// the chat it is purging.
+func (s *Service) Stop() {
+	if s.stop != nil {
+		s.stop()
+		s.stop = nil
+	}
+}
+
+// RunCycle purges every chat once and records the summary in the audit
+// log. A chat that fails to purge is recorded in the summary, and the
+// cycle goes on with the others.
+func (s *Service) RunCycle(ctx context.Context) (*Cycle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cycle := &Cycle{Started: time.Now().UTC(), Purged: make(map[Reason]int)}
+
+	// The chats are listed first, so no chat lock is held while purging.
+	var chats []*chat.Chat
+	err := s.chats.Iterate(ctx, func(c *chat.Chat) bool {
+		chats = append(chats, c)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing chats: %w", err)
+	}
+
+	for _, c := range chats {
+		if ctx.Err() != nil {
+			break
+		}
+		policy := ForChat(c, s.policy)
+		if policy.IsZero() {
+			continue
+		}
+
+		var summary *Summary
+		err := s.withMessages(c.ID, func(messages store.Store[*message.Message]) error {
+			var err error
+			summary, err = Purge(ctx, c.ID, messages, policy, cycle.Started)
+			return err
+		})
+		if summary == nil {
+			summary = &Summary{ChatID: c.ID, Policy: policy}
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			summary.Error = err.Error()
+		}
+		cycle.add(summary)
+	}
+	cycle.Finished = time.Now().UTC()
+
+	if cycle.Total() > 0 || cycle.Failed > 0 {
+		log.Printf("retention: purged %d messages in %d chats, %d failed", cycle.Total(), cycle.Chats, cycle.Failed)
+	}
+	if err := s.audit(cycle); err != nil {
+		return cycle, err
+	}
+	return cycle, ctx.Err()
+}
+
+// audit appends cycle to the audit log.
+func (s *Service) audit(cycle *Cycle) error {
+	line, err := json.Marshal(cycle)
+	if err != nil {
+		return fmt.Errorf("error encoding audit summary: %w", err)
+	}
+	line = append(line, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(s.auditPath), 0755); err != nil {
+		return fmt.Errorf("error creating audit directory: %w", err)
+	}
+	file, err := os.OpenFile(s.auditPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %w", err)
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return fmt.Errorf("error writing audit log: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("error syncing audit log: %w", err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,386 @@
+// Package snapshot archives a data root as a gzip compressed tar file with a
+// manifest of every file, and restores such archives into a new root.
+//
+// The archive holds the files of the root as they are on disk, write-ahead
+// logs included, so the stores recover from it as after a clean shutdown.
+// Writers must be stopped while a root is staged, see Stage and Link.
+package snapshot
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ManifestName is the name of the manifest entry, the last one of an archive.
+const ManifestName = "MANIFEST.json"
+
+const formatVersion = 1
+
+// File describes one file of an archive.
+type File struct {
+	Path   string      `json:"path"`
+	Size   int64       `json:"size"`
+	Mode   fs.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256"`
+}
+
+// Manifest lists the files of an archive, in archive order.
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Files     []File    `json:"files"`
+}
+
+// Staged is a data root set aside for archiving, see Stage and Link.
+type Staged struct {
+	// Dir holds the staged files.
+	Dir string
+	// sizes holds the size of every linked file when it was linked. Copied
+	// files are archived whole.
+	sizes map[string]int64
+}
+
+// Stage copies the regular files under root to a new directory in tmpDir.
+// It is the only part of a snapshot that needs writes to be stopped, so
+// the archive can then be written from the copy while the server runs.
+// The caller removes the staged files.
+func Stage(root, tmpDir string) (*Staged, error) {
+	staged, err := os.MkdirTemp(tmpDir, "snapshot-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %w", err)
+	}
+
+	err = walk(root, func(rel string, info fs.FileInfo) error {
+		return copyFile(filepath.Join(root, rel), filepath.Join(staged, rel), info.Mode())
+	})
+	if err != nil {
+		os.RemoveAll(staged)
+		return nil, fmt.Errorf("error staging %s: %w", root, err)
+	}
+	return &Staged{Dir: staged}, nil
+}
+
+// Link stages root like Stage, but with hard links to its files instead of
+// copies, so writes are only stopped while the files are listed. It suits
+// roots whose files are either replaced by renaming a new file over them,
+// which leaves the linked one as it was, or only appended to, since each
+// file is archived up to the size it had when linked. A file rewritten in
+// place must be empty when linked. tmpDir must be on the file system of
+// root.
+func Link(root, tmpDir string) (*Staged, error) {
+	staged, err := os.MkdirTemp(tmpDir, ".snapshot-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %w", err)
+	}
+
+	sizes := make(map[string]int64)
+	err = walk(root, func(rel string, info fs.FileInfo) error {
+		dst := filepath.Join(staged, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.Link(filepath.Join(root, rel), dst); err != nil {
+			return err
+		}
+		sizes[rel] = info.Size()
+		return nil
+	})
+	if err != nil {
+		os.RemoveAll(staged)
+		return nil, fmt.Errorf("error staging %s: %w", root, err)
+	}
+	return &Staged{Dir: staged, sizes: sizes}, nil
+}
+
+// Write archives the staged files to w and returns the manifest it
+// appended. Writers may run again meanwhile.
+func (s *Staged) Write(w io.Writer) (*Manifest, error) {
+	return write(w, s.Dir, s.sizes)
+}
+
+// Remove deletes the staged files.
+func (s *Staged) Remove() error {
+	return os.RemoveAll(s.Dir)
+}
+
+// Write archives the regular files under root to w and returns the manifest
+// it appended.
+func Write(w io.Writer, root string) (*Manifest, error) {
+	return write(w, root, nil)
+}
+
+// write archives the regular files under root, each one cut at its size
+// in sizes, if listed there.
+func write(w io.Writer, root string, sizes map[string]int64) (*Manifest, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest := &Manifest{Version: formatVersion, CreatedAt: time.Now().UTC()}
+	err := walk(root, func(rel string, info fs.FileInfo) error {
+		size, ok := sizes[rel]
+		if !ok {
+			size = info.Size()
+		}
+		file, err := writeFile(tw, filepath.Join(root, rel), filepath.ToSlash(rel), size, info)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error archiving %s: %w", root, err)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling manifest: %w", err)
+	}
+	header := &tar.Header{Name: ManifestName, Mode: 0644, Size: int64(len(data)), ModTime: manifest.CreatedAt}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, fmt.Errorf("error writing manifest: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, fmt.Errorf("error writing manifest: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("error closing archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("error closing archive: %w", err)
+	}
+	return manifest, nil
+}
+
+// Verify reads a whole archive and checks every file against the manifest.
+func Verify(r io.Reader) (*Manifest, error) {
+	return read(r, func(name string, mode fs.FileMode, content io.Reader) error {
+		_, err := io.Copy(io.Discard, content)
+		return err
+	})
+}
+
+// Restore verifies an archive and extracts it into dst, which must not
+// exist or be empty. Files are extracted into a temporary directory next to
+// dst that only replaces it once every file matched the manifest, so a
+// corrupt archive leaves dst untouched.
+func Restore(r io.Reader, dst string) (*Manifest, error) {
+	entries, err := os.ReadDir(dst)
+	switch {
+	case err == nil && len(entries) > 0:
+		return nil, fmt.Errorf("restore target %s is not empty", dst)
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("error reading restore target: %w", err)
+	}
+
+	parent := filepath.Dir(filepath.Clean(dst))
+	if err := os.MkdirAll(parent, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", parent, err)
+	}
+	staged, err := os.MkdirTemp(parent, ".restore-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %w", err)
+	}
+	defer os.RemoveAll(staged)
+
+	manifest, err := read(r, func(name string, mode fs.FileMode, content io.Reader) error {
+		return createFile(filepath.Join(staged, filepath.FromSlash(name)), mode, content)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty dst would make the rename fail.
+	if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error replacing restore target: %w", err)
+	}
+	if err := os.Rename(staged, dst); err != nil {
+		return nil, fmt.Errorf("error moving restored files into place: %w", err)
+	}
+	return manifest, nil
+}
+
+// walk calls fn for every regular file under root, with its path relative
+// to root, in lexical order. Other file types are skipped.
+func walk(root string, fn func(rel string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		return fn(rel, info)
+	})
+}
+
+func copyFile(src, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return createFile(dst, mode, in)
+}
+
+func createFile(name string, mode fs.FileMode, content io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, content); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func writeFile(tw *tar.Writer, src, name string, size int64, info fs.FileInfo) (File, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return File{}, err
+	}
+	defer in.Close()
+
+	header := &tar.Header{
+		Name:    name,
+		Mode:    int64(info.Mode().Perm()),
+		Size:    size,
+		ModTime: info.ModTime(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return File{}, err
+	}
+
+	hash := sha256.New()
+	// The size was fixed by the header, so a file that shrank since fails
+	// here instead of producing a corrupt archive.
+	if _, err := io.CopyN(io.MultiWriter(tw, hash), in, size); err != nil {
+		return File{}, fmt.Errorf("error copying %s: %w", name, err)
+	}
+
+	return File{
+		Path:   name,
+		Size:   size,
+		Mode:   info.Mode().Perm(),
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// read passes every file of an archive to fn and checks them against the
+// manifest at its end.
+func read(r io.Reader, fn func(name string, mode fs.FileMode, content io.Reader) error) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	var files []File
+	var manifest *Manifest
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading archive: %w", err)
+		}
+		if manifest != nil {
+			return nil, fmt.Errorf("archive has entries after the manifest")
+		}
+
+		if header.Name == ManifestName {
+			manifest = &Manifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("error reading manifest: %w", err)
+			}
+			continue
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected entry %s of type %c", header.Name, header.Typeflag)
+		}
+		if !validName(header.Name) {
+			return nil, fmt.Errorf("invalid entry name %q", header.Name)
+		}
+
+		hash := sha256.New()
+		counter := &countingReader{r: io.TeeReader(tr, hash)}
+		mode := fs.FileMode(header.Mode).Perm()
+		if err := fn(header.Name, mode, counter); err != nil {
+			return nil, fmt.Errorf("error extracting %s: %w", header.Name, err)
+		}
+		files = append(files, File{
+			Path:   header.Name,
+			Size:   counter.n,
+			Mode:   mode,
+			SHA256: hex.EncodeToString(hash.Sum(nil)),
+		})
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("archive has no manifest")
+	}
+	if manifest.Version != formatVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	if len(files) != len(manifest.Files) {
+		return nil, fmt.Errorf("archive has %d files, manifest lists %d", len(files), len(manifest.Files))
+	}
+	for i, file := range files {
+		if file != manifest.Files[i] {
+			return nil, fmt.Errorf("file %s does not match the manifest", file.Path)
+		}
+	}
+	return manifest, nil
+}
+
+// validName reports whether an entry name stays inside the restore target.
+func validName(name string) bool {
+	if name == "" || path.IsAbs(name) || strings.Contains(name, `\`) {
+		return false
+	}
+	clean := path.Clean(name)
+	return clean == name && clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,160 @@
+package snapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+)
+
+func TestRoundTrip(t *testing.T) {
+
+	root := t.TempDir()
+	messagesDir := filepath.Join(root, "chats", "c1", "messages")
+	manager, err := collection_manager.New[*message.Message](messagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := manager.Create(&message.Message{Caption: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	staged, err := Stage(root, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staged.Remove()
+
+	var archive bytes.Buffer
+	manifest, err := staged.Write(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) == 0 {
+		t.Fatal("manifest lists no files")
+	}
+
+	dst := filepath.Join(t.TempDir(), "restored")
+	restored, err := Restore(bytes.NewReader(archive.Bytes()), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.Files) != len(manifest.Files) {
+		t.Fatalf("restored %d files, archived %d", len(restored.Files), len(manifest.Files))
+	}
+
+	manager, err = collection_manager.New[*message.Message](filepath.Join(dst, "chats", "c1", "messages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	msg, err := manager.Read(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Caption != "hello" {
+		t.Fatalf("caption = %q, want %q", msg.Caption, "hello")
+	}
+
+	// A restore never overwrites an existing root.
+	if _, err := Restore(bytes.NewReader(archive.Bytes()), dst); err == nil {
+		t.Fatal("restore into a non-empty root succeeded")
+	}
+}
+
+// TestLink checks that files replaced or appended to after they were
+// linked are archived as they were when linked.
+func TestLink(t *testing.T) {
+
+	root := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("item.json", "old")
+	write("feed.log", "one\n")
+
+	staged, err := Link(root, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staged.Remove()
+
+	write("item.json.tmp", "new")
+	if err := os.Rename(filepath.Join(root, "item.json.tmp"), filepath.Join(root, "item.json")); err != nil {
+		t.Fatal(err)
+	}
+	feed, err := os.OpenFile(filepath.Join(root, "feed.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed.WriteString("two\n")
+	feed.Close()
+
+	var archive bytes.Buffer
+	if _, err := staged.Write(&archive); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "restored")
+	if _, err := Restore(&archive, dst); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"item.json": "old", "feed.log": "one\n"} {
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestRestoreRejectsCorruptArchive(t *testing.T) {
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "data.db"), bytes.Repeat([]byte("x"), 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if _, err := Write(&archive, root); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte of the file content, leaving the manifest as it was.
+	gz, err := gzip.NewReader(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[bytes.Index(raw, []byte("xxxx"))] = 'y'
+	var corrupt bytes.Buffer
+	zw := gzip.NewWriter(&corrupt)
+	zw.Write(raw)
+	zw.Close()
+
+	if _, err := Verify(bytes.NewReader(corrupt.Bytes())); err == nil {
+		t.Fatal("verify accepted a corrupt archive")
+	}
+	dst := filepath.Join(t.TempDir(), "restored")
+	if _, err := Restore(bytes.NewReader(corrupt.Bytes()), dst); err == nil {
+		t.Fatal("restore accepted a corrupt archive")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("corrupt restore left %s behind: %v", dst, err)
+	}
+}
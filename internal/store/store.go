@@ -0,0 +1,189 @@
+// Package store defines the interface every collection storage engine
+// implements, so a collection can be moved to another engine through
+// configuration without touching its callers.
+package store
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/changefeed"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager_db"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager_generic_index"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager_lazy_loading"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager_segment"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager_sqlite"
+)
+
+// Storage engines accepted by Open.
+const (
+	// EngineJSON keeps one JSON file per item and every item in memory.
+	EngineJSON = "collection_manager"
+	// EngineDB appends fixed 2 KB records to data.db and keeps every item in memory.
+	EngineDB = "collection_manager_db"
+	// EngineGenericIndex keeps paged, checksummed records in data.db with an
+	// index.db of offsets, and reads items from disk on demand through a
+	// memory map of the files.
+	EngineGenericIndex = "generic_index"
+	// EngineLazyLoading keeps fixed 4 KB records in data.db and caches the
+	// items it has read.
+	EngineLazyLoading = "lazy_loading"
+	// EngineSQLite keeps items in the SQLite database data.sqlite, with a
+	// column for every field tagged with `index:"true"`.
+	EngineSQLite = "sqlite"
+	// EngineSegment appends items to a log of segments sorted by ID, and
+	// keeps only a sparse index of them in memory.
+	EngineSegment = "segment"
+)
+
+// Item is implemented by every type kept in a store.
+type Item interface {
+	SetID(uuid.UUID)
+	GetID() uuid.UUID
+}
+
+// Store is a collection of items keyed by ID.
+//
+// Create keeps an ID already set on the item and assigns a UUID v7
+// otherwise. Update and Delete fail for an ID that does not exist.
+//
+// Items implementing version.Item get a new version on every write, and an
+// Update not based on the stored version fails with a *version.ConflictError.
+type Store[T Item] interface {
+	Create(item T) (T, error)
+	Read(id uuid.UUID) (T, error)
+	ReadAll() ([]T, error)
+	Update(item T) (T, error)
+	Delete(id uuid.UUID) error
+	Count() int
+	Close() error
+	// Iterate calls fn for every item in ID order, which is creation order
+	// for UUID v7 IDs, until fn returns false or ctx is cancelled.
+	Iterate(ctx context.Context, fn func(item T) bool) error
+	// IterateFrom is Iterate starting at the first item whose ID is from or
+	// after it.
+	IterateFrom(ctx context.Context, from uuid.UUID, fn func(item T) bool) error
+}
+
+// ReverseIterator is implemented by stores that can visit their items
+// newest first without reading the older ones.
+type ReverseIterator[T Item] interface {
+	// IterateBefore calls fn for every item whose ID is before before, in
+	// descending ID order, until fn returns false or ctx is cancelled. A
+	// nil before starts at the last item.
+	IterateBefore(ctx context.Context, before uuid.UUID, fn func(item T) bool) error
+}
+
+// Indexer is implemented by stores that keep secondary indexes.
+type Indexer[T Item] interface {
+	AddIndex(name string, keys collection_manager.KeyFunc[T]) error
+	FindBy(field string, value any) ([]T, error)
+	FindRange(field string, from, to any) ([]T, error)
+}
+
+// Publisher is implemented by stores that can report their changes to a
+// change feed.
+type Publisher interface {
+	SetChangeFeed(feed *changefeed.Feed, collection string)
+}
+
+// Reencrypter is implemented by stores that can seal their records, see
+// collection_manager.WithCipher.
+type Reencrypter interface {
+	// Reencrypt seals the records not sealed with the active data key with
+	// it, and returns how many it rewrote.
+	Reencrypt(ctx context.Context) (int, error)
+}
+
+// Pauser is implemented by stores that can hold their files unchanged
+// while they stay open, see collection_manager.Manager.Pause.
+type Pauser interface {
+	// Pause checkpoints the store and holds its writes back, background
+	// ones included, until resume is called.
+	Pause() (resume func(), err error)
+}
+
+var (
+	_ Store[Item]   = (*collection_manager.Manager[Item])(nil)
+	_ Indexer[Item] = (*collection_manager.Manager[Item])(nil)
+	_ Publisher     = (*collection_manager.Manager[Item])(nil)
+	_ Store[Item]   = (*collection_manager_db.Manager[Item])(nil)
+	_ Store[Item]   = (*collection_manager_generic_index.Manager[Item, *keyIndex])(nil)
+	_ Store[Item]   = (*collection_manager_lazy_loading.Manager[Item])(nil)
+	_ Store[Item]   = (*collection_manager_sqlite.Manager[Item])(nil)
+	_ Store[Item]   = (*collection_manager_segment.Manager[Item])(nil)
+
+	_ ReverseIterator[Item] = (*collection_manager_segment.Manager[Item])(nil)
+
+	_ Reencrypter = (*collection_manager.Manager[Item])(nil)
+	_ Pauser      = (*collection_manager.Manager[Item])(nil)
+	_ Reencrypter = (*collection_manager_generic_index.Manager[Item, *keyIndex])(nil)
+)
+
+// keyIndex is the index.db entry of EngineGenericIndex. It holds only the ID,
+// as the store does not know the index type of T.
+type keyIndex struct {
+	ID uuid.UUID `json:"id"`
+}
+
+func (k *keyIndex) SetID(id uuid.UUID) { k.ID = id }
+func (k *keyIndex) GetID() uuid.UUID   { return k.ID }
+
+// Open opens the collection stored in dir with the given engine. An empty
+// engine selects EngineJSON. The options only apply to EngineJSON and are
+// ignored by the other engines, except for a cipher set with
+// collection_manager.WithCipher, which EngineGenericIndex uses as well. The
+// other engines cannot seal their records and fail to open with one.
+func Open[T Item](engine, dir string, opts ...collection_manager.Option) (Store[T], error) {
+	var (
+		s   Store[T]
+		err error
+	)
+
+	cipher := collection_manager.CipherOf(opts...)
+	switch engine {
+	case "", EngineJSON, EngineGenericIndex:
+	default:
+		if cipher != nil {
+			return nil, fmt.Errorf("store engine %q does not support encryption", engine)
+		}
+	}
+
+	switch engine {
+	case "", EngineJSON:
+		s, err = open(collection_manager.New[T](dir, opts...))
+	case EngineDB:
+		s, err = open(collection_manager_db.NewAt[T](dir))
+	case EngineGenericIndex:
+		indexOpts := []collection_manager_generic_index.Option{collection_manager_generic_index.WithMmap()}
+		if cipher != nil {
+			indexOpts = append(indexOpts, collection_manager_generic_index.WithCipher(cipher))
+		}
+		s, err = open(collection_manager_generic_index.NewAt[T, *keyIndex](dir, indexOpts...))
+	case EngineLazyLoading:
+		s, err = open(collection_manager_lazy_loading.NewAt[T](dir))
+	case EngineSQLite:
+		s, err = open(collection_manager_sqlite.New[T](filepath.Join(dir, collection_manager_sqlite.FileName)))
+	case EngineSegment:
+		s, err = open(collection_manager_segment.NewAt[T](dir))
+	default:
+		return nil, fmt.Errorf("unknown store engine %q", engine)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s store in %s: %w", engine, dir, err)
+	}
+	return s, nil
+}
+
+// open converts the engine constructor result to a Store, so a failed
+// constructor returns a nil interface rather than a typed nil pointer.
+func open[T Item, S Store[T]](s S, err error) (Store[T], error) {
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
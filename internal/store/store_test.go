@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager"
+	"github.com/mahdi-cpp/messages-api/internal/collections/message"
+	"github.com/mahdi-cpp/messages-api/internal/version"
+)
+
+var engines = []string{EngineJSON, EngineDB, EngineGenericIndex, EngineLazyLoading, EngineSQLite, EngineSegment}
+
+func TestEngines(t *testing.T) {
+	for _, engine := range engines {
+		t.Run(engine, func(t *testing.T) {
+			dir := t.TempDir()
+
+			s, err := Open[*message.Message](engine, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Sorts before the generated UUID v7 IDs.
+			preset := uuid.MustParse("00000000-0000-4000-8000-000000000001")
+			if _, err := s.Create(&message.Message{ID: preset, Caption: "preset"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Create(&message.Message{ID: preset}); err == nil {
+				t.Fatal("created a second item with the same ID")
+			}
+
+			var ids []uuid.UUID
+			for i := 0; i < 3; i++ {
+				msg, err := s.Create(&message.Message{Caption: "generated"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msg.ID == uuid.Nil {
+					t.Fatal("no ID was assigned on create")
+				}
+				ids = append(ids, msg.ID)
+			}
+
+			updated, err := s.Update(&message.Message{ID: preset, Caption: "updated", Version: "1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated.Version != "2" {
+				t.Fatalf("version after update = %q, want %q", updated.Version, "2")
+			}
+			if _, err := s.Update(&message.Message{ID: preset, Caption: "stale", Version: "1"}); !errors.Is(err, version.ErrConflict) {
+				t.Fatalf("stale update returned %v, want a version conflict", err)
+			}
+			if _, err := s.Update(&message.Message{ID: uuid.New()}); err == nil {
+				t.Fatal("updated an item that does not exist")
+			}
+			if err := s.Delete(ids[0]); err != nil {
+				t.Fatal(err)
+			}
+
+			visited := 0
+			err = s.Iterate(context.Background(), func(*message.Message) bool {
+				visited++
+				return visited < 2
+			})
+			if err != nil || visited != 2 {
+				t.Fatalf("iterate visited %d items (err=%v), want it to stop after 2", visited, err)
+			}
+
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = Open[*message.Message](engine, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			got, err := s.Read(preset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Caption != "updated" {
+				t.Fatalf("got caption %q after reopening, want %q", got.Caption, "updated")
+			}
+			if _, err := s.Read(ids[0]); err == nil {
+				t.Fatal("deleted item is still readable after reopening")
+			}
+
+			all, err := s.ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 3 {
+				t.Fatalf("got %d items after reopening, want 3", len(all))
+			}
+
+			var ordered []uuid.UUID
+			err = s.IterateFrom(context.Background(), ids[1], func(msg *message.Message) bool {
+				ordered = append(ordered, msg.ID)
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(ordered, ids[1:]) {
+				t.Fatalf("IterateFrom = %v, want %v in ID order", ordered, ids[1:])
+			}
+		})
+	}
+}
+
+func TestJoinWithoutTransactions(t *testing.T) {
+	s, err := Open[*message.Message](EngineGenericIndex, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tx := collection_manager.NewTx()
+	defer tx.Rollback()
+	if _, err := Join(s, tx); !errors.Is(err, ErrNotTransactional) {
+		t.Fatalf("Join = %v, want ErrNotTransactional", err)
+	}
+}
@@ -0,0 +1,36 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/mahdi-cpp/messages-api/internal/collection_manager"
+)
+
+// ErrNotTransactional is returned by Join for a store whose engine cannot
+// take part in a transaction.
+var ErrNotTransactional = errors.New("store engine does not support transactions")
+
+// Writer stages writes to a store as part of a transaction.
+type Writer[T Item] interface {
+	Create(item T) error
+	Update(item T) error
+	Delete(id uuid.UUID) error
+}
+
+type transactional[T Item] interface {
+	Join(tx *collection_manager.Tx) *collection_manager.Txn[T]
+}
+
+// Join enlists s in tx, so its writes are applied on tx.Commit. Only
+// EngineJSON stores support transactions; Join fails with
+// ErrNotTransactional for the others rather than applying their writes
+// outside tx.
+func Join[T Item](s Store[T], tx *collection_manager.Tx) (Writer[T], error) {
+	t, ok := s.(transactional[T])
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrNotTransactional, s)
+	}
+	return t.Join(tx), nil
+}
@@ -0,0 +1,100 @@
+// Package version implements optimistic concurrency for items that carry a
+// version. Every write stores the next version of an item, and an update
+// must be based on the version currently stored, so two clients editing
+// the same item cannot silently overwrite each other.
+//
+// Versions are decimal counters kept in a string. Items stored before
+// versioning have an empty version, and their first update stores "1".
+package version
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// Item is implemented by items that carry a version. Items that do not
+// implement it are written without any check.
+type Item interface {
+	GetVersion() string
+	SetVersion(string)
+}
+
+// ErrConflict matches every ConflictError with errors.Is.
+var ErrConflict = errors.New("version conflict")
+
+// ConflictError is returned for an update that is not based on the stored
+// version of the item.
+type ConflictError struct {
+	ID uuid.UUID
+	// Expected is the version the update was based on.
+	Expected string
+	// Current is the version stored.
+	Current string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("item %s was modified: update is based on version %q, current version is %q", e.ID, e.Expected, e.Current)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Init sets the first version on an item about to be created.
+func Init(item any) {
+	if v, ok := item.(Item); ok {
+		v.SetVersion(next(""))
+	}
+}
+
+// Check returns a ConflictError if updated is not based on the version of
+// current, the item as stored.
+func Check(id uuid.UUID, current, updated any) error {
+	cur, ok := current.(Item)
+	if !ok {
+		return nil
+	}
+	upd, ok := updated.(Item)
+	if !ok {
+		return nil
+	}
+	if upd.GetVersion() != cur.GetVersion() {
+		return &ConflictError{ID: id, Expected: upd.GetVersion(), Current: cur.GetVersion()}
+	}
+	return nil
+}
+
+// Bump sets the version of an item about to be written to the next one,
+// and returns the version it had.
+func Bump(item any) string {
+	v, ok := item.(Item)
+	if !ok {
+		return ""
+	}
+	previous := v.GetVersion()
+	v.SetVersion(next(previous))
+	return previous
+}
+
+// Reset sets back the version an item had before Init or Bump, after it
+// failed to be written.
+func Reset(item any, previous string) {
+	if v, ok := item.(Item); ok {
+		v.SetVersion(previous)
+	}
+}
+
+func number(version string) uint64 {
+	n, err := strconv.ParseUint(version, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func next(version string) string {
+	return strconv.FormatUint(number(version)+1, 10)
+}